@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/mattbostock/timbala/internal/rebalance"
+)
+
+const decommissionPollInterval = 5 * time.Second
+
+// decommission asks the node listening for HTTP requests on the given address
+// to drain its data and leave the cluster, optionally waiting until it has
+// done so.
+func decommission(addr string, wait bool) error {
+	url := "http://" + addr + rebalance.DecommissionRoute
+
+	status, err := decommissionStatus(http.Post(url, "", nil))
+	if err != nil {
+		return fmt.Errorf("failed to decommission %s: %s", addr, err)
+	}
+	fmt.Printf("Node %s is leaving the cluster and will drain its data to %v\n", addr, status.CurrentMembers)
+
+	for wait && !status.Decommissioned() {
+		time.Sleep(decommissionPollInterval)
+		status, err = decommissionStatus(http.Get(url))
+		if err != nil {
+			return fmt.Errorf("failed to get status of %s: %s", addr, err)
+		}
+
+		fmt.Printf("Drained %d of %d days of data", status.DaysCompleted, status.DaysTotal)
+		if status.LastError != "" {
+			fmt.Printf("; last error: %s", status.LastError)
+		}
+		fmt.Println()
+	}
+
+	if status.Decommissioned() {
+		fmt.Printf("Node %s has left the cluster and can be shut down\n", addr)
+	}
+	return nil
+}
+
+func decommissionStatus(resp *http.Response, err error) (rebalance.Status, error) {
+	var status rebalance.Status
+	if err != nil {
+		return status, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return status, fmt.Errorf("unexpected HTTP status %s", resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	return status, err
+}
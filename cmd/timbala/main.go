@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	stdlog "log"
 	"math"
 	"net"
@@ -15,10 +16,16 @@ import (
 
 	gokitlog "github.com/go-kit/kit/log"
 	gokitlevel "github.com/go-kit/kit/log/level"
+	"github.com/mattbostock/timbala/internal/antientropy"
 	v1API "github.com/mattbostock/timbala/internal/api/v1"
 	"github.com/mattbostock/timbala/internal/cluster"
+	"github.com/mattbostock/timbala/internal/deletion"
 	"github.com/mattbostock/timbala/internal/fanout"
+	"github.com/mattbostock/timbala/internal/hashring"
+	"github.com/mattbostock/timbala/internal/outoforder"
+	"github.com/mattbostock/timbala/internal/querycache"
 	"github.com/mattbostock/timbala/internal/read"
+	"github.com/mattbostock/timbala/internal/rebalance"
 	"github.com/mattbostock/timbala/internal/write"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -38,6 +45,12 @@ const (
 	defaultHTTPAddr = "localhost:9080"
 	defaultPeerAddr = "localhost:7946"
 
+	hintsDirName             = "hints"
+	outOfOrderDirName        = "out_of_order"
+	outOfOrderBufferFileName = "out_of_order_buffer"
+
+	defaultQueryCacheSamples = 10000000
+
 	apiRoute     = "/api/v1"
 	metricsRoute = "/metrics"
 
@@ -60,7 +73,14 @@ var (
 		httpBindAddr        *net.TCPAddr
 		gossipAdvertiseAddr *net.TCPAddr
 		gossipBindAddr      *net.TCPAddr
+		hashRing            string
+		outOfOrderGrace     time.Duration
+		partitionBy         string
 		peers               []string
+		queryCacheSamples   int
+		replicationFactor   int
+		writeConsistency    string
+		zone                string
 	}
 	version = "undefined"
 )
@@ -101,25 +121,83 @@ func main() {
 		"List of peers to connect to",
 	).StringsVar(&config.peers)
 
+	kingpin.Flag(
+		"replication-factor",
+		"how many copies of each time-series to store across the cluster; must be the same on every node",
+	).Default(strconv.Itoa(cluster.DefaultReplFactor)).IntVar(&config.replicationFactor)
+
+	kingpin.Flag(
+		"hashring",
+		"algorithm used to assign time-series to nodes; must be the same on every node",
+	).Default(hashring.Default).EnumVar(&config.hashRing, hashring.Names()...)
+
+	kingpin.Flag(
+		"partition-by",
+		"whether to place time-series by all of their labels or only their metric name; must be the same on every node",
+	).Default(cluster.PartitionBySeries).EnumVar(&config.partitionBy, cluster.PartitionBySeries, cluster.PartitionByMetricName)
+
+	kingpin.Flag(
+		"zone",
+		"availability zone, rack or other failure domain the node runs in; replicas are spread across zones",
+	).StringVar(&config.zone)
+
+	kingpin.Flag(
+		"out-of-order-grace-period",
+		"how long after a sample's timestamp it is accepted out of order, e.g. when replayed after a failure; 0 disables out-of-order samples",
+	).Default(outoforder.DefaultGracePeriod.String()).DurationVar(&config.outOfOrderGrace)
+
+	kingpin.Flag(
+		"query-cache-samples",
+		"maximum number of samples to hold in the range query results cache; 0 disables the cache",
+	).Default(strconv.Itoa(defaultQueryCacheSamples)).IntVar(&config.queryCacheSamples)
+
+	kingpin.Flag(
+		"write-consistency",
+		"Number of replicas that must commit a write before it is acknowledged",
+	).Default(write.DefaultConsistencyLevel.String()).EnumVar(&config.writeConsistency, write.ConsistencyLevelNames()...)
+
 	level := kingpin.Flag(
 		"log-level",
 		"Log level",
 	).Default(log.InfoLevel.String()).Enum("debug", "info", "warn", "panic", "fatal")
 
+	kingpin.Command("server", "Run a Timbala node").Default()
+
+	decommissionCmd := kingpin.Command("decommission", "Drain a node's data to other nodes, then remove it from the cluster")
+	decommissionAddr := decommissionCmd.Arg(
+		"http-addr",
+		"host:port of the node to decommission",
+	).Required().String()
+	decommissionWait := decommissionCmd.Flag(
+		"wait",
+		"wait until the node has left the cluster",
+	).Bool()
+
 	kingpin.HelpFlag.Short('h')
-	_, err := kingpin.Version(version).
+	cmd, err := kingpin.Version(version).
 		DefaultEnvars().
 		Parse(os.Args[1:])
 	if err != nil {
 		kingpin.FatalUsage(err.Error())
 	}
 
+	if cmd == decommissionCmd.FullCommand() {
+		if err := decommission(*decommissionAddr, *decommissionWait); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	if config.httpAdvertiseAddr.IP == nil || config.httpAdvertiseAddr.IP.IsUnspecified() {
 		kingpin.FatalUsage("must specify host or IP for --http-advertise-addr")
 	}
 	if config.gossipAdvertiseAddr.IP == nil || config.gossipAdvertiseAddr.IP.IsUnspecified() {
 		kingpin.FatalUsage("must specify host or IP for --gossip-advertise-addr")
 	}
+	if config.replicationFactor < 1 {
+		kingpin.FatalUsage("--replication-factor must be at least 1")
+	}
 
 	lvl, err := log.ParseLevel(*level)
 	if err != nil {
@@ -147,6 +225,15 @@ func main() {
 	gokitLogger := gokitlog.NewLogfmtLogger(logrusWriter)
 	gokitLogger = gokitlevel.NewFilter(gokitLogger, lvlOption)
 
+	// Nodes whose data directory already holds data, but which have not
+	// chosen a partition key version, were created by versions that
+	// predate versioned partition keys and placed their data using the
+	// legacy keys
+	var partitionKeys cluster.KeyVersion
+	if files, err := ioutil.ReadDir(config.dataDir); err == nil && len(files) > 0 {
+		partitionKeys = cluster.LegacyKeys
+	}
+
 	localStorage, err := tsdb.Open(config.dataDir, gokitLogger, prometheus.DefaultRegisterer, &tsdb.Options{
 		WALFlushInterval:  5 * time.Second,
 		RetentionDuration: math.MaxUint64, // approximately 292,471,208 years
@@ -156,8 +243,18 @@ func main() {
 	if err != nil {
 		log.Fatalf("Opening storage failed: %s", err)
 	}
+	localStore, err := outoforder.New(
+		log.StandardLogger(),
+		promtsdb.Adapter(localStorage, 0),
+		filepath.Join(config.dataDir, outOfOrderDirName),
+		filepath.Join(config.dataDir, outOfOrderBufferFileName),
+		config.outOfOrderGrace,
+	)
+	if err != nil {
+		log.Fatalf("Opening out-of-order storage failed: %s", err)
+	}
 
-	var _, cancelCtx = context.WithCancel(context.Background())
+	var ctx, cancelCtx = context.WithCancel(context.Background())
 	defer cancelCtx()
 
 	// FIXME: Set context
@@ -194,13 +291,23 @@ func main() {
 		fmt.Fprintf(w, "Mutex profile fraction set to %d, previous value was: %d", fraction, prevValue)
 	})
 
+	ring, err := hashring.ByName(config.hashRing)
+	if err != nil {
+		log.Fatal(err)
+	}
 	clstr, err := cluster.New(
 		&cluster.Config{
+			DataDir:             config.dataDir,
 			HTTPAdvertiseAddr:   *config.httpAdvertiseAddr,
 			HTTPBindAddr:        *config.httpBindAddr,
 			GossipAdvertiseAddr: *config.gossipAdvertiseAddr,
 			GossipBindAddr:      *config.gossipBindAddr,
+			HashRing:            ring,
+			PartitionBy:         config.partitionBy,
+			PartitionKeys:       partitionKeys,
 			Peers:               config.peers,
+			ReplicationFactor:   config.replicationFactor,
+			Zone:                config.zone,
 		},
 		log.StandardLogger(),
 	)
@@ -208,11 +315,53 @@ func main() {
 		log.Fatal("Failed to join the cluster: ", err)
 	}
 
-	fanoutStorage := fanout.New(clstr, log.StandardLogger(), promtsdb.Adapter(localStorage, 0))
-	reader := read.New(clstr, log.StandardLogger(), promtsdb.Adapter(localStorage, 0), fanoutStorage)
-	writer := write.New(clstr, log.StandardLogger(), promtsdb.Adapter(localStorage, 0))
+	go localStore.Run(ctx)
+
+	localLabels := read.NewLocalLabelQuerier(localStorage, localStore)
+	// pushdownEngine evaluates aggregations pushed down from the node serving
+	// a query, over the local samples for which this node is the preferred
+	// replica
+	pushdownEngine := promql.NewEngine(read.NewPreferredQueryable(clstr, localStore), &promql.EngineOptions{
+		MaxConcurrentQueries: 20,
+		Timeout:              2 * time.Minute,
+		Logger:               gokitLogger,
+	})
+	fanoutStorage := fanout.New(clstr, log.StandardLogger(), localStore, localLabels, pushdownEngine)
+	go fanoutStorage.Run(ctx)
+	reader := read.New(clstr, log.StandardLogger(), localStore, fanoutStorage, localLabels, pushdownEngine)
+	writeConsistency, err := write.ParseConsistencyLevel(config.writeConsistency)
+	if err != nil {
+		log.Fatal(err)
+	}
+	writer, err := write.New(clstr, log.StandardLogger(), localStore, filepath.Join(config.dataDir, hintsDirName), writeConsistency)
+	if err != nil {
+		log.Fatalf("Failed to initialise writer: %s", err)
+	}
+	go writer.ReplayHints(ctx)
+	antiEntropy := antientropy.New(clstr, log.StandardLogger(), localStore)
+	go antiEntropy.Run(ctx)
+	rebalancer := rebalance.New(clstr, log.StandardLogger(), localStore)
+	go rebalancer.Run(ctx)
+	resultsCache := querycache.New(config.queryCacheSamples)
+	deleter := deletion.New(clstr, log.StandardLogger(), localStorage, localStore, resultsCache.Purge)
 	router.Post(read.Route, reader.HandlerFunc)
+	router.Get(read.LabelNamesRoute, reader.LabelNamesHandlerFunc)
+	router.Get(read.LabelValuesRoute, reader.LabelValuesHandlerFunc)
+	router.Get(read.TSDBStatusRoute, reader.TSDBStatusHandlerFunc)
+	router.Post(read.EvaluateRoute, reader.EvaluateHandlerFunc)
 	router.Post(write.Route, writer.HandlerFunc)
+	router.Post(deletion.Route, deleter.HandlerFunc)
+	router.Post(deletion.CleanTombstonesRoute, deleter.CleanTombstonesHandlerFunc)
+	router.Post(deletion.PurgeCacheRoute, deleter.PurgeCacheHandlerFunc)
+	router.Post(antientropy.TreeRoute, antiEntropy.TreeHandlerFunc)
+	router.Post(antientropy.SamplesRoute, antiEntropy.SamplesHandlerFunc)
+	router.Get(rebalance.Route, rebalancer.HandlerFunc)
+	router.Post(rebalance.Route, rebalancer.HandlerFunc)
+	router.Get(rebalance.ReplicationFactorRoute, rebalancer.ReplicationFactorHandlerFunc)
+	router.Post(rebalance.ReplicationFactorRoute, rebalancer.ReplicationFactorHandlerFunc)
+	router.Post(rebalance.VerifyRoute, rebalancer.VerifyHandlerFunc)
+	router.Get(rebalance.DecommissionRoute, rebalancer.DecommissionHandlerFunc)
+	router.Post(rebalance.DecommissionRoute, rebalancer.DecommissionHandlerFunc)
 	router.Get(metricsRoute, promhttp.Handler().ServeHTTP)
 
 	engineOptions := &promql.EngineOptions{
@@ -222,7 +371,7 @@ func main() {
 		Metrics:              prometheus.DefaultRegisterer,
 	}
 	queryEngine := promql.NewEngine(fanoutStorage, engineOptions)
-	api := v1API.NewAPI(queryEngine, fanoutStorage)
+	api := v1API.NewAPI(queryEngine, fanoutStorage, deleter, resultsCache)
 	api.Register(router.WithPrefix(apiRoute))
 
 	absoluteDataDir, _ := filepath.Abs(config.dataDir)
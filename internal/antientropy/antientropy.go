@@ -0,0 +1,588 @@
+// Package antientropy repairs differences between replicas in the
+// background, including data that is never queried and would therefore never
+// be fixed by read repair.
+//
+// Each node periodically compares the data it shares with each of its peers
+// for one day at a time. Both nodes build a Merkle tree over the samples that
+// they are both responsible for storing, with each leaf covering a range of
+// partition keys. The trees are compared starting from the root and only the
+// samples in leaves whose hashes differ are exchanged. Samples missing from
+// either node are then written to it using the internal write API.
+package antientropy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/mattbostock/timbala/internal/cluster"
+	"github.com/mattbostock/timbala/internal/write"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/context/ctxhttp"
+)
+
+const (
+	SamplesRoute = "/antientropy/samples"
+	TreeRoute    = "/antientropy/tree"
+
+	// Only compare data older than syncDelay to avoid repairing samples
+	// that are still being replicated as part of normal ingestion
+	syncDelay    = time.Hour
+	syncInterval = time.Minute
+	syncTimeout  = 5 * time.Minute
+
+	day          = 24 * time.Hour
+	treeCacheTTL = 10 * time.Minute
+)
+
+var (
+	httpClient = &http.Client{
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{
+				DualStack: true,
+				KeepAlive: 10 * time.Minute,
+				Timeout:   2 * time.Second,
+			}).DialContext,
+			ExpectContinueTimeout: 5 * time.Second,
+			IdleConnTimeout:       10 * time.Minute,
+			ResponseHeaderTimeout: time.Minute,
+		}}
+
+	exchanges = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "timbala",
+			Subsystem: "anti_entropy",
+			Name:      "exchanges_total",
+			Help:      "Total number of Merkle tree exchanges with peers, by result",
+		},
+		[]string{"result"},
+	)
+	differingLeaves = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "timbala",
+			Subsystem: "anti_entropy",
+			Name:      "differing_leaves_total",
+			Help:      "Total number of Merkle tree leaves found to differ from a peer",
+		},
+	)
+	samplesRepaired = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "timbala",
+			Subsystem: "anti_entropy",
+			Name:      "samples_repaired_total",
+			Help:      "Total number of samples written to a node that was missing them",
+		},
+		[]string{"node"},
+	)
+	lastSyncedDay = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "timbala",
+			Subsystem: "anti_entropy",
+			Name:      "last_synced_day_timestamp_seconds",
+			Help:      "Start of the day most recently compared with peers, as a Unix timestamp",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(exchanges, differingLeaves, samplesRepaired, lastSyncedDay)
+}
+
+type antiEntropy struct {
+	clstr      cluster.Cluster
+	localStore storage.Storage
+	log        *logrus.Logger
+
+	// cursor is the start of the day to be compared next; days are
+	// compared from newest to oldest
+	cursor time.Time
+	// oldest is the earliest start time reported by any peer
+	oldest int64
+
+	mu        sync.Mutex
+	treeCache map[treeCacheKey]cachedTree
+}
+
+type treeCacheKey struct {
+	peer       string
+	mint, maxt int64
+}
+
+type cachedTree struct {
+	tree    tree
+	expires time.Time
+}
+
+type treeRequest struct {
+	Peer    string `json:"peer"`
+	MinT    int64  `json:"mint"`
+	MaxT    int64  `json:"maxt"`
+	Indices []int  `json:"indices"`
+}
+
+type treeResponse struct {
+	StartTime int64    `json:"start_time"`
+	Hashes    []uint64 `json:"hashes"`
+}
+
+type samplesRequest struct {
+	Peer   string `json:"peer"`
+	MinT   int64  `json:"mint"`
+	MaxT   int64  `json:"maxt"`
+	Leaves []int  `json:"leaves"`
+}
+
+func New(c cluster.Cluster, l *logrus.Logger, s storage.Storage) *antiEntropy {
+	return &antiEntropy{
+		clstr:      c,
+		localStore: s,
+		log:        l,
+		treeCache:  make(map[treeCacheKey]cachedTree),
+	}
+}
+
+// Run compares one day of data with peers every syncInterval until the
+// context is cancelled.
+func (a *antiEntropy) Run(ctx context.Context) {
+	ticker := time.NewTicker(syncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		a.syncNextDay(ctx)
+	}
+}
+
+func (a *antiEntropy) syncNextDay(ctx context.Context) {
+	end := time.Now().Add(-syncDelay)
+	oldest := a.oldestTime()
+	if a.cursor.IsZero() || a.cursor.UnixNano()/1e6+int64(day/time.Millisecond) <= oldest {
+		a.cursor = end.UTC().Truncate(day)
+	}
+
+	mint := a.cursor.UnixNano() / 1e6
+	maxt := a.cursor.Add(day).UnixNano()/1e6 - 1
+	if endMs := end.UnixNano() / 1e6; maxt > endMs {
+		maxt = endMs
+	}
+
+	for _, n := range a.clstr.Nodes() {
+		if n.Name() == a.clstr.LocalNode().Name() {
+			continue
+		}
+
+		syncCtx, cancel := context.WithTimeout(ctx, syncTimeout)
+		err := a.syncWithPeer(syncCtx, n, mint, maxt)
+		cancel()
+		if err != nil {
+			exchanges.WithLabelValues("error").Inc()
+			a.log.Warningf("Anti-entropy exchange with %s for %s failed: %s", n.Name(), a.cursor.Format("2006-01-02"), err)
+			continue
+		}
+	}
+
+	lastSyncedDay.Set(float64(a.cursor.Unix()))
+	a.cursor = a.cursor.Add(-day)
+}
+
+func (a *antiEntropy) oldestTime() int64 {
+	start, err := a.localStore.StartTime()
+	if err != nil {
+		a.log.Warningf("Unable to determine local start time: %s", err)
+		return a.oldest
+	}
+	if a.oldest != 0 && a.oldest < start {
+		return a.oldest
+	}
+	return start
+}
+
+func (a *antiEntropy) syncWithPeer(ctx context.Context, n *cluster.Node, mint, maxt int64) error {
+	httpAddr, err := n.HTTPAddr()
+	if err != nil {
+		return err
+	}
+	// FIXME handle HTTPS
+	baseURL := "http://" + httpAddr
+
+	local, err := a.tree(n.Name(), mint, maxt)
+	if err != nil {
+		return err
+	}
+
+	leaves, err := local.diff(func(indices []int) ([]uint64, error) {
+		var resp treeResponse
+		err := postJSON(ctx, baseURL+TreeRoute, &treeRequest{
+			Peer:    a.clstr.LocalNode().Name(),
+			MinT:    mint,
+			MaxT:    maxt,
+			Indices: indices,
+		}, &resp)
+		if err != nil {
+			return nil, err
+		}
+		if a.oldest == 0 || resp.StartTime < a.oldest {
+			a.oldest = resp.StartTime
+		}
+		return resp.Hashes, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(leaves) == 0 {
+		exchanges.WithLabelValues("in_sync").Inc()
+		return nil
+	}
+	exchanges.WithLabelValues("differ").Inc()
+	differingLeaves.Add(float64(len(leaves)))
+	a.log.Debugf("Found %d differing Merkle tree leaves with %s", len(leaves), n.Name())
+
+	remoteSeries, err := fetchSamples(ctx, baseURL+SamplesRoute, &samplesRequest{
+		Peer:   a.clstr.LocalNode().Name(),
+		MinT:   mint,
+		MaxT:   maxt,
+		Leaves: leaves,
+	})
+	if err != nil {
+		return err
+	}
+
+	localSeries, err := a.samples(n.Name(), mint, maxt, leaves)
+	if err != nil {
+		return err
+	}
+
+	if err := a.repair(ctx, *a.clstr.LocalNode(), missing(localSeries, remoteSeries)); err != nil {
+		return err
+	}
+	return a.repair(ctx, *n, missing(remoteSeries, localSeries))
+}
+
+func (a *antiEntropy) repair(ctx context.Context, n cluster.Node, series []*prompb.TimeSeries) error {
+	if len(series) == 0 {
+		return nil
+	}
+
+	var numSamples int
+	for _, ts := range series {
+		numSamples += len(ts.Samples)
+	}
+
+	// Samples rejected by the node are still missing from it, so the
+	// exchange has failed and the leaves will differ when next compared
+	accepted, err := write.WriteToNode(ctx, httpClient, n, series)
+	samplesRepaired.WithLabelValues(n.Name()).Add(float64(accepted))
+	if err != nil {
+		return fmt.Errorf("unable to write %d of %d samples to %s: %s", numSamples-accepted, numSamples, n.Name(), err)
+	}
+	a.log.Infof("Anti-entropy repaired %d samples across %d series on %s", numSamples, len(series), n.Name())
+	return nil
+}
+
+// tree returns the Merkle tree of local samples between mint and maxt that
+// are replicated to both the local node and the given peer.
+func (a *antiEntropy) tree(peer string, mint, maxt int64) (tree, error) {
+	key := treeCacheKey{peer, mint, maxt}
+
+	a.mu.Lock()
+	for k, c := range a.treeCache {
+		if time.Now().After(c.expires) {
+			delete(a.treeCache, k)
+		}
+	}
+	cached, ok := a.treeCache[key]
+	a.mu.Unlock()
+	if ok {
+		return cached.tree, nil
+	}
+
+	t := newTree()
+	err := a.scan(peer, mint, maxt, func(_ labels.Labels, seriesHash, pKey uint64, ts int64, v float64) {
+		t.add(pKey, seriesHash, ts, v)
+	})
+	if err != nil {
+		return nil, err
+	}
+	t.build()
+
+	a.mu.Lock()
+	a.treeCache[key] = cachedTree{tree: t, expires: time.Now().Add(treeCacheTTL)}
+	a.mu.Unlock()
+	return t, nil
+}
+
+// samples returns the local samples between mint and maxt that are
+// replicated to both the local node and the given peer and that fall within
+// the given leaves of the Merkle tree.
+func (a *antiEntropy) samples(peer string, mint, maxt int64, leaves []int) ([]*prompb.TimeSeries, error) {
+	wanted := make(map[int]bool, len(leaves))
+	for _, l := range leaves {
+		wanted[l] = true
+	}
+
+	bySeries := make(map[uint64]*prompb.TimeSeries)
+	err := a.scan(peer, mint, maxt, func(lbls labels.Labels, seriesHash, pKey uint64, ts int64, v float64) {
+		if !wanted[leafForPartitionKey(pKey)] {
+			return
+		}
+		if _, ok := bySeries[seriesHash]; !ok {
+			pairs := make([]*prompb.Label, 0, len(lbls))
+			for _, l := range lbls {
+				pairs = append(pairs, &prompb.Label{Name: l.Name, Value: l.Value})
+			}
+			bySeries[seriesHash] = &prompb.TimeSeries{Labels: pairs}
+		}
+		bySeries[seriesHash].Samples = append(bySeries[seriesHash].Samples, &prompb.Sample{Timestamp: ts, Value: v})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	series := make([]*prompb.TimeSeries, 0, len(bySeries))
+	for _, ts := range bySeries {
+		series = append(series, ts)
+	}
+	return series, nil
+}
+
+// scan calls fn for every local sample between mint and maxt that is
+// replicated to both the local node and the given peer.
+func (a *antiEntropy) scan(peer string, mint, maxt int64, fn func(lbls labels.Labels, seriesHash, pKey uint64, t int64, v float64)) error {
+	q, err := a.localStore.Querier(context.Background(), mint, maxt)
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+
+	allSeries, err := labels.NewMatcher(labels.MatchRegexp, labels.MetricName, ".+")
+	if err != nil {
+		return err
+	}
+	set, err := q.Select(allSeries)
+	if err != nil {
+		return err
+	}
+
+	local := a.clstr.LocalNode().Name()
+	keys := a.clstr.KeyVersion()
+	shared := make(map[uint64]bool)
+	for set.Next() {
+		s := set.At()
+		lbls := s.Labels()
+		seriesHash := lbls.Hash()
+		pHash := a.clstr.PartitionHash(lbls.Get(labels.MetricName), seriesHash)
+
+		it := s.Iterator()
+		for it.Next() {
+			t, v := it.At()
+			if t < mint || t > maxt {
+				continue
+			}
+
+			pKey := keys.SamplePartitionKey(t, pHash)
+			isShared, ok := shared[pKey]
+			if !ok {
+				var hasLocal, hasPeer bool
+				for _, n := range a.clstr.NodesByPartitionKey(pKey) {
+					hasLocal = hasLocal || n.Name() == local
+					hasPeer = hasPeer || n.Name() == peer
+				}
+				isShared = hasLocal && hasPeer
+				shared[pKey] = isShared
+			}
+			if isShared {
+				fn(lbls, seriesHash, pKey, t, v)
+			}
+		}
+		if err := it.Err(); err != nil {
+			return err
+		}
+	}
+	return set.Err()
+}
+
+// TreeHandlerFunc responds with the requested hashes from the Merkle tree
+// of data shared between the local node and the requesting peer.
+func (a *antiEntropy) TreeHandlerFunc(w http.ResponseWriter, r *http.Request) {
+	var req treeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		a.log.Debug(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	t, err := a.tree(req.Peer, req.MinT, req.MaxT)
+	if err != nil {
+		a.log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	startTime, err := a.localStore.StartTime()
+	if err != nil {
+		a.log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := treeResponse{
+		StartTime: startTime,
+		Hashes:    make([]uint64, 0, len(req.Indices)),
+	}
+	for _, i := range req.Indices {
+		if i < 0 || i >= len(t) {
+			err := fmt.Errorf("tree index %d out of range", i)
+			a.log.Debug(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp.Hashes = append(resp.Hashes, t[i])
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&resp); err != nil {
+		a.log.Error(err)
+	}
+}
+
+// SamplesHandlerFunc responds with the local samples in the requested leaves
+// of the Merkle tree of data shared between the local node and the requesting
+// peer.
+func (a *antiEntropy) SamplesHandlerFunc(w http.ResponseWriter, r *http.Request) {
+	var req samplesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		a.log.Debug(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	series, err := a.samples(req.Peer, req.MinT, req.MaxT, req.Leaves)
+	if err != nil {
+		a.log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := &prompb.WriteRequest{Timeseries: series}
+	data, err := resp.Marshal()
+	if err != nil {
+		a.log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Header().Set("Content-Encoding", "snappy")
+	if _, err := w.Write(snappy.Encode(nil, data)); err != nil {
+		a.log.Error(err)
+	}
+}
+
+func postJSON(ctx context.Context, url string, req, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	httpResp, err := ctxhttp.Post(ctx, httpClient, url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode/100 != 2 {
+		return fmt.Errorf("server returned HTTP status %s", httpResp.Status)
+	}
+	return json.NewDecoder(httpResp.Body).Decode(resp)
+}
+
+func fetchSamples(ctx context.Context, url string, req *samplesRequest) ([]*prompb.TimeSeries, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	httpResp, err := ctxhttp.Post(ctx, httpClient, url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("server returned HTTP status %s", httpResp.Status)
+	}
+
+	compressed, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, err
+	}
+	uncompressed, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp prompb.WriteRequest
+	if err := resp.Unmarshal(uncompressed); err != nil {
+		return nil, err
+	}
+	return resp.Timeseries, nil
+}
+
+// missing returns the samples in from that are not present in to.
+func missing(to, from []*prompb.TimeSeries) []*prompb.TimeSeries {
+	existing := make(map[string]map[int64]bool, len(to))
+	for _, ts := range to {
+		timestamps := make(map[int64]bool, len(ts.Samples))
+		for _, s := range ts.Samples {
+			timestamps[s.Timestamp] = true
+		}
+		existing[seriesKey(ts)] = timestamps
+	}
+
+	var result []*prompb.TimeSeries
+	for _, ts := range from {
+		timestamps := existing[seriesKey(ts)]
+		var samples []*prompb.Sample
+		for _, s := range ts.Samples {
+			if !timestamps[s.Timestamp] {
+				samples = append(samples, s)
+			}
+		}
+		if len(samples) == 0 {
+			continue
+		}
+		sort.Slice(samples, func(i, j int) bool { return samples[i].Timestamp < samples[j].Timestamp })
+		result = append(result, &prompb.TimeSeries{
+			Labels:  ts.Labels,
+			Samples: samples,
+		})
+	}
+	return result
+}
+
+func seriesKey(ts *prompb.TimeSeries) string {
+	lbls := make(labels.Labels, 0, len(ts.Labels))
+	for _, l := range ts.Labels {
+		lbls = append(lbls, labels.Label{Name: l.Name, Value: l.Value})
+	}
+	sort.Sort(lbls)
+	return lbls.String()
+}
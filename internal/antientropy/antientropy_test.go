@@ -0,0 +1,239 @@
+package antientropy
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mattbostock/timbala/internal/cluster"
+	"github.com/mattbostock/timbala/internal/outoforder"
+	"github.com/mattbostock/timbala/internal/write"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/storage"
+	promtsdb "github.com/prometheus/prometheus/storage/tsdb"
+	"github.com/prometheus/tsdb"
+	"github.com/sirupsen/logrus"
+)
+
+type testNode struct {
+	name  string
+	clstr *cluster.Static
+	store storage.Storage
+	ae    *antiEntropy
+}
+
+// startNodes starts two nodes that both store all series. If repair is
+// false, the second node does not accept historical samples.
+func startNodes(t *testing.T, dir string, repair bool) (*testNode, *testNode, func()) {
+	var (
+		names     = []string{"a", "b"}
+		listeners = make([]net.Listener, len(names))
+		nodes     = make([]*testNode, len(names))
+		closers   []func() error
+	)
+	for i := range names {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners[i] = l
+	}
+
+	for i, name := range names {
+		c := cluster.NewStatic(logrus.New(), name, listeners[i].Addr().String(), i, len(names))
+		for j, peer := range names {
+			if j != i {
+				c.Join(peer, listeners[j].Addr().String(), j)
+			}
+		}
+
+		db, err := tsdb.Open(filepath.Join(dir, name), nil, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		closers = append(closers, db.Close)
+
+		var s storage.Storage = promtsdb.Adapter(db, 0)
+		if repair || i == 0 {
+			ooo, err := outoforder.New(logrus.New(), s, filepath.Join(dir, name, "out_of_order"), filepath.Join(dir, name, "buffer"), outoforder.DefaultGracePeriod)
+			if err != nil {
+				t.Fatal(err)
+			}
+			closers = append(closers, ooo.Close)
+			s = ooo
+		}
+
+		wr, err := write.New(c, logrus.New(), s, filepath.Join(dir, name, "hints"), write.ConsistencyOne)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ae := New(c, logrus.New(), s)
+
+		mux := http.NewServeMux()
+		mux.HandleFunc(write.Route, wr.HandlerFunc)
+		mux.HandleFunc(TreeRoute, ae.TreeHandlerFunc)
+		mux.HandleFunc(SamplesRoute, ae.SamplesHandlerFunc)
+		srv := &http.Server{Handler: mux}
+		go srv.Serve(listeners[i])
+		closers = append([]func() error{srv.Close}, closers...)
+
+		nodes[i] = &testNode{name: name, clstr: c, store: s, ae: ae}
+	}
+
+	return nodes[0], nodes[1], func() {
+		for _, c := range closers {
+			c()
+		}
+	}
+}
+
+// appendSamples appends samples to the node's storage, accepting historical
+// samples if the storage supports it.
+func appendSamples(t *testing.T, s storage.Storage, lbls labels.Labels, timestamps ...int64) {
+	newAppender := s.Appender
+	if r, ok := s.(interface {
+		RepairAppender() (storage.Appender, error)
+	}); ok {
+		newAppender = r.RepairAppender
+	}
+	app, err := newAppender()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ts := range timestamps {
+		if _, err := app.Add(lbls, ts, float64(ts)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := app.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func selectTimestamps(t *testing.T, s storage.Storage, name string, mint, maxt int64) []int64 {
+	q, err := s.Querier(context.Background(), mint, maxt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	m, err := labels.NewMatcher(labels.MatchEqual, labels.MetricName, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, err := q.Select(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var timestamps []int64
+	for set.Next() {
+		it := set.At().Iterator()
+		for it.Next() {
+			ts, _ := it.At()
+			timestamps = append(timestamps, ts)
+		}
+	}
+	if err := set.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return timestamps
+}
+
+func peer(n *testNode, name string) *cluster.Node {
+	for _, p := range n.clstr.Nodes() {
+		if p.Name() == name {
+			return p
+		}
+	}
+	return nil
+}
+
+func TestAntiEntropyConverges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timbala-antientropy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a, b, stop := startNodes(t, dir, true)
+	defer stop()
+
+	now := timestamp.FromTime(time.Now())
+	old := now - int64(3*time.Hour/time.Millisecond)
+	foo := labels.FromStrings(labels.MetricName, "foo")
+	bar := labels.FromStrings(labels.MetricName, "bar")
+
+	// Each node holds historical samples missing from the other, and a
+	// newer sample so that the historical samples are out of order
+	appendSamples(t, a.store, foo, now)
+	appendSamples(t, b.store, foo, now)
+	appendSamples(t, a.store, foo, old, old+1000)
+	appendSamples(t, b.store, bar, now)
+	appendSamples(t, b.store, bar, old)
+
+	mint, maxt := old-int64(time.Hour/time.Millisecond), old+int64(time.Hour/time.Millisecond)
+	if err := a.ae.syncWithPeer(context.Background(), peer(a, "b"), mint, maxt); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, n := range []*testNode{a, b} {
+		if got := selectTimestamps(t, n.store, "foo", mint, maxt); len(got) != 2 {
+			t.Errorf("Expected node %s to hold 2 samples for foo, got %v", n.name, got)
+		}
+		if got := selectTimestamps(t, n.store, "bar", mint, maxt); len(got) != 1 {
+			t.Errorf("Expected node %s to hold 1 sample for bar, got %v", n.name, got)
+		}
+	}
+
+	// Trees built from the repaired data are identical
+	local, err := newTestAntiEntropy(a).tree("b", mint, maxt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err := newTestAntiEntropy(b).tree("a", mint, maxt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if local[0] != remote[0] {
+		t.Error("Expected Merkle trees to match after repair")
+	}
+}
+
+func TestAntiEntropyRejected(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timbala-antientropy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a, b, stop := startNodes(t, dir, false)
+	defer stop()
+
+	now := timestamp.FromTime(time.Now())
+	old := now - int64(3*time.Hour/time.Millisecond)
+	foo := labels.FromStrings(labels.MetricName, "foo")
+
+	appendSamples(t, a.store, foo, now)
+	appendSamples(t, b.store, foo, now)
+	appendSamples(t, a.store, foo, old)
+
+	// Node b cannot store the historical sample, so the exchange fails
+	mint, maxt := old-int64(time.Hour/time.Millisecond), old+int64(time.Hour/time.Millisecond)
+	if err := a.ae.syncWithPeer(context.Background(), peer(a, "b"), mint, maxt); err == nil {
+		t.Fatal("Expected exchange to fail when samples are rejected")
+	}
+	if got := selectTimestamps(t, b.store, "foo", mint, maxt); len(got) != 0 {
+		t.Fatalf("Expected node b not to hold the historical sample, got %v", got)
+	}
+}
+
+// newTestAntiEntropy returns an anti-entropy instance for the node that does
+// not share a tree cache with the node's running instance.
+func newTestAntiEntropy(n *testNode) *antiEntropy {
+	return New(n.clstr, logrus.New(), n.store)
+}
@@ -0,0 +1,101 @@
+package antientropy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/cespare/xxhash"
+)
+
+const (
+	treeDepth = 10
+	numLeaves = 1 << treeDepth
+	treeSize  = 2*numLeaves - 1
+
+	rootIndex = 0
+)
+
+// tree is a Merkle tree stored in a flat slice, with the root at index zero
+// and the children of node i at 2i+1 and 2i+2. Each leaf covers the
+// partition keys that map to it using leafForPartitionKey.
+//
+// Leaves are the sum of the hashes of the samples they cover, so that the
+// order in which samples are added does not affect the hash.
+type tree []uint64
+
+func newTree() tree {
+	return make(tree, treeSize)
+}
+
+func leafForPartitionKey(pKey uint64) int {
+	return int(pKey % numLeaves)
+}
+
+func leafIndex(leaf int) int {
+	return numLeaves - 1 + leaf
+}
+
+func isLeafIndex(i int) bool {
+	return i >= numLeaves-1
+}
+
+func children(i int) (int, int) {
+	return 2*i + 1, 2*i + 2
+}
+
+func (t tree) add(pKey, seriesHash uint64, timestamp int64, value float64) {
+	t[leafIndex(leafForPartitionKey(pKey))] += sampleHash(seriesHash, timestamp, value)
+}
+
+// build computes the hashes of all non-leaf nodes. It must be called once
+// all samples have been added.
+func (t tree) build() {
+	var buf [16]byte
+	for i := numLeaves - 2; i >= 0; i-- {
+		l, r := children(i)
+		binary.LittleEndian.PutUint64(buf[:8], t[l])
+		binary.LittleEndian.PutUint64(buf[8:], t[r])
+		t[i] = xxhash.Sum64(buf[:])
+	}
+}
+
+func sampleHash(seriesHash uint64, timestamp int64, value float64) uint64 {
+	var buf [24]byte
+	binary.LittleEndian.PutUint64(buf[:8], seriesHash)
+	binary.LittleEndian.PutUint64(buf[8:16], uint64(timestamp))
+	binary.LittleEndian.PutUint64(buf[16:], math.Float64bits(value))
+	return xxhash.Sum64(buf[:])
+}
+
+// diff descends the tree, comparing hashes with a remote tree, and returns
+// the leaves that differ. fetch is called once per level of the tree with the
+// indices of the nodes whose remote hashes are required.
+func (t tree) diff(fetch func(indices []int) ([]uint64, error)) ([]int, error) {
+	var leaves []int
+	indices := []int{rootIndex}
+	for len(indices) > 0 {
+		remote, err := fetch(indices)
+		if err != nil {
+			return nil, err
+		}
+		if len(remote) != len(indices) {
+			return nil, fmt.Errorf("expected %d tree hashes, got %d", len(indices), len(remote))
+		}
+
+		var next []int
+		for j, i := range indices {
+			if t[i] == remote[j] {
+				continue
+			}
+			if isLeafIndex(i) {
+				leaves = append(leaves, i-(numLeaves-1))
+				continue
+			}
+			l, r := children(i)
+			next = append(next, l, r)
+		}
+		indices = next
+	}
+	return leaves, nil
+}
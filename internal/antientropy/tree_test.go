@@ -0,0 +1,69 @@
+package antientropy
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTreeDiff(t *testing.T) {
+	local, remote := newTree(), newTree()
+	for i := uint64(0); i < 10000; i++ {
+		local.add(i, i*7, int64(i), float64(i))
+		remote.add(i, i*7, int64(i), float64(i))
+	}
+
+	// Add the same samples in a different order to ensure that the
+	// order samples are added in doesn't matter
+	local.add(numLeaves*3+5, 1, 1, 1)
+	local.add(numLeaves*3+5, 2, 2, 2)
+	remote.add(numLeaves*3+5, 2, 2, 2)
+	remote.add(numLeaves*3+5, 1, 1, 1)
+
+	// Introduce differences in two leaves
+	local.add(42, 1, 1, 1)
+	remote.add(numLeaves+100, 1, 1, 1)
+
+	local.build()
+	remote.build()
+
+	var requests int
+	leaves, err := local.diff(func(indices []int) ([]uint64, error) {
+		requests++
+		hashes := make([]uint64, 0, len(indices))
+		for _, i := range indices {
+			hashes = append(hashes, remote[i])
+		}
+		return hashes, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []int{42, 100}; !reflect.DeepEqual(leaves, expected) {
+		t.Fatalf("Expected differing leaves %v, got %v", expected, leaves)
+	}
+	if expected := treeDepth + 1; requests != expected {
+		t.Fatalf("Expected %d requests to descend the tree, got %d", expected, requests)
+	}
+}
+
+func TestTreeDiffInSync(t *testing.T) {
+	local := newTree()
+	local.add(1, 1, 1, 1)
+	local.build()
+
+	var requests int
+	leaves, err := local.diff(func(indices []int) ([]uint64, error) {
+		requests++
+		return []uint64{local[rootIndex]}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leaves) != 0 {
+		t.Fatalf("Expected no differing leaves, got %v", leaves)
+	}
+	if requests != 1 {
+		t.Fatalf("Expected only the root to be compared, got %d requests", requests)
+	}
+}
@@ -19,9 +19,17 @@ import (
 	"fmt"
 	"math"
 	"net/http"
+	"sort"
 	"strconv"
 	"time"
 
+	"github.com/mattbostock/timbala/internal/cardinality"
+	"github.com/mattbostock/timbala/internal/cluster"
+	"github.com/mattbostock/timbala/internal/deletion"
+	"github.com/mattbostock/timbala/internal/pushdown"
+	"github.com/mattbostock/timbala/internal/querycache"
+	"github.com/mattbostock/timbala/internal/selectors"
+	"github.com/mattbostock/timbala/internal/warnings"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/common/route"
@@ -43,6 +51,10 @@ const (
 
 type errorType string
 
+// defaultStatusLimit is the number of metric names and label pairs returned in
+// a TSDB status if no limit is given
+const defaultStatusLimit = 10
+
 const (
 	errorNone     errorType = ""
 	errorTimeout            = "timeout"
@@ -72,6 +84,7 @@ type response struct {
 	Data      interface{} `json:"data,omitempty"`
 	ErrorType errorType   `json:"errorType,omitempty"`
 	Error     string      `json:"error,omitempty"`
+	Warnings  []string    `json:"warnings,omitempty"`
 }
 
 // Enables cross-site script calls.
@@ -83,21 +96,44 @@ func setCORS(w http.ResponseWriter) {
 
 type apiFunc func(r *http.Request) (interface{}, *apiError)
 
+// SeriesDeleter deletes series from every node in the cluster.
+type SeriesDeleter interface {
+	DeleteSeries(ctx context.Context, mint, maxt int64, matchers [][]*labels.Matcher) ([]deletion.Result, error)
+	CleanTombstones(ctx context.Context) ([]deletion.Result, error)
+}
+
+// RangeQueryCache caches the results of range queries, evaluating any results
+// that are not cached using the given function.
+type RangeQueryCache interface {
+	QueryRange(ctx context.Context, expr promql.Expr, start, end time.Time, step time.Duration, eval querycache.EvalFunc) (promql.Matrix, error)
+}
+
+// aggregateEvaluator is implemented by storage that can evaluate aggregations
+// on the nodes holding the data being aggregated.
+type aggregateEvaluator interface {
+	EvaluateAggregate(ctx context.Context, agg *promql.AggregateExpr, start, end time.Time, step time.Duration) (promql.Matrix, error)
+	KeyVersion() cluster.KeyVersion
+}
+
 // API can register a set of endpoints in a router and handle
 // them using the provided storage and query engine.
 type API struct {
-	Storage     storage.Storage
-	QueryEngine *promql.Engine
+	Storage      storage.Storage
+	QueryEngine  *promql.Engine
+	Deleter      SeriesDeleter
+	ResultsCache RangeQueryCache
 
 	now func() time.Time
 }
 
 // NewAPI returns an initialized API type.
-func NewAPI(qe *promql.Engine, st storage.Storage) *API {
+func NewAPI(qe *promql.Engine, st storage.Storage, d SeriesDeleter, rc RangeQueryCache) *API {
 	return &API{
-		QueryEngine: qe,
-		Storage:     st,
-		now:         time.Now,
+		QueryEngine:  qe,
+		Storage:      st,
+		Deleter:      d,
+		ResultsCache: rc,
+		now:          time.Now,
 	}
 }
 
@@ -106,10 +142,11 @@ func (api *API) Register(r *route.Router) {
 	instr := func(name string, f apiFunc) http.HandlerFunc {
 		hf := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			setCORS(w)
+			r = r.WithContext(warnings.NewContext(r.Context()))
 			if data, err := f(r); err != nil {
 				respondError(w, err, data)
 			} else if data != nil {
-				respond(w, data)
+				respond(w, data, warnings.FromContext(r.Context()))
 			} else {
 				w.WriteHeader(http.StatusNoContent)
 			}
@@ -125,9 +162,14 @@ func (api *API) Register(r *route.Router) {
 	r.Get("/query_range", instr("query_range", api.queryRange))
 
 	r.Get("/label/:name/values", instr("label_values", api.labelValues))
+	r.Get("/labels", instr("label_names", api.labelNames))
 
 	r.Get("/series", instr("series", api.series))
 	r.Del("/series", instr("drop_series", api.dropSeries))
+	r.Post("/admin/tsdb/delete_series", instr("drop_series", api.dropSeries))
+	r.Post("/admin/tsdb/clean_tombstones", instr("clean_tombstones", api.cleanTombstones))
+
+	r.Get("/status/tsdb", instr("status_tsdb", api.tsdbStatus))
 }
 
 type queryData struct {
@@ -168,7 +210,7 @@ func (api *API) query(r *http.Request) (interface{}, *apiError) {
 		return nil, &apiError{errorBadData, err}
 	}
 
-	res := qry.Exec(ctx)
+	res := qry.Exec(withSelectors(ctx, qry))
 	if res.Err != nil {
 		switch res.Err.(type) {
 		case promql.ErrQueryCanceled:
@@ -184,6 +226,16 @@ func (api *API) query(r *http.Request) (interface{}, *apiError) {
 	}, nil
 }
 
+// withSelectors passes the query's selectors to the storage, so that the
+// series for all of them can be fetched from each node in one request.
+func withSelectors(ctx context.Context, qry promql.Query) context.Context {
+	stmt, ok := qry.Statement().(*promql.EvalStmt)
+	if !ok {
+		return ctx
+	}
+	return selectors.NewContext(ctx, selectors.FromExpr(stmt.Expr))
+}
+
 func (api *API) queryRange(r *http.Request) (interface{}, *apiError) {
 	start, err := parseTime(r.FormValue("start"))
 	if err != nil {
@@ -227,25 +279,57 @@ func (api *API) queryRange(r *http.Request) (interface{}, *apiError) {
 		defer cancel()
 	}
 
-	qry, err := api.QueryEngine.NewRangeQuery(r.FormValue("query"), start, end, step)
+	qs := r.FormValue("query")
+	qry, err := api.QueryEngine.NewRangeQuery(qs, start, end, step)
 	if err != nil {
 		return nil, &apiError{errorBadData, err}
 	}
 
-	res := qry.Exec(ctx)
-	if res.Err != nil {
-		switch res.Err.(type) {
+	// evalLocal evaluates the query over part of the requested range using
+	// this node's query engine
+	evalLocal := func(ctx context.Context, start, end time.Time) (promql.Matrix, error) {
+		qry, err := api.QueryEngine.NewRangeQuery(qs, start, end, step)
+		if err != nil {
+			return nil, err
+		}
+		res := qry.Exec(withSelectors(ctx, qry))
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Matrix()
+	}
+
+	// eval evaluates the query over part of the requested range, so that
+	// the results cache can evaluate only the results it does not hold.
+	// Aggregations are pushed down to the nodes holding the data if
+	// possible.
+	expr := qry.Statement().(*promql.EvalStmt).Expr
+	eval := evalLocal
+	if ae, ok := api.Storage.(aggregateEvaluator); ok {
+		eval = func(ctx context.Context, start, end time.Time) (promql.Matrix, error) {
+			return pushdown.Evaluate(ctx, expr, start, end, step, ae.KeyVersion(), evalLocal, ae.EvaluateAggregate)
+		}
+	}
+
+	var mat promql.Matrix
+	if api.ResultsCache != nil {
+		mat, err = api.ResultsCache.QueryRange(ctx, expr, start, end, step, eval)
+	} else {
+		mat, err = eval(ctx, start, end)
+	}
+	if err != nil {
+		switch err.(type) {
 		case promql.ErrQueryCanceled:
-			return nil, &apiError{errorCanceled, res.Err}
+			return nil, &apiError{errorCanceled, err}
 		case promql.ErrQueryTimeout:
-			return nil, &apiError{errorTimeout, res.Err}
+			return nil, &apiError{errorTimeout, err}
 		}
-		return nil, &apiError{errorExec, res.Err}
+		return nil, &apiError{errorExec, err}
 	}
 
 	return &queryData{
-		ResultType: res.Value.Type(),
-		Result:     res.Value,
+		ResultType: mat.Type(),
+		Result:     mat,
 	}, nil
 }
 
@@ -271,46 +355,61 @@ func (api *API) labelValues(r *http.Request) (interface{}, *apiError) {
 	return vals, nil
 }
 
-var (
-	minTime = time.Unix(math.MinInt64/1000+62135596801, 0)
-	maxTime = time.Unix(math.MaxInt64/1000-62135596801, 999999999)
-)
-
-func (api *API) series(r *http.Request) (interface{}, *apiError) {
-	r.ParseForm()
-	if len(r.Form["match[]"]) == 0 {
-		return nil, &apiError{errorBadData, fmt.Errorf("no match[] parameter provided")}
-	}
-
-	var start time.Time
+// parseTimeRange returns the time range given by the start and end
+// parameters, defaulting to all time.
+func parseTimeRange(r *http.Request) (time.Time, time.Time, *apiError) {
+	start, end := minTime, maxTime
 	if t := r.FormValue("start"); t != "" {
 		var err error
 		start, err = parseTime(t)
 		if err != nil {
-			return nil, &apiError{errorBadData, err}
+			return start, end, &apiError{errorBadData, err}
 		}
-	} else {
-		start = minTime
 	}
-
-	var end time.Time
 	if t := r.FormValue("end"); t != "" {
 		var err error
 		end, err = parseTime(t)
 		if err != nil {
-			return nil, &apiError{errorBadData, err}
+			return start, end, &apiError{errorBadData, err}
 		}
-	} else {
-		end = maxTime
 	}
+	return start, end, nil
+}
 
-	var matcherSets [][]*labels.Matcher
-	for _, s := range r.Form["match[]"] {
+// selectMatchers returns the series matching any of the given series
+// selectors.
+func selectMatchers(q storage.Querier, exprs []string) (storage.SeriesSet, *apiError) {
+	var sets []storage.SeriesSet
+	for _, s := range exprs {
 		matchers, err := promql.ParseMetricSelector(s)
 		if err != nil {
 			return nil, &apiError{errorBadData, err}
 		}
-		matcherSets = append(matcherSets, matchers)
+		set, err := q.Select(matchers...)
+		if err != nil {
+			return nil, &apiError{errorExec, err}
+		}
+		sets = append(sets, set)
+	}
+	return storage.NewMergeSeriesSet(sets), nil
+}
+
+var (
+	minTime = time.Unix(math.MinInt64/1000+62135596801, 0)
+	maxTime = time.Unix(math.MaxInt64/1000-62135596801, 999999999)
+)
+
+// labelNamer is implemented by queriers that can list the names of all
+// labels within their time range.
+type labelNamer interface {
+	LabelNames() ([]string, error)
+}
+
+func (api *API) labelNames(r *http.Request) (interface{}, *apiError) {
+	r.ParseForm()
+	start, end, apiErr := parseTimeRange(r)
+	if apiErr != nil {
+		return nil, apiErr
 	}
 
 	q, err := api.Storage.Querier(r.Context(), timestamp.FromTime(start), timestamp.FromTime(end))
@@ -319,16 +418,61 @@ func (api *API) series(r *http.Request) (interface{}, *apiError) {
 	}
 	defer q.Close()
 
-	var sets []storage.SeriesSet
-	for _, mset := range matcherSets {
-		s, err := q.Select(mset...)
+	if len(r.Form["match[]"]) == 0 {
+		ln, ok := q.(labelNamer)
+		if !ok {
+			return nil, &apiError{errorExec, errors.New("listing label names is not supported without match[]")}
+		}
+		names, err := ln.LabelNames()
 		if err != nil {
 			return nil, &apiError{errorExec, err}
 		}
-		sets = append(sets, s)
+		return names, nil
+	}
+
+	set, apiErr := selectMatchers(q, r.Form["match[]"])
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	seen := make(map[string]struct{})
+	for set.Next() {
+		for _, l := range set.At().Labels() {
+			seen[l.Name] = struct{}{}
+		}
+	}
+	if set.Err() != nil {
+		return nil, &apiError{errorExec, set.Err()}
+	}
+
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
 	}
+	sort.Strings(names)
+	return names, nil
+}
 
-	set := storage.NewMergeSeriesSet(sets)
+func (api *API) series(r *http.Request) (interface{}, *apiError) {
+	r.ParseForm()
+	if len(r.Form["match[]"]) == 0 {
+		return nil, &apiError{errorBadData, fmt.Errorf("no match[] parameter provided")}
+	}
+
+	start, end, apiErr := parseTimeRange(r)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	q, err := api.Storage.Querier(r.Context(), timestamp.FromTime(start), timestamp.FromTime(end))
+	if err != nil {
+		return nil, &apiError{errorExec, err}
+	}
+	defer q.Close()
+
+	set, apiErr := selectMatchers(q, r.Form["match[]"])
+	if apiErr != nil {
+		return nil, apiErr
+	}
 	metrics := []labels.Labels{}
 	for set.Next() {
 		metrics = append(metrics, set.At().Labels())
@@ -340,43 +484,92 @@ func (api *API) series(r *http.Request) (interface{}, *apiError) {
 	return metrics, nil
 }
 
+// tsdbStatusQuerier is implemented by queriers that can summarise the
+// cardinality of the series they hold.
+type tsdbStatusQuerier interface {
+	TSDBStatus(limit int) (*cardinality.TSDBStatus, error)
+}
+
+func (api *API) tsdbStatus(r *http.Request) (interface{}, *apiError) {
+	limit := defaultStatusLimit
+	if l := r.FormValue("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 1 {
+			return nil, &apiError{errorBadData, fmt.Errorf("invalid limit: %q", l)}
+		}
+	}
+
+	q, err := api.Storage.Querier(r.Context(), math.MinInt64, math.MaxInt64)
+	if err != nil {
+		return nil, &apiError{errorExec, err}
+	}
+	defer q.Close()
+
+	sq, ok := q.(tsdbStatusQuerier)
+	if !ok {
+		return nil, &apiError{errorExec, errors.New("TSDB status is not supported")}
+	}
+	s, err := sq.TSDBStatus(limit)
+	if err != nil {
+		return nil, &apiError{errorExec, err}
+	}
+	return s, nil
+}
+
+// dropSeries deletes the samples between start and end from the series
+// matching any of the match[] selectors on every node, responding with the
+// number of series each node deleted samples from.
 func (api *API) dropSeries(r *http.Request) (interface{}, *apiError) {
 	r.ParseForm()
 	if len(r.Form["match[]"]) == 0 {
 		return nil, &apiError{errorBadData, fmt.Errorf("no match[] parameter provided")}
 	}
 
-	// TODO(fabxc): temporarily disabled
-	panic("disabled")
-
-	// numDeleted := 0
-	// for _, s := range r.Form["match[]"] {
-	// 	matchers, err := promql.ParseMetricSelector(s)
-	// 	if err != nil {
-	// 		return nil, &apiError{errorBadData, err}
-	// 	}
-	// 	n, err := api.Storage.DropMetricsForLabelMatchers(context.TODO(), matchers...)
-	// 	if err != nil {
-	// 		return nil, &apiError{errorExec, err}
-	// 	}
-	// 	numDeleted += n
-	// }
-
-	// res := struct {
-	// 	NumDeleted int `json:"numDeleted"`
-	// }{
-	// 	NumDeleted: numDeleted,
-	// }
-	// return res, nil
+	start, end, apiErr := parseTimeRange(r)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	matchers := make([][]*labels.Matcher, 0, len(r.Form["match[]"]))
+	for _, s := range r.Form["match[]"] {
+		ms, err := promql.ParseMetricSelector(s)
+		if err != nil {
+			return nil, &apiError{errorBadData, err}
+		}
+		matchers = append(matchers, ms)
+	}
+
+	if api.Deleter == nil {
+		return nil, &apiError{errorExec, errors.New("deleting series is not supported")}
+	}
+	results, err := api.Deleter.DeleteSeries(r.Context(), timestamp.FromTime(start), timestamp.FromTime(end), matchers)
+	if err != nil {
+		return results, &apiError{errorExec, err}
+	}
+	return results, nil
+}
+
+// cleanTombstones removes deleted samples from disk on every node, returning
+// the result from each node.
+func (api *API) cleanTombstones(r *http.Request) (interface{}, *apiError) {
+	if api.Deleter == nil {
+		return nil, &apiError{errorExec, errors.New("cleaning tombstones is not supported")}
+	}
+	results, err := api.Deleter.CleanTombstones(r.Context())
+	if err != nil {
+		return results, &apiError{errorExec, err}
+	}
+	return results, nil
 }
 
-func respond(w http.ResponseWriter, data interface{}) {
+func respond(w http.ResponseWriter, data interface{}, warns []string) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 
 	b, err := json.Marshal(&response{
-		Status: statusSuccess,
-		Data:   data,
+		Status:   statusSuccess,
+		Data:     data,
+		Warnings: warns,
 	})
 	if err != nil {
 		return
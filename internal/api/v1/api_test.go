@@ -25,6 +25,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/mattbostock/timbala/internal/deletion"
 	"github.com/prometheus/common/route"
 	"golang.org/x/net/context"
 
@@ -250,6 +251,50 @@ func TestEndpoints(t *testing.T) {
 			},
 			errType: errorBadData,
 		},
+		{
+			endpoint: api.labelNames,
+			query: url.Values{
+				"match[]": []string{`test_metric2`},
+			},
+			response: []string{
+				"__name__",
+				"foo",
+			},
+		},
+		// Start and end after series ends.
+		{
+			endpoint: api.labelNames,
+			query: url.Values{
+				"match[]": []string{`test_metric2`},
+				"start":   []string{"100000"},
+				"end":     []string{"100001"},
+			},
+			response: []string{},
+		},
+		// Storage that cannot list label names.
+		{
+			endpoint: api.labelNames,
+			errType:  errorExec,
+		},
+		{
+			endpoint: api.labelNames,
+			query: url.Values{
+				"match[]": []string{`not!!!allowed`},
+			},
+			errType: errorBadData,
+		},
+		// Storage that cannot summarise cardinality.
+		{
+			endpoint: api.tsdbStatus,
+			errType:  errorExec,
+		},
+		{
+			endpoint: api.tsdbStatus,
+			query: url.Values{
+				"limit": []string{"0"},
+			},
+			errType: errorBadData,
+		},
 		{
 			endpoint: api.series,
 			query: url.Values{
@@ -363,37 +408,7 @@ func TestEndpoints(t *testing.T) {
 			endpoint: api.dropSeries,
 			errType:  errorBadData,
 		},
-		// The following tests delete time series from the test storage. They
-		// must remain at the end and are fixed in their order.
-		// {
-		// 	endpoint: api.dropSeries,
-		// 	query: url.Values{
-		// 		"match[]": []string{`test_metric1{foo=~".+o"}`},
-		// 	},
-		// 	response: struct {
-		// 		NumDeleted int `json:"numDeleted"`
-		// 	}{1},
-		// },
 		// {
-		// 	endpoint: api.series,
-		// 	query: url.Values{
-		// 		"match[]": []string{`test_metric1`},
-		// 	},
-		// 	response: []model.Metric{
-		// 		{
-		// 			"__name__": "test_metric1",
-		// 			"foo":      "bar",
-		// 		},
-		// 	},
-		// }, {
-		// 	endpoint: api.dropSeries,
-		// 	query: url.Values{
-		// 		"match[]": []string{`{__name__=~".+"}`},
-		// 	},
-		// 	response: struct {
-		// 		NumDeleted int `json:"numDeleted"`
-		// 	}{2},
-		// }, {
 		// 	endpoint: api.targets,
 		// 	response: []*Target{
 		// 		&Target{
@@ -437,9 +452,97 @@ func TestEndpoints(t *testing.T) {
 	}
 }
 
+type fakeDeleter struct {
+	mint, maxt int64
+	matchers   [][]*labels.Matcher
+	results    []deletion.Result
+	err        error
+}
+
+func (d *fakeDeleter) DeleteSeries(_ context.Context, mint, maxt int64, matchers [][]*labels.Matcher) ([]deletion.Result, error) {
+	d.mint, d.maxt, d.matchers = mint, maxt, matchers
+	return d.results, d.err
+}
+
+func (d *fakeDeleter) CleanTombstones(_ context.Context) ([]deletion.Result, error) {
+	return d.results, d.err
+}
+
+func TestDropSeries(t *testing.T) {
+	results := []deletion.Result{
+		{Node: "node1", NumDeleted: 2},
+		{Node: "node2", NumDeleted: 1},
+	}
+	d := &fakeDeleter{results: results}
+	api := &API{Deleter: d}
+
+	query := url.Values{
+		"match[]": []string{`test_metric1{foo=~".+o"}`, `test_metric2`},
+		"start":   []string{"1"},
+		"end":     []string{"2"},
+	}
+	req, err := http.NewRequest("DELETE", "http://example.com?"+query.Encode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, apiErr := api.dropSeries(req)
+	if apiErr != nil {
+		t.Fatalf("Unexpected error: %s", apiErr)
+	}
+	if !reflect.DeepEqual(resp, results) {
+		t.Fatalf("Expected response %v, got %v", results, resp)
+	}
+	if d.mint != 1000 || d.maxt != 2000 {
+		t.Fatalf("Expected deletion between 1000 and 2000, got %d and %d", d.mint, d.maxt)
+	}
+	expected := [][]*labels.Matcher{
+		{
+			mustNewMatcher(t, labels.MatchRegexp, "foo", ".+o"),
+			mustNewMatcher(t, labels.MatchEqual, "__name__", "test_metric1"),
+		},
+		{
+			mustNewMatcher(t, labels.MatchEqual, "__name__", "test_metric2"),
+		},
+	}
+	if !reflect.DeepEqual(d.matchers, expected) {
+		t.Fatalf("Expected matchers %v, got %v", expected, d.matchers)
+	}
+
+	// Failures on any node are reported along with the results
+	d.err = errors.New("failed on 1 of 2 nodes")
+	resp, apiErr = api.dropSeries(req)
+	if apiErr == nil || apiErr.typ != errorExec {
+		t.Fatalf("Expected error of type %q, got %v", errorExec, apiErr)
+	}
+	if !reflect.DeepEqual(resp, results) {
+		t.Fatalf("Expected response %v, got %v", results, resp)
+	}
+
+	resp, apiErr = api.cleanTombstones(req)
+	if apiErr == nil || apiErr.typ != errorExec {
+		t.Fatalf("Expected error of type %q, got %v", errorExec, apiErr)
+	}
+	d.err = nil
+	resp, apiErr = api.cleanTombstones(req)
+	if apiErr != nil {
+		t.Fatalf("Unexpected error: %s", apiErr)
+	}
+	if !reflect.DeepEqual(resp, results) {
+		t.Fatalf("Expected response %v, got %v", results, resp)
+	}
+}
+
+func mustNewMatcher(t *testing.T, mt labels.MatchType, name, value string) *labels.Matcher {
+	m, err := labels.NewMatcher(mt, name, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
 func TestRespondSuccess(t *testing.T) {
 	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		respond(w, "test")
+		respond(w, "test", []string{"node a did not respond"})
 	}))
 	defer s.Close()
 
@@ -466,8 +569,9 @@ func TestRespondSuccess(t *testing.T) {
 	}
 
 	exp := &response{
-		Status: statusSuccess,
-		Data:   "test",
+		Status:   statusSuccess,
+		Data:     "test",
+		Warnings: []string{"node a did not respond"},
 	}
 	if !reflect.DeepEqual(&res, exp) {
 		t.Fatalf("Expected response \n%v\n but got \n%v\n", res, exp)
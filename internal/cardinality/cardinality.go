@@ -0,0 +1,205 @@
+// Package cardinality summarises the series held in each node's head block, so
+// that the causes of cardinality explosions can be found.
+package cardinality
+
+import (
+	"sort"
+
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/chunks"
+	"github.com/prometheus/tsdb/index"
+	"github.com/prometheus/tsdb/labels"
+)
+
+const metricName = "__name__"
+
+// TSDBStatus summarises the series in the head block and those buffered
+// alongside it.
+type TSDBStatus struct {
+	HeadStats                   HeadStats `json:"headStats"`
+	SeriesCountByMetricName     []Stat    `json:"seriesCountByMetricName"`
+	SeriesCountByLabelValuePair []Stat    `json:"seriesCountByLabelValuePair"`
+}
+
+type HeadStats struct {
+	NumSeries uint64 `json:"numSeries"`
+}
+
+// Stat is the number of series with a given metric name or label pair.
+type Stat struct {
+	Name  string `json:"name"`
+	Value uint64 `json:"value"`
+}
+
+// FromHead returns the number of series in the given head block and in
+// buffered, which holds the label sets of series whose samples are held in
+// memory outside the head, such as out-of-order samples waiting to be written
+// to a block. It also returns the limit metric names and label pairs with the
+// most series. Series both in the head and buffered are counted once.
+func FromHead(h *tsdb.Head, buffered []labels.Labels, limit int) (*TSDBStatus, error) {
+	ir, err := h.Index()
+	if err != nil {
+		return nil, err
+	}
+	defer ir.Close()
+
+	allName, allValue := index.AllPostingsKey()
+	numSeries, err := countPostings(ir, allName, allValue)
+	if err != nil {
+		return nil, err
+	}
+
+	indices, err := ir.LabelIndices()
+	if err != nil {
+		return nil, err
+	}
+
+	byMetricName := make(map[string]uint64)
+	byLabelPair := make(map[string]uint64)
+	for _, names := range indices {
+		if len(names) != 1 {
+			continue
+		}
+		name := names[0]
+
+		values, err := ir.LabelValues(name)
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < values.Len(); i++ {
+			tuple, err := values.At(i)
+			if err != nil {
+				return nil, err
+			}
+			count, err := countPostings(ir, name, tuple[0])
+			if err != nil {
+				return nil, err
+			}
+
+			if name == metricName {
+				byMetricName[tuple[0]] = count
+			}
+			byLabelPair[name+"="+tuple[0]] = count
+		}
+	}
+
+	for _, lset := range buffered {
+		ok, err := inIndex(ir, lset)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			continue
+		}
+		numSeries++
+		for _, l := range lset {
+			if l.Name == metricName {
+				byMetricName[l.Value]++
+			}
+			byLabelPair[l.Name+"="+l.Value]++
+		}
+	}
+
+	return &TSDBStatus{
+		HeadStats:                   HeadStats{NumSeries: numSeries},
+		SeriesCountByMetricName:     topFromMap(byMetricName, 1, limit),
+		SeriesCountByLabelValuePair: topFromMap(byLabelPair, 1, limit),
+	}, nil
+}
+
+// inIndex returns whether the index holds a series with exactly the given
+// labels.
+func inIndex(ir tsdb.IndexReader, lset labels.Labels) (bool, error) {
+	its := make([]index.Postings, 0, len(lset))
+	for _, l := range lset {
+		p, err := ir.Postings(l.Name, l.Value)
+		if err != nil {
+			return false, err
+		}
+		its = append(its, ir.SortedPostings(p))
+	}
+
+	p := index.Intersect(its...)
+	var got labels.Labels
+	var chks []chunks.Meta
+	for p.Next() {
+		if err := ir.Series(p.At(), &got, &chks); err != nil {
+			return false, err
+		}
+		// The series has every label given, so it is the same series if
+		// it has no others
+		if len(got) == len(lset) {
+			return true, nil
+		}
+	}
+	return false, p.Err()
+}
+
+func countPostings(ir tsdb.IndexReader, name, value string) (uint64, error) {
+	p, err := ir.Postings(name, value)
+	if err != nil {
+		return 0, err
+	}
+	var n uint64
+	for p.Next() {
+		n++
+	}
+	return n, p.Err()
+}
+
+// Merge combines the statuses reported by several nodes. Each series is held
+// by replicas nodes, so the number of series is divided accordingly.
+//
+// Each node only reports its own top metric names and label pairs, so the
+// merged results are approximate for entries near the limit. Nodes should be
+// asked for more entries than are needed to reduce the error.
+func Merge(statuses []*TSDBStatus, replicas, limit int) *TSDBStatus {
+	if replicas < 1 {
+		replicas = 1
+	}
+
+	var numSeries uint64
+	byMetricName := make(map[string]uint64)
+	byLabelPair := make(map[string]uint64)
+	for _, s := range statuses {
+		numSeries += s.HeadStats.NumSeries
+		for _, stat := range s.SeriesCountByMetricName {
+			byMetricName[stat.Name] += stat.Value
+		}
+		for _, stat := range s.SeriesCountByLabelValuePair {
+			byLabelPair[stat.Name] += stat.Value
+		}
+	}
+
+	return &TSDBStatus{
+		HeadStats:                   HeadStats{NumSeries: numSeries / uint64(replicas)},
+		SeriesCountByMetricName:     topFromMap(byMetricName, replicas, limit),
+		SeriesCountByLabelValuePair: topFromMap(byLabelPair, replicas, limit),
+	}
+}
+
+func topFromMap(m map[string]uint64, replicas, limit int) []Stat {
+	stats := make([]Stat, 0, len(m))
+	for name, value := range m {
+		stats = append(stats, Stat{name, value / uint64(replicas)})
+	}
+	return top(stats, limit)
+}
+
+// top returns the limit stats with the highest values, sorted in descending
+// order of value.
+func top(stats []Stat, limit int) []Stat {
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Value != stats[j].Value {
+			return stats[i].Value > stats[j].Value
+		}
+		return stats[i].Name < stats[j].Name
+	})
+	if len(stats) > limit {
+		stats = stats[:limit]
+	}
+	if stats == nil {
+		stats = []Stat{}
+	}
+	return stats
+}
@@ -0,0 +1,83 @@
+package cardinality
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+)
+
+func TestFromHead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "status_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := tsdb.Open(dir, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	app := db.Appender()
+	for _, lset := range []labels.Labels{
+		labels.FromStrings("__name__", "a", "job", "x"),
+		labels.FromStrings("__name__", "a", "job", "y"),
+		labels.FromStrings("__name__", "b", "job", "x"),
+	} {
+		if _, err := app.Add(lset, 1, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := app.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Buffered series already in the head are counted once, and a subset
+	// of a head series' labels is a different series
+	buffered := []labels.Labels{
+		labels.FromStrings("__name__", "a", "job", "x"),
+		labels.FromStrings("__name__", "b"),
+		labels.FromStrings("__name__", "b", "job", "z"),
+	}
+	s, err := FromHead(db.Head(), buffered, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &TSDBStatus{
+		HeadStats:                   HeadStats{NumSeries: 5},
+		SeriesCountByMetricName:     []Stat{{"b", 3}, {"a", 2}},
+		SeriesCountByLabelValuePair: []Stat{{"__name__=b", 3}, {"__name__=a", 2}},
+	}
+	if !reflect.DeepEqual(s, expected) {
+		t.Fatalf("Expected status %+v, got %+v", expected, s)
+	}
+}
+
+func TestMergeDividesByReplicas(t *testing.T) {
+	statuses := []*TSDBStatus{
+		{
+			HeadStats:               HeadStats{NumSeries: 40},
+			SeriesCountByMetricName: []Stat{{"a", 30}, {"b", 10}},
+		},
+		{
+			HeadStats:               HeadStats{NumSeries: 40},
+			SeriesCountByMetricName: []Stat{{"a", 20}, {"c", 20}},
+		},
+	}
+
+	s := Merge(statuses, 2, 2)
+	expected := &TSDBStatus{
+		HeadStats:                   HeadStats{NumSeries: 40},
+		SeriesCountByMetricName:     []Stat{{"a", 25}, {"c", 10}},
+		SeriesCountByLabelValuePair: []Stat{},
+	}
+	if !reflect.DeepEqual(s, expected) {
+		t.Fatalf("Expected status %+v, got %+v", expected, s)
+	}
+}
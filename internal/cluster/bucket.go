@@ -0,0 +1,191 @@
+package cluster
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	bucketIDFileName = "bucket_id"
+	noBucketID       = -1
+	updateTimeout    = 10 * time.Second
+)
+
+// BucketID returns the bucket the node occupies in the hashring, or -1 if the
+// node has not advertised one.
+//
+// Bucket IDs are assigned when a node first joins the cluster and persisted
+// in its data directory, so that a node's position in the hashring does not
+// depend on its name or on the names of other nodes. New nodes take the next
+// unused bucket, which means that jump hashing only moves the minimal
+// fraction of partition keys when the cluster grows.
+func (n *Node) BucketID() int {
+	if len(n.mln.Meta) == 0 {
+		return noBucketID
+	}
+	m, err := n.meta()
+	if err != nil {
+		return noBucketID
+	}
+	return m.BucketID
+}
+
+type bucketNode struct {
+	id   int
+	node *Node
+}
+
+// bucketOrder returns the given nodes sorted by bucket ID and the number of
+// buckets in the hashring. Nodes that have not advertised a bucket ID, such as
+// nodes running versions that predate bucket IDs, are assigned the buckets
+// following the highest advertised bucket ID in order of name.
+func bucketOrder(nodes Nodes) ([]bucketNode, int) {
+	ordered := make([]bucketNode, 0, len(nodes))
+	var unassigned Nodes
+	maxID := noBucketID
+	for _, n := range nodes {
+		id := n.BucketID()
+		if id == noBucketID {
+			unassigned = append(unassigned, n)
+			continue
+		}
+		if id > maxID {
+			maxID = id
+		}
+		ordered = append(ordered, bucketNode{id, n})
+	}
+
+	sort.Stable(unassigned)
+	for _, n := range unassigned {
+		maxID++
+		ordered = append(ordered, bucketNode{maxID, n})
+	}
+
+	// Break ties between nodes claiming the same bucket by name so that
+	// placement remains deterministic until the conflict is resolved
+	sort.Slice(ordered, func(i, j int) bool {
+		if ordered[i].id != ordered[j].id {
+			return ordered[i].id < ordered[j].id
+		}
+		return ordered[i].node.Name() < ordered[j].node.Name()
+	})
+	return ordered, maxID + 1
+}
+
+// loadBucketID adopts the bucket ID persisted in the data directory, if the
+// local node has been assigned one, so that it is advertised in the first
+// metadata the node gossips to its peers.
+func (c *cluster) loadBucketID() error {
+	id, err := readBucketID(filepath.Join(c.dataDir, bucketIDFileName))
+	if err != nil {
+		return err
+	}
+	c.delegate.setBucketID(id)
+	return nil
+}
+
+// assignBucketID claims the next unused bucket if the local node has not been
+// assigned one. The buckets claimed by other nodes are only known once the
+// node has joined the cluster, so until then the node advertises that it is
+// joining and other nodes do not place any data on it.
+func (c *cluster) assignBucketID() error {
+	if c.delegate.bucketID() != noBucketID {
+		return nil
+	}
+
+	id := c.nextBucketID()
+	if err := writeBucketID(filepath.Join(c.dataDir, bucketIDFileName), id); err != nil {
+		return err
+	}
+	c.log.Infof("Assigned bucket %d in the hashring to this node", id)
+
+	c.delegate.setBucketID(id)
+	return c.ml.UpdateMeta(updateTimeout)
+}
+
+// Joining returns true if the node has joined the cluster for the first time
+// and has yet to claim a bucket in the hashring. Such nodes are not
+// responsible for any partition keys.
+func (n *Node) Joining() bool {
+	if len(n.mln.Meta) == 0 {
+		return false
+	}
+	m, err := n.meta()
+	if err != nil {
+		return false
+	}
+	return m.Joining
+}
+
+// resolveBucketConflict claims a new bucket ID if another node has claimed
+// the same bucket as the local node. The node with the lowest name keeps the
+// bucket.
+func (c *cluster) resolveBucketConflict(other *Node) {
+	if other.BucketID() == noBucketID || other.BucketID() != c.delegate.bucketID() {
+		return
+	}
+	if local := c.LocalNode(); other.Name() >= local.Name() {
+		return
+	}
+
+	id := c.nextBucketID()
+	c.log.Warningf("Node %s has claimed the same bucket (%d) in the hashring as this node; moving this node to bucket %d", other.Name(), other.BucketID(), id)
+	if err := writeBucketID(filepath.Join(c.dataDir, bucketIDFileName), id); err != nil {
+		c.log.Errorf("Failed to persist bucket ID: %s", err)
+		return
+	}
+	c.delegate.setBucketID(id)
+	if err := c.ml.UpdateMeta(updateTimeout); err != nil {
+		c.log.Errorf("Failed to advertise bucket ID: %s", err)
+	}
+}
+
+func (c *cluster) nextBucketID() int {
+	next := 0
+	for _, n := range c.Nodes() {
+		if n.Name() == c.LocalNode().Name() {
+			continue
+		}
+		if id := n.BucketID(); id >= next {
+			next = id + 1
+		}
+	}
+	if id := c.delegate.bucketID(); id >= next {
+		next = id + 1
+	}
+	return next
+}
+
+func readBucketID(path string) (int, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return noBucketID, nil
+	}
+	if err != nil {
+		return noBucketID, err
+	}
+
+	id, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || id < 0 {
+		return noBucketID, fmt.Errorf("invalid bucket ID in %s: %q", path, b)
+	}
+	return id, nil
+}
+
+func writeBucketID(path string, id int) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strconv.Itoa(id)+"\n"), 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
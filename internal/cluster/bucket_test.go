@@ -0,0 +1,211 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/mattbostock/timbala/internal/hashring"
+	"github.com/sirupsen/logrus"
+)
+
+func newTestNode(name string, bucketID int) *Node {
+	return &Node{mln: &memberlist.Node{
+		Name: name,
+		Meta: []byte(fmt.Sprintf(`{"http_addr":"%s:9080","bucket_id":%d}`, name, bucketID)),
+	}}
+}
+
+func TestAddingNodeMovesMinimalPartitionKeys(t *testing.T) {
+	const numKeys = 100000
+
+	clstr := &cluster{
+		log:        logrus.StandardLogger(),
+		replFactor: 1,
+		ring:       hashring.New(),
+	}
+
+	before := Nodes{
+		newTestNode("b", 0),
+		newTestNode("d", 1),
+		newTestNode("f", 2),
+		newTestNode("h", 3),
+		newTestNode("j", 4),
+	}
+	// The new node's name sorts before all existing nodes, which would
+	// previously have moved almost every partition key
+	newNode := newTestNode("a", 5)
+	after := append(Nodes{newNode}, before...)
+
+	var moved int
+	for pKey := uint64(0); pKey < numKeys; pKey++ {
+		prev := clstr.NodesByPartitionKeyFrom(before, clstr.ReplicationFactor(), pKey)[0]
+		cur := clstr.NodesByPartitionKeyFrom(after, clstr.ReplicationFactor(), pKey)[0]
+		if prev.Name() == cur.Name() {
+			continue
+		}
+		if cur.Name() != newNode.Name() {
+			t.Fatalf("Partition key %d moved from %s to %s rather than to the new node", pKey, prev, cur)
+		}
+		moved++
+	}
+
+	// Jump hashing should move approximately 1/n of keys to the new node
+	expected := float64(numKeys) / float64(len(after))
+	if float64(moved) > expected*1.05 || float64(moved) < expected*0.95 {
+		t.Fatalf("Expected approximately %.0f partition keys to move, %d moved", expected, moved)
+	}
+}
+
+func TestNodesByPartitionKeySkipsMissingBuckets(t *testing.T) {
+	clstr := &cluster{
+		log:        logrus.StandardLogger(),
+		replFactor: DefaultReplFactor,
+		ring:       hashring.New(),
+	}
+
+	// Bucket 1 is unoccupied, e.g. because the node has left the cluster
+	nodes := Nodes{
+		newTestNode("a", 0),
+		newTestNode("c", 2),
+		newTestNode("d", 3),
+	}
+
+	for pKey := uint64(0); pKey < 1000; pKey++ {
+		replicas := clstr.NodesByPartitionKeyFrom(nodes, clstr.ReplicationFactor(), pKey)
+		if len(replicas) != len(nodes) {
+			t.Fatalf("Expected %d replicas, got %d", len(nodes), len(replicas))
+		}
+		seen := make(map[string]bool)
+		for _, n := range replicas {
+			if seen[n.Name()] {
+				t.Fatalf("Node %s used more than once for partition key %d", n, pKey)
+			}
+			seen[n.Name()] = true
+		}
+	}
+}
+
+func TestBucketOrderAssignsUnadvertisedNodes(t *testing.T) {
+	nodes := Nodes{
+		&Node{mln: &memberlist.Node{Name: "z"}},
+		newTestNode("b", 1),
+		&Node{mln: &memberlist.Node{Name: "y"}},
+		newTestNode("a", 0),
+	}
+
+	ordered, numBuckets := bucketOrder(nodes)
+	if numBuckets != 4 {
+		t.Fatalf("Expected 4 buckets, got %d", numBuckets)
+	}
+	for i, expected := range []string{"a", "b", "y", "z"} {
+		if ordered[i].id != i || ordered[i].node.Name() != expected {
+			t.Fatalf("Expected node %s in bucket %d, got %s in bucket %d", expected, i, ordered[i].node, ordered[i].id)
+		}
+	}
+}
+
+func TestRemovingNodeFromSparseHashRingMovesOnlyItsPartitionKeys(t *testing.T) {
+	const numKeys = 100000
+
+	for _, ring := range []hashring.HashRing{hashring.NewConsistent(256), hashring.NewRendezvous()} {
+		t.Run(ring.String(), func(t *testing.T) {
+			clstr := &cluster{
+				log:        logrus.StandardLogger(),
+				replFactor: 1,
+				ring:       ring,
+			}
+
+			before := Nodes{
+				newTestNode("a", 0),
+				newTestNode("b", 1),
+				newTestNode("c", 2),
+				newTestNode("d", 3),
+				newTestNode("e", 4),
+			}
+			// Remove a node from the middle of the hashring
+			removed := before[2]
+			after := append(Nodes{}, before[:2]...)
+			after = append(after, before[3:]...)
+
+			movedTo := make(map[string]int)
+			for pKey := uint64(0); pKey < numKeys; pKey++ {
+				prev := clstr.NodesByPartitionKeyFrom(before, clstr.ReplicationFactor(), pKey)[0]
+				cur := clstr.NodesByPartitionKeyFrom(after, clstr.ReplicationFactor(), pKey)[0]
+				if prev.Name() == cur.Name() {
+					continue
+				}
+				if prev.Name() != removed.Name() {
+					t.Fatalf("Partition key %d moved from %s to %s but did not belong to the removed node", pKey, prev, cur)
+				}
+				movedTo[cur.Name()]++
+			}
+
+			// The removed node's partition keys should be spread across
+			// all of the remaining nodes, rather than moving to the node
+			// in the next bucket
+			var total int
+			for _, moved := range movedTo {
+				total += moved
+			}
+			fairShare := float64(total) / float64(len(after))
+			for _, n := range after {
+				if moved := float64(movedTo[n.Name()]); moved < fairShare/2 {
+					t.Fatalf("Expected at least %.0f partition keys to move to node %s, %.0f moved", fairShare/2, n, moved)
+				}
+			}
+		})
+	}
+}
+
+func TestBucketIDAdvertisedBeforeRejoining(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timbala-bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	advertised := func(c *Static) nodeMeta {
+		var m nodeMeta
+		if err := json.Unmarshal(c.delegate.NodeMeta(0), &m); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	// A new node advertises that it is joining until it has claimed a
+	// bucket, and is not responsible for any partition keys meanwhile
+	s := NewStatic(logrus.StandardLogger(), "c", "localhost:9080", noBucketID, 1)
+	s.dataDir = dir
+	s.Join("a", "a:9080", 0)
+	s.Join("b", "b:9080", 1)
+	if m := advertised(s); !m.Joining || m.BucketID != noBucketID {
+		t.Fatalf("Expected new node to advertise that it is joining, got %+v", m)
+	}
+	s.ml.UpdateMeta(0)
+	for pKey := uint64(0); pKey < 1000; pKey++ {
+		if n := s.NodesByPartitionKey(pKey)[0]; n.Name() == "c" {
+			t.Fatalf("Expected no partition keys to be placed on a joining node, got %d", pKey)
+		}
+	}
+
+	if err := s.assignBucketID(); err != nil {
+		t.Fatal(err)
+	}
+	if m := advertised(s); m.Joining || m.BucketID != 2 {
+		t.Fatalf("Expected node to advertise the next unused bucket, got %+v", m)
+	}
+
+	// The node advertises its bucket from the outset when it restarts
+	restarted := NewStatic(logrus.StandardLogger(), "c", "localhost:9080", noBucketID, 1)
+	restarted.dataDir = dir
+	if err := restarted.loadBucketID(); err != nil {
+		t.Fatal(err)
+	}
+	if m := advertised(restarted); m.Joining || m.BucketID != 2 {
+		t.Fatalf("Expected restarted node to advertise its persisted bucket, got %+v", m)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"net"
 	"sort"
+	"sync"
 	"time"
 
 	"github.com/cespare/xxhash"
@@ -18,17 +19,60 @@ const (
 	primaryKeyDateFormat = "20060102"
 
 	DefaultReplFactor = 3
+
+	// PartitionBySeries derives partition keys from all of the labels of
+	// each time-series, spreading the time-series for a metric across
+	// the cluster
+	PartitionBySeries = "series"
+	// PartitionByMetricName derives partition keys from the metric name
+	// of each time-series, placing all of the time-series for a metric on
+	// the same replicas each day. Queries that select a metric name are
+	// then sent only to those replicas.
+	PartitionByMetricName = "metric"
+
+	subscriberBufferSize = 64
 )
 
 func New(conf *Config, l *logrus.Logger) (*cluster, error) {
 	if conf.ReplicationFactor == 0 {
 		conf.ReplicationFactor = DefaultReplFactor
 	}
+	if conf.ReplicationFactor < 0 {
+		return nil, fmt.Errorf("invalid replication factor: %d", conf.ReplicationFactor)
+	}
+	if conf.HashRing == nil {
+		conf.HashRing = hashring.New()
+	}
+	if conf.PartitionBy == "" {
+		conf.PartitionBy = PartitionBySeries
+	}
+	if conf.PartitionBy != PartitionBySeries && conf.PartitionBy != PartitionByMetricName {
+		return nil, fmt.Errorf("invalid partitioning: %q", conf.PartitionBy)
+	}
 
 	cluster := &cluster{
-		log:        l,
-		replFactor: conf.ReplicationFactor,
-		ring:       hashring.New(),
+		dataDir:     conf.DataDir,
+		log:         l,
+		members:     make(map[string]bool),
+		metas:       newMetaCache(),
+		partitionBy: conf.PartitionBy,
+		replFactor:  conf.ReplicationFactor,
+		ring:        conf.HashRing,
+	}
+	cluster.delegate = &delegate{
+		cluster:                cluster,
+		id:                     noBucketID,
+		localHTTPAdvertiseAddr: conf.HTTPAdvertiseAddr.String(),
+		zone:                   conf.Zone,
+	}
+	if err := cluster.loadReplicationFactor(); err != nil {
+		return nil, fmt.Errorf("failed to load replication factor: %s", err)
+	}
+	if err := cluster.loadBucketID(); err != nil {
+		return nil, fmt.Errorf("failed to load bucket in hashring: %s", err)
+	}
+	if err := cluster.loadKeyVersion(conf.PartitionKeys); err != nil {
+		return nil, fmt.Errorf("failed to load partition key version: %s", err)
 	}
 
 	// FIXME(mbostock): Consider using a non-local config for memberlist
@@ -37,25 +81,42 @@ func New(conf *Config, l *logrus.Logger) (*cluster, error) {
 	memberConf.AdvertisePort = conf.GossipAdvertiseAddr.Port
 	memberConf.BindAddr = conf.GossipBindAddr.IP.String()
 	memberConf.BindPort = conf.GossipBindAddr.Port
-	memberConf.Delegate = &delegate{
-		localHTTPAdvertiseAddr: conf.HTTPAdvertiseAddr.String(),
-	}
+	memberConf.Delegate = cluster.delegate
 	memberConf.Events = &eventDelegate{
 		cluster: cluster,
 		log:     l,
 	}
+	memberConf.Alive = &membershipFilter{cluster}
+	memberConf.Merge = &membershipFilter{cluster}
 	memberConf.LogOutput = ioutil.Discard
 
+	cluster.broadcasts = &memberlist.TransmitLimitedQueue{
+		NumNodes:       cluster.numMembers,
+		RetransmitMult: memberConf.RetransmitMult,
+	}
+
 	ml, err := memberlist.Create(memberConf)
 	if err != nil {
 		return nil, fmt.Errorf("failed to configure cluster settings: %s", err)
 	}
+	cluster.ml = &membership{l: ml, metas: cluster.metas}
 	ml.Join(conf.Peers)
 
-	cluster.ml = &membership{ml}
+	if err := cluster.adoptKeyVersion(); err != nil {
+		return nil, fmt.Errorf("failed to choose partition key version: %s", err)
+	}
+	if err := cluster.assignBucketID(); err != nil {
+		return nil, fmt.Errorf("failed to assign bucket in hashring: %s", err)
+	}
 	return cluster, nil
 }
 
+// node returns the given memberlist node, caching its parsed metadata in the
+// cluster.
+func (c *cluster) node(mln *memberlist.Node) *Node {
+	return &Node{mln: mln, metas: c.metas}
+}
+
 func (c *cluster) LocalNode() *Node {
 	return c.ml.LocalNode()
 }
@@ -64,37 +125,93 @@ func (c *cluster) Nodes() Nodes {
 	return c.ml.Nodes()
 }
 
+// Subscribe returns a channel on which changes to cluster membership are
+// published. Events are dropped if the subscriber is not keeping up, so
+// subscribers should treat an event as a prompt to re-examine Nodes() rather
+// than as a complete record of membership changes.
+func (c *cluster) Subscribe() <-chan NodeEvent {
+	ch := make(chan NodeEvent, subscriberBufferSize)
+	c.mu.Lock()
+	c.subscribers = append(c.subscribers, ch)
+	c.mu.Unlock()
+	return ch
+}
+
+func (c *cluster) publish(ev NodeEvent) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, ch := range c.subscribers {
+		select {
+		case ch <- ev:
+		default:
+			c.log.Debugf("Dropped cluster event for %s; subscriber is not keeping up", ev.Node)
+		}
+	}
+}
+
 func (c *cluster) NodesByPartitionKey(pKey uint64) Nodes {
-	nodes := c.Nodes()
+	return c.NodesByPartitionKeyFrom(c.Nodes().Active(), c.ReplicationFactor(), pKey)
+}
+
+// NodesByPartitionKeyFrom returns the nodes that would be responsible for the
+// given partition key if the cluster consisted of the given nodes and used the
+// given replication factor. It is used to determine how data placement changes
+// when cluster membership or the replication factor changes.
+//
+// Replicas are chosen in order, so the nodes returned for a lower replication
+// factor are always a prefix of those returned for a higher one.
+func (c *cluster) NodesByPartitionKeyFrom(members Nodes, replFactor int, pKey uint64) Nodes {
+	// Order nodes by bucket ID to ensure function is deterministic
+	nodes, numBuckets := bucketOrder(members)
 	nodesUsed := make(map[*Node]bool, len(nodes))
 	retNodes := make(Nodes, 0, len(nodes))
 
-	// Sort nodes to ensure function is deterministic
-	sort.Stable(nodes)
+	zones := make(map[string]bool)
+	for _, n := range nodes {
+		zones[n.node.Zone()] = true
+	}
+	zonesUsed := make(map[string]bool, len(zones))
+
+	// Hashrings that support it choose only between occupied buckets, so
+	// that the data belonging to a node that leaves the cluster is spread
+	// across all remaining nodes
+	sparse, isSparse := c.HashRing().(hashring.SparseHashRing)
+	var occupied []int32
+	if isSparse {
+		occupied = make([]int32, 0, len(nodes))
+		for j, n := range nodes {
+			if j == 0 || n.id != nodes[j-1].id {
+				occupied = append(occupied, int32(n.id))
+			}
+		}
+	}
 
-	for i := 0; i < c.ReplicationFactor(); i++ {
-		if len(nodesUsed) == c.ReplicationFactor() || len(nodesUsed) == len(nodes) {
+	for i := 0; i < replFactor; i++ {
+		if len(nodesUsed) == replFactor || len(nodesUsed) == len(nodes) {
 			break
 		}
 
-		hashedNodeIndex := c.HashRing().Get(uint64(i)+pKey, len(nodes))
-		useNextNode := false
-	nodeLoop:
-		for j := 0; ; j++ {
-			if j == 2 {
-				panic("iterated through all nodes twice and still couldn't find a match")
-			}
-			for k, n := range nodes {
-				if int32(k) == hashedNodeIndex || useNextNode {
-					if _, ok := nodesUsed[n]; ok {
-						useNextNode = true
-						continue
-					}
-					retNodes = append(retNodes, n)
-					nodesUsed[n] = true
-					break nodeLoop
-				}
+		// Use the node occupying the hashed bucket, or the next occupied
+		// bucket if the node has left the cluster or is already in use.
+		// Prefer nodes in zones that don't yet hold a replica, so that
+		// replicas are spread across as many zones as possible.
+		var hashedBucket int
+		if isSparse {
+			hashedBucket = int(sparse.GetFrom(uint64(i)+pKey, occupied))
+		} else {
+			hashedBucket = int(c.HashRing().Get(uint64(i)+pKey, numBuckets))
+		}
+		start := sort.Search(len(nodes), func(j int) bool { return nodes[j].id >= hashedBucket })
+		requireNewZone := len(zonesUsed) < len(zones)
+		for j := 0; j < len(nodes); j++ {
+			n := nodes[(start+j)%len(nodes)].node
+			if nodesUsed[n] || (requireNewZone && zonesUsed[n.Zone()]) {
+				continue
 			}
+			retNodes = append(retNodes, n)
+			nodesUsed[n] = true
+			zonesUsed[n.Zone()] = true
+			break
 		}
 	}
 	return retNodes
@@ -105,21 +222,98 @@ func PartitionKey(end time.Time, metricHash uint64) uint64 {
 	return xxhash.Sum64String(end.Format(primaryKeyDateFormat)) + metricHash
 }
 
-func (c *cluster) ReplicationFactor() int {
-	return c.replFactor
-}
-
 func (c *cluster) HashRing() hashring.HashRing {
 	return c.ring
 }
 
+// PartitionBy returns how partition keys are derived from the labels of each
+// time-series: PartitionBySeries or PartitionByMetricName.
+func (c *cluster) PartitionBy() string {
+	return c.partitionBy
+}
+
+// PartitionHash returns the hash from which the partition keys of the samples
+// in a series are derived, given the series' metric name and the hash of all
+// of its labels.
+func (c *cluster) PartitionHash(metricName string, seriesHash uint64) uint64 {
+	if c.partitionBy == PartitionByMetricName {
+		return MetricNameHash(metricName)
+	}
+	return seriesHash
+}
+
+// MetricNameHash returns the partition hash of every series with the given
+// metric name when partitioning by metric name.
+func MetricNameHash(name string) uint64 {
+	return xxhash.Sum64String(name)
+}
+
 type Node struct {
-	mln *memberlist.Node
+	mln   *memberlist.Node
+	metas *metaCache
+}
+
+func (n *Node) meta() (nodeMeta, error) {
+	if m, ok := n.metas.get(n.mln); ok {
+		return m, nil
+	}
+
+	m := nodeMeta{BucketID: noBucketID}
+	if err := json.Unmarshal(n.mln.Meta, &m); err != nil {
+		return m, err
+	}
+	n.metas.put(n.mln, m)
+	return m, nil
+}
+
+// metaCache holds the metadata most recently parsed for each node in a
+// cluster, keyed by node name. Metadata is parsed frequently when determining
+// which nodes are responsible for a sample, so it is only parsed again once
+// the node advertises different metadata. A nil metaCache caches nothing.
+type metaCache struct {
+	mu sync.RWMutex
+	m  map[string]cachedMeta
+}
+
+type cachedMeta struct {
+	raw  string
+	meta nodeMeta
+}
+
+func newMetaCache() *metaCache {
+	return &metaCache{m: make(map[string]cachedMeta)}
+}
+
+func (c *metaCache) get(mln *memberlist.Node) (nodeMeta, bool) {
+	if c == nil {
+		return nodeMeta{}, false
+	}
+	c.mu.RLock()
+	cm, ok := c.m[mln.Name]
+	c.mu.RUnlock()
+	if !ok || cm.raw != string(mln.Meta) {
+		return nodeMeta{}, false
+	}
+	return cm.meta, true
 }
 
-func (n *Node) meta() (m nodeMeta, err error) {
-	err = json.Unmarshal(n.mln.Meta, &m)
-	return
+func (c *metaCache) put(mln *memberlist.Node, m nodeMeta) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.m[mln.Name] = cachedMeta{raw: string(mln.Meta), meta: m}
+	c.mu.Unlock()
+}
+
+// remove forgets the metadata of a node that has left the cluster.
+func (c *metaCache) remove(name string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	delete(c.m, name)
+	c.mu.Unlock()
 }
 
 func (n *Node) Name() string {
@@ -135,42 +329,130 @@ func (n *Node) HTTPAddr() (string, error) {
 	}
 	return m.HTTPAddr, nil
 }
+
+// Zone returns the availability zone, rack or other failure domain that the
+// node has advertised, if any.
+func (n *Node) Zone() string {
+	if len(n.mln.Meta) == 0 {
+		return ""
+	}
+	m, err := n.meta()
+	if err != nil {
+		return ""
+	}
+	return m.Zone
+}
+
 func (n *Node) String() string {
 	return n.Name()
 }
 
 type Nodes []*Node
 
+// Active returns the nodes that are neither joining nor leaving the cluster,
+// and so are responsible for partition keys.
+func (nodes Nodes) Active() Nodes {
+	active := make(Nodes, 0, len(nodes))
+	for _, n := range nodes {
+		if !n.Joining() && !n.Leaving() {
+			active = append(active, n)
+		}
+	}
+	return active
+}
+
 func (nodes Nodes) Len() int           { return len(nodes) }
 func (nodes Nodes) Less(i, j int) bool { return nodes[i].Name() < nodes[j].Name() }
 func (nodes Nodes) Swap(i, j int)      { nodes[i], nodes[j] = nodes[j], nodes[i] }
 
 type delegate struct {
+	cluster                *cluster
 	localHTTPAdvertiseAddr string
+	zone                   string
+
+	mu      sync.Mutex
+	id      int
+	leaving bool
 }
 
 func (d *delegate) NodeMeta(limit int) []byte {
 	// FIXME respect limit
+	rf := d.cluster.currentReplicationFactor()
+	id := d.bucketID()
 	j, _ := json.Marshal(&nodeMeta{
-		HTTPAddr: d.localHTTPAdvertiseAddr,
+		HTTPAddr:          d.localHTTPAdvertiseAddr,
+		BucketID:          id,
+		HashRing:          d.cluster.HashRing().String(),
+		Joining:           id == noBucketID,
+		Leaving:           d.isLeaving(),
+		PartitionBy:       d.cluster.PartitionBy(),
+		PartitionKeys:     d.cluster.KeyVersion(),
+		ReplicationFactor: rf.ReplicationFactor,
+		Zone:              d.zone,
+
+		ReplicationFactorSetAt: rf.SetAt,
 	})
 	return j
 }
 
-func (d *delegate) NotifyMsg([]byte) {}
+func (d *delegate) bucketID() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.id
+}
+
+func (d *delegate) setBucketID(id int) {
+	d.mu.Lock()
+	d.id = id
+	d.mu.Unlock()
+}
+
+func (d *delegate) NotifyMsg(msg []byte) {
+	d.cluster.receiveReplicationFactor(msg)
+}
 
 func (d *delegate) GetBroadcasts(overhead int, limit int) [][]byte {
-	return [][]byte{}
+	return d.cluster.broadcasts.GetBroadcasts(overhead, limit)
 }
 
 func (d *delegate) LocalState(join bool) []byte {
-	return []byte{}
+	return d.cluster.replicationFactorState()
 }
 
-func (d *delegate) MergeRemoteState(buf []byte, join bool) {}
+func (d *delegate) MergeRemoteState(buf []byte, join bool) {
+	if len(buf) > 0 {
+		d.cluster.receiveReplicationFactor(buf)
+	}
+}
 
 type nodeMeta struct {
-	HTTPAddr string `json:"http_addr"`
+	HTTPAddr          string     `json:"http_addr"`
+	BucketID          int        `json:"bucket_id"`
+	HashRing          string     `json:"hashring,omitempty"`
+	Joining           bool       `json:"joining,omitempty"`
+	Leaving           bool       `json:"leaving,omitempty"`
+	PartitionBy       string     `json:"partition_by,omitempty"`
+	PartitionKeys     KeyVersion `json:"partition_keys,omitempty"`
+	ReplicationFactor int        `json:"replication_factor,omitempty"`
+	Zone              string     `json:"zone,omitempty"`
+
+	ReplicationFactorSetAt int64 `json:"replication_factor_set_at,omitempty"`
+}
+
+type NodeEventType int
+
+const (
+	NodeJoin NodeEventType = iota
+	NodeLeave
+	NodeUpdate
+	// ReplicationFactorChange is published when the cluster's replication
+	// factor is changed; Node is the local node
+	ReplicationFactorChange
+)
+
+type NodeEvent struct {
+	Type NodeEventType
+	Node *Node
 }
 
 type eventDelegate struct {
@@ -180,37 +462,72 @@ type eventDelegate struct {
 
 func (e *eventDelegate) NotifyJoin(n *memberlist.Node) {
 	e.log.Infof("Node joined: %s on %s", n.Name, n.Address())
+	e.cluster.setMember(n.Name, true)
+	// Avoid blocking the memberlist event loop while advertising a new
+	// bucket ID
+	go e.cluster.resolveBucketConflict(e.cluster.node(n))
+	e.cluster.publish(NodeEvent{NodeJoin, e.cluster.node(n)})
 }
 
 func (e *eventDelegate) NotifyLeave(n *memberlist.Node) {
 	e.log.Infof("Node left cluster: %s on %s", n.Name, n.Address())
-	// FIXME remove node from ring
+	e.cluster.setMember(n.Name, false)
+	e.cluster.publish(NodeEvent{NodeLeave, e.cluster.node(n)})
+	e.cluster.metas.remove(n.Name)
 }
 
 func (e *eventDelegate) NotifyUpdate(n *memberlist.Node) {
 	e.log.Infof("Node updated: %s on %s", n.Name, n.Address())
+	go e.cluster.resolveBucketConflict(e.cluster.node(n))
+	e.cluster.publish(NodeEvent{NodeUpdate, e.cluster.node(n)})
 }
 
 type cluster struct {
-	log        *logrus.Logger
-	ml         Membership
-	replFactor int
-	ring       hashring.HashRing
+	broadcasts  *memberlist.TransmitLimitedQueue
+	dataDir     string
+	delegate    *delegate
+	log         *logrus.Logger
+	metas       *metaCache
+	ml          Membership
+	partitionBy string
+	ring        hashring.HashRing
+
+	mu          sync.Mutex
+	keys        KeyVersion
+	members     map[string]bool
+	subscribers []chan NodeEvent
+
+	replMu          sync.RWMutex
+	replFactor      int
+	replFactorSetAt int64
 }
 
 type Config struct {
+	DataDir             string
 	HTTPAdvertiseAddr   net.TCPAddr
 	HTTPBindAddr        net.TCPAddr
 	GossipAdvertiseAddr net.TCPAddr
 	GossipBindAddr      net.TCPAddr
+	HashRing            hashring.HashRing
+	PartitionBy         string
+	PartitionKeys       KeyVersion
 	Peers               []string
 	ReplicationFactor   int
+	Zone                string
 }
 
 type Cluster interface {
 	HashRing() hashring.HashRing
+	KeyVersion() KeyVersion
+	Leave() error
 	LocalNode() *Node
+	MarkLeaving() error
 	Nodes() Nodes
 	NodesByPartitionKey(uint64) Nodes
+	NodesByPartitionKeyFrom(Nodes, int, uint64) Nodes
+	PartitionBy() string
+	PartitionHash(string, uint64) uint64
 	ReplicationFactor() int
+	SetReplicationFactor(int) error
+	Subscribe() <-chan NodeEvent
 }
@@ -0,0 +1,43 @@
+package cluster
+
+import (
+	"testing"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/sirupsen/logrus"
+)
+
+func TestNodeMetaCachedByName(t *testing.T) {
+	c := NewStatic(logrus.New(), "a", "127.0.0.1:0", 0, 1)
+	mln := &memberlist.Node{Name: "b", Meta: []byte(`{"http_addr":"b:9080","bucket_id":1}`)}
+	if id := c.node(mln).BucketID(); id != 1 {
+		t.Fatalf("Expected bucket 1, got %d", id)
+	}
+
+	// A node advertising new metadata replaces its cached metadata
+	mln = &memberlist.Node{Name: "b", Meta: []byte(`{"http_addr":"b:9080","bucket_id":2}`)}
+	if id := c.node(mln).BucketID(); id != 2 {
+		t.Fatalf("Expected bucket 2 once the node advertised it, got %d", id)
+	}
+	if len(c.metas.m) != 1 {
+		t.Fatalf("Expected metadata cached for 1 node, got %d", len(c.metas.m))
+	}
+
+	c.Join("c", "c:9080", 3)
+	for _, n := range c.Nodes() {
+		n.BucketID()
+	}
+	if _, ok := c.metas.m["c"]; !ok {
+		t.Fatal("Expected metadata of a node that joined to be cached")
+	}
+	c.Remove("c")
+	if _, ok := c.metas.m["c"]; ok {
+		t.Fatal("Expected metadata of a node that left to be forgotten")
+	}
+
+	// Metadata is not shared between clusters
+	other := NewStatic(logrus.New(), "a", "127.0.0.1:0", 0, 1)
+	if _, ok := other.metas.m["b"]; ok {
+		t.Fatal("Expected metadata to be cached per cluster")
+	}
+}
@@ -53,20 +53,26 @@ func BenchmarkHashringDistribution(b *testing.B) {
 }
 
 func TestHashringDistribution(t *testing.T) {
-	for _, numTestNodes := range testClusterSizes {
-		for _, replFactor := range testReplicationFactors {
-			ml := newMockMemberlist(replFactor, numTestNodes)
-			clstr := &cluster{
-				ml:         ml,
-				log:        logrus.StandardLogger(),
-				replFactor: replFactor,
-				ring:       hashring.New(),
+	for _, ringName := range hashring.Names() {
+		for _, numTestNodes := range testClusterSizes {
+			for _, replFactor := range testReplicationFactors {
+				ring, err := hashring.ByName(ringName)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ml := newMockMemberlist(replFactor, numTestNodes)
+				clstr := &cluster{
+					ml:         ml,
+					log:        logrus.StandardLogger(),
+					replFactor: replFactor,
+					ring:       ring,
+				}
+
+				t.Run(fmt.Sprintf("%s hashring with %d replicas across %d nodes", ringName, replFactor, numTestNodes),
+					func(t *testing.T) {
+						testSampleDistribution(t, clstr, samples)
+					})
 			}
-
-			t.Run(fmt.Sprintf("%d replicas across %d nodes", replFactor, numTestNodes),
-				func(t *testing.T) {
-					testSampleDistribution(t, clstr, samples)
-				})
 		}
 	}
 }
@@ -196,6 +202,14 @@ func (m *mockMemberlist) Nodes() Nodes {
 
 }
 
+func (m *mockMemberlist) Leave(time.Duration) error {
+	return nil
+}
+
+func (m *mockMemberlist) UpdateMeta(time.Duration) error {
+	return nil
+}
+
 func (m *mockMemberlist) LocalNode() *Node {
 	// There's no special significant for the first node, any node will do
 	return m.nodes[0]
@@ -204,7 +218,7 @@ func (m *mockMemberlist) LocalNode() *Node {
 func newMockMemberlist(replFactor, numNodes int) *mockMemberlist {
 	nodes := make(Nodes, 0, numNodes)
 	for i := 0; i < numNodes; i++ {
-		nodes = append(nodes, &Node{&memberlist.Node{Name: strconv.Itoa(i)}})
+		nodes = append(nodes, &Node{mln: &memberlist.Node{Name: strconv.Itoa(i)}})
 	}
 
 	return &mockMemberlist{nodes}
@@ -0,0 +1,198 @@
+package cluster
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const keyVersionFileName = "partition_keys"
+
+// KeyVersion identifies how the partition key of each sample is derived from
+// its timestamp. Every node in a cluster must use the same version, since
+// nodes using different versions disagree about which nodes hold each sample.
+type KeyVersion int
+
+const (
+	// LegacyKeys is used by clusters created by versions that predate
+	// versioned partition keys. Those versions converted each sample's
+	// timestamp to a date incorrectly, placing samples according to a date
+	// far in the future. The conversion is kept so that existing clusters
+	// continue to find the data they hold.
+	LegacyKeys KeyVersion = 1
+	// DailyKeys derives partition keys from the calendar day of each
+	// sample's timestamp.
+	DailyKeys KeyVersion = 2
+
+	// latestKeys is the version used by new clusters
+	latestKeys = DailyKeys
+)
+
+func (v KeyVersion) String() string {
+	switch v {
+	case LegacyKeys:
+		return "legacy"
+	case DailyKeys:
+		return "daily"
+	}
+	return strconv.Itoa(int(v))
+}
+
+// time returns the time from which the partition key of a sample with the
+// given timestamp, in milliseconds since the Unix epoch, is derived.
+func (v KeyVersion) time(timestamp int64) time.Time {
+	if v == LegacyKeys {
+		return time.Unix(timestamp/1000, (timestamp-timestamp/1000)*1e6)
+	}
+	return time.Unix(timestamp/1000, (timestamp%1000)*1e6)
+}
+
+// SamplePartitionKey returns the partition key for a sample with the given
+// timestamp, in milliseconds since the Unix epoch, belonging to a series with
+// the given partition hash (see PartitionHash).
+func (v KeyVersion) SamplePartitionKey(timestamp int64, metricHash uint64) uint64 {
+	return PartitionKey(v.time(timestamp), metricHash)
+}
+
+// PartitionKeys returns the partition keys of the samples between mint and
+// maxt, in milliseconds since the Unix epoch, belonging to a series with the
+// given partition hash.
+func (v KeyVersion) PartitionKeys(mint, maxt int64, metricHash uint64) []uint64 {
+	if mint > maxt {
+		return nil
+	}
+	// Both versions map later timestamps to later times, so the samples
+	// in the range fall on the days between those of mint and maxt
+	start, end := v.time(mint), v.time(maxt)
+
+	// Step through each calendar day at midday, which exists even when
+	// clocks change for daylight saving time
+	var pKeys []uint64
+	day := time.Date(start.Year(), start.Month(), start.Day(), 12, 0, 0, 0, start.Location())
+	last := time.Date(end.Year(), end.Month(), end.Day(), 12, 0, 0, 0, end.Location())
+	for ; !day.After(last); day = day.AddDate(0, 0, 1) {
+		pKeys = append(pKeys, PartitionKey(day, metricHash))
+	}
+	return pKeys
+}
+
+// SamePartition returns true if samples in the same series with the given
+// timestamps, in milliseconds since the Unix epoch, have the same partition
+// key and so are held by the same replicas.
+func (v KeyVersion) SamePartition(a, b int64) bool {
+	return v.SamplePartitionKey(a, 0) == v.SamplePartitionKey(b, 0)
+}
+
+// KeyVersion returns the version of partition keys used by the cluster, or
+// zero while a node joining the cluster for the first time has yet to adopt
+// the cluster's version.
+func (c *cluster) KeyVersion() KeyVersion {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.keys
+}
+
+func (c *cluster) setKeyVersion(v KeyVersion) {
+	c.mu.Lock()
+	c.keys = v
+	c.mu.Unlock()
+}
+
+// loadKeyVersion adopts the partition key version persisted in the data
+// directory. If none was persisted, the configured version is persisted
+// instead, if any; nodes upgraded from versions that predate versioned
+// partition keys are configured to use LegacyKeys.
+func (c *cluster) loadKeyVersion(configured KeyVersion) error {
+	v, err := readKeyVersion(filepath.Join(c.dataDir, keyVersionFileName))
+	if err != nil {
+		return err
+	}
+	if v == 0 && configured != 0 {
+		v = configured
+		if err := c.persistKeyVersion(v); err != nil {
+			return err
+		}
+		c.log.Infof("Using %s partition keys", v)
+	}
+	c.setKeyVersion(v)
+	return nil
+}
+
+// adoptKeyVersion chooses the partition key version of a node that has joined
+// the cluster for the first time: the version advertised by the other nodes,
+// or the latest version if none of them advertise one, such as when the node
+// is the first in a new cluster.
+func (c *cluster) adoptKeyVersion() error {
+	if c.KeyVersion() != 0 {
+		return nil
+	}
+
+	v := latestKeys
+	for _, n := range c.Nodes() {
+		if n.Name() == c.LocalNode().Name() {
+			continue
+		}
+		if nv := n.keyVersion(); nv != 0 {
+			v = nv
+			break
+		}
+	}
+	if err := c.persistKeyVersion(v); err != nil {
+		return err
+	}
+	c.log.Infof("Using %s partition keys", v)
+
+	c.setKeyVersion(v)
+	return c.ml.UpdateMeta(updateTimeout)
+}
+
+// keyVersion returns the partition key version the node has advertised, or
+// zero if it has not advertised one.
+func (n *Node) keyVersion() KeyVersion {
+	if len(n.mln.Meta) == 0 {
+		return 0
+	}
+	m, err := n.meta()
+	if err != nil {
+		return 0
+	}
+	return m.PartitionKeys
+}
+
+func readKeyVersion(path string) (KeyVersion, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	v, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || KeyVersion(v) < LegacyKeys || KeyVersion(v) > latestKeys {
+		return 0, fmt.Errorf("invalid partition key version in %s: %q", path, b)
+	}
+	return KeyVersion(v), nil
+}
+
+// persistKeyVersion writes the partition key version to the data directory.
+// Clusters without a data directory do not persist it.
+func (c *cluster) persistKeyVersion(v KeyVersion) error {
+	if c.dataDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(c.dataDir, 0777); err != nil {
+		return err
+	}
+
+	path := filepath.Join(c.dataDir, keyVersionFileName)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strconv.Itoa(int(v))+"\n"), 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
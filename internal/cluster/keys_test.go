@@ -0,0 +1,135 @@
+package cluster
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/sirupsen/logrus"
+)
+
+func TestSamplePartitionKey(t *testing.T) {
+	const hash = 42
+	day := time.Date(2018, 3, 14, 0, 0, 0, 0, time.Local)
+
+	var tests = []struct {
+		timestamp time.Time
+		expected  time.Time
+	}{
+		{day, day},
+		{day.Add(999 * time.Millisecond), day},
+		{day.Add(24*time.Hour - time.Millisecond), day},
+		{day.Add(24 * time.Hour), day.Add(24 * time.Hour)},
+	}
+
+	for _, test := range tests {
+		ms := test.timestamp.UnixNano() / 1e6
+		if got, want := DailyKeys.SamplePartitionKey(ms, hash), PartitionKey(test.expected, hash); got != want {
+			t.Errorf("Expected sample at %s to have the partition key for %s", test.timestamp, test.expected.Format(primaryKeyDateFormat))
+		}
+	}
+
+	// Legacy keys are unchanged, so that existing clusters find the data
+	// they hold
+	ms := day.UnixNano() / 1e6
+	legacy := time.Unix(ms/1000, (ms-ms/1000)*1e6)
+	if got, want := LegacyKeys.SamplePartitionKey(ms, hash), PartitionKey(legacy, hash); got != want {
+		t.Errorf("Expected sample at %s to have the legacy partition key for %s", day, legacy.Format(primaryKeyDateFormat))
+	}
+}
+
+func TestPartitionKeys(t *testing.T) {
+	const hash = 42
+	start := time.Date(2018, 3, 9, 23, 30, 0, 0, time.Local)
+	end := time.Date(2018, 3, 14, 0, 30, 0, 0, time.Local)
+
+	for _, keys := range []KeyVersion{LegacyKeys, DailyKeys} {
+		pKeys := make(map[uint64]bool)
+		for _, pKey := range keys.PartitionKeys(start.UnixNano()/1e6, end.UnixNano()/1e6, hash) {
+			pKeys[pKey] = true
+		}
+		if keys == DailyKeys && len(pKeys) != 6 {
+			t.Fatalf("Expected partition keys for 6 days, got %d", len(pKeys))
+		}
+
+		// Every sample in the range has one of the partition keys,
+		// including across a change to daylight saving time
+		for ts := start; !ts.After(end); ts = ts.Add(time.Minute) {
+			if !pKeys[keys.SamplePartitionKey(ts.UnixNano()/1e6, hash)] {
+				t.Fatalf("Expected %s partition key for sample at %s", keys, ts)
+			}
+		}
+
+		if pKeys := keys.PartitionKeys(end.UnixNano()/1e6, start.UnixNano()/1e6, hash); len(pKeys) != 0 {
+			t.Fatalf("Expected no %s partition keys for an empty range, got %d", keys, len(pKeys))
+		}
+	}
+}
+
+func TestKeyVersionAdopted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timbala-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	newNode := func(name, dir string, configured KeyVersion) *Static {
+		s := NewStatic(logrus.StandardLogger(), name, "localhost:9080", noBucketID, 1)
+		s.dataDir = dir
+		s.keys = 0
+		if err := s.loadKeyVersion(configured); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	joinPeer := func(s *Static, name string, keys KeyVersion) {
+		meta, _ := json.Marshal(&nodeMeta{HTTPAddr: name + ":9080", BucketID: 0, PartitionKeys: keys})
+		s.ml.mu.Lock()
+		s.ml.nodes = append(s.ml.nodes, &memberlist.Node{Name: name, Meta: meta})
+		s.ml.mu.Unlock()
+	}
+
+	// A new node adopts the version used by the cluster it joins, and
+	// keeps it when it restarts
+	s := newNode("b", dir, 0)
+	if v := s.KeyVersion(); v != 0 {
+		t.Fatalf("Expected new node not to have chosen a partition key version, got %s", v)
+	}
+	joinPeer(s, "a", LegacyKeys)
+	if err := s.adoptKeyVersion(); err != nil {
+		t.Fatal(err)
+	}
+	if v := s.KeyVersion(); v != LegacyKeys {
+		t.Fatalf("Expected node to adopt the cluster's %s partition keys, got %s", LegacyKeys, v)
+	}
+	if v := newNode("b", dir, DailyKeys).KeyVersion(); v != LegacyKeys {
+		t.Fatalf("Expected restarted node to keep %s partition keys, got %s", LegacyKeys, v)
+	}
+
+	// The first node in a new cluster uses the latest version
+	first := newNode("a", "", 0)
+	if err := first.adoptKeyVersion(); err != nil {
+		t.Fatal(err)
+	}
+	if v := first.KeyVersion(); v != latestKeys {
+		t.Fatalf("Expected first node to use %s partition keys, got %s", latestKeys, v)
+	}
+
+	// A node configured with a version, such as one upgraded from a
+	// version that predates versioned partition keys, does not adopt
+	// another
+	upgraded := newNode("c", "", LegacyKeys)
+	joinPeer(upgraded, "a", DailyKeys)
+	if err := upgraded.adoptKeyVersion(); err != nil {
+		t.Fatal(err)
+	}
+	if v := upgraded.KeyVersion(); v != LegacyKeys {
+		t.Fatalf("Expected configured %s partition keys, got %s", LegacyKeys, v)
+	}
+	if err := upgraded.checkPlacement(upgraded.Nodes()[1]); err == nil {
+		t.Fatal("Expected node using different partition keys to be refused")
+	}
+}
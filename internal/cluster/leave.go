@@ -0,0 +1,42 @@
+package cluster
+
+// Leaving returns true if the node is being decommissioned. Nodes that are
+// leaving the cluster remain members until their data has been moved to other
+// nodes, but are no longer responsible for any partition keys.
+func (n *Node) Leaving() bool {
+	if len(n.mln.Meta) == 0 {
+		return false
+	}
+	m, err := n.meta()
+	if err != nil {
+		return false
+	}
+	return m.Leaving
+}
+
+// MarkLeaving advertises to other nodes that the local node is leaving the
+// cluster, so that it is no longer sent new data.
+func (c *cluster) MarkLeaving() error {
+	c.delegate.setLeaving()
+	c.log.Info("Marked this node as leaving the cluster")
+	return c.ml.UpdateMeta(updateTimeout)
+}
+
+// Leave removes the local node from the cluster. The node cannot rejoin the
+// cluster without being restarted.
+func (c *cluster) Leave() error {
+	c.log.Info("Leaving the cluster")
+	return c.ml.Leave(updateTimeout)
+}
+
+func (d *delegate) isLeaving() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.leaving
+}
+
+func (d *delegate) setLeaving() {
+	d.mu.Lock()
+	d.leaving = true
+	d.mu.Unlock()
+}
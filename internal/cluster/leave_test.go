@@ -0,0 +1,36 @@
+package cluster
+
+import (
+	"testing"
+
+	"github.com/hashicorp/memberlist"
+)
+
+func TestActiveExcludesLeavingNodes(t *testing.T) {
+	nodes := Nodes{
+		newTestNode("a", 0),
+		&Node{mln: &memberlist.Node{
+			Name: "b",
+			Meta: []byte(`{"http_addr":"b:9080","bucket_id":1,"leaving":true}`),
+		}},
+		newTestNode("c", 2),
+		&Node{mln: &memberlist.Node{Name: "d"}},
+		&Node{mln: &memberlist.Node{
+			Name: "e",
+			Meta: []byte(`{"http_addr":"e:9080","bucket_id":-1,"joining":true}`),
+		}},
+	}
+
+	active := nodes.Active()
+	if len(active) != 3 {
+		t.Fatalf("Expected 3 active nodes, got %d: %v", len(active), active)
+	}
+	for _, n := range active {
+		if n.Name() == "b" {
+			t.Fatal("Expected node that is leaving to be excluded")
+		}
+		if n.Name() == "e" {
+			t.Fatal("Expected node that is joining to be excluded")
+		}
+	}
+}
@@ -1,23 +1,43 @@
 package cluster
 
-import "github.com/hashicorp/memberlist"
+import (
+	"time"
 
-type membership struct{ l *memberlist.Memberlist }
+	"github.com/hashicorp/memberlist"
+)
+
+type membership struct {
+	l     *memberlist.Memberlist
+	metas *metaCache
+}
 
 func (m *membership) Nodes() Nodes {
 	nodes := make(Nodes, 0, len(m.l.Members()))
 	for _, n := range m.l.Members() {
-		nodes = append(nodes, &Node{n})
+		nodes = append(nodes, &Node{mln: n, metas: m.metas})
 	}
 	return nodes
 
 }
 
 func (m *membership) LocalNode() *Node {
-	return &Node{m.l.LocalNode()}
+	return &Node{mln: m.l.LocalNode(), metas: m.metas}
+}
+
+func (m *membership) Leave(timeout time.Duration) error {
+	if err := m.l.Leave(timeout); err != nil {
+		return err
+	}
+	return m.l.Shutdown()
+}
+
+func (m *membership) UpdateMeta(timeout time.Duration) error {
+	return m.l.UpdateNode(timeout)
 }
 
 type Membership interface {
+	Leave(time.Duration) error
 	LocalNode() *Node
 	Nodes() Nodes
+	UpdateMeta(time.Duration) error
 }
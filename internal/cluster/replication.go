@@ -0,0 +1,288 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+const replicationFactorFileName = "replication_factor"
+
+func (c *cluster) ReplicationFactor() int {
+	c.replMu.RLock()
+	defer c.replMu.RUnlock()
+	return c.replFactor
+}
+
+// SetReplicationFactor changes the replication factor used by the whole
+// cluster. The change is gossiped to all other nodes, each of which publishes
+// a ReplicationFactorChange event so that data can be copied to any new
+// replicas.
+//
+// The replication factor is persisted in each node's data directory and takes
+// precedence over the replication factor the node is configured with when it
+// restarts. Nodes that join the cluster afterwards adopt it from their peers.
+func (c *cluster) SetReplicationFactor(replFactor int) error {
+	if replFactor < 1 {
+		return fmt.Errorf("replication factor must be at least 1, got %d", replFactor)
+	}
+	c.applyReplicationFactor(replicationFactorState{
+		ReplicationFactor: replFactor,
+		SetAt:             time.Now().UnixNano(),
+	})
+	return nil
+}
+
+// ReplicationFactor returns the replication factor the node has advertised,
+// or zero if it has not advertised one.
+func (n *Node) ReplicationFactor() int {
+	if len(n.mln.Meta) == 0 {
+		return 0
+	}
+	m, err := n.meta()
+	if err != nil {
+		return 0
+	}
+	return m.ReplicationFactor
+}
+
+// replicationFactorSetAt returns when the replication factor the node has
+// advertised was set, or zero if it was set using a command-line flag.
+func (n *Node) replicationFactorSetAt() int64 {
+	if len(n.mln.Meta) == 0 {
+		return 0
+	}
+	m, err := n.meta()
+	if err != nil {
+		return 0
+	}
+	return m.ReplicationFactorSetAt
+}
+
+// replicationFactorState is exchanged between nodes to agree on the
+// replication factor. The most recently set replication factor wins; nodes
+// that have only been configured using a command-line flag have a zero SetAt.
+type replicationFactorState struct {
+	ReplicationFactor int   `json:"replication_factor"`
+	SetAt             int64 `json:"set_at"`
+}
+
+func (c *cluster) replicationFactorState() []byte {
+	b, _ := json.Marshal(c.currentReplicationFactor())
+	return b
+}
+
+func (c *cluster) currentReplicationFactor() replicationFactorState {
+	c.replMu.RLock()
+	defer c.replMu.RUnlock()
+	return replicationFactorState{c.replFactor, c.replFactorSetAt}
+}
+
+// loadReplicationFactor adopts the replication factor persisted in the data
+// directory, which was set using the admin API and so takes precedence over
+// the replication factor the node was configured with.
+func (c *cluster) loadReplicationFactor() error {
+	b, err := ioutil.ReadFile(filepath.Join(c.dataDir, replicationFactorFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var s replicationFactorState
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("invalid replication factor in %s: %s", replicationFactorFileName, err)
+	}
+	prev, ok := c.mergeReplicationFactor(s)
+	if ok && prev != s.ReplicationFactor {
+		c.log.Warningf("Using replication factor %d set using the admin API at %s instead of the configured replication factor %d", s.ReplicationFactor, time.Unix(0, s.SetAt).UTC().Format(time.RFC3339), prev)
+	}
+	return nil
+}
+
+// persistReplicationFactor writes the replication factor to the data
+// directory. Clusters without a data directory do not persist it.
+func (c *cluster) persistReplicationFactor(s replicationFactorState) error {
+	if c.dataDir == "" {
+		return nil
+	}
+	b, err := json.Marshal(&s)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(c.dataDir, replicationFactorFileName)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (c *cluster) receiveReplicationFactor(msg []byte) {
+	var s replicationFactorState
+	if err := json.Unmarshal(msg, &s); err != nil {
+		c.log.Warningf("Ignoring invalid replication factor message: %s", err)
+		return
+	}
+	c.applyReplicationFactor(s)
+}
+
+// applyReplicationFactor adopts the given replication factor if it is newer
+// than the local one and passes it on to other nodes.
+func (c *cluster) applyReplicationFactor(s replicationFactorState) {
+	prev, ok := c.mergeReplicationFactor(s)
+	if !ok {
+		return
+	}
+	if err := c.persistReplicationFactor(s); err != nil {
+		c.log.Errorf("Failed to persist replication factor: %s", err)
+	}
+
+	msg, _ := json.Marshal(&s)
+	c.broadcasts.QueueBroadcast(replicationFactorBroadcast(msg))
+	if prev == s.ReplicationFactor {
+		return
+	}
+
+	c.log.Infof("Replication factor changed from %d to %d", prev, s.ReplicationFactor)
+	// Avoid blocking the memberlist event loop while advertising the new
+	// replication factor
+	go func() {
+		if err := c.ml.UpdateMeta(updateTimeout); err != nil {
+			c.log.Errorf("Failed to advertise replication factor: %s", err)
+		}
+		c.publish(NodeEvent{ReplicationFactorChange, c.LocalNode()})
+	}()
+}
+
+// mergeReplicationFactor updates the local replication factor if the given
+// state is newer, returning the previous replication factor and whether the
+// state was adopted.
+func (c *cluster) mergeReplicationFactor(s replicationFactorState) (int, bool) {
+	c.replMu.Lock()
+	defer c.replMu.Unlock()
+
+	prev := c.replFactor
+	if s.ReplicationFactor < 1 || s.SetAt <= c.replFactorSetAt {
+		return prev, false
+	}
+	c.replFactor = s.ReplicationFactor
+	c.replFactorSetAt = s.SetAt
+	return prev, true
+}
+
+// checkPlacement returns an error if the given node has advertised a
+// different replication factor, hashring, partitioning or partition key
+// version to the local node.
+// Such nodes would disagree with the local node about where data should be
+// placed.
+//
+// A different replication factor is accepted if either node's replication
+// factor was set using the admin API, such as when a node restarts with the
+// replication factor it was originally configured with or when a network
+// partition heals; both nodes then adopt whichever was set most recently.
+func (c *cluster) checkPlacement(n *Node) error {
+	var err error
+	local := c.currentReplicationFactor()
+	if rf := n.ReplicationFactor(); rf != 0 && rf != local.ReplicationFactor && n.replicationFactorSetAt() == local.SetAt {
+		err = fmt.Errorf("node %s has replication factor %d but this node has replication factor %d", n, rf, local.ReplicationFactor)
+	} else if h := n.hashRing(); h != "" && h != c.HashRing().String() {
+		err = fmt.Errorf("node %s uses the %s hashring but this node uses the %s hashring", n, h, c.HashRing())
+	} else if p := n.partitionBy(); p != "" && p != c.PartitionBy() {
+		err = fmt.Errorf("node %s partitions by %s but this node partitions by %s", n, p, c.PartitionBy())
+	} else if v, local := n.keyVersion(), c.KeyVersion(); v != 0 && local != 0 && v != local {
+		err = fmt.Errorf("node %s uses %s partition keys but this node uses %s partition keys", n, v, local)
+	}
+
+	if err != nil {
+		c.log.Warningf("Refusing to accept node into cluster: %s", err)
+	}
+	return err
+}
+
+func (n *Node) hashRing() string {
+	if len(n.mln.Meta) == 0 {
+		return ""
+	}
+	m, err := n.meta()
+	if err != nil {
+		return ""
+	}
+	return m.HashRing
+}
+
+func (n *Node) partitionBy() string {
+	if len(n.mln.Meta) == 0 {
+		return ""
+	}
+	m, err := n.meta()
+	if err != nil {
+		return ""
+	}
+	return m.PartitionBy
+}
+
+func (c *cluster) setMember(name string, member bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if member {
+		c.members[name] = true
+	} else {
+		delete(c.members, name)
+	}
+}
+
+func (c *cluster) isMember(name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.members[name]
+}
+
+func (c *cluster) numMembers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.members) == 0 {
+		return 1
+	}
+	return len(c.members)
+}
+
+// membershipFilter refuses to let nodes join the cluster if they have been
+// configured with a different replication factor, hashring, partitioning or
+// partition key version.
+type membershipFilter struct {
+	cluster *cluster
+}
+
+func (f *membershipFilter) NotifyAlive(peer *memberlist.Node) error {
+	// Existing members advertise a different replication factor for a
+	// short time while a change is gossiped across the cluster
+	if f.cluster.isMember(peer.Name) {
+		return nil
+	}
+	return f.cluster.checkPlacement(f.cluster.node(peer))
+}
+
+func (f *membershipFilter) NotifyMerge(peers []*memberlist.Node) error {
+	for _, p := range peers {
+		if err := f.cluster.checkPlacement(f.cluster.node(p)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replicationFactorBroadcast gossips a change in replication factor. Only the
+// most recent change matters, so each broadcast replaces any queued before it.
+type replicationFactorBroadcast []byte
+
+func (b replicationFactorBroadcast) Invalidates(memberlist.Broadcast) bool { return true }
+func (b replicationFactorBroadcast) Message() []byte                       { return b }
+func (b replicationFactorBroadcast) Finished()                             {}
@@ -0,0 +1,153 @@
+package cluster
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/sirupsen/logrus"
+)
+
+func newTestReplicationNode(name string, replFactor int) *memberlist.Node {
+	return &memberlist.Node{
+		Name: name,
+		Meta: []byte(fmt.Sprintf(`{"http_addr":"%s:9080","bucket_id":0,"replication_factor":%d}`, name, replFactor)),
+	}
+}
+
+func newTestReplicationNodeSetAt(name string, replFactor int, setAt int64) *memberlist.Node {
+	return &memberlist.Node{
+		Name: name,
+		Meta: []byte(fmt.Sprintf(`{"http_addr":"%s:9080","bucket_id":0,"replication_factor":%d,"replication_factor_set_at":%d}`, name, replFactor, setAt)),
+	}
+}
+
+func TestMembershipFilterRejectsMismatchedReplicationFactor(t *testing.T) {
+	clstr := &cluster{
+		log:        logrus.StandardLogger(),
+		members:    map[string]bool{"existing": true},
+		replFactor: 3,
+	}
+	filter := &membershipFilter{clstr}
+
+	var tests = []struct {
+		node      *memberlist.Node
+		expectErr bool
+	}{
+		{newTestReplicationNode("matching", 3), false},
+		{newTestReplicationNode("mismatched", 1), true},
+		{&memberlist.Node{Name: "unadvertised"}, false},
+		// Existing members may be part way through changing their
+		// replication factor
+		{newTestReplicationNode("existing", 1), false},
+	}
+
+	for _, test := range tests {
+		if err := filter.NotifyAlive(test.node); (err != nil) != test.expectErr {
+			t.Fatalf("Expected error for alive node %s: %t, got: %v", test.node.Name, test.expectErr, err)
+		}
+	}
+
+	if err := filter.NotifyMerge([]*memberlist.Node{newTestReplicationNode("matching", 3), newTestReplicationNode("other", 3)}); err != nil {
+		t.Fatalf("Expected merge to succeed, got: %s", err)
+	}
+	if err := filter.NotifyMerge([]*memberlist.Node{newTestReplicationNode("matching", 3), newTestReplicationNode("existing", 1)}); err == nil {
+		t.Fatal("Expected merge with mismatched replication factor to fail")
+	}
+}
+
+func TestMembershipFilterRejectsMismatchedPartitioning(t *testing.T) {
+	clstr := &cluster{
+		log:         logrus.StandardLogger(),
+		members:     make(map[string]bool),
+		partitionBy: PartitionByMetricName,
+		replFactor:  3,
+	}
+	filter := &membershipFilter{clstr}
+
+	for partitionBy, expectErr := range map[string]bool{
+		PartitionByMetricName: false,
+		PartitionBySeries:     true,
+	} {
+		node := &memberlist.Node{
+			Name: partitionBy,
+			Meta: []byte(fmt.Sprintf(`{"http_addr":"%s:9080","bucket_id":0,"replication_factor":3,"partition_by":"%s"}`, partitionBy, partitionBy)),
+		}
+		if err := filter.NotifyAlive(node); (err != nil) != expectErr {
+			t.Fatalf("Expected error for node partitioning by %s: %t, got: %v", partitionBy, expectErr, err)
+		}
+	}
+}
+
+func TestMergeReplicationFactorAdoptsNewest(t *testing.T) {
+	clstr := &cluster{replFactor: 3}
+
+	if _, ok := clstr.mergeReplicationFactor(replicationFactorState{ReplicationFactor: 1, SetAt: 0}); ok {
+		t.Fatal("Expected replication factor configured at startup to be ignored")
+	}
+	if prev, ok := clstr.mergeReplicationFactor(replicationFactorState{ReplicationFactor: 5, SetAt: 20}); !ok || prev != 3 {
+		t.Fatalf("Expected newer replication factor to be adopted, got previous %d, adopted %t", prev, ok)
+	}
+	if _, ok := clstr.mergeReplicationFactor(replicationFactorState{ReplicationFactor: 2, SetAt: 10}); ok {
+		t.Fatal("Expected older replication factor to be ignored")
+	}
+	if rf := clstr.ReplicationFactor(); rf != 5 {
+		t.Fatalf("Expected replication factor 5, got %d", rf)
+	}
+}
+
+func TestMembershipFilterAcceptsReplicationFactorSetUsingAPI(t *testing.T) {
+	clstr := &cluster{
+		log:             logrus.StandardLogger(),
+		members:         map[string]bool{},
+		replFactor:      5,
+		replFactorSetAt: 20,
+	}
+	filter := &membershipFilter{clstr}
+
+	// A node restarted with the replication factor it was originally
+	// configured with adopts the cluster's replication factor
+	if err := filter.NotifyAlive(newTestReplicationNode("restarted", 3)); err != nil {
+		t.Fatalf("Expected node configured using a flag to be accepted, got: %s", err)
+	}
+	// Both sides of a healed partition adopt the newest replication factor
+	if err := filter.NotifyMerge([]*memberlist.Node{newTestReplicationNodeSetAt("partitioned", 2, 30)}); err != nil {
+		t.Fatalf("Expected merge with replication factor set using the API to succeed, got: %s", err)
+	}
+	if err := filter.NotifyMerge([]*memberlist.Node{newTestReplicationNodeSetAt("conflicting", 2, 20)}); err == nil {
+		t.Fatal("Expected merge with a different replication factor set at the same time to fail")
+	}
+}
+
+func TestReplicationFactorPersisted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timbala-replication")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := NewStatic(logrus.StandardLogger(), "node", "localhost:9080", 0, 3)
+	s.dataDir = dir
+	if err := s.SetReplicationFactor(5); err != nil {
+		t.Fatal(err)
+	}
+
+	// The node is restarted with the replication factor it was originally
+	// configured with
+	restarted := &cluster{
+		dataDir:    dir,
+		log:        logrus.StandardLogger(),
+		replFactor: 3,
+	}
+	if err := restarted.loadReplicationFactor(); err != nil {
+		t.Fatal(err)
+	}
+	if rf := restarted.ReplicationFactor(); rf != 5 {
+		t.Fatalf("Expected persisted replication factor 5, got %d", rf)
+	}
+	if got, want := restarted.currentReplicationFactor(), s.currentReplicationFactor(); got != want {
+		t.Fatalf("Expected persisted replication factor %+v, got %+v", want, got)
+	}
+}
@@ -0,0 +1,157 @@
+package cluster
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/mattbostock/timbala/internal/hashring"
+	"github.com/sirupsen/logrus"
+)
+
+// Static is a cluster whose membership is set explicitly rather than
+// discovered by gossip. It allows components that communicate with other
+// nodes to be tested against real HTTP servers without running the gossip
+// protocol.
+type Static struct {
+	*cluster
+	ml *staticMembership
+}
+
+// NewStatic returns a cluster consisting of only the local node, which has
+// the given name and serves HTTP on httpAddr.
+func NewStatic(l *logrus.Logger, name, httpAddr string, bucketID, replFactor int) *Static {
+	c := &cluster{
+		keys:        latestKeys,
+		log:         l,
+		members:     make(map[string]bool),
+		metas:       newMetaCache(),
+		partitionBy: PartitionBySeries,
+		replFactor:  replFactor,
+		ring:        hashring.New(),
+	}
+	c.delegate = &delegate{
+		cluster:                c,
+		id:                     bucketID,
+		localHTTPAdvertiseAddr: httpAddr,
+	}
+	c.broadcasts = &memberlist.TransmitLimitedQueue{
+		NumNodes:       c.numMembers,
+		RetransmitMult: 1,
+	}
+
+	ml := &staticMembership{delegate: c.delegate, metas: c.metas}
+	ml.local = &memberlist.Node{Name: name, Meta: c.delegate.NodeMeta(0)}
+	ml.nodes = []*memberlist.Node{ml.local}
+	c.ml = ml
+	c.setMember(name, true)
+	return &Static{cluster: c, ml: ml}
+}
+
+// SetPartitionBy sets how partition keys are derived from the labels of each
+// time-series. It must be called before any data is written.
+func (s *Static) SetPartitionBy(partitionBy string) {
+	s.partitionBy = partitionBy
+}
+
+// Join adds a node with the given name, serving HTTP on httpAddr, to the
+// cluster.
+func (s *Static) Join(name, httpAddr string, bucketID int) {
+	meta, _ := json.Marshal(&nodeMeta{
+		HTTPAddr:          httpAddr,
+		BucketID:          bucketID,
+		PartitionKeys:     s.KeyVersion(),
+		ReplicationFactor: s.ReplicationFactor(),
+	})
+	n := &memberlist.Node{Name: name, Meta: meta}
+
+	s.ml.mu.Lock()
+	s.ml.nodes = append(s.ml.nodes, n)
+	s.ml.mu.Unlock()
+
+	s.setMember(name, true)
+	s.publish(NodeEvent{NodeJoin, s.node(n)})
+}
+
+// Remove removes the node with the given name from the cluster.
+func (s *Static) Remove(name string) {
+	s.ml.mu.Lock()
+	var removed *memberlist.Node
+	nodes := s.ml.nodes[:0]
+	for _, n := range s.ml.nodes {
+		if n.Name == name {
+			removed = n
+			continue
+		}
+		nodes = append(nodes, n)
+	}
+	s.ml.nodes = nodes
+	s.ml.mu.Unlock()
+
+	if removed == nil {
+		return
+	}
+	s.setMember(name, false)
+	s.publish(NodeEvent{NodeLeave, s.node(removed)})
+	s.metas.remove(name)
+}
+
+// staticMembership implements Membership for a Static cluster.
+type staticMembership struct {
+	delegate *delegate
+	metas    *metaCache
+
+	mu    sync.Mutex
+	local *memberlist.Node
+	nodes []*memberlist.Node
+}
+
+func (m *staticMembership) Nodes() Nodes {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	nodes := make(Nodes, 0, len(m.nodes))
+	for _, n := range m.nodes {
+		nodes = append(nodes, &Node{mln: n, metas: m.metas})
+	}
+	return nodes
+}
+
+func (m *staticMembership) LocalNode() *Node {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return &Node{mln: m.local, metas: m.metas}
+}
+
+func (m *staticMembership) Leave(time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	nodes := m.nodes[:0]
+	for _, n := range m.nodes {
+		if n != m.local {
+			nodes = append(nodes, n)
+		}
+	}
+	m.nodes = nodes
+	return nil
+}
+
+// UpdateMeta replaces the local node, so that the metadata of nodes that
+// have already been returned is not modified.
+func (m *staticMembership) UpdateMeta(time.Duration) error {
+	meta := m.delegate.NodeMeta(0)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	local := &memberlist.Node{Name: m.local.Name, Meta: meta}
+	for i, n := range m.nodes {
+		if n == m.local {
+			m.nodes[i] = local
+		}
+	}
+	m.local = local
+	return nil
+}
@@ -0,0 +1,66 @@
+package cluster
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/mattbostock/timbala/internal/hashring"
+	"github.com/sirupsen/logrus"
+)
+
+func newTestZoneNode(name string, bucketID int, zone string) *Node {
+	return &Node{mln: &memberlist.Node{
+		Name: name,
+		Meta: []byte(fmt.Sprintf(`{"http_addr":"%s:9080","bucket_id":%d,"zone":"%s"}`, name, bucketID, zone)),
+	}}
+}
+
+func TestReplicasSpreadAcrossZones(t *testing.T) {
+	var tests = []struct {
+		numZones      int
+		numNodes      int
+		replFactor    int
+		expectedZones int
+	}{
+		{3, 9, 3, 3},
+		{3, 4, 3, 3},
+		{2, 6, 3, 2},
+		{5, 19, 3, 3},
+		{1, 5, 3, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%d replicas across %d nodes in %d zones", test.replFactor, test.numNodes, test.numZones), func(t *testing.T) {
+			clstr := &cluster{
+				log:        logrus.StandardLogger(),
+				replFactor: test.replFactor,
+				ring:       hashring.New(),
+			}
+
+			// Place nodes in zones such that neighbouring buckets are
+			// often in the same zone
+			nodes := make(Nodes, 0, test.numNodes)
+			for i := 0; i < test.numNodes; i++ {
+				zone := "zone" + strconv.Itoa(i*test.numZones/test.numNodes)
+				nodes = append(nodes, newTestZoneNode(strconv.Itoa(i), i, zone))
+			}
+
+			for pKey := uint64(0); pKey < 10000; pKey++ {
+				replicas := clstr.NodesByPartitionKeyFrom(nodes, clstr.ReplicationFactor(), pKey)
+				if len(replicas) != test.replFactor {
+					t.Fatalf("Expected %d replicas, got %d", test.replFactor, len(replicas))
+				}
+
+				zones := make(map[string]bool)
+				for _, n := range replicas {
+					zones[n.Zone()] = true
+				}
+				if len(zones) != test.expectedZones {
+					t.Fatalf("Expected replicas for partition key %d to span %d zones, got %d: %v", pKey, test.expectedZones, len(zones), replicas)
+				}
+			}
+		})
+	}
+}
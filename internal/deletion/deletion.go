@@ -0,0 +1,400 @@
+// Package deletion deletes series from every node in the cluster. Deleted
+// samples are recorded as tombstones, which hide them from queries until the
+// tombstones are cleaned and the samples are removed from disk.
+package deletion
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattbostock/timbala/internal/cluster"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/tsdb"
+	tsdbLabels "github.com/prometheus/tsdb/labels"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/context/ctxhttp"
+)
+
+const (
+	Route                = "/admin/delete_series"
+	CleanTombstonesRoute = "/admin/clean_tombstones"
+	PurgeCacheRoute      = "/admin/purge_query_cache"
+
+	// requestTimeout is how long each node has to delete series or clean
+	// tombstones, which may involve rewriting many blocks
+	requestTimeout = 5 * time.Minute
+)
+
+var httpClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			DualStack: true,
+			KeepAlive: 10 * time.Minute,
+			Timeout:   2 * time.Second,
+		}).DialContext,
+		ExpectContinueTimeout: 5 * time.Second,
+		IdleConnTimeout:       10 * time.Minute,
+	}}
+
+// Result is the outcome of a deletion on a single node.
+type Result struct {
+	Node       string `json:"node"`
+	NumDeleted int    `json:"numDeleted"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Tombstoner is local storage held outside of the main database that samples
+// must also be deleted from, such as samples received out of order.
+type Tombstoner interface {
+	Delete(mint, maxt int64, ms ...tsdbLabels.Matcher) error
+	CleanTombstones() error
+}
+
+type deleter struct {
+	clstr      cluster.Cluster
+	db         *tsdb.DB
+	log        *logrus.Logger
+	outOfOrder Tombstoner
+	purge      func()
+}
+
+// New returns a deleter for the given local storage. purge is called whenever
+// series are deleted from the local node, to discard any cached query results
+// that may include them.
+func New(c cluster.Cluster, l *logrus.Logger, db *tsdb.DB, outOfOrder Tombstoner, purge func()) *deleter {
+	return &deleter{
+		clstr:      c,
+		db:         db,
+		log:        l,
+		outOfOrder: outOfOrder,
+		purge:      purge,
+	}
+}
+
+// DeleteSeries deletes the samples between mint and maxt inclusive from the
+// series matching any of the given selectors on every node in the cluster.
+// Any node may hold matching series, since partition keys are derived from
+// all of the labels of a series.
+//
+// It returns the number of series each node deleted samples from. An error is
+// returned if any node failed, since replicas that still hold the deleted
+// samples would restore them to other nodes during anti-entropy; the deletion
+// should be retried until every node succeeds.
+//
+// Once every node has deleted the samples, the query results cached by every
+// node are purged again, since a query evaluated while the deletion was in
+// progress may have read the samples from a node that had yet to delete them.
+func (d *deleter) DeleteSeries(ctx context.Context, mint, maxt int64, matchers [][]*labels.Matcher) ([]Result, error) {
+	d.log.Infof("Deleting series matching %s between %d and %d", formatSelectors(matchers), mint, maxt)
+
+	form := url.Values{
+		"match[]": formatSelectors(matchers),
+		"start":   []string{strconv.FormatInt(mint, 10)},
+		"end":     []string{strconv.FormatInt(maxt, 10)},
+	}
+	results, err := d.fanout(ctx, Route, form, func() (int, error) {
+		return d.deleteLocal(mint, maxt, matchers)
+	})
+
+	if _, purgeErr := d.fanout(ctx, PurgeCacheRoute, nil, func() (int, error) {
+		d.purgeCache()
+		return 0, nil
+	}); purgeErr != nil && err == nil {
+		err = fmt.Errorf("unable to purge cached query results: %s", purgeErr)
+	}
+	return results, err
+}
+
+// CleanTombstones removes deleted samples from disk on every node in the
+// cluster, by rewriting any blocks with tombstones. It returns an error if any
+// node failed.
+func (d *deleter) CleanTombstones(ctx context.Context) ([]Result, error) {
+	d.log.Info("Cleaning tombstones")
+	return d.fanout(ctx, CleanTombstonesRoute, nil, func() (int, error) {
+		return 0, d.cleanTombstones()
+	})
+}
+
+// fanout runs local on this node and sends the given form to path on every
+// other node, returning the result for each node sorted by node name.
+func (d *deleter) fanout(ctx context.Context, path string, form url.Values, local func() (int, error)) ([]Result, error) {
+	nodes := d.clstr.Nodes()
+	results := make([]Result, len(nodes))
+	var wg sync.WaitGroup
+	for i, n := range nodes {
+		results[i].Node = n.Name()
+
+		wg.Add(1)
+		go func(r *Result, n *cluster.Node) {
+			defer wg.Done()
+
+			var err error
+			if n.Name() == d.clstr.LocalNode().Name() {
+				r.NumDeleted, err = local()
+			} else {
+				r.NumDeleted, err = postToNode(ctx, n, path, form)
+			}
+			if err != nil {
+				d.log.Errorf("Deletion failed on node %s: %s", n.Name(), err)
+				r.Error = err.Error()
+			}
+		}(&results[i], n)
+	}
+	wg.Wait()
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Node < results[j].Node
+	})
+
+	var failed []string
+	for _, r := range results {
+		if r.Error != "" {
+			failed = append(failed, r.Node)
+		}
+	}
+	if len(failed) > 0 {
+		return results, fmt.Errorf("failed on %d of %d nodes (%s); retry until all nodes succeed", len(failed), len(results), strings.Join(failed, ", "))
+	}
+	return results, nil
+}
+
+// deleteLocal writes tombstones for the samples between mint and maxt in the
+// local series matching any of the given selectors, returning the number of
+// series that had samples deleted.
+func (d *deleter) deleteLocal(mint, maxt int64, matchers [][]*labels.Matcher) (int, error) {
+	sels := make([][]tsdbLabels.Matcher, 0, len(matchers))
+	for _, ms := range matchers {
+		sel, err := toTSDBMatchers(ms)
+		if err != nil {
+			return 0, err
+		}
+		sels = append(sels, sel)
+	}
+
+	numDeleted, err := d.countSeries(mint, maxt, sels)
+	if err != nil {
+		return 0, err
+	}
+	for _, sel := range sels {
+		if err := d.db.Delete(mint, maxt, sel...); err != nil {
+			return 0, err
+		}
+		if d.outOfOrder == nil {
+			continue
+		}
+		if err := d.outOfOrder.Delete(mint, maxt, sel...); err != nil {
+			return 0, err
+		}
+	}
+	d.purgeCache()
+	return numDeleted, nil
+}
+
+func (d *deleter) purgeCache() {
+	if d.purge != nil {
+		d.purge()
+	}
+}
+
+func (d *deleter) cleanTombstones() error {
+	if err := d.db.CleanTombstones(); err != nil {
+		return err
+	}
+	if d.outOfOrder == nil {
+		return nil
+	}
+	return d.outOfOrder.CleanTombstones()
+}
+
+// countSeries returns the number of distinct series matching any of the given
+// selectors that have samples between mint and maxt.
+func (d *deleter) countSeries(mint, maxt int64, sels [][]tsdbLabels.Matcher) (int, error) {
+	q, err := d.db.Querier(mint, maxt)
+	if err != nil {
+		return 0, err
+	}
+	defer q.Close()
+
+	seen := make(map[string]struct{})
+	for _, sel := range sels {
+		set, err := q.Select(sel...)
+		if err != nil {
+			return 0, err
+		}
+		for set.Next() {
+			s := set.At()
+			key := s.Labels().String()
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			it := s.Iterator()
+			if !it.Seek(mint) {
+				if err := it.Err(); err != nil {
+					return 0, err
+				}
+				continue
+			}
+			if t, _ := it.At(); t <= maxt {
+				seen[key] = struct{}{}
+			}
+		}
+		if err := set.Err(); err != nil {
+			return 0, err
+		}
+	}
+	return len(seen), nil
+}
+
+// HandlerFunc deletes the samples between the start and end form values from
+// the local series matching any of the match[] selectors. It does not delete
+// series from other nodes.
+func (d *deleter) HandlerFunc(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	mint, maxt := int64(math.MinInt64), int64(math.MaxInt64)
+	var err error
+	if s := r.Form.Get("start"); s != "" {
+		if mint, err = strconv.ParseInt(s, 10, 64); err != nil {
+			http.Error(w, fmt.Sprintf("invalid start: %q", s), http.StatusBadRequest)
+			return
+		}
+	}
+	if e := r.Form.Get("end"); e != "" {
+		if maxt, err = strconv.ParseInt(e, 10, 64); err != nil {
+			http.Error(w, fmt.Sprintf("invalid end: %q", e), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if len(r.Form["match[]"]) == 0 {
+		http.Error(w, "no match[] parameter provided", http.StatusBadRequest)
+		return
+	}
+	matchers := make([][]*labels.Matcher, 0, len(r.Form["match[]"]))
+	for _, s := range r.Form["match[]"] {
+		ms, err := promql.ParseMetricSelector(s)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		matchers = append(matchers, ms)
+	}
+
+	d.log.Infof("Deleting local series matching %s between %d and %d", r.Form["match[]"], mint, maxt)
+	numDeleted, err := d.deleteLocal(mint, maxt, matchers)
+	if err != nil {
+		d.log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	d.respond(w, numDeleted)
+}
+
+// CleanTombstonesHandlerFunc removes deleted samples from the local node's
+// disk. It does not clean tombstones on other nodes.
+func (d *deleter) CleanTombstonesHandlerFunc(w http.ResponseWriter, r *http.Request) {
+	d.log.Info("Cleaning local tombstones")
+	if err := d.cleanTombstones(); err != nil {
+		d.log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	d.respond(w, 0)
+}
+
+// PurgeCacheHandlerFunc discards the query results cached by the local node.
+func (d *deleter) PurgeCacheHandlerFunc(w http.ResponseWriter, r *http.Request) {
+	d.purgeCache()
+	d.respond(w, 0)
+}
+
+type response struct {
+	NumDeleted int `json:"numDeleted"`
+}
+
+func (d *deleter) respond(w http.ResponseWriter, numDeleted int) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response{numDeleted}); err != nil {
+		d.log.Error(err)
+	}
+}
+
+func postToNode(ctx context.Context, n *cluster.Node, path string, form url.Values) (int, error) {
+	httpAddr, err := n.HTTPAddr()
+	if err != nil {
+		return 0, err
+	}
+
+	// FIXME handle HTTPS
+	httpReq, err := http.NewRequest("POST", "http://"+httpAddr+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return 0, fmt.Errorf("unable to create request: %v", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	httpResp, err := ctxhttp.Do(ctx, httpClient, httpReq)
+	if err != nil {
+		return 0, fmt.Errorf("error sending request: %v", err)
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode/100 != 2 {
+		return 0, fmt.Errorf("server returned HTTP status %s", httpResp.Status)
+	}
+
+	var resp response
+	if err := json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
+		return 0, fmt.Errorf("unable to unmarshal response body: %v", err)
+	}
+	return resp.NumDeleted, nil
+}
+
+// formatSelectors formats each set of matchers as a series selector that can
+// be parsed by promql.ParseMetricSelector.
+func formatSelectors(matchers [][]*labels.Matcher) []string {
+	sels := make([]string, 0, len(matchers))
+	for _, ms := range matchers {
+		strs := make([]string, 0, len(ms))
+		for _, m := range ms {
+			strs = append(strs, m.String())
+		}
+		sels = append(sels, "{"+strings.Join(strs, ",")+"}")
+	}
+	return sels
+}
+
+func toTSDBMatchers(matchers []*labels.Matcher) ([]tsdbLabels.Matcher, error) {
+	result := make([]tsdbLabels.Matcher, 0, len(matchers))
+	for _, m := range matchers {
+		switch m.Type {
+		case labels.MatchEqual:
+			result = append(result, tsdbLabels.NewEqualMatcher(m.Name, m.Value))
+		case labels.MatchNotEqual:
+			result = append(result, tsdbLabels.Not(tsdbLabels.NewEqualMatcher(m.Name, m.Value)))
+		case labels.MatchRegexp, labels.MatchNotRegexp:
+			re, err := tsdbLabels.NewRegexpMatcher(m.Name, "^(?:"+m.Value+")$")
+			if err != nil {
+				return nil, err
+			}
+			if m.Type == labels.MatchNotRegexp {
+				re = tsdbLabels.Not(re)
+			}
+			result = append(result, re)
+		default:
+			return nil, fmt.Errorf("invalid matcher type")
+		}
+	}
+	return result, nil
+}
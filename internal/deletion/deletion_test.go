@@ -0,0 +1,179 @@
+package deletion
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mattbostock/timbala/internal/cluster"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/tsdb"
+	tsdbLabels "github.com/prometheus/tsdb/labels"
+	"github.com/sirupsen/logrus"
+)
+
+func TestDeleteLocal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deletion_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := tsdb.Open(dir, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	app := db.Appender()
+	for _, lset := range []tsdbLabels.Labels{
+		tsdbLabels.FromStrings("__name__", "a", "user", "alice"),
+		tsdbLabels.FromStrings("__name__", "a", "user", "bob"),
+		tsdbLabels.FromStrings("__name__", "b", "user", "alice"),
+	} {
+		for ts := int64(1); ts <= 3; ts++ {
+			if _, err := app.Add(lset, ts, 1); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := app.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	d := &deleter{db: db}
+	// Both selectors match the first series, which must only be counted once
+	matchers := [][]*labels.Matcher{
+		mustParse(t, `{user="alice"}`),
+		mustParse(t, `a{user=~"al.*"}`),
+	}
+	numDeleted, err := d.deleteLocal(2, 3, matchers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if numDeleted != 2 {
+		t.Fatalf("Expected 2 series to be deleted, got %d", numDeleted)
+	}
+
+	// Deleting again finds no samples to delete
+	numDeleted, err = d.deleteLocal(2, 3, matchers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if numDeleted != 0 {
+		t.Fatalf("Expected no series to be deleted, got %d", numDeleted)
+	}
+
+	q, err := db.Querier(0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	set, err := q.Select(tsdbLabels.NewEqualMatcher("user", "alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for set.Next() {
+		var timestamps []int64
+		it := set.At().Iterator()
+		for it.Next() {
+			ts, _ := it.At()
+			timestamps = append(timestamps, ts)
+		}
+		if !reflect.DeepEqual(timestamps, []int64{1}) {
+			t.Fatalf("Expected only sample at timestamp 1 to remain in %s, got %v", set.At().Labels(), timestamps)
+		}
+	}
+	if err := set.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFormatSelectors(t *testing.T) {
+	matchers := [][]*labels.Matcher{
+		mustParse(t, `a{user=~"al.*",team!="ops",quote="\"x\""}`),
+		mustParse(t, `{user=~"b.+",team!~"ops|dev"}`),
+	}
+	for i, sel := range formatSelectors(matchers) {
+		if parsed := mustParse(t, sel); !reflect.DeepEqual(parsed, matchers[i]) {
+			t.Fatalf("Expected %s to parse to %v, got %v", sel, matchers[i], parsed)
+		}
+	}
+}
+
+func mustParse(t *testing.T, sel string) []*labels.Matcher {
+	ms, err := promql.ParseMetricSelector(sel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ms
+}
+
+func TestDeleteSeriesPurgesCachesAfterEveryNodeDeletes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deletion_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := tsdb.Open(dir, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var (
+		mu     sync.Mutex
+		events []string
+	)
+	record := func(event string) {
+		mu.Lock()
+		events = append(events, event)
+		mu.Unlock()
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(Route, func(w http.ResponseWriter, r *http.Request) {
+		// Node b deletes its series after node a
+		time.Sleep(50 * time.Millisecond)
+		record("b deleted")
+		w.Write([]byte(`{"numDeleted":0}`))
+	})
+	mux.HandleFunc(PurgeCacheRoute, func(w http.ResponseWriter, r *http.Request) {
+		record("b purged")
+		w.Write([]byte(`{"numDeleted":0}`))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	clstr := cluster.NewStatic(logrus.New(), "a", "127.0.0.1:0", 0, 2)
+	clstr.Join("b", srv.Listener.Addr().String(), 1)
+	d := New(clstr, logrus.New(), db, nil, func() { record("a purged") })
+
+	if _, err := d.DeleteSeries(context.Background(), 0, 10, [][]*labels.Matcher{mustParse(t, `{user="alice"}`)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both nodes purge their caches once node b has deleted its series
+	mu.Lock()
+	defer mu.Unlock()
+	deleted := -1
+	purged := make(map[string]bool)
+	for i, event := range events {
+		if event == "b deleted" {
+			deleted = i
+		} else if deleted >= 0 {
+			purged[event] = true
+		}
+	}
+	if !purged["a purged"] || !purged["b purged"] {
+		t.Fatalf("Expected both nodes to purge their caches after every node deleted series, got %v", events)
+	}
+}
@@ -0,0 +1,331 @@
+package fanout
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mattbostock/timbala/internal/cluster"
+	"github.com/mattbostock/timbala/internal/read"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/storage"
+)
+
+const (
+	// membershipSettleTime is how long reads are sent to all replicas after
+	// cluster membership changes. Nodes that have newly become the preferred
+	// replica for a partition key may not hold its data until rebalancing
+	// has completed.
+	membershipSettleTime = time.Hour
+
+	// readRepairChance is the proportion of queries that read from every
+	// replica, so that inconsistencies between replicas can be repaired
+	readRepairChance = 0.1
+)
+
+// Run reads from all replicas for a while whenever cluster membership or the
+// replication factor changes, and compares the results of queries that read
+// from all replicas, until the context is cancelled.
+func (f *fanoutStorage) Run(ctx context.Context) {
+	go f.repairer.run(ctx)
+
+	events := f.clstr.Subscribe()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-events:
+			if ev.Type == cluster.NodeUpdate && !ev.Node.Leaving() {
+				continue
+			}
+			f.mu.Lock()
+			f.unsettledUntil = time.Now().Add(membershipSettleTime)
+			f.mu.Unlock()
+		}
+	}
+}
+
+// preferReplicas returns true if a query should read each partition key from
+// only its preferred replica.
+func (f *fanoutStorage) preferReplicas() bool {
+	return f.settled() && rand.Float64() >= readRepairChance
+}
+
+// settled returns true if cluster membership has not changed recently, so the
+// preferred replica for each partition key can be expected to hold its data.
+func (f *fanoutStorage) settled() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return !time.Now().Before(f.unsettledUntil)
+}
+
+// selectPreferred reads each partition key from only its preferred replica,
+// returning the series sets from each node for each selector. If a node fails
+// to respond, the partition keys it was preferred for are read from the next
+// replica, until every partition key has been read or no replicas remain.
+// Series are read lazily, so a node that fails after it has started to
+// respond fails the query instead.
+//
+// If pKeys is not nil, only the preferred replicas of the given partition keys
+// are queried.
+func (q *fanoutQuerier) selectPreferred(sels [][]*labels.Matcher, pKeys []uint64) ([]map[string][]storage.SeriesSet, map[string]error) {
+	results := make([]map[string][]storage.SeriesSet, len(sels))
+	for i := range results {
+		results[i] = make(map[string][]storage.SeriesSet, len(q.queriers))
+	}
+	failed := make(map[string]error)
+	excluded := make(map[string]bool)
+
+	// keep filters the results of each round to the partition keys that
+	// were not read successfully in an earlier round
+	var keep func(pKey uint64) bool
+	for {
+		// Nodes are queried concurrently within each round
+		var mu sync.Mutex
+		roundFailed := q.each(q.skipped(pKeys, false, excluded), func(name string, querier nodeQuerier) error {
+			sets, err := querier.selectBatch(excluded, sels)
+			if err != nil {
+				return err
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for i, set := range sets {
+				if keep != nil {
+					set = read.FilterPartitions(set, q.clstr, keep)
+				}
+				results[i][name] = append(results[i][name], set)
+			}
+			return nil
+		})
+
+		newlyFailed := make(map[string]bool, len(roundFailed))
+		for name, err := range roundFailed {
+			failed[name] = err
+			newlyFailed[name] = true
+		}
+
+		if len(newlyFailed) == 0 || len(failed) == len(q.queriers) || q.budget.exceeded() {
+			return results, failed
+		}
+
+		prevExcluded := make(map[string]bool, len(excluded))
+		for name := range excluded {
+			prevExcluded[name] = true
+		}
+		for name := range newlyFailed {
+			excluded[name] = true
+		}
+		keep = func(pKey uint64) bool {
+			return newlyFailed[read.PreferredReplica(q.clstr, pKey, prevExcluded)]
+		}
+	}
+}
+
+// mergeSeriesSet merges the series sets returned by each node, each of which
+// is sorted by labels, combining the series with the same labels. Series are
+// only read from each node's set as the merged set is iterated over.
+//
+// If repair is set, it is passed the series read from each node, keyed by
+// node name, once every set has been read without error.
+type mergeSeriesSet struct {
+	nodes []string
+	sets  []storage.SeriesSet
+	ok    []bool
+	cur   storage.Series
+
+	started bool
+	// advance holds the sets whose current series was returned by At, and
+	// which must be advanced on the next call to Next
+	advance []int
+
+	repair func(results map[string][]storage.Series)
+	read   map[string][]storage.Series
+}
+
+func newMergeSeriesSet(results map[string][]storage.SeriesSet) *mergeSeriesSet {
+	// Merge nodes in a consistent order, so that the same sample is chosen
+	// when replicas disagree about the value for a timestamp
+	names := make([]string, 0, len(results))
+	for name := range results {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	m := &mergeSeriesSet{read: make(map[string][]storage.Series, len(results))}
+	for _, name := range names {
+		// Nodes that returned no series were still queried
+		m.read[name] = nil
+		for _, set := range results[name] {
+			m.nodes = append(m.nodes, name)
+			m.sets = append(m.sets, set)
+		}
+	}
+	m.ok = make([]bool, len(m.sets))
+	return m
+}
+
+func (m *mergeSeriesSet) Next() bool {
+	if !m.started {
+		for i, set := range m.sets {
+			m.ok[i] = set.Next()
+		}
+		m.started = true
+	}
+	for _, i := range m.advance {
+		m.ok[i] = m.sets[i].Next()
+	}
+	m.advance = m.advance[:0]
+
+	var lset labels.Labels
+	for i, set := range m.sets {
+		if !m.ok[i] {
+			continue
+		}
+		l := set.At().Labels()
+		switch {
+		case len(m.advance) == 0 || labels.Compare(l, lset) < 0:
+			lset = l
+			m.advance = append(m.advance[:0], i)
+		case labels.Compare(l, lset) == 0:
+			m.advance = append(m.advance, i)
+		}
+	}
+	if len(m.advance) == 0 {
+		if m.repair != nil && m.Err() == nil {
+			m.repair(m.read)
+		}
+		m.repair = nil
+		return false
+	}
+
+	if m.repair != nil {
+		for _, i := range m.advance {
+			m.read[m.nodes[i]] = append(m.read[m.nodes[i]], m.sets[i].At())
+		}
+	}
+	if len(m.advance) == 1 {
+		m.cur = m.sets[m.advance[0]].At()
+		return true
+	}
+	merged := &mergedSeries{labels: lset}
+	for _, i := range m.advance {
+		merged.series = append(merged.series, m.sets[i].At())
+	}
+	m.cur = merged
+	return true
+}
+
+func (m *mergeSeriesSet) At() storage.Series {
+	return m.cur
+}
+
+func (m *mergeSeriesSet) Err() error {
+	for _, set := range m.sets {
+		if err := set.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergedSeries implements storage.Series, merging the samples from several
+// series with the same labels by timestamp. Samples with duplicate
+// timestamps, such as those returned by more than one replica, are dropped.
+type mergedSeries struct {
+	labels labels.Labels
+	series []storage.Series
+}
+
+func (m *mergedSeries) Labels() labels.Labels {
+	return m.labels
+}
+
+func (m *mergedSeries) Iterator() storage.SeriesIterator {
+	its := make([]storage.SeriesIterator, 0, len(m.series))
+	for _, s := range m.series {
+		its = append(its, s.Iterator())
+	}
+	return &mergedSeriesIterator{
+		its: its,
+		ok:  make([]bool, len(its)),
+		cur: -1,
+	}
+}
+
+type mergedSeriesIterator struct {
+	its     []storage.SeriesIterator
+	ok      []bool
+	cur     int
+	started bool
+}
+
+func (m *mergedSeriesIterator) Seek(t int64) bool {
+	if m.cur >= 0 {
+		if ct, _ := m.At(); ct >= t {
+			return true
+		}
+	}
+	for i, it := range m.its {
+		if m.ok[i] || !m.started {
+			m.ok[i] = it.Seek(t)
+		}
+	}
+	m.started = true
+	return m.pick()
+}
+
+func (m *mergedSeriesIterator) At() (int64, float64) {
+	return m.its[m.cur].At()
+}
+
+func (m *mergedSeriesIterator) Next() bool {
+	if !m.started {
+		for i, it := range m.its {
+			m.ok[i] = it.Next()
+		}
+		m.started = true
+		return m.pick()
+	}
+	if m.cur < 0 {
+		return false
+	}
+
+	// Advance every iterator at the current timestamp, dropping duplicates
+	ct, _ := m.At()
+	for i, it := range m.its {
+		if !m.ok[i] {
+			continue
+		}
+		if t, _ := it.At(); t == ct {
+			m.ok[i] = it.Next()
+		}
+	}
+	return m.pick()
+}
+
+// pick chooses the iterator with the earliest sample, preferring the first
+// such iterator when several have a sample at the same timestamp.
+func (m *mergedSeriesIterator) pick() bool {
+	m.cur = -1
+	var min int64
+	for i, it := range m.its {
+		if !m.ok[i] {
+			continue
+		}
+		if t, _ := it.At(); m.cur < 0 || t < min {
+			m.cur, min = i, t
+		}
+	}
+	return m.cur >= 0
+}
+
+func (m *mergedSeriesIterator) Err() error {
+	for _, it := range m.its {
+		if err := it.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -3,48 +3,108 @@ package fanout
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
 	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang/snappy"
+	"github.com/mattbostock/timbala/internal/cardinality"
 	"github.com/mattbostock/timbala/internal/cluster"
 	"github.com/mattbostock/timbala/internal/read"
+	"github.com/mattbostock/timbala/internal/selectors"
+	"github.com/mattbostock/timbala/internal/warnings"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/promql"
 	"github.com/prometheus/prometheus/storage"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/net/context/ctxhttp"
 )
 
-const readTimeoutSeconds = 30 * time.Second
+const (
+	readTimeoutSeconds = 30 * time.Second
 
-var httpClient = &http.Client{
-	Transport: &http.Transport{
-		DialContext: (&net.Dialer{
-			DualStack: true,
-			KeepAlive: 10 * time.Minute,
-			Timeout:   2 * time.Second,
-		}).DialContext,
-		ExpectContinueTimeout: 5 * time.Second,
-		IdleConnTimeout:       10 * time.Minute,
-		ResponseHeaderTimeout: 5 * time.Second,
-	}}
+	// statusLimitFactor is how many more metric names and label pairs each
+	// node is asked for than are returned in a TSDB status
+	statusLimitFactor = 10
+
+	// maxRoutedRange is the longest query for which the nodes holding the
+	// partition keys of each selector are determined. Longer queries are
+	// sent to every node, which likely holds some of their partition keys.
+	maxRoutedRange = 366 * 24 * time.Hour
+
+	// maxQueryBytes bounds the size of the responses read from other
+	// nodes for a single query. The series in each response are held in
+	// memory, as compressed chunks, until the query has been evaluated.
+	maxQueryBytes = 1 << 30
+)
+
+var errQueryTooLarge = fmt.Errorf("query read more than %d bytes of series from other nodes; select fewer series or a shorter time range", maxQueryBytes)
+
+var (
+	httpClient = &http.Client{
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{
+				DualStack: true,
+				KeepAlive: 10 * time.Minute,
+				Timeout:   2 * time.Second,
+			}).DialContext,
+			ExpectContinueTimeout: 5 * time.Second,
+			IdleConnTimeout:       10 * time.Minute,
+			ResponseHeaderTimeout: 5 * time.Second,
+		}}
+
+	failedQueries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "timbala",
+			Subsystem: "fanout",
+			Name:      "failed_queries_total",
+			Help:      "Total number of queries to each node that failed, causing results to be omitted from the query response",
+		},
+		[]string{"node"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(failedQueries)
+}
 
 type fanoutStorage struct {
-	clstr      cluster.Cluster
-	localStore storage.Storage
-	log        *logrus.Logger
+	clstr       cluster.Cluster
+	engine      *promql.Engine
+	localLabels read.LabelQuerier
+	localStore  storage.Storage
+	log         *logrus.Logger
+	repairer    *readRepairer
+
+	mu sync.Mutex
+	// unsettledUntil is the time until which reads are sent to all
+	// replicas following a change in cluster membership
+	unsettledUntil time.Time
 }
 
-func New(c cluster.Cluster, l *logrus.Logger, s storage.Storage) *fanoutStorage {
+// New returns a storage.Storage that queries every node in the cluster. The
+// given engine evaluates pushed-down aggregations over the local storage.
+func New(c cluster.Cluster, l *logrus.Logger, s storage.Storage, lq read.LabelQuerier, e *promql.Engine) *fanoutStorage {
 	return &fanoutStorage{
-		clstr:      c,
-		localStore: s,
-		log:        l,
+		clstr:       c,
+		engine:      e,
+		localLabels: lq,
+		localStore:  s,
+		log:         l,
+		repairer:    newReadRepairer(c, l),
+
+		unsettledUntil: time.Now().Add(membershipSettleTime),
 	}
 }
 
@@ -53,7 +113,14 @@ func (f *fanoutStorage) Querier(ctx context.Context, mint int64, maxt int64) (st
 	if err != nil {
 		return nil, err
 	}
-	queriers := append([]storage.Querier{}, localQuerier)
+	budget := &readBudget{remaining: maxQueryBytes}
+	queriers := map[string]nodeQuerier{
+		f.clstr.LocalNode().Name(): localNodeQuerier{
+			Querier: localQuerier,
+			clstr:   f.clstr,
+			labels:  f.localLabels,
+		},
+	}
 
 	// FIXME handle cluster node membership changes
 	for _, n := range f.clstr.Nodes() {
@@ -66,16 +133,30 @@ func (f *fanoutStorage) Querier(ctx context.Context, mint int64, maxt int64) (st
 			return nil, err
 		}
 
-		queriers = append(queriers, remoteQuerier{
-			ctx:  ctx,
-			maxt: maxt,
-			mint: mint,
+		queriers[n.Name()] = &remoteQuerier{
+			budget: budget,
+			ctx:    ctx,
+			maxt:   maxt,
+			mint:   mint,
 			// FIXME handle HTTPS
-			url: "http://" + httpAddr + read.Route,
-		})
+			baseURL: "http://" + httpAddr,
+		}
 	}
 
-	return storage.NewMergeQuerier(queriers), nil
+	return &fanoutQuerier{
+		budget:         budget,
+		clstr:          f.clstr,
+		ctx:            ctx,
+		log:            f.log,
+		maxt:           maxt,
+		mint:           mint,
+		preferReplicas: f.preferReplicas(),
+		queriers:       queriers,
+		replFactor:     f.clstr.ReplicationFactor(),
+		repairer:       f.repairer,
+		selectors:      selectors.FromContext(ctx),
+		settled:        f.settled(),
+	}, nil
 }
 
 func (f *fanoutStorage) Appender() (storage.Appender, error) {
@@ -90,57 +171,600 @@ func (f *fanoutStorage) Close() error {
 	return nil
 }
 
+// fanoutQuerier merges the results of querying each node in the cluster.
+//
+// Usually, each node returns only the samples for which it is the preferred
+// replica. Some queries instead read from every replica, checking the results
+// for inconsistencies between replicas along the way.
+//
+// If the selectors of the PromQL expression being evaluated are known, the
+// series for all of them are fetched from each node in a single request when
+// the first selector is queried.
+//
+// If the cluster partitions by metric name, selectors that select a single
+// metric name are sent only to the nodes holding its partition keys.
+type fanoutQuerier struct {
+	budget         *readBudget
+	clstr          cluster.Cluster
+	ctx            context.Context
+	log            *logrus.Logger
+	mint, maxt     int64
+	preferReplicas bool
+	queriers       map[string]nodeQuerier
+	replFactor     int
+	repairer       *readRepairer
+	selectors      [][]*labels.Matcher
+	settled        bool
+
+	prefetchOnce sync.Once
+	// prefetched holds the series sets returned by each node for each
+	// selector, keyed by the selector's key
+	prefetched       map[string]map[string][]storage.SeriesSet
+	prefetchedFailed map[string]error
+
+	repairMu sync.Mutex
+	// repairing is the number of read repairs still comparing the series
+	// read by the querier, and closing is true if the querier should be
+	// closed once they have finished
+	repairing int
+	closing   bool
+}
+
+// nodeQuerier queries a single node.
+type nodeQuerier interface {
+	storage.Querier
+
+	// selectBatch returns a series set, sorted by labels, for each of the
+	// given selectors. The sets are read lazily and can only be iterated
+	// over once. If excluded is not nil, the node returns only the samples
+	// for which it is the preferred replica, disregarding the excluded
+	// nodes.
+	selectBatch(excluded map[string]bool, sels [][]*labels.Matcher) ([]storage.SeriesSet, error)
+	labelNames(mint, maxt int64) ([]string, error)
+	tsdbStatus(limit int) (*cardinality.TSDBStatus, error)
+}
+
+// Select returns the series matching the given matchers from all nodes.
+// Nodes that fail to respond are reported as warnings rather than failing the
+// query, since other replicas hold the same data. The query only fails if no
+// nodes respond, or if a node fails after it has started to respond.
+//
+// Queries that read from every replica check the results for inconsistencies
+// between replicas once the returned series set has been read in full.
+func (q *fanoutQuerier) Select(matchers ...*labels.Matcher) (storage.SeriesSet, error) {
+	q.prefetchOnce.Do(q.prefetch)
+
+	// Prefetched series sets can only be read once, so selecting the same
+	// series again fetches them anew
+	key := selectors.Key(matchers)
+	results, ok := q.prefetched[key]
+	failed := q.prefetchedFailed
+	if ok {
+		delete(q.prefetched, key)
+	} else {
+		var batch []map[string][]storage.SeriesSet
+		batch, failed = q.fetch([][]*labels.Matcher{matchers})
+		results = batch[0]
+	}
+	if q.budget.exceeded() {
+		return nil, errQueryTooLarge
+	}
+
+	if len(results) == 0 {
+		for name, err := range failed {
+			return nil, fmt.Errorf("no nodes responded to query; %s: %s", name, err)
+		}
+	}
+
+	set := newMergeSeriesSet(results)
+	if !q.preferReplicas {
+		set.repair = q.repair
+	}
+	return set, nil
+}
+
+// repair queues the series read from each node to be compared in the
+// background. The queriers stay open until they have been compared, so that
+// the series can still be read.
+func (q *fanoutQuerier) repair(results map[string][]storage.Series) {
+	q.repairMu.Lock()
+	q.repairing++
+	q.repairMu.Unlock()
+
+	q.repairer.repair(q.budget, results, func() {
+		q.repairMu.Lock()
+		q.repairing--
+		closing := q.closing && q.repairing == 0
+		q.repairMu.Unlock()
+
+		if closing {
+			if err := q.close(); err != nil {
+				q.log.Debugf("Error closing querier after read repair: %s", err)
+			}
+		}
+	})
+}
+
+// prefetch fetches the series for every selector of the PromQL expression
+// being evaluated, if they are known.
+func (q *fanoutQuerier) prefetch() {
+	if len(q.selectors) == 0 {
+		return
+	}
+
+	batch, failed := q.fetch(q.selectors)
+	q.prefetched = make(map[string]map[string][]storage.SeriesSet, len(q.selectors))
+	for i, sel := range q.selectors {
+		q.prefetched[selectors.Key(sel)] = batch[i]
+	}
+	q.prefetchedFailed = failed
+}
+
+// fetch sends one request to each node for all of the given selectors,
+// returning the series sets from each node for each selector and the errors
+// for any nodes that failed to respond.
+func (q *fanoutQuerier) fetch(sels [][]*labels.Matcher) ([]map[string][]storage.SeriesSet, map[string]error) {
+	var results []map[string][]storage.SeriesSet
+	var failed map[string]error
+	pKeys := q.partitionKeys(sels)
+	if q.preferReplicas {
+		results, failed = q.selectPreferred(sels, pKeys)
+	} else {
+		results, failed = q.selectAll(sels, pKeys)
+	}
+	if q.budget.exceeded() {
+		// The query fails, so there is no need to warn that the
+		// results may be incomplete
+		return results, failed
+	}
+
+	q.warnFailed(failed)
+	return results, failed
+}
+
+// partitionKeys returns the partition keys of the series matching the given
+// selectors, or nil if they cannot be known and every node must be queried.
+// They are known only if the cluster partitions by metric name, every selector
+// selects a single metric name, and cluster membership has settled so that
+// each partition key is held by the nodes it is assigned to.
+func (q *fanoutQuerier) partitionKeys(sels [][]*labels.Matcher) []uint64 {
+	if !q.settled || q.clstr.PartitionBy() != cluster.PartitionByMetricName {
+		return nil
+	}
+	if q.maxt-q.mint > int64(maxRoutedRange/time.Millisecond) {
+		return nil
+	}
+
+	var pKeys []uint64
+	for _, sel := range sels {
+		name := metricName(sel)
+		if name == "" {
+			return nil
+		}
+		pKeys = append(pKeys, q.clstr.KeyVersion().PartitionKeys(q.mint, q.maxt, cluster.MetricNameHash(name))...)
+	}
+	return pKeys
+}
+
+// metricName returns the metric name selected by the given matchers, or an
+// empty string if they do not select a single metric name.
+func metricName(matchers []*labels.Matcher) string {
+	for _, m := range matchers {
+		if m.Name == labels.MetricName && m.Type == labels.MatchEqual {
+			return m.Value
+		}
+	}
+	return ""
+}
+
+// skipped returns the nodes that need not be queried for the given partition
+// keys, in addition to the excluded nodes. If all is true, every replica of
+// each partition key is queried; otherwise only its preferred replica,
+// disregarding the excluded nodes. If pKeys is nil, only the excluded nodes
+// are skipped.
+func (q *fanoutQuerier) skipped(pKeys []uint64, all bool, excluded map[string]bool) map[string]bool {
+	skipped := make(map[string]bool, len(q.queriers))
+	for name := range excluded {
+		skipped[name] = true
+	}
+	if pKeys == nil {
+		return skipped
+	}
+
+	wanted := make(map[string]bool)
+	for _, pKey := range pKeys {
+		if !all {
+			wanted[read.PreferredReplica(q.clstr, pKey, excluded)] = true
+			continue
+		}
+		for _, n := range q.clstr.NodesByPartitionKey(pKey) {
+			wanted[n.Name()] = true
+		}
+	}
+	for name := range q.queriers {
+		if !wanted[name] {
+			skipped[name] = true
+		}
+	}
+	return skipped
+}
+
+// selectAll reads all matching series from every replica of the given
+// partition keys, or from every node if pKeys is nil.
+func (q *fanoutQuerier) selectAll(sels [][]*labels.Matcher, pKeys []uint64) ([]map[string][]storage.SeriesSet, map[string]error) {
+	results := make([]map[string][]storage.SeriesSet, len(sels))
+	for i := range results {
+		results[i] = make(map[string][]storage.SeriesSet, len(q.queriers))
+	}
+	var mu sync.Mutex
+	failed := q.each(q.skipped(pKeys, true, nil), func(name string, querier nodeQuerier) error {
+		sets, err := querier.selectBatch(nil, sels)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for i, set := range sets {
+			results[i][name] = []storage.SeriesSet{set}
+		}
+		return nil
+	})
+	return results, failed
+}
+
+// each calls fn concurrently for each node that is not excluded, so that a
+// slow node does not delay querying the others, and returns the errors for
+// the nodes that failed once every call has returned.
+func (q *fanoutQuerier) each(excluded map[string]bool, fn func(name string, querier nodeQuerier) error) map[string]error {
+	var (
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		failed = make(map[string]error)
+	)
+	for name, querier := range q.queriers {
+		if excluded[name] {
+			continue
+		}
+
+		wg.Add(1)
+		go func(name string, querier nodeQuerier) {
+			defer wg.Done()
+			if err := fn(name, querier); err != nil {
+				mu.Lock()
+				failed[name] = err
+				mu.Unlock()
+			}
+		}(name, querier)
+	}
+	wg.Wait()
+	return failed
+}
+
+// warnFailed records a warning for each node that failed to respond. Every
+// partition key has replicas on replFactor distinct nodes, so results are
+// only known to be complete if fewer nodes than that failed.
+func (q *fanoutQuerier) warnFailed(failed map[string]error) {
+	if len(failed) == 0 {
+		return
+	}
+
+	names := make([]string, 0, len(failed))
+	for name := range failed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		q.log.Warningf("Node %s failed to respond to query: %s", name, failed[name])
+		failedQueries.WithLabelValues(name).Inc()
+		warnings.Add(q.ctx, fmt.Sprintf("node %s did not respond: %s", name, failed[name]))
+	}
+	if len(failed) >= q.replFactor {
+		warnings.Add(q.ctx, fmt.Sprintf("results may be incomplete: %d nodes did not respond and the replication factor is %d", len(failed), q.replFactor))
+	}
+}
+
+// LabelValues returns the values of the given label held by any node.
+func (q *fanoutQuerier) LabelValues(name string) ([]string, error) {
+	return q.mergeLabels(func(nq nodeQuerier) ([]string, error) {
+		return nq.LabelValues(name)
+	})
+}
+
+// LabelNames returns the names of the labels held by any node in the blocks
+// overlapping the querier's time range.
+func (q *fanoutQuerier) LabelNames() ([]string, error) {
+	return q.mergeLabels(func(nq nodeQuerier) ([]string, error) {
+		return nq.labelNames(q.mint, q.maxt)
+	})
+}
+
+// TSDBStatus summarises the series held in the head block of every node. The
+// series counts are divided by the number of replicas holding each series.
+func (q *fanoutQuerier) TSDBStatus(limit int) (*cardinality.TSDBStatus, error) {
+	// Ask each node for more entries than needed, so that entries with
+	// many series across the cluster are unlikely to be missed
+	nodeLimit := limit * statusLimitFactor
+
+	var (
+		mu       sync.Mutex
+		statuses []*cardinality.TSDBStatus
+	)
+	failed := q.each(nil, func(_ string, querier nodeQuerier) error {
+		s, err := querier.tsdbStatus(nodeLimit)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		statuses = append(statuses, s)
+		mu.Unlock()
+		return nil
+	})
+
+	if len(failed) == len(q.queriers) {
+		for name, err := range failed {
+			return nil, fmt.Errorf("no nodes responded to query; %s: %s", name, err)
+		}
+	}
+	q.warnFailed(failed)
+
+	replicas := q.replFactor
+	if len(q.queriers) < replicas {
+		replicas = len(q.queriers)
+	}
+	return cardinality.Merge(statuses, replicas, limit), nil
+}
+
+// mergeLabels returns the sorted union of the strings returned by each node.
+// Like Select, it only fails if no nodes respond.
+func (q *fanoutQuerier) mergeLabels(get func(nodeQuerier) ([]string, error)) ([]string, error) {
+	var mu sync.Mutex
+	set := make(map[string]struct{})
+	failed := q.each(nil, func(_ string, querier nodeQuerier) error {
+		values, err := get(querier)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, v := range values {
+			set[v] = struct{}{}
+		}
+		return nil
+	})
+
+	if len(failed) == len(q.queriers) {
+		for name, err := range failed {
+			return nil, fmt.Errorf("no nodes responded to query; %s: %s", name, err)
+		}
+	}
+	q.warnFailed(failed)
+
+	merged := make([]string, 0, len(set))
+	for v := range set {
+		merged = append(merged, v)
+	}
+	sort.Strings(merged)
+	return merged, nil
+}
+
+// Close closes the querier for each node, or marks them to be closed once any
+// read repairs comparing their series have finished.
+func (q *fanoutQuerier) Close() error {
+	q.repairMu.Lock()
+	if q.repairing > 0 {
+		q.closing = true
+		q.repairMu.Unlock()
+		return nil
+	}
+	q.repairMu.Unlock()
+	return q.close()
+}
+
+func (q *fanoutQuerier) close() error {
+	return storage.NewMergeQuerier(q.querierList()).Close()
+}
+
+func (q *fanoutQuerier) querierList() []storage.Querier {
+	queriers := make([]storage.Querier, 0, len(q.queriers))
+	for _, querier := range q.queriers {
+		queriers = append(queriers, querier)
+	}
+	return queriers
+}
+
+// localNodeQuerier queries the local node's storage.
+type localNodeQuerier struct {
+	storage.Querier
+	clstr  cluster.Cluster
+	labels read.LabelQuerier
+}
+
+func (q localNodeQuerier) LabelValues(name string) ([]string, error) {
+	return q.labels.LabelValues(name)
+}
+
+func (q localNodeQuerier) labelNames(mint, maxt int64) ([]string, error) {
+	return q.labels.LabelNames(mint, maxt)
+}
+
+func (q localNodeQuerier) tsdbStatus(limit int) (*cardinality.TSDBStatus, error) {
+	return q.labels.TSDBStatus(limit)
+}
+
+func (q localNodeQuerier) selectBatch(excluded map[string]bool, sels [][]*labels.Matcher) ([]storage.SeriesSet, error) {
+	sets := make([]storage.SeriesSet, len(sels))
+	for i, sel := range sels {
+		set, err := q.Select(sel...)
+		if err != nil {
+			return nil, err
+		}
+		if excluded != nil {
+			set = read.FilterPreferred(set, q.clstr, q.clstr.LocalNode().Name(), excluded)
+		}
+		sets[i] = set
+	}
+	return sets, nil
+}
+
 type remoteQuerier struct {
+	budget     *readBudget
 	ctx        context.Context
 	mint, maxt int64
-	url        string
+	baseURL    string
+
+	mu sync.Mutex
+	// responses holds the streamed responses that may not have been read
+	// in full, which are closed along with the querier
+	responses []*streamedResponse
 }
 
-func (q remoteQuerier) Select(matchers ...*labels.Matcher) (storage.SeriesSet, error) {
-	protoMatchers, err := toLabelMatchers(matchers)
-	if err != nil {
-		return nil, err
+// readBudget is the number of bytes that may still be read from other nodes
+// for a query, shared by the queriers for each node. Read repair also reserves
+// part of the budget for the samples it decodes while comparing replicas.
+type readBudget struct {
+	remaining int64
+}
+
+// exceeded returns true if more than the budgeted number of bytes were read.
+// A nil budget is never exceeded.
+func (b *readBudget) exceeded() bool {
+	return b != nil && atomic.LoadInt64(&b.remaining) < 0
+}
+
+// reserve takes n bytes from the budget, returning false without taking any if
+// fewer than n bytes remain, so that a reservation never exceeds the budget.
+// A nil budget always has room.
+func (b *readBudget) reserve(n int64) bool {
+	if b == nil {
+		return true
+	}
+	for {
+		remaining := atomic.LoadInt64(&b.remaining)
+		if remaining < n {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&b.remaining, remaining, remaining-n) {
+			return true
+		}
+	}
+}
+
+// release returns n reserved bytes to the budget.
+func (b *readBudget) release(n int64) {
+	if b != nil {
+		atomic.AddInt64(&b.remaining, n)
 	}
+}
+
+// budgetReader reads from r, failing once the budget has been exceeded.
+type budgetReader struct {
+	r      io.Reader
+	budget *readBudget
+}
+
+func (br budgetReader) Read(p []byte) (int, error) {
+	n, err := br.r.Read(p)
+	if br.budget != nil && atomic.AddInt64(&br.budget.remaining, -int64(n)) < 0 {
+		return n, errQueryTooLarge
+	}
+	return n, err
+}
 
-	res, err := q.remoteRead(protoMatchers)
-	// FIXME: Don't fail if just one node fails to respond
+func (q *remoteQuerier) Select(matchers ...*labels.Matcher) (storage.SeriesSet, error) {
+	sets, err := q.selectBatch(nil, [][]*labels.Matcher{matchers})
 	if err != nil {
 		return nil, err
 	}
+	return sets[0], nil
+}
 
-	series := make([]storage.Series, 0, len(res))
-	for _, ts := range res {
-		labels := labelPairsToLabels(ts.Labels)
-		series = append(series, &concreteSeries{
-			labels:  labels,
-			samples: ts.Samples,
+func (q *remoteQuerier) selectBatch(excluded map[string]bool, sels [][]*labels.Matcher) ([]storage.SeriesSet, error) {
+	queries := make([]*prompb.Query, 0, len(sels))
+	for _, sel := range sels {
+		protoMatchers, err := toLabelMatchers(sel)
+		if err != nil {
+			return nil, err
+		}
+		queries = append(queries, &prompb.Query{
+			StartTimestampMs: q.mint,
+			EndTimestampMs:   q.maxt,
+			Matchers:         protoMatchers,
 		})
 	}
-	sort.Sort(byLabel(series))
-	return &concreteSeriesSet{
-		series: series,
-	}, nil
+	return q.remoteRead(queries, excluded)
 }
 
-func (_ remoteQuerier) LabelValues(name string) ([]string, error) {
-	panic("not implemented")
+func (q *remoteQuerier) LabelValues(name string) ([]string, error) {
+	var values []string
+	err := q.getJSON(read.LabelValuesRoute+"?"+url.Values{"name": {name}}.Encode(), &values)
+	return values, err
 }
 
-func (_ remoteQuerier) Close() error {
-	// Nothing to do
+func (q *remoteQuerier) labelNames(mint, maxt int64) ([]string, error) {
+	var names []string
+	params := url.Values{
+		"start": {strconv.FormatInt(mint, 10)},
+		"end":   {strconv.FormatInt(maxt, 10)},
+	}
+	err := q.getJSON(read.LabelNamesRoute+"?"+params.Encode(), &names)
+	return names, err
+}
+
+func (q *remoteQuerier) tsdbStatus(limit int) (*cardinality.TSDBStatus, error) {
+	var s cardinality.TSDBStatus
+	if err := q.getJSON(read.TSDBStatusRoute+"?limit="+strconv.Itoa(limit), &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// getJSON requests the given path from the node, decoding the JSON response
+// into v.
+func (q *remoteQuerier) getJSON(path string, v interface{}) error {
+	httpReq, err := http.NewRequest("GET", q.baseURL+path, nil)
+	if err != nil {
+		return fmt.Errorf("unable to create request: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(q.ctx, readTimeoutSeconds)
+	defer cancel()
+
+	httpResp, err := ctxhttp.Do(ctx, httpClient, httpReq)
+	if err != nil {
+		return fmt.Errorf("error sending request: %v", err)
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode/100 != 2 {
+		return fmt.Errorf("server returned HTTP status %s", httpResp.Status)
+	}
+
+	if err := json.NewDecoder(httpResp.Body).Decode(v); err != nil {
+		return fmt.Errorf("unable to unmarshal response body: %v", err)
+	}
 	return nil
 }
 
-func (q remoteQuerier) remoteRead(matchers []*prompb.LabelMatcher) ([]*prompb.TimeSeries, error) {
-	req := &prompb.ReadRequest{
-		// FIXME: Support batching multiple queries into one read
-		// request, as the protobuf interface allows for it.
-		Queries: []*prompb.Query{{
-			StartTimestampMs: q.mint,
-			EndTimestampMs:   q.maxt,
-			Matchers:         matchers,
-		}},
+// Close stops reading any streamed responses that have not been read in full.
+func (q *remoteQuerier) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, resp := range q.responses {
+		resp.close()
 	}
+	q.responses = nil
+	return nil
+}
+
+// remoteRead sends the given queries to the node in a single read request,
+// returning a series set for each query. Unless the node does not support
+// streamed reads, the response is streamed: each frame is read when a series
+// set reaches it, and each series' chunks are decoded as the series is
+// iterated over. The query engine holds the series in memory until the query
+// has been evaluated, so reading fails once the responses for the query exceed
+// its budget.
+func (q *remoteQuerier) remoteRead(queries []*prompb.Query, excluded map[string]bool) ([]storage.SeriesSet, error) {
+	req := &prompb.ReadRequest{Queries: queries}
 
 	data, err := req.Marshal()
 	if err != nil {
@@ -148,7 +772,7 @@ func (q remoteQuerier) remoteRead(matchers []*prompb.LabelMatcher) ([]*prompb.Ti
 	}
 
 	compressed := snappy.Encode(nil, data)
-	httpReq, err := http.NewRequest("POST", q.url, bytes.NewReader(compressed))
+	httpReq, err := http.NewRequest("POST", q.baseURL+read.Route, bytes.NewReader(compressed))
 	if err != nil {
 		return nil, fmt.Errorf("unable to create request: %v", err)
 	}
@@ -156,24 +780,57 @@ func (q remoteQuerier) remoteRead(matchers []*prompb.LabelMatcher) ([]*prompb.Ti
 	httpReq.Header.Set("Content-Type", "application/x-protobuf")
 	httpReq.Header.Set(read.HTTPHeaderRemoteRead, read.HTTPHeaderRemoteReadVersion)
 	httpReq.Header.Set(read.HTTPHeaderInternalRead, read.HTTPHeaderInternalReadVersion)
+	httpReq.Header.Set(read.HTTPHeaderStreamedRead, read.HTTPHeaderStreamedReadVersion)
+	if excluded != nil {
+		httpReq.Header.Set(read.HTTPHeaderPreferredReplica, read.FormatExcluded(excluded))
+	}
 
 	ctx, cancel := context.WithTimeout(q.ctx, readTimeoutSeconds)
-	defer cancel()
-
 	httpResp, err := ctxhttp.Do(ctx, httpClient, httpReq)
 	if err != nil {
+		cancel()
 		return nil, fmt.Errorf("error sending request: %v", err)
 	}
-	defer httpResp.Body.Close()
 	if httpResp.StatusCode/100 != 2 {
+		httpResp.Body.Close()
+		cancel()
 		return nil, fmt.Errorf("server returned HTTP status %s", httpResp.Status)
 	}
 
-	compressed, err = ioutil.ReadAll(httpResp.Body)
+	body := budgetReader{r: httpResp.Body, budget: q.budget}
+	if httpResp.Header.Get("Content-Type") == read.StreamedReadContentType {
+		resp := &streamedResponse{
+			body:    httpResp.Body,
+			budget:  q.budget,
+			cancel:  cancel,
+			pending: make([][]storage.Series, len(queries)),
+			sr:      read.NewStreamReader(body),
+		}
+		q.mu.Lock()
+		q.responses = append(q.responses, resp)
+		q.mu.Unlock()
+
+		sets := make([]storage.SeriesSet, len(queries))
+		for i := range sets {
+			sets[i] = &streamSeriesSet{resp: resp, query: i}
+		}
+		return sets, nil
+	}
+	defer cancel()
+	defer httpResp.Body.Close()
+
+	compressed, err = ioutil.ReadAll(body)
 	if err != nil {
 		return nil, fmt.Errorf("error reading response: %v", err)
 	}
 
+	// Samples are held uncompressed when the node does not support
+	// streamed reads
+	if n, err := snappy.DecodedLen(compressed); err == nil && q.budget != nil {
+		if atomic.AddInt64(&q.budget.remaining, -int64(n-len(compressed))) < 0 {
+			return nil, errQueryTooLarge
+		}
+	}
 	uncompressed, err := snappy.Decode(nil, compressed)
 	if err != nil {
 		return nil, fmt.Errorf("error reading response: %v", err)
@@ -189,7 +846,119 @@ func (q remoteQuerier) remoteRead(matchers []*prompb.LabelMatcher) ([]*prompb.Ti
 		return nil, fmt.Errorf("responses: want %d, got %d", len(req.Queries), len(resp.Results))
 	}
 
-	return resp.Results[0].Timeseries, nil
+	sets := make([]storage.SeriesSet, len(resp.Results))
+	for i, res := range resp.Results {
+		series := make([]storage.Series, 0, len(res.Timeseries))
+		for _, ts := range res.Timeseries {
+			series = append(series, &concreteSeries{
+				labels:  labelPairsToLabels(ts.Labels),
+				samples: ts.Samples,
+			})
+		}
+		sort.Sort(byLabel(series))
+		sets[i] = &concreteSeriesSet{series: series}
+	}
+	return sets, nil
+}
+
+// streamedResponse reads the series for each query from a streamed read
+// response. Frames are only read as the series set for a query is iterated
+// over; the series read along the way for other queries, whose frames are
+// interleaved with those of the query, are held until their series sets reach
+// them.
+type streamedResponse struct {
+	body   io.Closer
+	budget *readBudget
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	done    bool
+	err     error
+	pending [][]storage.Series
+	sr      *read.StreamReader
+}
+
+// next returns the next series for the given query, returning false once the
+// response has been read in full or reading it has failed.
+func (r *streamedResponse) next(query int) (storage.Series, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if pending := r.pending[query]; len(pending) > 0 {
+		s := pending[0]
+		pending[0] = nil
+		r.pending[query] = pending[1:]
+		return s, true
+	}
+
+	for !r.done {
+		if !r.sr.Next() {
+			if err := r.sr.Err(); err != nil {
+				r.err = fmt.Errorf("error reading response: %v", err)
+			}
+			r.closeLocked()
+			break
+		}
+
+		i, s := r.sr.At()
+		if i >= len(r.pending) {
+			r.err = fmt.Errorf("response for query %d, but only %d queries were sent", i, len(r.pending))
+			r.closeLocked()
+			break
+		}
+		if i == query {
+			return s, true
+		}
+		r.pending[i] = append(r.pending[i], s)
+	}
+	return nil, false
+}
+
+func (r *streamedResponse) Err() error {
+	if r.budget.exceeded() {
+		return errQueryTooLarge
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// close stops reading the response, releasing its connection.
+func (r *streamedResponse) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closeLocked()
+}
+
+func (r *streamedResponse) closeLocked() {
+	if r.done {
+		return
+	}
+	r.done = true
+	r.body.Close()
+	r.cancel()
+}
+
+// streamSeriesSet implements storage.SeriesSet, reading the series for a
+// single query from a streamed response.
+type streamSeriesSet struct {
+	resp  *streamedResponse
+	query int
+	cur   storage.Series
+}
+
+func (s *streamSeriesSet) Next() bool {
+	var ok bool
+	s.cur, ok = s.resp.next(s.query)
+	return ok
+}
+
+func (s *streamSeriesSet) At() storage.Series {
+	return s.cur
+}
+
+func (s *streamSeriesSet) Err() error {
+	return s.resp.Err()
 }
 
 func labelPairsToLabels(labelPairs []*prompb.Label) labels.Labels {
@@ -204,6 +973,17 @@ func labelPairsToLabels(labelPairs []*prompb.Label) labels.Labels {
 	return result
 }
 
+func labelsToLabelPairs(lbls labels.Labels) []*prompb.Label {
+	result := make([]*prompb.Label, 0, len(lbls))
+	for _, l := range lbls {
+		result = append(result, &prompb.Label{
+			Name:  l.Name,
+			Value: l.Value,
+		})
+	}
+	return result
+}
+
 // concreteSeriesSet implements storage.SeriesSet.
 type concreteSeriesSet struct {
 	cur    int
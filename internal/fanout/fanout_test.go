@@ -0,0 +1,365 @@
+package fanout
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/mattbostock/timbala/internal/cardinality"
+	"github.com/mattbostock/timbala/internal/cluster"
+	"github.com/mattbostock/timbala/internal/read"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/storage"
+	promtsdb "github.com/prometheus/prometheus/storage/tsdb"
+	"github.com/prometheus/tsdb"
+	tsdbLabels "github.com/prometheus/tsdb/labels"
+	"github.com/sirupsen/logrus"
+)
+
+// blockingQuerier is a node that responds to queries once it is released,
+// reporting each query it receives.
+type blockingQuerier struct {
+	storage.Querier
+	queried chan<- struct{}
+	release <-chan struct{}
+}
+
+func (q blockingQuerier) wait() {
+	q.queried <- struct{}{}
+	if q.release != nil {
+		<-q.release
+	}
+}
+
+func (q blockingQuerier) selectBatch(_ map[string]bool, sels [][]*labels.Matcher) ([]storage.SeriesSet, error) {
+	q.wait()
+	return emptySets(len(sels)), nil
+}
+
+func emptySets(n int) []storage.SeriesSet {
+	sets := make([]storage.SeriesSet, n)
+	for i := range sets {
+		sets[i] = storage.NoopSeriesSet()
+	}
+	return sets
+}
+
+func (q blockingQuerier) labelNames(int64, int64) ([]string, error) {
+	q.wait()
+	return nil, nil
+}
+
+func (q blockingQuerier) tsdbStatus(int) (*cardinality.TSDBStatus, error) {
+	q.wait()
+	return &cardinality.TSDBStatus{}, nil
+}
+
+func TestSlowNodeDoesNotDelayOthers(t *testing.T) {
+	m, err := labels.NewMatcher(labels.MatchEqual, labels.MetricName, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sels := [][]*labels.Matcher{{m}}
+
+	var tests = map[string]func(q *fanoutQuerier){
+		"all replicas": func(q *fanoutQuerier) {
+			q.selectAll(sels, nil)
+		},
+		"preferred replicas": func(q *fanoutQuerier) {
+			q.selectPreferred(sels, nil)
+		},
+		"label names": func(q *fanoutQuerier) {
+			q.LabelNames()
+		},
+	}
+
+	for name, query := range tests {
+		queried := make(chan struct{}, 3)
+		release := make(chan struct{})
+		q := &fanoutQuerier{
+			queriers: map[string]nodeQuerier{
+				"slow":  blockingQuerier{queried: queried, release: release},
+				"fast1": blockingQuerier{queried: queried},
+				"fast2": blockingQuerier{queried: queried},
+			},
+			replFactor: 3,
+		}
+
+		done := make(chan struct{})
+		go func() {
+			query(q)
+			close(done)
+		}()
+
+		// Every node is queried while the slow node has yet to respond
+		for i := 0; i < len(q.queriers); i++ {
+			select {
+			case <-queried:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s: expected every node to be queried while the slow node is responding, %d were", name, i)
+			}
+		}
+		select {
+		case <-done:
+			t.Fatalf("%s: expected query to wait for the slow node", name)
+		default:
+		}
+
+		close(release)
+		<-done
+	}
+}
+
+// recordingQuerier is a node that reports the name of the node each time it
+// is queried, failing if err is set.
+type recordingQuerier struct {
+	storage.Querier
+	name    string
+	queried chan<- string
+	err     error
+}
+
+func (q recordingQuerier) selectBatch(_ map[string]bool, sels [][]*labels.Matcher) ([]storage.SeriesSet, error) {
+	q.queried <- q.name
+	return emptySets(len(sels)), q.err
+}
+
+func (q recordingQuerier) labelNames(int64, int64) ([]string, error) {
+	return nil, nil
+}
+
+func (q recordingQuerier) tsdbStatus(int) (*cardinality.TSDBStatus, error) {
+	return &cardinality.TSDBStatus{}, nil
+}
+
+func TestSelectRoutedByMetricName(t *testing.T) {
+	clstr := cluster.NewStatic(logrus.New(), "a", "127.0.0.1:0", 0, 2)
+	for i, name := range []string{"b", "c", "d", "e"} {
+		clstr.Join(name, "127.0.0.1:0", i+1)
+	}
+	clstr.SetPartitionBy(cluster.PartitionByMetricName)
+
+	day := time.Date(2018, 3, 14, 0, 0, 0, 0, time.Local)
+	mint := timestamp.FromTime(day.Add(time.Hour))
+	maxt := timestamp.FromTime(day.Add(2 * time.Hour))
+	replicas := clstr.NodesByPartitionKey(cluster.PartitionKey(day, cluster.MetricNameHash("foo")))
+
+	byName, err := labels.NewMatcher(labels.MatchEqual, labels.MetricName, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	byJob, err := labels.NewMatcher(labels.MatchEqual, "job", "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// query returns the nodes queried for the given selector
+	query := func(sel []*labels.Matcher, preferReplicas, settled bool, failing string) map[string]bool {
+		queried := make(chan string, 10)
+		q := &fanoutQuerier{
+			clstr:          clstr,
+			ctx:            context.Background(),
+			log:            logrus.New(),
+			maxt:           maxt,
+			mint:           mint,
+			preferReplicas: preferReplicas,
+			queriers:       make(map[string]nodeQuerier),
+			replFactor:     2,
+			repairer:       newReadRepairer(clstr, logrus.New()),
+			settled:        settled,
+		}
+		for _, n := range clstr.Nodes() {
+			rq := recordingQuerier{name: n.Name(), queried: queried}
+			if n.Name() == failing {
+				rq.err = errors.New("unavailable")
+			}
+			q.queriers[n.Name()] = rq
+		}
+		q.fetch([][]*labels.Matcher{sel})
+		close(queried)
+
+		names := make(map[string]bool)
+		for name := range queried {
+			names[name] = true
+		}
+		return names
+	}
+
+	// Only the preferred replica is queried
+	if queried := query([]*labels.Matcher{byName}, true, true, ""); len(queried) != 1 || !queried[replicas[0].Name()] {
+		t.Fatalf("Expected only %s to be queried, got %v", replicas[0], queried)
+	}
+	// The next replica is queried if the preferred replica fails
+	if queried := query([]*labels.Matcher{byName}, true, true, replicas[0].Name()); len(queried) != 2 || !queried[replicas[1].Name()] {
+		t.Fatalf("Expected %s to be queried after %s failed, got %v", replicas[1], replicas[0], queried)
+	}
+	// Every replica is queried when reading from all replicas
+	if queried := query([]*labels.Matcher{byName}, false, true, ""); len(queried) != len(replicas) {
+		t.Fatalf("Expected only the %d replicas to be queried, got %v", len(replicas), queried)
+	}
+	// Every node is queried if the metric name is not known, or the
+	// data may not yet be held by its replicas
+	if queried := query([]*labels.Matcher{byJob}, true, true, ""); len(queried) != len(clstr.Nodes()) {
+		t.Fatalf("Expected every node to be queried without a metric name, got %v", queried)
+	}
+	if queried := query([]*labels.Matcher{byName}, false, false, ""); len(queried) != len(clstr.Nodes()) {
+		t.Fatalf("Expected every node to be queried while membership is unsettled, got %v", queried)
+	}
+}
+
+func TestQueryReadingTooMuchFails(t *testing.T) {
+	resp := &prompb.ReadResponse{Results: []*prompb.QueryResult{{
+		Timeseries: []*prompb.TimeSeries{{
+			Labels:  []*prompb.Label{{Name: "__name__", Value: "foo"}},
+			Samples: make([]*prompb.Sample, 1000),
+		}},
+	}}}
+	for i := range resp.Results[0].Timeseries[0].Samples {
+		resp.Results[0].Timeseries[0].Samples[i] = &prompb.Sample{Timestamp: int64(i), Value: float64(i)}
+	}
+	data, err := resp.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(snappy.Encode(nil, data))
+	}))
+	defer srv.Close()
+
+	m, err := labels.NewMatcher(labels.MatchEqual, labels.MetricName, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, budget := range []int64{int64(len(data)), 100} {
+		b := &readBudget{remaining: budget}
+		q := &fanoutQuerier{
+			budget: b,
+			ctx:    context.Background(),
+			log:    logrus.New(),
+			queriers: map[string]nodeQuerier{
+				"remote": &remoteQuerier{budget: b, ctx: context.Background(), maxt: 1000, baseURL: srv.URL},
+			},
+			replFactor: 1,
+		}
+
+		_, err := q.Select(m)
+		if budget < int64(len(data)) && err != errQueryTooLarge {
+			t.Fatalf("Expected query reading more than %d bytes to fail, got %v", budget, err)
+		}
+		if budget >= int64(len(data)) && err != nil {
+			t.Fatalf("Expected query reading no more than %d bytes to succeed, got %v", budget, err)
+		}
+	}
+}
+
+func TestStreamedSeriesReadLazily(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fanout_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := tsdb.Open(dir, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	const numSeries = 100
+	app := db.Appender()
+	for i := 0; i < numSeries; i++ {
+		for _, name := range []string{"foo", "bar"} {
+			if _, err := app.Add(tsdbLabels.FromStrings("__name__", name, "i", strconv.Itoa(i)), 1000, float64(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := app.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	clstr := cluster.NewStatic(logrus.New(), "remote", "127.0.0.1:0", 0, 1)
+	reader := read.New(clstr, logrus.New(), promtsdb.Adapter(db, 0), nil, nil, nil)
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		reader.HandlerFunc(w, r)
+	}))
+	defer srv.Close()
+
+	foo, err := labels.NewMatcher(labels.MatchEqual, labels.MetricName, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bar, err := labels.NewMatcher(labels.MatchEqual, labels.MetricName, "bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newQuerier := func(budget int64) *fanoutQuerier {
+		b := &readBudget{remaining: budget}
+		return &fanoutQuerier{
+			budget:         b,
+			ctx:            context.Background(),
+			log:            logrus.New(),
+			maxt:           2000,
+			preferReplicas: true,
+			queriers: map[string]nodeQuerier{
+				"remote": &remoteQuerier{budget: b, ctx: context.Background(), maxt: 2000, baseURL: srv.URL},
+			},
+			replFactor: 1,
+			selectors:  [][]*labels.Matcher{{foo}, {bar}},
+		}
+	}
+
+	// Both selectors are fetched in a single request, and the series for
+	// each are read from the interleaved frames in the response
+	q := newQuerier(maxQueryBytes)
+	for _, m := range []*labels.Matcher{bar, foo} {
+		set, err := q.Select(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var n int
+		for set.Next() {
+			if name := set.At().Labels().Get(labels.MetricName); name != m.Value {
+				t.Fatalf("Expected series for %s, got %s", m.Value, name)
+			}
+			n++
+		}
+		if err := set.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if n != numSeries {
+			t.Fatalf("Expected %d series for %s, got %d", numSeries, m.Value, n)
+		}
+	}
+	q.Close()
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatalf("Expected 1 request, got %d", n)
+	}
+
+	// The response is not read until the series set is iterated over, so
+	// the budget is only exceeded while iterating
+	q = newQuerier(100)
+	defer q.Close()
+	set, err := q.Select(foo)
+	if err != nil {
+		t.Fatalf("Expected Select to succeed before reading the response, got %v", err)
+	}
+	for set.Next() {
+	}
+	if err := set.Err(); err != errQueryTooLarge {
+		t.Fatalf("Expected reading more than the budget to fail, got %v", err)
+	}
+}
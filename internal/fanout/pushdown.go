@@ -0,0 +1,121 @@
+package fanout
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/mattbostock/timbala/internal/cluster"
+	"github.com/mattbostock/timbala/internal/pushdown"
+	"github.com/mattbostock/timbala/internal/read"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/promql"
+	"golang.org/x/net/context/ctxhttp"
+)
+
+var errUnsettled = errors.New("cluster membership changed recently; preferred replicas may not hold their data")
+
+// KeyVersion returns the version of partition keys used by the cluster, which
+// determines the timestamps for which aggregations can be pushed down.
+func (f *fanoutStorage) KeyVersion() cluster.KeyVersion {
+	return f.clstr.KeyVersion()
+}
+
+// EvaluateAggregate evaluates the given aggregation on every node, over the
+// samples for which each node is the preferred replica, and merges the partial
+// aggregates. It fails if any node fails to respond, or if cluster membership
+// has changed recently, in which case the aggregation should be evaluated by
+// the local node instead.
+func (f *fanoutStorage) EvaluateAggregate(ctx context.Context, agg *promql.AggregateExpr, start, end time.Time, step time.Duration) (promql.Matrix, error) {
+	if !f.settled() {
+		return nil, errUnsettled
+	}
+
+	nodes := f.clstr.Nodes()
+	results := make([]promql.Matrix, len(nodes))
+	errs := make([]error, len(nodes))
+	var wg sync.WaitGroup
+	for i, n := range nodes {
+		wg.Add(1)
+		go func(i int, n *cluster.Node) {
+			defer wg.Done()
+			if n.Name() == f.clstr.LocalNode().Name() {
+				results[i], errs[i] = f.evaluateLocal(ctx, agg, start, end, step)
+			} else {
+				results[i], errs[i] = evaluateRemote(ctx, n, agg, start, end, step)
+			}
+		}(i, n)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			f.log.Debugf("Evaluating aggregation on node %s failed; evaluating locally instead: %s", nodes[i].Name(), err)
+			return nil, err
+		}
+	}
+	return pushdown.Merge(agg, results), nil
+}
+
+func (f *fanoutStorage) evaluateLocal(ctx context.Context, agg *promql.AggregateExpr, start, end time.Time, step time.Duration) (promql.Matrix, error) {
+	qry, err := f.engine.NewRangeQuery(agg.String(), start, end, step)
+	if err != nil {
+		return nil, err
+	}
+	return qry.Exec(ctx).Matrix()
+}
+
+func evaluateRemote(ctx context.Context, n *cluster.Node, agg *promql.AggregateExpr, start, end time.Time, step time.Duration) (promql.Matrix, error) {
+	httpAddr, err := n.HTTPAddr()
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"query": []string{agg.String()},
+		"start": []string{strconv.FormatInt(timestamp.FromTime(start), 10)},
+		"end":   []string{strconv.FormatInt(timestamp.FromTime(end), 10)},
+		"step":  []string{strconv.FormatInt(int64(step/time.Millisecond), 10)},
+	}
+	// FIXME handle HTTPS
+	httpReq, err := http.NewRequest("POST", "http://"+httpAddr+read.EvaluateRoute, bytes.NewBufferString(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("unable to create request: %v", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	ctx, cancel := context.WithTimeout(ctx, readTimeoutSeconds)
+	defer cancel()
+
+	httpResp, err := ctxhttp.Do(ctx, httpClient, httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("error sending request: %v", err)
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("server returned HTTP status %s", httpResp.Status)
+	}
+
+	compressed, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response: %v", err)
+	}
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decompress response: %v", err)
+	}
+	var res prompb.QueryResult
+	if err := res.Unmarshal(data); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal response body: %v", err)
+	}
+	return pushdown.FromQueryResult(&res), nil
+}
@@ -0,0 +1,387 @@
+package fanout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/mattbostock/timbala/internal/cluster"
+	"github.com/mattbostock/timbala/internal/write"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	maxConcurrentRepairs = 4
+	repairTimeout        = 30 * time.Second
+
+	// maxQueuedRepairs is how many queries' results may wait to be
+	// compared. Results are compared one query at a time, away from the
+	// queries themselves.
+	maxQueuedRepairs = 16
+
+	// repairSampleBytes approximates the memory used by each sample held
+	// while comparing replicas, which is reserved from the query's read
+	// budget in batches of repairBatchSize samples
+	repairSampleBytes = 64
+	repairBatchSize   = 1024
+)
+
+var (
+	readRepairSamples = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "timbala",
+			Subsystem: "read_repair",
+			Name:      "samples_total",
+			Help:      "Total number of samples written back to a replica that was missing them",
+		},
+		[]string{"node"},
+	)
+	readRepairFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "timbala",
+			Subsystem: "read_repair",
+			Name:      "failures_total",
+			Help:      "Total number of read repairs that could not be written to a replica",
+		},
+		[]string{"node"},
+	)
+	readRepairsDropped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "timbala",
+			Subsystem: "read_repair",
+			Name:      "dropped_total",
+			Help:      "Total number of read repairs skipped because too many repairs were already queued or in progress",
+		},
+	)
+	readRepairSeriesSkipped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "timbala",
+			Subsystem: "read_repair",
+			Name:      "skipped_series_total",
+			Help:      "Total number of series not compared across replicas because comparing them would exceed the query's read budget",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(readRepairSamples, readRepairFailures, readRepairsDropped, readRepairSeriesSkipped)
+}
+
+var errRepairTooLarge = errors.New("comparing the series would exceed the query's read budget")
+
+// readRepairer compares the series returned by each node for a query and
+// asynchronously writes back any samples that a replica is missing compared
+// to the other replicas for the same partition key.
+type readRepairer struct {
+	clstr cluster.Cluster
+	jobs  chan repairJob
+	log   *logrus.Logger
+	sem   chan struct{}
+}
+
+// repairJob holds the series returned by each node for a query, keyed by node
+// name, waiting to be compared.
+type repairJob struct {
+	budget  *readBudget
+	results map[string][]storage.Series
+	// done is called once the series are no longer read
+	done func()
+}
+
+func newReadRepairer(c cluster.Cluster, l *logrus.Logger) *readRepairer {
+	return &readRepairer{
+		clstr: c,
+		jobs:  make(chan repairJob, maxQueuedRepairs),
+		log:   l,
+		sem:   make(chan struct{}, maxConcurrentRepairs),
+	}
+}
+
+// repair queues the series returned by each node, keyed by node name, to be
+// compared in the background, calling done once they are no longer read. The
+// memory used to compare them is reserved from the given budget. The series
+// are dropped if too many queries' results are already queued.
+func (r *readRepairer) repair(budget *readBudget, results map[string][]storage.Series, done func()) {
+	if len(results) < 2 {
+		done()
+		return
+	}
+
+	select {
+	case r.jobs <- repairJob{budget: budget, results: results, done: done}:
+	default:
+		readRepairsDropped.Inc()
+		done()
+	}
+}
+
+// run compares the queued results one query at a time, scheduling writes of
+// any missing samples to the replicas lacking them, until the context is
+// cancelled.
+func (r *readRepairer) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-r.jobs:
+			repairs := r.diff(job.budget, job.results)
+			job.done()
+			r.schedule(repairs)
+		}
+	}
+}
+
+// schedule writes the missing samples for each node, keyed by node name, to
+// the node.
+func (r *readRepairer) schedule(repairs map[string][]*prompb.TimeSeries) {
+	if len(repairs) == 0 {
+		return
+	}
+
+	nodes := make(map[string]*cluster.Node, len(r.clstr.Nodes()))
+	for _, n := range r.clstr.Nodes() {
+		nodes[n.Name()] = n
+	}
+
+	for name, series := range repairs {
+		n, ok := nodes[name]
+		if !ok {
+			continue
+		}
+
+		select {
+		case r.sem <- struct{}{}:
+		default:
+			readRepairsDropped.Inc()
+			continue
+		}
+
+		go func(n *cluster.Node, series []*prompb.TimeSeries) {
+			defer func() { <-r.sem }()
+
+			var numSamples int
+			for _, ts := range series {
+				numSamples += len(ts.Samples)
+			}
+
+			// Only count the samples the node accepted; any it
+			// rejected are still missing from it
+			accepted, err := r.write(n, series)
+			readRepairSamples.WithLabelValues(n.Name()).Add(float64(accepted))
+			if err != nil {
+				readRepairFailures.WithLabelValues(n.Name()).Inc()
+				r.log.Warningf("Read repair of %d of %d samples to %s failed: %s", numSamples-accepted, numSamples, n.Name(), err)
+				return
+			}
+			r.log.Debugf("Read repair wrote %d samples across %d series to %s", numSamples, len(series), n.Name())
+		}(n, series)
+	}
+}
+
+// diff returns the samples missing from each node, keyed by node name. Each
+// series is compared separately; once comparing a series would exceed the
+// budget, it and the remaining series are skipped.
+func (r *readRepairer) diff(budget *readBudget, results map[string][]storage.Series) map[string][]*prompb.TimeSeries {
+	// Group the series returned by each node by their labels
+	bySeries := make(map[string]map[string]storage.Series)
+	seriesLabels := make(map[string]labels.Labels)
+	for node, series := range results {
+		for _, s := range series {
+			key := s.Labels().String()
+			if _, ok := bySeries[key]; !ok {
+				bySeries[key] = make(map[string]storage.Series, len(results))
+				seriesLabels[key] = s.Labels()
+			}
+			bySeries[key][node] = s
+		}
+	}
+
+	keys := r.clstr.KeyVersion()
+	repairs := make(map[string][]*prompb.TimeSeries)
+
+	// The missing samples are held until every series has been compared
+	var kept int64
+	defer func() { budget.release(kept) }()
+
+	var compared int
+	for key, byNode := range bySeries {
+		lbls := seriesLabels[key]
+		missing, n, err := r.diffSeries(keys, budget, lbls, byNode, results)
+		if err == errRepairTooLarge {
+			readRepairSeriesSkipped.Add(float64(len(bySeries) - compared))
+			r.log.Debugf("Skipping read repair of %d series: %s", len(bySeries)-compared, err)
+			break
+		}
+		compared++
+		if err != nil {
+			r.log.Debugf("Skipping read repair of series %s: %s", lbls, err)
+			continue
+		}
+		kept += n
+
+		for node, samples := range missing {
+			repairs[node] = append(repairs[node], &prompb.TimeSeries{
+				Labels:  labelsToLabelPairs(lbls),
+				Samples: samples,
+			})
+		}
+	}
+	return repairs
+}
+
+// diffSeries returns the samples of a series missing from each node, given the
+// series returned by each node and the series returned for the whole query.
+// The samples are compared one partition key at a time, in timestamp order, so
+// that only the samples for a single partition key are held at once, besides
+// those found to be missing. It returns the number of bytes that remain
+// reserved from the budget for the missing samples.
+func (r *readRepairer) diffSeries(keys cluster.KeyVersion, budget *readBudget, lbls labels.Labels, byNode map[string]storage.Series, results map[string][]storage.Series) (map[string][]*prompb.Sample, int64, error) {
+	nodes := make([]string, 0, len(byNode))
+	for node := range byNode {
+		nodes = append(nodes, node)
+	}
+	// Nodes are compared in a consistent order, so that the same value is
+	// chosen when replicas disagree about it
+	sort.Strings(nodes)
+
+	its := make([]storage.SeriesIterator, len(nodes))
+	ok := make([]bool, len(nodes))
+	index := make(map[string]int, len(nodes))
+	for i, node := range nodes {
+		its[i] = byNode[node].Iterator()
+		ok[i] = its[i].Next()
+		index[node] = i
+	}
+
+	var (
+		pHash   = r.clstr.PartitionHash(lbls.Get(labels.MetricName), lbls.Hash())
+		missing = make(map[string][]*prompb.Sample)
+
+		// The samples returned by any node for the current partition
+		// key, and whether each node returned each of them
+		pKey  uint64
+		union []*prompb.Sample
+		held  [][]bool
+
+		// room is the number of bytes reserved for the samples in
+		// union, and kept the number reserved for missing samples
+		room, kept int64
+	)
+	defer func() { budget.release(room) }()
+
+	flush := func() {
+		counts := make(map[string]int, len(nodes))
+		for _, h := range held {
+			for i, node := range nodes {
+				if h[i] {
+					counts[node]++
+				}
+			}
+		}
+
+		var max int
+		replicas := r.clstr.NodesByPartitionKey(pKey)
+		for _, n := range replicas {
+			if counts[n.Name()] > max {
+				max = counts[n.Name()]
+			}
+		}
+
+		isMissing := make([]bool, len(union))
+		for _, n := range replicas {
+			if _, queried := results[n.Name()]; !queried || counts[n.Name()] >= max {
+				continue
+			}
+			i, returned := index[n.Name()]
+			for j, sample := range union {
+				if !returned || !held[j][i] {
+					missing[n.Name()] = append(missing[n.Name()], sample)
+					isMissing[j] = true
+				}
+			}
+		}
+
+		// Move the reservation for the missing samples out of room
+		for _, m := range isMissing {
+			if m {
+				room -= repairSampleBytes
+				kept += repairSampleBytes
+			}
+		}
+		union, held = union[:0], held[:0]
+	}
+
+	for {
+		// Find the earliest sample returned by any node
+		var t int64
+		found := false
+		for i, it := range its {
+			if !ok[i] {
+				continue
+			}
+			if st, _ := it.At(); !found || st < t {
+				t, found = st, true
+			}
+		}
+		if !found {
+			break
+		}
+
+		k := keys.SamplePartitionKey(t, pHash)
+		if len(union) > 0 && k != pKey {
+			flush()
+		}
+		pKey = k
+
+		if int64(len(union)+1)*repairSampleBytes > room {
+			if !budget.reserve(repairBatchSize * repairSampleBytes) {
+				budget.release(kept)
+				return nil, 0, errRepairTooLarge
+			}
+			room += repairBatchSize * repairSampleBytes
+		}
+
+		sample := &prompb.Sample{Timestamp: t}
+		h := make([]bool, len(nodes))
+		found = false
+		for i, it := range its {
+			if !ok[i] {
+				continue
+			}
+			if st, v := it.At(); st == t {
+				if !found {
+					sample.Value, found = v, true
+				}
+				h[i] = true
+				ok[i] = it.Next()
+			}
+		}
+		union = append(union, sample)
+		held = append(held, h)
+	}
+
+	for i, it := range its {
+		if err := it.Err(); err != nil {
+			budget.release(kept)
+			return nil, 0, fmt.Errorf("error reading series from %s: %s", nodes[i], err)
+		}
+	}
+	if len(union) > 0 {
+		flush()
+	}
+	return missing, kept, nil
+}
+
+// write writes the series to the node, returning the number of samples the
+// node accepted.
+func (r *readRepairer) write(n *cluster.Node, series []*prompb.TimeSeries) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), repairTimeout)
+	defer cancel()
+	return write.WriteToNode(ctx, httpClient, *n, series)
+}
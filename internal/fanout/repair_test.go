@@ -0,0 +1,93 @@
+package fanout
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mattbostock/timbala/internal/cluster"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/sirupsen/logrus"
+)
+
+func TestReadRepairDiff(t *testing.T) {
+	clstr := cluster.NewStatic(logrus.New(), "a", "127.0.0.1:0", 0, 2)
+	clstr.Join("b", "127.0.0.1:0", 1)
+	r := newReadRepairer(clstr, logrus.New())
+
+	// Node b is missing the samples for the second of three days, each of
+	// which has a different partition key
+	lbls := labels.FromStrings("__name__", "foo")
+	start := time.Date(2018, 3, 14, 0, 0, 0, 0, time.Local)
+	a := &concreteSeries{labels: lbls}
+	b := &concreteSeries{labels: lbls}
+	for i := 0; i < 72; i++ {
+		s := &prompb.Sample{Timestamp: timestamp.FromTime(start.Add(time.Duration(i) * time.Hour)), Value: float64(i)}
+		a.samples = append(a.samples, s)
+		if i < 24 || i >= 48 {
+			b.samples = append(b.samples, s)
+		}
+	}
+	results := map[string][]storage.Series{"a": {a}, "b": {b}}
+
+	budget := &readBudget{remaining: maxQueryBytes}
+	repairs := r.diff(budget, results)
+	if len(repairs) != 1 || len(repairs["b"]) != 1 {
+		t.Fatalf("Expected one series to be repaired on b, got %v", repairs)
+	}
+	missing := repairs["b"][0].Samples
+	if len(missing) != 24 || missing[0].Timestamp != a.samples[24].Timestamp || missing[23].Timestamp != a.samples[47].Timestamp {
+		t.Fatalf("Expected the second day's samples to be missing from b, got %v", missing)
+	}
+	if budget.remaining != maxQueryBytes {
+		t.Fatalf("Expected the budget to be released once compared, %d bytes remain", budget.remaining)
+	}
+
+	// Series are skipped if comparing them would exceed the budget
+	budget = &readBudget{remaining: repairSampleBytes}
+	if repairs := r.diff(budget, results); len(repairs) != 0 {
+		t.Fatalf("Expected no repairs once the budget is exceeded, got %v", repairs)
+	}
+	if budget.remaining != repairSampleBytes {
+		t.Fatalf("Expected the budget to be released after skipping, %d bytes remain", budget.remaining)
+	}
+}
+
+func TestReadRepairQueued(t *testing.T) {
+	clstr := cluster.NewStatic(logrus.New(), "a", "127.0.0.1:0", 0, 2)
+	clstr.Join("b", "127.0.0.1:0", 1)
+	r := newReadRepairer(clstr, logrus.New())
+
+	results := map[string][]storage.Series{"a": nil, "b": nil}
+	done := make(chan struct{}, maxQueuedRepairs+1)
+	for i := 0; i < maxQueuedRepairs+1; i++ {
+		r.repair(nil, results, func() { done <- struct{}{} })
+	}
+
+	// Results are only compared by the worker, and are dropped once too
+	// many are queued
+	select {
+	case <-done:
+	default:
+		t.Fatal("Expected the results to be dropped when the queue is full")
+	}
+	select {
+	case <-done:
+		t.Fatal("Expected queued results not to be compared until the worker runs")
+	default:
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.run(ctx)
+	for i := 0; i < maxQueuedRepairs; i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected queued results to be compared, %d were", i)
+		}
+	}
+}
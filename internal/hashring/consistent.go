@@ -0,0 +1,68 @@
+package hashring
+
+import "sort"
+
+const defaultVirtualNodes = 256
+
+// NewConsistent returns a consistent hash ring in which each bucket occupies
+// the given number of points, or virtual nodes, on the ring. Keys are assigned
+// to the bucket owning the next point on the ring, so removing any bucket
+// moves only the keys assigned to it. More virtual nodes give a more even
+// distribution at the cost of memory.
+func NewConsistent(virtualNodes int) *consistentHashRing {
+	h := &consistentHashRing{virtualNodes: virtualNodes}
+	h.tables.build = h.build
+	return h
+}
+
+type consistentHashRing struct {
+	virtualNodes int
+	tables       tableCache
+}
+
+type point struct {
+	hash   uint64
+	bucket int32
+}
+
+// consistentTable holds the points on the ring, sorted by hash.
+type consistentTable []point
+
+func (h *consistentHashRing) Get(key uint64, numBuckets int) int32 {
+	return h.GetFrom(key, allBuckets(numBuckets))
+}
+
+func (h *consistentHashRing) GetFrom(key uint64, buckets []int32) int32 {
+	if len(buckets) == 0 {
+		return -1
+	}
+	return h.tables.get(buckets).Get(key)
+}
+
+// build returns the points on the ring for the given buckets.
+func (h *consistentHashRing) build(buckets []int32) table {
+	t := make(consistentTable, 0, len(buckets)*h.virtualNodes)
+	for _, b := range buckets {
+		for v := 0; v < h.virtualNodes; v++ {
+			t = append(t, point{mix(uint64(b)<<32 | uint64(v)), b})
+		}
+	}
+	sort.Slice(t, func(i, j int) bool { return t[i].hash < t[j].hash })
+	return t
+}
+
+func (h *consistentHashRing) String() string {
+	return Consistent
+}
+
+func (t consistentTable) Get(key uint64) int32 {
+	if len(t) == 0 {
+		return -1
+	}
+	k := mix(key)
+	i := sort.Search(len(t), func(i int) bool { return t[i].hash >= k })
+	if i == len(t) {
+		i = 0
+	}
+	return t[i].bucket
+}
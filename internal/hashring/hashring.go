@@ -1,17 +1,87 @@
 package hashring
 
-import jump "github.com/dgryski/go-jump"
+import (
+	"fmt"
+	"sort"
+
+	jump "github.com/dgryski/go-jump"
+)
+
+const (
+	Jump       = "jump"
+	Consistent = "consistent"
+	Rendezvous = "rendezvous"
+
+	Default = Jump
+)
+
+var constructors = map[string]func() HashRing{
+	Jump:       func() HashRing { return New() },
+	Consistent: func() HashRing { return NewConsistent(defaultVirtualNodes) },
+	Rendezvous: func() HashRing { return NewRendezvous() },
+}
 
 func New() *hashRing {
 	return &hashRing{}
 }
 
+// ByName returns a new hashring using the named algorithm.
+func ByName(name string) (HashRing, error) {
+	c, ok := constructors[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown hashring %q", name)
+	}
+	return c(), nil
+}
+
+// Names returns the names of the available hashring algorithms.
+func Names() []string {
+	names := make([]string, 0, len(constructors))
+	for name := range constructors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 type hashRing struct{}
 
 func (h *hashRing) Get(key uint64, numBuckets int) int32 {
 	return jump.Hash(key, numBuckets)
 }
 
+func (h *hashRing) String() string {
+	return Jump
+}
+
 type HashRing interface {
 	Get(uint64, int) int32
+	String() string
+}
+
+// SparseHashRing is implemented by hashrings that can choose between an
+// arbitrary set of buckets. Removing a bucket from the middle of such a
+// hashring only moves the keys that were assigned to that bucket, and spreads
+// them across all remaining buckets.
+type SparseHashRing interface {
+	HashRing
+	GetFrom(key uint64, buckets []int32) int32
+}
+
+// mix is the finaliser from the SplitMix64 generator. Partition keys for
+// different replicas differ only in their lowest bits, so they must be mixed
+// before use.
+func mix(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+func allBuckets(numBuckets int) []int32 {
+	buckets := make([]int32, numBuckets)
+	for i := range buckets {
+		buckets[i] = int32(i)
+	}
+	return buckets
 }
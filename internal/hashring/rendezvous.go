@@ -0,0 +1,69 @@
+package hashring
+
+// rendezvousSlots is the number of slots in a rendezvous table. It must be a
+// power of two.
+const rendezvousSlots = 1 << 16
+
+// NewRendezvous returns a hashring using rendezvous, or highest random weight,
+// hashing. Keys are hashed to one of a fixed number of slots, and each slot is
+// assigned to the bucket with the highest score for that slot, so removing any
+// bucket moves only the keys assigned to it.
+//
+// Slots are assigned once for each set of buckets, taking time proportional
+// to the number of buckets; lookups then take constant time.
+func NewRendezvous() *rendezvousHashRing {
+	h := &rendezvousHashRing{}
+	h.tables.build = h.build
+	return h
+}
+
+type rendezvousHashRing struct {
+	tables tableCache
+}
+
+// rendezvousTable holds the bucket assigned to each slot.
+type rendezvousTable []int32
+
+func (h *rendezvousHashRing) Get(key uint64, numBuckets int) int32 {
+	return h.GetFrom(key, allBuckets(numBuckets))
+}
+
+func (h *rendezvousHashRing) GetFrom(key uint64, buckets []int32) int32 {
+	if len(buckets) == 0 {
+		return -1
+	}
+	return h.tables.get(buckets).Get(key)
+}
+
+// build assigns each slot to the bucket with the highest score for it.
+func (h *rendezvousHashRing) build(buckets []int32) table {
+	seeds := make([]uint64, len(buckets))
+	for i, b := range buckets {
+		seeds[i] = mix(uint64(b))
+	}
+
+	t := make(rendezvousTable, rendezvousSlots)
+	for s := range t {
+		var (
+			best      int32 = -1
+			bestScore uint64
+		)
+		k := mix(uint64(s))
+		for i, b := range buckets {
+			score := mix(k ^ seeds[i])
+			if best == -1 || score > bestScore {
+				best, bestScore = b, score
+			}
+		}
+		t[s] = best
+	}
+	return t
+}
+
+func (h *rendezvousHashRing) String() string {
+	return Rendezvous
+}
+
+func (t rendezvousTable) Get(key uint64) int32 {
+	return t[mix(key)&(rendezvousSlots-1)]
+}
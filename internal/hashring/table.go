@@ -0,0 +1,77 @@
+package hashring
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// maxCachedTables bounds the number of distinct sets of buckets for which a
+// table is kept in memory. Rebalancing looks up keys using the sets of
+// buckets from before and after a membership change.
+const maxCachedTables = 4
+
+// table assigns keys to a fixed set of buckets. Tables are immutable, so they
+// are built once when the set of buckets changes and shared by all lookups
+// without locking.
+type table interface {
+	Get(key uint64) int32
+}
+
+// tableCache holds the tables most recently built by a hashring. Lookups load
+// the cached tables atomically; a table is built only when a set of buckets
+// that is not cached is used, such as after cluster membership changes.
+type tableCache struct {
+	build func(buckets []int32) table
+
+	// mu serialises building tables
+	mu sync.Mutex
+	// tables holds a []cachedTable, most recently built first
+	tables atomic.Value
+}
+
+type cachedTable struct {
+	buckets []int32
+	table   table
+}
+
+func (c *tableCache) get(buckets []int32) table {
+	if t := c.lookup(buckets); t != nil {
+		return t
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t := c.lookup(buckets); t != nil {
+		return t
+	}
+
+	t := c.build(buckets)
+	cached, _ := c.tables.Load().([]cachedTable)
+	if len(cached) == maxCachedTables {
+		cached = cached[:maxCachedTables-1]
+	}
+	c.tables.Store(append([]cachedTable{{append([]int32(nil), buckets...), t}}, cached...))
+	return t
+}
+
+func (c *tableCache) lookup(buckets []int32) table {
+	cached, _ := c.tables.Load().([]cachedTable)
+	for _, ct := range cached {
+		if equalBuckets(ct.buckets, buckets) {
+			return ct.table
+		}
+	}
+	return nil
+}
+
+func equalBuckets(a, b []int32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
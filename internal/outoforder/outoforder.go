@@ -0,0 +1,1066 @@
+// Package outoforder accepts samples that the tsdb head rejects because they
+// are older than the most recent sample in their series or older than the
+// time range covered by the head.
+//
+// Samples written by clients are accepted if they arrive within a grace
+// period. Samples written to restore data missing from a node, such as those
+// replayed from hinted handoff or copied by read repair, anti-entropy or
+// rebalancing, are accepted regardless of their age.
+//
+// The tsdb head only accepts samples newer than the last sample appended to
+// each series, and a tsdb database cannot contain overlapping blocks, so
+// out-of-order samples are held in a buffer and then written to blocks that
+// are managed by this package rather than by a tsdb database. These blocks
+// may overlap each other and the blocks of the main database. Queries merge
+// the samples from the main database, the blocks and the buffer, and blocks
+// are merged once there are too many of them.
+package outoforder
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	gokitlog "github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/tsdb"
+	tsdbLabels "github.com/prometheus/tsdb/labels"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultGracePeriod = 10 * time.Minute
+
+	flushInterval = time.Minute
+	logTmpFileExt = ".tmp"
+
+	// maxBufferedSamples bounds the memory used by the buffer. Once it is
+	// full, all buffered samples are written to a block, regardless of
+	// whether their grace period has passed.
+	maxBufferedSamples = 1 << 20
+
+	// maxBlocks is the number of blocks above which the smallest blocks are
+	// merged, so that queries do not need to read from too many blocks
+	maxBlocks = 16
+
+	// blockRange is the block range given to the compactor, which is only
+	// used when planning compactions; blocks written by the store span the
+	// samples written to them
+	blockRange = int64(2 * time.Hour / time.Millisecond)
+
+	// storedWindow is the span of time for which the samples already
+	// stored for a series are read at once when an out-of-order sample is
+	// added to it
+	storedWindow = blockRange
+)
+
+var (
+	samplesAccepted = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "timbala",
+			Subsystem: "out_of_order",
+			Name:      "accepted_samples_total",
+			Help:      "Total number of out-of-order samples accepted",
+		},
+	)
+	samplesBuffered = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "timbala",
+			Subsystem: "out_of_order",
+			Name:      "buffered_samples",
+			Help:      "Number of out-of-order samples buffered until they are written to a block",
+		},
+	)
+	samplesFlushed = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "timbala",
+			Subsystem: "out_of_order",
+			Name:      "flushed_samples_total",
+			Help:      "Total number of buffered out-of-order samples written to a block",
+		},
+	)
+	numBlocks = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "timbala",
+			Subsystem: "out_of_order",
+			Name:      "blocks",
+			Help:      "Number of blocks holding out-of-order samples",
+		},
+	)
+	blocksMerged = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "timbala",
+			Subsystem: "out_of_order",
+			Name:      "merged_blocks_total",
+			Help:      "Total number of blocks of out-of-order samples merged into larger blocks",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(samplesAccepted)
+	prometheus.MustRegister(samplesBuffered)
+	prometheus.MustRegister(samplesFlushed)
+	prometheus.MustRegister(numBlocks)
+	prometheus.MustRegister(blocksMerged)
+}
+
+type store struct {
+	compactor   *tsdb.LeveledCompactor
+	dir         string
+	gracePeriod time.Duration
+	log         *logrus.Logger
+	logPath     string
+	now         func() time.Time
+	primary     storage.Storage
+
+	mu         sync.Mutex
+	blocks     []*tsdb.Block
+	logFile    *os.File
+	numSamples int
+	series     map[string]*bufferedSeries
+}
+
+// bufferedSeries holds the out-of-order samples for a series, sorted by
+// timestamp.
+type bufferedSeries struct {
+	lset    labels.Labels
+	samples []prompb.Sample
+}
+
+// New returns storage that writes to and reads from the primary storage,
+// accepting out-of-order samples whose timestamps are no older than the grace
+// period. Buffered samples are logged to logPath so that they survive a
+// restart, and are written to blocks in dir.
+func New(l *logrus.Logger, primary storage.Storage, dir, logPath string, gracePeriod time.Duration) (*store, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	compactor, err := tsdb.NewLeveledCompactor(nil, gokitlog.NewNopLogger(), []int64{blockRange}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &store{
+		compactor:   compactor,
+		dir:         dir,
+		gracePeriod: gracePeriod,
+		log:         l,
+		logPath:     logPath,
+		now:         time.Now,
+		primary:     primary,
+		series:      make(map[string]*bufferedSeries),
+	}
+	if err := s.openBlocks(); err != nil {
+		return nil, fmt.Errorf("unable to open out-of-order blocks: %s", err)
+	}
+	if err := s.replayLog(); err != nil {
+		closeBlocks(s.blocks)
+		return nil, fmt.Errorf("unable to replay out-of-order samples: %s", err)
+	}
+
+	f, err := os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		closeBlocks(s.blocks)
+		return nil, err
+	}
+	s.logFile = f
+	return s, nil
+}
+
+func (s *store) StartTime() (int64, error) {
+	return s.primary.StartTime()
+}
+
+func (s *store) Querier(ctx context.Context, mint, maxt int64) (storage.Querier, error) {
+	return s.querier(ctx, mint, maxt, true)
+}
+
+// querier returns a querier over the primary storage and the blocks and, if
+// buffered is true, the buffer.
+func (s *store) querier(ctx context.Context, mint, maxt int64, buffered bool) (storage.Querier, error) {
+	pq, err := s.primary.Querier(ctx, mint, maxt)
+	if err != nil {
+		return nil, err
+	}
+	// The primary storage takes precedence if the same sample was written
+	// both in order and out of order
+	queriers := []storage.Querier{pq}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Queriers must be opened with the store locked, so that blocks are
+	// not closed after being replaced but before reading has begun
+	for _, b := range s.blocks {
+		meta := b.Meta()
+		if meta.MinTime > maxt || meta.MaxTime <= mint {
+			continue
+		}
+		bq, err := tsdb.NewBlockQuerier(b, mint, maxt)
+		if err != nil {
+			(&mergeQuerier{queriers: queriers}).Close()
+			return nil, err
+		}
+		queriers = append(queriers, blockQuerier{bq})
+	}
+	if buffered {
+		queriers = append(queriers, s.bufferQuerier(mint, maxt))
+	}
+	return &mergeQuerier{queriers: queriers}, nil
+}
+
+// OutOfOrderLabelNames returns the sorted names of the labels of series with
+// samples in the buffer, or in the blocks overlapping the given time range.
+// Names are read from each block's index, so they may include labels of
+// series with no samples in the range itself.
+func (s *store) OutOfOrderLabelNames(mint, maxt int64) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	set := make(map[string]struct{})
+	for _, b := range s.blocks {
+		if meta := b.Meta(); meta.MinTime > maxt || meta.MaxTime <= mint {
+			continue
+		}
+		ir, err := b.Index()
+		if err != nil {
+			return nil, err
+		}
+		indices, err := ir.LabelIndices()
+		ir.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, names := range indices {
+			// Indices over more than one label name are not used
+			if len(names) == 1 {
+				set[names[0]] = struct{}{}
+			}
+		}
+	}
+	for _, bs := range s.series {
+		if len(bs.samples) == 0 || bs.samples[0].Timestamp > maxt || bs.samples[len(bs.samples)-1].Timestamp < mint {
+			continue
+		}
+		for _, l := range bs.lset {
+			set[l.Name] = struct{}{}
+		}
+	}
+
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// BufferedSeries returns the label sets of the series with samples in the
+// buffer.
+func (s *store) BufferedSeries() []tsdbLabels.Labels {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	series := make([]tsdbLabels.Labels, 0, len(s.series))
+	for _, bs := range s.series {
+		lset := make(tsdbLabels.Labels, 0, len(bs.lset))
+		for _, l := range bs.lset {
+			lset = append(lset, tsdbLabels.Label{Name: l.Name, Value: l.Value})
+		}
+		series = append(series, lset)
+	}
+	return series
+}
+
+func (s *store) Appender() (storage.Appender, error) {
+	app, err := s.primary.Appender()
+	if err != nil {
+		return nil, err
+	}
+	return &appender{Appender: app, store: s}, nil
+}
+
+// RepairAppender returns an appender that accepts out-of-order samples
+// regardless of their age. It is used for writes that restore samples
+// missing from this node, which may be far older than the grace period.
+func (s *store) RepairAppender() (storage.Appender, error) {
+	app, err := s.primary.Appender()
+	if err != nil {
+		return nil, err
+	}
+	return &appender{Appender: app, store: s, repair: true}, nil
+}
+
+// Close closes the buffer log and the blocks. The primary storage is not
+// closed.
+func (s *store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var lastErr error
+	for _, b := range s.blocks {
+		if err := b.Close(); err != nil {
+			lastErr = err
+		}
+	}
+	s.blocks = nil
+	if err := s.logFile.Close(); err != nil {
+		lastErr = err
+	}
+	return lastErr
+}
+
+// Run writes buffered samples whose grace period has passed to a block
+// periodically, until the context is cancelled.
+func (s *store) Run(ctx context.Context) {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := s.flush(s.cutoff()); err != nil {
+			s.log.Errorf("Unable to write buffered out-of-order samples: %s", err)
+		}
+	}
+}
+
+// Delete deletes the samples between mint and maxt from the series matching
+// all of the given matchers, from both the buffer and the blocks. Samples in
+// the primary storage must be deleted separately.
+func (s *store) Delete(mint, maxt int64, ms ...tsdbLabels.Matcher) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, b := range s.blocks {
+		if err := b.Delete(mint, maxt, ms...); err != nil {
+			return err
+		}
+	}
+
+	var deleted bool
+	for key, bs := range s.series {
+		if !matches(bs.lset, ms) {
+			continue
+		}
+		kept := bs.samples[:0]
+		for _, smpl := range bs.samples {
+			if smpl.Timestamp >= mint && smpl.Timestamp <= maxt {
+				deleted = true
+				s.numSamples--
+				continue
+			}
+			kept = append(kept, smpl)
+		}
+		bs.samples = kept
+		if len(bs.samples) == 0 {
+			delete(s.series, key)
+		}
+	}
+	samplesBuffered.Set(float64(s.numSamples))
+
+	if !deleted {
+		return nil
+	}
+	return s.rewriteLog()
+}
+
+// CleanTombstones rewrites the blocks holding deleted samples, removing the
+// deleted samples from disk.
+func (s *store) CleanTombstones() error {
+	s.mu.Lock()
+	var replaced []*tsdb.Block
+	var err error
+	for i, b := range s.blocks {
+		var deleted bool
+		deleted, err = hasTombstones(b)
+		if err != nil {
+			break
+		}
+		if !deleted {
+			continue
+		}
+
+		meta := b.Meta()
+		var uid ulid.ULID
+		uid, err = s.compactor.Write(s.dir, b, meta.MinTime, meta.MaxTime)
+		if err != nil {
+			break
+		}
+		var nb *tsdb.Block
+		nb, err = tsdb.OpenBlock(filepath.Join(s.dir, uid.String()), nil)
+		if err != nil {
+			break
+		}
+		s.blocks[i] = nb
+		replaced = append(replaced, b)
+	}
+	s.mu.Unlock()
+
+	removeBlocks(s.log, replaced)
+	return err
+}
+
+func hasTombstones(b *tsdb.Block) (bool, error) {
+	tr, err := b.Tombstones()
+	if err != nil {
+		return false, err
+	}
+	defer tr.Close()
+
+	var found bool
+	err = tr.Iter(func(uint64, tsdb.Intervals) error {
+		found = true
+		return nil
+	})
+	return found, err
+}
+
+func matches(lset labels.Labels, ms []tsdbLabels.Matcher) bool {
+	for _, m := range ms {
+		if !m.Matches(lset.Get(m.Name())) {
+			return false
+		}
+	}
+	return true
+}
+
+// cutoff returns the timestamp before which out-of-order samples are no
+// longer accepted from clients.
+func (s *store) cutoff() int64 {
+	return timestamp.FromTime(s.now().Add(-s.gracePeriod))
+}
+
+// accepts returns true if an out-of-order sample with the given timestamp is
+// within the grace period.
+func (s *store) accepts(t int64) bool {
+	return s.gracePeriod > 0 && t >= s.cutoff()
+}
+
+// lookup returns whether a sample with the given timestamp is already
+// buffered for the series and, if so, whether it has the same value.
+func (s *store) lookup(lset labels.Labels, t int64, v float64) (found, same bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bs, ok := s.series[lset.String()]
+	if !ok {
+		return false, false
+	}
+	i := sort.Search(len(bs.samples), func(i int) bool { return bs.samples[i].Timestamp >= t })
+	if i == len(bs.samples) || bs.samples[i].Timestamp != t {
+		return false, false
+	}
+	return true, sameValue(bs.samples[i].Value, v)
+}
+
+// sameValue compares sample values in the same way as the tsdb head, so that
+// staleness markers, which are NaN values, compare equal.
+func sameValue(a, b float64) bool {
+	return math.Float64bits(a) == math.Float64bits(b)
+}
+
+// add logs the given samples and adds them to the buffer, writing the buffer
+// to a block if it is full.
+func (s *store) add(series []*prompb.TimeSeries) error {
+	s.mu.Lock()
+	if err := writeRecord(s.logFile, series); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	for _, ts := range series {
+		s.insert(ts)
+	}
+	samplesBuffered.Set(float64(s.numSamples))
+	full := s.numSamples >= maxBufferedSamples
+	s.mu.Unlock()
+
+	if full {
+		// The samples were accepted and logged, so failing to write
+		// the buffer to a block is not a failure of this write
+		if err := s.flush(math.MaxInt64); err != nil {
+			s.log.Errorf("Unable to write full buffer of out-of-order samples: %s", err)
+		}
+	}
+	return nil
+}
+
+// insert adds samples to the buffer, ignoring samples whose timestamps are
+// already buffered for the same series. The store must be locked.
+func (s *store) insert(ts *prompb.TimeSeries) {
+	lset := make(labels.Labels, 0, len(ts.Labels))
+	for _, l := range ts.Labels {
+		lset = append(lset, labels.Label{Name: l.Name, Value: l.Value})
+	}
+	sort.Sort(lset)
+
+	key := lset.String()
+	bs, ok := s.series[key]
+	if !ok {
+		bs = &bufferedSeries{lset: lset}
+		s.series[key] = bs
+	}
+	for _, smpl := range ts.Samples {
+		i := sort.Search(len(bs.samples), func(i int) bool { return bs.samples[i].Timestamp >= smpl.Timestamp })
+		if i < len(bs.samples) && bs.samples[i].Timestamp == smpl.Timestamp {
+			continue
+		}
+		bs.samples = append(bs.samples, prompb.Sample{})
+		copy(bs.samples[i+1:], bs.samples[i:])
+		bs.samples[i] = *smpl
+		s.numSamples++
+	}
+}
+
+// flush writes the buffered samples older than cutoff to a new block, merging
+// blocks if there are too many.
+func (s *store) flush(cutoff int64) error {
+	s.mu.Lock()
+	replaced, err := s.flushLocked(cutoff)
+	s.mu.Unlock()
+
+	// Blocks can only be closed once queries reading from them have
+	// finished, which must not hold up writes
+	removeBlocks(s.log, replaced)
+	return err
+}
+
+// flushLocked writes the buffered samples older than cutoff to a new block,
+// returning the blocks replaced by merging, which must be removed once the
+// store is unlocked. The store must be locked.
+func (s *store) flushLocked(cutoff int64) ([]*tsdb.Block, error) {
+	var flushing bufferQuerier
+	mint, maxt := int64(math.MaxInt64), int64(math.MinInt64)
+	var numFlushed int
+	for _, bs := range s.series {
+		i := sort.Search(len(bs.samples), func(i int) bool { return bs.samples[i].Timestamp >= cutoff })
+		if i == 0 {
+			continue
+		}
+		flushing = append(flushing, &bufferedSeries{lset: bs.lset, samples: bs.samples[:i]})
+		if t := bs.samples[0].Timestamp; t < mint {
+			mint = t
+		}
+		if t := bs.samples[i-1].Timestamp; t > maxt {
+			maxt = t
+		}
+		numFlushed += i
+	}
+	if numFlushed == 0 {
+		return nil, nil
+	}
+
+	set, _ := flushing.Select()
+	b, err := s.writeBlock(set, mint, maxt)
+	if err != nil {
+		return nil, err
+	}
+	s.blocks = append(s.blocks, b)
+	numBlocks.Set(float64(len(s.blocks)))
+
+	for key, bs := range s.series {
+		i := sort.Search(len(bs.samples), func(i int) bool { return bs.samples[i].Timestamp >= cutoff })
+		bs.samples = bs.samples[i:]
+		s.numSamples -= i
+		if len(bs.samples) == 0 {
+			delete(s.series, key)
+		}
+	}
+	samplesBuffered.Set(float64(s.numSamples))
+	samplesFlushed.Add(float64(numFlushed))
+	if err := s.rewriteLog(); err != nil {
+		return nil, err
+	}
+
+	if len(s.blocks) <= maxBlocks {
+		return nil, nil
+	}
+	return s.mergeBlocks()
+}
+
+// mergeBlocks merges the smallest blocks into a single block, returning the
+// blocks that were merged. The store must be locked.
+func (s *store) mergeBlocks() ([]*tsdb.Block, error) {
+	blocks := make([]*tsdb.Block, len(s.blocks))
+	copy(blocks, s.blocks)
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].Meta().Stats.NumSamples < blocks[j].Meta().Stats.NumSamples
+	})
+	merging := blocks[:len(blocks)-maxBlocks/2]
+
+	mint, maxt := int64(math.MaxInt64), int64(math.MinInt64)
+	queriers := make([]storage.Querier, 0, len(merging))
+	for _, b := range merging {
+		meta := b.Meta()
+		if meta.MinTime < mint {
+			mint = meta.MinTime
+		}
+		if meta.MaxTime-1 > maxt {
+			maxt = meta.MaxTime - 1
+		}
+		bq, err := tsdb.NewBlockQuerier(b, math.MinInt64, math.MaxInt64)
+		if err != nil {
+			(&mergeQuerier{queriers: queriers}).Close()
+			return nil, err
+		}
+		queriers = append(queriers, blockQuerier{bq})
+	}
+	q := &mergeQuerier{queriers: queriers}
+	defer q.Close()
+
+	all, err := labels.NewMatcher(labels.MatchRegexp, labels.MetricName, ".*")
+	if err != nil {
+		return nil, err
+	}
+	set, err := q.Select(all)
+	if err != nil {
+		return nil, err
+	}
+	merged, err := s.writeBlock(set, mint, maxt)
+	if err != nil {
+		return nil, err
+	}
+
+	isMerging := make(map[*tsdb.Block]bool, len(merging))
+	for _, b := range merging {
+		isMerging[b] = true
+	}
+	kept := s.blocks[:0]
+	for _, b := range s.blocks {
+		if !isMerging[b] {
+			kept = append(kept, b)
+		}
+	}
+	s.blocks = append(kept, merged)
+	numBlocks.Set(float64(len(s.blocks)))
+	blocksMerged.Add(float64(len(merging)))
+	return merging, nil
+}
+
+// writeBlock writes the given series, whose samples lie between mint and
+// maxt inclusive, to a new block and opens it.
+func (s *store) writeBlock(set storage.SeriesSet, mint, maxt int64) (*tsdb.Block, error) {
+	// The head only accepts samples within half of its chunk range of the
+	// first sample appended to it, so the chunk range must be large
+	// enough for every sample to be accepted regardless of the order in
+	// which series are appended
+	head, err := tsdb.NewHead(nil, nil, nil, 2*(maxt-mint+1))
+	if err != nil {
+		return nil, err
+	}
+	defer head.Close()
+
+	app := head.Appender()
+	for set.Next() {
+		series := set.At()
+		lset := make(tsdbLabels.Labels, 0, len(series.Labels()))
+		for _, l := range series.Labels() {
+			lset = append(lset, tsdbLabels.Label{Name: l.Name, Value: l.Value})
+		}
+
+		var ref uint64
+		it := series.Iterator()
+		for it.Next() {
+			t, v := it.At()
+			if ref == 0 {
+				ref, err = app.Add(lset, t, v)
+			} else {
+				err = app.AddFast(ref, t, v)
+			}
+			if err != nil {
+				app.Rollback()
+				return nil, err
+			}
+		}
+		if err := it.Err(); err != nil {
+			app.Rollback()
+			return nil, err
+		}
+	}
+	if err := set.Err(); err != nil {
+		app.Rollback()
+		return nil, err
+	}
+	if err := app.Commit(); err != nil {
+		return nil, err
+	}
+
+	uid, err := s.compactor.Write(s.dir, head, mint, maxt+1)
+	if err != nil {
+		return nil, err
+	}
+	return tsdb.OpenBlock(filepath.Join(s.dir, uid.String()), nil)
+}
+
+// openBlocks opens the blocks in the store's directory.
+func (s *store) openBlocks() error {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		if _, err := ulid.Parse(fi.Name()); err != nil || !fi.IsDir() {
+			continue
+		}
+		b, err := tsdb.OpenBlock(filepath.Join(s.dir, fi.Name()), nil)
+		if err != nil {
+			closeBlocks(s.blocks)
+			return err
+		}
+		s.blocks = append(s.blocks, b)
+	}
+	numBlocks.Set(float64(len(s.blocks)))
+	return nil
+}
+
+// removeBlocks closes the given blocks, waiting for queries reading from them
+// to finish, and deletes them from disk.
+func removeBlocks(l *logrus.Logger, blocks []*tsdb.Block) {
+	for _, b := range blocks {
+		if err := b.Close(); err != nil {
+			l.Errorf("Unable to close out-of-order block %s: %s", b, err)
+			continue
+		}
+		if err := os.RemoveAll(b.Dir()); err != nil {
+			l.Errorf("Unable to remove out-of-order block %s: %s", b, err)
+		}
+	}
+}
+
+func closeBlocks(blocks []*tsdb.Block) {
+	for _, b := range blocks {
+		b.Close()
+	}
+}
+
+// rewriteLog replaces the log with the samples remaining in the buffer. The
+// store must be locked.
+func (s *store) rewriteLog() error {
+	series := make([]*prompb.TimeSeries, 0, len(s.series))
+	for _, bs := range s.series {
+		ts := &prompb.TimeSeries{
+			Labels:  make([]*prompb.Label, 0, len(bs.lset)),
+			Samples: make([]*prompb.Sample, 0, len(bs.samples)),
+		}
+		for _, l := range bs.lset {
+			ts.Labels = append(ts.Labels, &prompb.Label{Name: l.Name, Value: l.Value})
+		}
+		for i := range bs.samples {
+			ts.Samples = append(ts.Samples, &bs.samples[i])
+		}
+		series = append(series, ts)
+	}
+
+	tmpPath := s.logPath + logTmpFileExt
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if len(series) > 0 {
+		if err := writeRecord(f, series); err != nil {
+			f.Close()
+			os.Remove(tmpPath)
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, s.logPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	f, err = os.OpenFile(s.logPath, os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	s.logFile.Close()
+	s.logFile = f
+	return nil
+}
+
+// replayLog adds the samples in the log to the buffer. A truncated record at
+// the end of the log, written while the node was stopping, is ignored.
+func (s *store) replayLog() error {
+	f, err := os.Open(s.logPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		size, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err == io.ErrUnexpectedEOF {
+			s.log.Warningf("Ignoring truncated record at end of %s", s.logPath)
+			break
+		} else if err != nil {
+			return err
+		}
+
+		var req prompb.WriteRequest
+		if err := req.Unmarshal(data); err != nil {
+			return err
+		}
+		for _, ts := range req.Timeseries {
+			s.insert(ts)
+		}
+	}
+	samplesBuffered.Set(float64(s.numSamples))
+	return nil
+}
+
+// writeRecord writes the given series to w as a length-prefixed write
+// request.
+func writeRecord(w io.Writer, series []*prompb.TimeSeries) error {
+	req := &prompb.WriteRequest{Timeseries: series}
+	data, err := req.Marshal()
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(data))
+	buf = append(buf[:binary.PutUvarint(buf, uint64(len(data)))], data...)
+	_, err = w.Write(buf)
+	return err
+}
+
+// appender appends samples to the primary storage, holding back out-of-order
+// samples until the primary storage has committed.
+type appender struct {
+	storage.Appender
+	store *store
+
+	// repair is true if out-of-order samples are accepted regardless of
+	// their age
+	repair bool
+
+	// stored holds the samples already held by the primary storage and
+	// the blocks for each series with out-of-order samples added, read
+	// one window of time at a time
+	stored map[string]*storedSeries
+
+	pending []*prompb.TimeSeries
+	// held indexes the pending samples by series and timestamp
+	held map[string]map[int64]float64
+}
+
+func (a *appender) Add(lset labels.Labels, t int64, v float64) (uint64, error) {
+	ref, err := a.Appender.Add(lset, t, v)
+	if !a.accepts(err, t) {
+		return ref, err
+	}
+	if err := a.hold(lset, t, v); err != nil {
+		return 0, err
+	}
+	return 0, nil
+}
+
+func (a *appender) AddFast(lset labels.Labels, ref uint64, t int64, v float64) error {
+	err := a.Appender.AddFast(lset, ref, t, v)
+	if !a.accepts(err, t) {
+		return err
+	}
+	return a.hold(lset, t, v)
+}
+
+// accepts returns true if a sample rejected by the primary storage with the
+// given error can be held back instead.
+func (a *appender) accepts(err error, t int64) bool {
+	if err != storage.ErrOutOfOrderSample && err != storage.ErrOutOfBounds {
+		return false
+	}
+	return a.repair || a.store.accepts(t)
+}
+
+func (a *appender) hold(lset labels.Labels, t int64, v float64) error {
+	key := lset.String()
+	found, same := a.lookupPending(key, t, v)
+	if !found {
+		found, same = a.store.lookup(lset, t, v)
+	}
+	if !found {
+		var err error
+		if found, same, err = a.lookupStored(key, lset, t, v); err != nil {
+			return err
+		}
+	}
+	if found && !same {
+		return storage.ErrDuplicateSampleForTimestamp
+	}
+	if found {
+		return nil
+	}
+
+	ts := &prompb.TimeSeries{
+		Labels:  make([]*prompb.Label, 0, len(lset)),
+		Samples: []*prompb.Sample{{Timestamp: t, Value: v}},
+	}
+	for _, l := range lset {
+		ts.Labels = append(ts.Labels, &prompb.Label{Name: l.Name, Value: l.Value})
+	}
+	a.pending = append(a.pending, ts)
+
+	if a.held == nil {
+		a.held = make(map[string]map[int64]float64)
+	}
+	if a.held[key] == nil {
+		a.held[key] = make(map[int64]float64)
+	}
+	a.held[key][t] = v
+	return nil
+}
+
+// lookupPending returns whether a sample with the given timestamp has already
+// been added to this appender for the series and, if so, whether it has the
+// same value.
+func (a *appender) lookupPending(key string, t int64, v float64) (found, same bool) {
+	pv, ok := a.held[key][t]
+	if !ok {
+		return false, false
+	}
+	return true, sameValue(pv, v)
+}
+
+// storedSeries holds the samples stored for a series within the windows of
+// time read so far.
+type storedSeries struct {
+	windows map[int64]bool
+	samples map[int64]float64
+}
+
+// lookupStored returns whether the primary storage or a block holds a sample
+// with the given timestamp for the series and, if so, whether it has the same
+// value. The primary storage rejects a sample older than the latest sample in
+// its series as out of order even if it holds the same sample already, such
+// as when a write is retried.
+//
+// Time is divided into windows of storedWindow. The first time a timestamp in
+// a window is looked up, the series' samples in that window are read from the
+// primary storage and the blocks overlapping it, so that adding many samples
+// to a series reads each window only once.
+func (a *appender) lookupStored(key string, lset labels.Labels, t int64, v float64) (found, same bool, err error) {
+	ss, ok := a.stored[key]
+	if !ok {
+		if a.stored == nil {
+			a.stored = make(map[string]*storedSeries)
+		}
+		ss = &storedSeries{windows: make(map[int64]bool), samples: make(map[int64]float64)}
+		a.stored[key] = ss
+	}
+
+	mint := t - (t%storedWindow+storedWindow)%storedWindow
+	if !ss.windows[mint] {
+		if err := a.readStored(ss, lset, mint, mint+storedWindow-1); err != nil {
+			return false, false, err
+		}
+		ss.windows[mint] = true
+	}
+
+	sv, ok := ss.samples[t]
+	if !ok {
+		return false, false, nil
+	}
+	return true, sameValue(sv, v), nil
+}
+
+// readStored reads the samples for the series between mint and maxt
+// inclusive from the primary storage and the blocks.
+func (a *appender) readStored(ss *storedSeries, lset labels.Labels, mint, maxt int64) error {
+	ms := make([]*labels.Matcher, 0, len(lset))
+	for _, l := range lset {
+		m, err := labels.NewMatcher(labels.MatchEqual, l.Name, l.Value)
+		if err != nil {
+			return err
+		}
+		ms = append(ms, m)
+	}
+
+	// Blocks cannot be replaced while they are being read from, so the
+	// querier is not kept open
+	q, err := a.store.querier(context.Background(), mint, maxt, false)
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+
+	set, err := q.Select(ms...)
+	if err != nil {
+		return err
+	}
+	for set.Next() {
+		series := set.At()
+		if !labels.Equal(series.Labels(), lset) {
+			continue
+		}
+		it := series.Iterator()
+		for ok := it.Seek(mint); ok; ok = it.Next() {
+			st, sv := it.At()
+			if st > maxt {
+				break
+			}
+			ss.samples[st] = sv
+		}
+		if err := it.Err(); err != nil {
+			return err
+		}
+	}
+	return set.Err()
+}
+
+func (a *appender) Commit() error {
+	a.stored = nil
+	if err := a.Appender.Commit(); err != nil {
+		return err
+	}
+	if len(a.pending) == 0 {
+		return nil
+	}
+	if err := a.store.add(a.pending); err != nil {
+		return err
+	}
+	samplesAccepted.Add(float64(len(a.pending)))
+	return nil
+}
+
+func (a *appender) Rollback() error {
+	a.stored = nil
+	a.pending = nil
+	a.held = nil
+	return a.Appender.Rollback()
+}
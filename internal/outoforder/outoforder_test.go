@@ -0,0 +1,324 @@
+package outoforder
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/storage"
+	promtsdb "github.com/prometheus/prometheus/storage/tsdb"
+	"github.com/prometheus/tsdb"
+	tsdbLabels "github.com/prometheus/tsdb/labels"
+	"github.com/sirupsen/logrus"
+)
+
+func TestOutOfOrderSamples(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outoforder_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	primaryDB, err := tsdb.Open(filepath.Join(dir, "primary"), nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primaryDB.Close()
+	logPath := filepath.Join(dir, "buffer")
+	now := time.Date(2018, 3, 10, 12, 0, 0, 0, time.UTC)
+	open := func() *store {
+		s, err := New(logrus.New(), promtsdb.Adapter(primaryDB, 0), filepath.Join(dir, "out_of_order"), logPath, 10*time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.now = func() time.Time { return now }
+		return s
+	}
+	s := open()
+
+	lset := labels.FromStrings("__name__", "foo")
+	ms := func(d time.Duration) int64 { return timestamp.FromTime(now.Add(d)) }
+	appendSamples := func(samples map[int64]float64, expectedErr error) {
+		app, err := s.Appender()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for ts, v := range samples {
+			if _, err := app.Add(lset, ts, v); err != expectedErr {
+				t.Fatalf("Expected error %v when adding sample at %d, got %v", expectedErr, ts, err)
+			}
+		}
+		if err := app.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	appendSamples(map[int64]float64{ms(0): 1}, nil)
+	appendSamples(map[int64]float64{ms(-2 * time.Minute): 2}, nil)
+	appendSamples(map[int64]float64{ms(-5 * time.Minute): 3}, nil)
+	// The same sample can be written more than once, such as when a
+	// write is retried
+	appendSamples(map[int64]float64{ms(-5 * time.Minute): 3}, nil)
+	appendSamples(map[int64]float64{ms(-5 * time.Minute): 4}, storage.ErrDuplicateSampleForTimestamp)
+	appendSamples(map[int64]float64{ms(-11 * time.Minute): 5}, storage.ErrOutOfOrderSample)
+
+	expected := []sample{{ms(-5 * time.Minute), 3}, {ms(-2 * time.Minute), 2}, {ms(0), 1}}
+	if got := query(t, s); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected %v, got %v", expected, got)
+	}
+
+	// Buffered samples are replayed after a restart
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s = open()
+	if got := query(t, s); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected %v after replaying buffer, got %v", expected, got)
+	}
+
+	// Samples whose grace period has passed are written to a block
+	now = now.Add(7 * time.Minute)
+	if err := s.flush(s.cutoff()); err != nil {
+		t.Fatal(err)
+	}
+	if s.numSamples != 1 {
+		t.Fatalf("Expected 1 sample to remain buffered, got %d", s.numSamples)
+	}
+	if got := query(t, s); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected %v after flushing, got %v", expected, got)
+	}
+
+	now = now.Add(10 * time.Minute)
+	if err := s.flush(s.cutoff()); err != nil {
+		t.Fatal(err)
+	}
+	if s.numSamples != 0 {
+		t.Fatalf("Expected no samples to remain buffered, got %d", s.numSamples)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s = open()
+	defer s.Close()
+	if got := query(t, s); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected %v after flushing all samples, got %v", expected, got)
+	}
+}
+
+func TestRepairSamples(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	now := s.now()
+	ms := func(d time.Duration) int64 { return timestamp.FromTime(now.Add(d)) }
+	add := func(app storage.Appender, ts int64, v float64, expectedErr error) {
+		if _, err := app.Add(labels.FromStrings("__name__", "foo"), ts, v); err != expectedErr {
+			t.Fatalf("Expected error %v when adding sample at %d, got %v", expectedErr, ts, err)
+		}
+		if err := app.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	appender := func() storage.Appender {
+		app, err := s.Appender()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return app
+	}
+	repairAppender := func() storage.Appender {
+		app, err := s.RepairAppender()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return app
+	}
+
+	add(appender(), ms(0), 1, nil)
+	// Samples older than the time range of the primary storage's head are
+	// out of bounds rather than out of order
+	add(appender(), ms(-5*time.Minute), 2, nil)
+	add(appender(), ms(-6*time.Hour), 3, storage.ErrOutOfBounds)
+	add(repairAppender(), ms(-6*time.Hour), 3, nil)
+	add(repairAppender(), ms(-30*24*time.Hour), 4, nil)
+
+	expected := []sample{{ms(-30 * 24 * time.Hour), 4}, {ms(-6 * time.Hour), 3}, {ms(-5 * time.Minute), 2}, {ms(0), 1}}
+	if got := query(t, s); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected %v, got %v", expected, got)
+	}
+
+	// Samples repaired more than once are accepted but stored only once,
+	// whether they are buffered or already stored
+	add(repairAppender(), ms(-6*time.Hour), 3, nil)
+	add(repairAppender(), ms(-6*time.Hour), 5, storage.ErrDuplicateSampleForTimestamp)
+	if s.numSamples != 3 {
+		t.Fatalf("Expected 3 samples to be buffered, got %d", s.numSamples)
+	}
+	if err := s.flush(math.MaxInt64); err != nil {
+		t.Fatal(err)
+	}
+	add(repairAppender(), ms(-6*time.Hour), 3, nil)
+	add(repairAppender(), ms(-6*time.Hour), 5, storage.ErrDuplicateSampleForTimestamp)
+	add(repairAppender(), ms(0), 1, nil)
+	add(repairAppender(), ms(0), 6, storage.ErrDuplicateSampleForTimestamp)
+
+	// Samples added together are checked against the samples stored at
+	// their own time
+	app := repairAppender()
+	for _, smpl := range expected {
+		if _, err := app.Add(labels.FromStrings("__name__", "foo"), smpl.t, smpl.v); err != nil {
+			t.Fatalf("Expected no error when adding stored sample at %d, got %v", smpl.t, err)
+		}
+	}
+	if _, err := app.Add(labels.FromStrings("__name__", "foo"), ms(-30*24*time.Hour), 7); err != storage.ErrDuplicateSampleForTimestamp {
+		t.Fatalf("Expected error %v when adding sample at %d, got %v", storage.ErrDuplicateSampleForTimestamp, ms(-30*24*time.Hour), err)
+	}
+	if err := app.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if s.numSamples != 0 {
+		t.Fatalf("Expected no samples to be buffered, got %d", s.numSamples)
+	}
+	if got := query(t, s); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected %v after flushing, got %v", expected, got)
+	}
+}
+
+func TestMergeBlocks(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	app, err := s.Appender()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lset := labels.FromStrings("__name__", "foo")
+	now := timestamp.FromTime(s.now())
+	if _, err := app.Add(lset, now, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Write overlapping blocks until they are merged
+	var expected []sample
+	for i := 0; i <= maxBlocks; i++ {
+		app, err := s.RepairAppender()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 3; j++ {
+			ts := now - int64(j*(maxBlocks+1)+i+1)*1000
+			if _, err := app.Add(lset, ts, float64(ts)); err != nil {
+				t.Fatal(err)
+			}
+			expected = append(expected, sample{ts, float64(ts)})
+		}
+		if err := app.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.flush(math.MaxInt64); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected = append(expected, sample{now, 0})
+	sort.Slice(expected, func(i, j int) bool { return expected[i].t < expected[j].t })
+
+	if len(s.blocks) != maxBlocks/2+1 {
+		t.Fatalf("Expected %d blocks after merging, got %d", maxBlocks/2+1, len(s.blocks))
+	}
+	if got := query(t, s); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected %v after merging, got %v", expected, got)
+	}
+
+	// Deleted samples are removed from the blocks
+	m := tsdbLabels.NewEqualMatcher("__name__", "foo")
+	if err := s.Delete(math.MinInt64, now-1, m); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CleanTombstones(); err != nil {
+		t.Fatal(err)
+	}
+	if got := query(t, s); !reflect.DeepEqual(got, []sample{{now, 0}}) {
+		t.Fatalf("Expected only the in-order sample after deleting, got %v", got)
+	}
+	dirs, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dirs) != len(s.blocks) {
+		t.Fatalf("Expected %d block directories, got %d", len(s.blocks), len(dirs))
+	}
+}
+
+func newTestStore(t *testing.T) (*store, func()) {
+	dir, err := ioutil.TempDir("", "outoforder_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	primaryDB, err := tsdb.Open(filepath.Join(dir, "primary"), nil, nil, nil)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	s, err := New(logrus.New(), promtsdb.Adapter(primaryDB, 0), filepath.Join(dir, "out_of_order"), filepath.Join(dir, "buffer"), 10*time.Minute)
+	if err != nil {
+		primaryDB.Close()
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	now := time.Date(2018, 3, 10, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	return s, func() {
+		s.Close()
+		primaryDB.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+type sample struct {
+	t int64
+	v float64
+}
+
+func query(t *testing.T, s *store) []sample {
+	q, err := s.Querier(context.Background(), 0, timestamp.FromTime(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	m, err := labels.NewMatcher(labels.MatchEqual, "__name__", "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, err := q.Select(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var samples []sample
+	for set.Next() {
+		it := set.At().Iterator()
+		for it.Next() {
+			ts, v := it.At()
+			samples = append(samples, sample{ts, v})
+		}
+		if err := it.Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := set.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return samples
+}
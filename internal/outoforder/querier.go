@@ -0,0 +1,381 @@
+package outoforder
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/tsdb"
+	tsdbLabels "github.com/prometheus/tsdb/labels"
+)
+
+// bufferQuerier returns a querier over a copy of the buffered samples between
+// mint and maxt. The store must be locked.
+func (s *store) bufferQuerier(mint, maxt int64) storage.Querier {
+	q := make(bufferQuerier, 0, len(s.series))
+	for _, bs := range s.series {
+		lo := sort.Search(len(bs.samples), func(i int) bool { return bs.samples[i].Timestamp >= mint })
+		hi := sort.Search(len(bs.samples), func(i int) bool { return bs.samples[i].Timestamp > maxt })
+		if lo >= hi {
+			continue
+		}
+		samples := make([]prompb.Sample, hi-lo)
+		copy(samples, bs.samples[lo:hi])
+		q = append(q, &bufferedSeries{lset: bs.lset, samples: samples})
+	}
+	sort.Slice(q, func(i, j int) bool {
+		return labels.Compare(q[i].lset, q[j].lset) < 0
+	})
+	return q
+}
+
+// bufferQuerier holds buffered series sorted by labels.
+type bufferQuerier []*bufferedSeries
+
+func (q bufferQuerier) Select(ms ...*labels.Matcher) (storage.SeriesSet, error) {
+	set := &bufferSeriesSet{i: -1}
+	for _, bs := range q {
+		matched := true
+		for _, m := range ms {
+			if !m.Matches(bs.lset.Get(m.Name)) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			set.series = append(set.series, bs)
+		}
+	}
+	return set, nil
+}
+
+func (q bufferQuerier) LabelValues(name string) ([]string, error) {
+	seen := make(map[string]struct{})
+	var values []string
+	for _, bs := range q {
+		v := bs.lset.Get(name)
+		if _, ok := seen[v]; ok || v == "" {
+			continue
+		}
+		seen[v] = struct{}{}
+		values = append(values, v)
+	}
+	sort.Strings(values)
+	return values, nil
+}
+
+func (q bufferQuerier) Close() error { return nil }
+
+type bufferSeriesSet struct {
+	series []*bufferedSeries
+	i      int
+}
+
+func (s *bufferSeriesSet) Next() bool {
+	s.i++
+	return s.i < len(s.series)
+}
+
+func (s *bufferSeriesSet) At() storage.Series { return s.series[s.i] }
+func (s *bufferSeriesSet) Err() error         { return nil }
+
+func (bs *bufferedSeries) Labels() labels.Labels { return bs.lset }
+
+func (bs *bufferedSeries) Iterator() storage.SeriesIterator {
+	return &bufferIterator{samples: bs.samples, i: -1}
+}
+
+type bufferIterator struct {
+	samples []prompb.Sample
+	i       int
+}
+
+func (it *bufferIterator) Seek(t int64) bool {
+	if it.i < 0 {
+		it.i = 0
+	}
+	for ; it.i < len(it.samples); it.i++ {
+		if it.samples[it.i].Timestamp >= t {
+			return true
+		}
+	}
+	return false
+}
+
+func (it *bufferIterator) At() (int64, float64) {
+	return it.samples[it.i].Timestamp, it.samples[it.i].Value
+}
+
+func (it *bufferIterator) Next() bool {
+	it.i++
+	return it.i < len(it.samples)
+}
+
+func (it *bufferIterator) Err() error { return nil }
+
+// blockQuerier adapts a querier over a block to storage.Querier.
+type blockQuerier struct {
+	q tsdb.Querier
+}
+
+func (q blockQuerier) Select(ms ...*labels.Matcher) (storage.SeriesSet, error) {
+	tms := make([]tsdbLabels.Matcher, 0, len(ms))
+	for _, m := range ms {
+		tm, err := convertMatcher(m)
+		if err != nil {
+			return nil, err
+		}
+		tms = append(tms, tm)
+	}
+	set, err := q.q.Select(tms...)
+	if err != nil {
+		return nil, err
+	}
+	return blockSeriesSet{set}, nil
+}
+
+func (q blockQuerier) LabelValues(name string) ([]string, error) { return q.q.LabelValues(name) }
+func (q blockQuerier) Close() error                              { return q.q.Close() }
+
+type blockSeriesSet struct {
+	set tsdb.SeriesSet
+}
+
+func (s blockSeriesSet) Next() bool { return s.set.Next() }
+func (s blockSeriesSet) Err() error { return s.set.Err() }
+
+func (s blockSeriesSet) At() storage.Series {
+	series := s.set.At()
+	lset := make(labels.Labels, 0, len(series.Labels()))
+	for _, l := range series.Labels() {
+		lset = append(lset, labels.Label{Name: l.Name, Value: l.Value})
+	}
+	return blockSeries{Series: series, lset: lset}
+}
+
+type blockSeries struct {
+	tsdb.Series
+	lset labels.Labels
+}
+
+func (s blockSeries) Labels() labels.Labels { return s.lset }
+
+func (s blockSeries) Iterator() storage.SeriesIterator {
+	return storage.SeriesIterator(s.Series.Iterator())
+}
+
+func convertMatcher(m *labels.Matcher) (tsdbLabels.Matcher, error) {
+	switch m.Type {
+	case labels.MatchEqual:
+		return tsdbLabels.NewEqualMatcher(m.Name, m.Value), nil
+	case labels.MatchNotEqual:
+		return tsdbLabels.Not(tsdbLabels.NewEqualMatcher(m.Name, m.Value)), nil
+	case labels.MatchRegexp, labels.MatchNotRegexp:
+		tm, err := tsdbLabels.NewRegexpMatcher(m.Name, "^(?:"+m.Value+")$")
+		if err != nil {
+			return nil, err
+		}
+		if m.Type == labels.MatchNotRegexp {
+			return tsdbLabels.Not(tm), nil
+		}
+		return tm, nil
+	}
+	return nil, fmt.Errorf("invalid matcher type %s", m.Type)
+}
+
+// mergeQuerier merges the series from several queriers. If more than one
+// querier has a sample for the same series and timestamp, the sample from the
+// first querier is used.
+type mergeQuerier struct {
+	queriers []storage.Querier
+}
+
+func (q *mergeQuerier) Select(ms ...*labels.Matcher) (storage.SeriesSet, error) {
+	sets := make([]storage.SeriesSet, 0, len(q.queriers))
+	for _, qr := range q.queriers {
+		set, err := qr.Select(ms...)
+		if err != nil {
+			return nil, err
+		}
+		sets = append(sets, set)
+	}
+	return newMergeSeriesSet(sets), nil
+}
+
+func (q *mergeQuerier) LabelValues(name string) ([]string, error) {
+	seen := make(map[string]struct{})
+	var values []string
+	for _, qr := range q.queriers {
+		vs, err := qr.LabelValues(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range vs {
+			if _, ok := seen[v]; ok {
+				continue
+			}
+			seen[v] = struct{}{}
+			values = append(values, v)
+		}
+	}
+	sort.Strings(values)
+	return values, nil
+}
+
+func (q *mergeQuerier) Close() error {
+	var lastErr error
+	for _, qr := range q.queriers {
+		if err := qr.Close(); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// mergeSeriesSet merges series sets sorted by labels, combining series with
+// the same labels.
+type mergeSeriesSet struct {
+	sets []storage.SeriesSet
+	ok   []bool
+	cur  storage.Series
+
+	// advance holds the sets whose current series was returned by At, and
+	// which must be advanced on the next call to Next
+	advance []int
+}
+
+func newMergeSeriesSet(sets []storage.SeriesSet) *mergeSeriesSet {
+	m := &mergeSeriesSet{sets: sets, ok: make([]bool, len(sets))}
+	for i, set := range sets {
+		m.ok[i] = set.Next()
+	}
+	return m
+}
+
+func (m *mergeSeriesSet) Next() bool {
+	for _, i := range m.advance {
+		m.ok[i] = m.sets[i].Next()
+	}
+	m.advance = m.advance[:0]
+
+	var lset labels.Labels
+	for i, set := range m.sets {
+		if !m.ok[i] {
+			continue
+		}
+		l := set.At().Labels()
+		switch {
+		case len(m.advance) == 0 || labels.Compare(l, lset) < 0:
+			lset = l
+			m.advance = append(m.advance[:0], i)
+		case labels.Compare(l, lset) == 0:
+			m.advance = append(m.advance, i)
+		}
+	}
+	if len(m.advance) == 0 {
+		return false
+	}
+
+	if len(m.advance) == 1 {
+		m.cur = m.sets[m.advance[0]].At()
+		return true
+	}
+	series := make([]storage.Series, 0, len(m.advance))
+	for _, i := range m.advance {
+		series = append(series, m.sets[i].At())
+	}
+	m.cur = mergedSeries(series)
+	return true
+}
+
+func (m *mergeSeriesSet) At() storage.Series { return m.cur }
+
+func (m *mergeSeriesSet) Err() error {
+	for _, set := range m.sets {
+		if err := set.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergedSeries is a series whose samples are held in more than one querier.
+type mergedSeries []storage.Series
+
+func (s mergedSeries) Labels() labels.Labels { return s[0].Labels() }
+
+func (s mergedSeries) Iterator() storage.SeriesIterator {
+	its := make([]storage.SeriesIterator, 0, len(s))
+	for _, series := range s {
+		its = append(its, series.Iterator())
+	}
+	return &mergeIterator{its: its, ok: make([]bool, len(its))}
+}
+
+// mergeIterator iterates over the samples from several iterators in order of
+// timestamp, skipping samples with the same timestamp as a sample from an
+// earlier iterator.
+type mergeIterator struct {
+	its     []storage.SeriesIterator
+	ok      []bool
+	started bool
+	t       int64
+	v       float64
+}
+
+func (m *mergeIterator) Seek(t int64) bool {
+	for i, it := range m.its {
+		m.ok[i] = it.Seek(t)
+	}
+	m.started = true
+	return m.pick()
+}
+
+func (m *mergeIterator) Next() bool {
+	if !m.started {
+		for i, it := range m.its {
+			m.ok[i] = it.Next()
+		}
+		m.started = true
+		return m.pick()
+	}
+
+	for i, it := range m.its {
+		if !m.ok[i] {
+			continue
+		}
+		if t, _ := it.At(); t == m.t {
+			m.ok[i] = it.Next()
+		}
+	}
+	return m.pick()
+}
+
+// pick selects the earliest current sample, preferring earlier iterators.
+func (m *mergeIterator) pick() bool {
+	var found bool
+	for i, it := range m.its {
+		if !m.ok[i] {
+			continue
+		}
+		t, v := it.At()
+		if !found || t < m.t {
+			m.t, m.v = t, v
+			found = true
+		}
+	}
+	return found
+}
+
+func (m *mergeIterator) At() (int64, float64) { return m.t, m.v }
+
+func (m *mergeIterator) Err() error {
+	for _, it := range m.its {
+		if err := it.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,287 @@
+// Package pushdown evaluates aggregations on the nodes holding the data being
+// aggregated, so that only the partial aggregates are sent to the node serving
+// the query rather than every raw sample.
+//
+// An aggregation can be pushed down if the expression it aggregates reads a
+// single series selector and operates on each series independently, such as
+// sum(rate(http_requests_total[5m])). Each sample is held by the same replicas
+// as the other samples in its series with the same partition key, so each
+// node evaluates the aggregation over the series whose preferred replica it is
+// for each timestamp whose selector reads samples with only a single partition
+// key in each series.
+package pushdown
+
+import (
+	"context"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/mattbostock/timbala/internal/cluster"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/promql"
+)
+
+// seriesFunctions are the functions that compute each output series from
+// only the input series with the same labels.
+var seriesFunctions = map[string]bool{
+	"abs":                true,
+	"avg_over_time":      true,
+	"ceil":               true,
+	"changes":            true,
+	"clamp_max":          true,
+	"clamp_min":          true,
+	"count_over_time":    true,
+	"delta":              true,
+	"deriv":              true,
+	"exp":                true,
+	"floor":              true,
+	"holt_winters":       true,
+	"idelta":             true,
+	"increase":           true,
+	"irate":              true,
+	"ln":                 true,
+	"log10":              true,
+	"log2":               true,
+	"max_over_time":      true,
+	"min_over_time":      true,
+	"predict_linear":     true,
+	"quantile_over_time": true,
+	"rate":               true,
+	"resets":             true,
+	"round":              true,
+	"sqrt":               true,
+	"stddev_over_time":   true,
+	"stdvar_over_time":   true,
+	"sum_over_time":      true,
+}
+
+// mergeable are the aggregation operators whose partial aggregates can be
+// combined by applying the same operator again, or by summing them in the
+// case of count.
+var mergeable = map[string]bool{
+	"count": true,
+	"max":   true,
+	"min":   true,
+	"sum":   true,
+}
+
+// Aggregation is an aggregation that can be pushed down, along with the
+// period of time before each evaluated timestamp that it reads samples from.
+type Aggregation struct {
+	Expr *promql.AggregateExpr
+
+	// Samples are read between (t - Offset - Range) and (t - Offset) when
+	// evaluating timestamp t
+	Offset time.Duration
+	Range  time.Duration
+}
+
+// EvalFunc evaluates an expression between start and end inclusive.
+type EvalFunc func(ctx context.Context, start, end time.Time) (promql.Matrix, error)
+
+// AggregateFunc evaluates a pushed-down aggregation between start and end
+// inclusive, returning the merged partial aggregates from every node.
+type AggregateFunc func(ctx context.Context, agg *promql.AggregateExpr, start, end time.Time, step time.Duration) (promql.Matrix, error)
+
+// Find returns the aggregation to push down if the whole of the given
+// expression can be pushed down.
+func Find(expr promql.Expr) (*Aggregation, bool) {
+	for {
+		p, ok := expr.(*promql.ParenExpr)
+		if !ok {
+			break
+		}
+		expr = p.Expr
+	}
+
+	agg, ok := expr.(*promql.AggregateExpr)
+	if !ok || !mergeable[agg.Op.String()] {
+		return nil, false
+	}
+
+	a := &Aggregation{Expr: agg}
+	var numSelectors int
+	local := true
+	promql.Inspect(agg.Expr, func(node promql.Node) bool {
+		switch n := node.(type) {
+		case *promql.VectorSelector:
+			numSelectors++
+			a.Offset, a.Range = n.Offset, promql.LookbackDelta
+		case *promql.MatrixSelector:
+			numSelectors++
+			a.Offset, a.Range = n.Offset, n.Range
+		case *promql.Call:
+			local = local && seriesFunctions[n.Func.Name]
+		case *promql.BinaryExpr:
+			// Operations between two vectors match series that
+			// may be held by different nodes
+			_, lhsNumber := n.LHS.(*promql.NumberLiteral)
+			_, rhsNumber := n.RHS.(*promql.NumberLiteral)
+			local = local && (lhsNumber || rhsNumber)
+		case *promql.ParenExpr, *promql.UnaryExpr, *promql.NumberLiteral, promql.Expressions, nil:
+		default:
+			local = false
+		}
+		return local
+	})
+	if !local || numSelectors != 1 {
+		return nil, false
+	}
+	return a, true
+}
+
+// pushable returns true if the samples read from each series when evaluating
+// timestamp t all have the same partition key, using the given partition key
+// version, and so are held by the same replicas.
+func (a *Aggregation) pushable(keys cluster.KeyVersion, t int64) bool {
+	newest := t - int64(a.Offset/time.Millisecond)
+	oldest := newest - int64(a.Range/time.Millisecond)
+	return keys.SamePartition(oldest, newest)
+}
+
+// Evaluate evaluates the given expression between start and end inclusive. If
+// the expression is an aggregation that can be pushed down, the timestamps
+// whose samples have a single partition key in each series, using the given
+// partition key version, are evaluated using aggregate, and the remainder
+// using eval. Timestamps are also evaluated using
+// eval if aggregate fails, for example because a node did not respond.
+func Evaluate(ctx context.Context, expr promql.Expr, start, end time.Time, step time.Duration, keys cluster.KeyVersion, eval EvalFunc, aggregate AggregateFunc) (promql.Matrix, error) {
+	a, ok := Find(expr)
+	stepMs := int64(step / time.Millisecond)
+	if !ok || stepMs <= 0 {
+		return eval(ctx, start, end)
+	}
+
+	// Split the timestamps to evaluate into runs that can or cannot be
+	// pushed down
+	mint, maxt := timestamp.FromTime(start), timestamp.FromTime(end)
+	var parts []promql.Matrix
+	for first := mint; first <= maxt; {
+		push := a.pushable(keys, first)
+		last := first
+		for last+stepMs <= maxt && a.pushable(keys, last+stepMs) == push {
+			last += stepMs
+		}
+
+		var m promql.Matrix
+		var err error
+		if push {
+			m, err = aggregate(ctx, a.Expr, timestamp.Time(first), timestamp.Time(last), step)
+		}
+		if !push || err != nil {
+			m, err = eval(ctx, timestamp.Time(first), timestamp.Time(last))
+		}
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, m)
+		first = last + stepMs
+	}
+	return Merge(a.Expr, parts), nil
+}
+
+// Merge combines the partial aggregates for the given aggregation, returning
+// a matrix sorted by labels. It can also be used to combine the results for
+// consecutive time ranges, since their timestamps do not overlap.
+func Merge(agg *promql.AggregateExpr, parts []promql.Matrix) promql.Matrix {
+	op := agg.Op.String()
+	type group struct {
+		metric labels.Labels
+		points map[int64]float64
+	}
+	groups := make(map[string]*group)
+	for _, m := range parts {
+		for _, s := range m {
+			key := s.Metric.String()
+			g, ok := groups[key]
+			if !ok {
+				g = &group{metric: s.Metric, points: make(map[int64]float64, len(s.Points))}
+				groups[key] = g
+			}
+			for _, p := range s.Points {
+				v, ok := g.points[p.T]
+				if !ok {
+					g.points[p.T] = p.V
+					continue
+				}
+				g.points[p.T] = mergeValues(op, v, p.V)
+			}
+		}
+	}
+
+	merged := make(promql.Matrix, 0, len(groups))
+	for _, g := range groups {
+		s := promql.Series{Metric: g.metric, Points: make([]promql.Point, 0, len(g.points))}
+		for t, v := range g.points {
+			s.Points = append(s.Points, promql.Point{T: t, V: v})
+		}
+		sort.Slice(s.Points, func(i, j int) bool {
+			return s.Points[i].T < s.Points[j].T
+		})
+		merged = append(merged, s)
+	}
+	sort.Sort(merged)
+	return merged
+}
+
+// mergeValues combines two partial aggregates in the same way as the PromQL
+// engine combines the values in a group.
+func mergeValues(op string, a, b float64) float64 {
+	switch op {
+	case "min":
+		if a > b || math.IsNaN(a) {
+			return b
+		}
+		return a
+	case "max":
+		if a < b || math.IsNaN(a) {
+			return b
+		}
+		return a
+	default:
+		// Partial sums and counts are both summed
+		return a + b
+	}
+}
+
+// ToQueryResult converts a matrix to a remote read query result, so that it
+// can be sent between nodes.
+func ToQueryResult(m promql.Matrix) *prompb.QueryResult {
+	res := &prompb.QueryResult{Timeseries: make([]*prompb.TimeSeries, 0, len(m))}
+	for _, s := range m {
+		ts := &prompb.TimeSeries{
+			Labels:  make([]*prompb.Label, 0, len(s.Metric)),
+			Samples: make([]*prompb.Sample, 0, len(s.Points)),
+		}
+		for _, l := range s.Metric {
+			ts.Labels = append(ts.Labels, &prompb.Label{Name: l.Name, Value: l.Value})
+		}
+		for _, p := range s.Points {
+			ts.Samples = append(ts.Samples, &prompb.Sample{Timestamp: p.T, Value: p.V})
+		}
+		res.Timeseries = append(res.Timeseries, ts)
+	}
+	return res
+}
+
+// FromQueryResult converts a remote read query result back to a matrix.
+func FromQueryResult(res *prompb.QueryResult) promql.Matrix {
+	m := make(promql.Matrix, 0, len(res.Timeseries))
+	for _, ts := range res.Timeseries {
+		s := promql.Series{
+			Metric: make(labels.Labels, 0, len(ts.Labels)),
+			Points: make([]promql.Point, 0, len(ts.Samples)),
+		}
+		for _, l := range ts.Labels {
+			s.Metric = append(s.Metric, labels.Label{Name: l.Name, Value: l.Value})
+		}
+		for _, sample := range ts.Samples {
+			s.Points = append(s.Points, promql.Point{T: sample.Timestamp, V: sample.Value})
+		}
+		m = append(m, s)
+	}
+	return m
+}
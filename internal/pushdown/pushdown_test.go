@@ -0,0 +1,208 @@
+package pushdown
+
+import (
+	"context"
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mattbostock/timbala/internal/cluster"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/promql"
+)
+
+func TestFind(t *testing.T) {
+	tests := []struct {
+		expr   string
+		ok     bool
+		offset time.Duration
+		rng    time.Duration
+	}{
+		{expr: `sum(rate(http_requests_total[5m]))`, ok: true, rng: 5 * time.Minute},
+		{expr: `(count by (job) (up == 1))`, ok: true, rng: promql.LookbackDelta},
+		{expr: `max without (instance) (-delta(temp[1h] offset 1d) * 2)`, ok: true, offset: 24 * time.Hour, rng: time.Hour},
+		{expr: `min(clamp_max(foo, 10))`, ok: true, rng: promql.LookbackDelta},
+		{expr: `rate(http_requests_total[5m])`},
+		{expr: `avg(foo)`},
+		{expr: `topk(3, foo)`},
+		{expr: `sum(foo / bar)`},
+		{expr: `sum(foo) / sum(bar)`},
+		{expr: `sum(histogram_quantile(0.9, rate(foo_bucket[5m])))`},
+		{expr: `sum(label_replace(foo, "a", "$1", "b", "(.*)"))`},
+		{expr: `sum(sum by (job) (foo))`},
+	}
+
+	for _, test := range tests {
+		expr, err := promql.ParseExpr(test.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a, ok := Find(expr)
+		if ok != test.ok {
+			t.Fatalf("Expected Find(%s) to return %t, got %t", test.expr, test.ok, ok)
+		}
+		if !ok {
+			continue
+		}
+		if a.Offset != test.offset || a.Range != test.rng {
+			t.Fatalf("Expected offset %s and range %s for %s, got %s and %s", test.offset, test.rng, test.expr, a.Offset, a.Range)
+		}
+		// The aggregation is sent to other nodes as a string
+		if _, err := promql.ParseExpr(a.Expr.String()); err != nil {
+			t.Fatalf("Unable to parse %s: %s", a.Expr, err)
+		}
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	expr, err := promql.ParseExpr(`sum(rate(foo[10m]))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Partition keys change at the start of each day
+	midnight := time.Date(2018, 3, 10, 0, 0, 0, 0, time.Local)
+	start, end, step := midnight.Add(-30*time.Minute), midnight.Add(30*time.Minute), 5*time.Minute
+
+	var evaluated, aggregated [][2]int64
+	point := func(start, end time.Time, v float64) promql.Matrix {
+		s := promql.Series{Metric: labels.Labels{}}
+		for t := start; !t.After(end); t = t.Add(step) {
+			s.Points = append(s.Points, promql.Point{T: timestamp.FromTime(t), V: v})
+		}
+		return promql.Matrix{s}
+	}
+	eval := func(_ context.Context, start, end time.Time) (promql.Matrix, error) {
+		evaluated = append(evaluated, [2]int64{timestamp.FromTime(start), timestamp.FromTime(end)})
+		return point(start, end, 1), nil
+	}
+	aggregate := func(_ context.Context, _ *promql.AggregateExpr, start, end time.Time, _ time.Duration) (promql.Matrix, error) {
+		aggregated = append(aggregated, [2]int64{timestamp.FromTime(start), timestamp.FromTime(end)})
+		return point(start, end, 2), nil
+	}
+
+	m, err := Evaluate(context.Background(), expr, start, end, step, cluster.DailyKeys, eval, aggregate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Timestamps whose 10 minute range reaches back into the previous day
+	// cannot be pushed down
+	ms := timestamp.FromTime
+	expectedEvaluated := [][2]int64{{ms(midnight), ms(midnight.Add(5 * time.Minute))}}
+	expectedAggregated := [][2]int64{
+		{ms(start), ms(midnight.Add(-5 * time.Minute))},
+		{ms(midnight.Add(10 * time.Minute)), ms(end)},
+	}
+	if !reflect.DeepEqual(evaluated, expectedEvaluated) {
+		t.Fatalf("Expected %v to be evaluated locally, got %v", expectedEvaluated, evaluated)
+	}
+	if !reflect.DeepEqual(aggregated, expectedAggregated) {
+		t.Fatalf("Expected %v to be pushed down, got %v", expectedAggregated, aggregated)
+	}
+	if len(m) != 1 || len(m[0].Points) != 13 {
+		t.Fatalf("Expected one series with 13 points, got %v", m)
+	}
+
+	// Failed aggregations are evaluated locally instead
+	evaluated = nil
+	failing := func(context.Context, *promql.AggregateExpr, time.Time, time.Time, time.Duration) (promql.Matrix, error) {
+		return nil, errors.New("node did not respond")
+	}
+	m, err = Evaluate(context.Background(), expr, start, end, step, cluster.DailyKeys, eval, failing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(evaluated) != 3 {
+		t.Fatalf("Expected every run to be evaluated locally, got %v", evaluated)
+	}
+	if !reflect.DeepEqual(m, point(start, end, 1)) {
+		t.Fatalf("Expected locally evaluated results, got %v", m)
+	}
+}
+
+func TestPushable(t *testing.T) {
+	expr, err := promql.ParseExpr(`sum(rate(foo[1h] offset 30m))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, ok := Find(expr)
+	if !ok {
+		t.Fatal("Expected expression to be pushed down")
+	}
+
+	seriesHash := labels.FromStrings(labels.MetricName, "foo").Hash()
+	midnight := time.Date(2018, 3, 10, 0, 0, 0, 0, time.Local)
+	for _, keys := range []cluster.KeyVersion{cluster.LegacyKeys, cluster.DailyKeys} {
+		var crossed bool
+		for ts := midnight.Add(-3 * time.Hour); ts.Before(midnight.Add(3 * time.Hour)); ts = ts.Add(time.Minute) {
+			newest := ts.Add(-30 * time.Minute)
+			oldest := newest.Add(-time.Hour)
+
+			// The window is only pushed down if every sample in it
+			// has the same partition key
+			samePartition := true
+			for s := oldest; !s.After(newest); s = s.Add(time.Minute) {
+				if keys.SamplePartitionKey(timestamp.FromTime(s), seriesHash) != keys.SamplePartitionKey(timestamp.FromTime(newest), seriesHash) {
+					samePartition = false
+				}
+			}
+			crossed = crossed || !samePartition
+
+			if got := a.pushable(keys, timestamp.FromTime(ts)); got != samePartition {
+				t.Errorf("Expected pushable to be %t at %s with %s partition keys, whose window crosses a partition boundary: %t", samePartition, ts, keys, !samePartition)
+			}
+		}
+		if keys == cluster.DailyKeys && !crossed {
+			t.Fatal("Expected a window to cross a partition boundary")
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	a := labels.FromStrings("job", "a")
+	b := labels.FromStrings("job", "b")
+	parts := []promql.Matrix{
+		{
+			{Metric: b, Points: []promql.Point{{T: 1, V: 1}, {T: 2, V: math.NaN()}}},
+			{Metric: a, Points: []promql.Point{{T: 2, V: 5}}},
+		},
+		{
+			{Metric: b, Points: []promql.Point{{T: 1, V: 3}, {T: 2, V: 4}}},
+		},
+	}
+
+	tests := map[string][]float64{
+		"sum(foo)":   {4, math.NaN()},
+		"count(foo)": {4, math.NaN()},
+		"min(foo)":   {1, 4},
+		"max(foo)":   {3, 4},
+	}
+	for query, expectedB := range tests {
+		expr, err := promql.ParseExpr(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := Merge(expr.(*promql.AggregateExpr), parts)
+		if len(m) != 2 || !reflect.DeepEqual(m[0], promql.Series{Metric: a, Points: []promql.Point{{T: 2, V: 5}}}) {
+			t.Fatalf("Unexpected result for %s: %v", query, m)
+		}
+		for i, p := range m[1].Points {
+			if p.T != int64(i+1) || !(p.V == expectedB[i] || math.IsNaN(p.V) && math.IsNaN(expectedB[i])) {
+				t.Fatalf("Expected %v for %s, got %v", expectedB, query, m[1].Points)
+			}
+		}
+	}
+}
+
+func TestQueryResultRoundTrip(t *testing.T) {
+	m := promql.Matrix{
+		{Metric: labels.FromStrings("job", "a"), Points: []promql.Point{{T: 1, V: math.Inf(1)}, {T: 2, V: 3}}},
+		{Metric: labels.Labels{}, Points: []promql.Point{}},
+	}
+	if got := FromQueryResult(ToQueryResult(m)); !reflect.DeepEqual(got, m) {
+		t.Fatalf("Expected %v, got %v", m, got)
+	}
+}
@@ -0,0 +1,336 @@
+// Package querycache splits range queries into day-aligned sub-ranges, which
+// are evaluated concurrently. The results for days whose data is no longer
+// expected to change are cached, so that only the most recent part of a query
+// needs to be evaluated again when it is repeated, such as when a dashboard is
+// refreshed.
+package querycache
+
+import (
+	"container/list"
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mattbostock/timbala/internal/warnings"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/promql"
+)
+
+const (
+	dayMs = int64(24 * time.Hour / time.Millisecond)
+
+	// immutableAfter is how long after the end of a day its results are
+	// cached. Samples may still be written for a day shortly after it ends,
+	// while they are replicated to every node responsible for them.
+	immutableAfter = time.Hour
+
+	// maxEntryAge is how long results are cached for. Samples may still
+	// be written for past days, such as when writes queued for a node
+	// that was unreachable are replayed or when replicas are repaired, so
+	// cached results are evaluated again periodically to include them.
+	maxEntryAge = 10 * time.Minute
+
+	// maxConcurrentShards limits how many days of a single range query are
+	// evaluated at once
+	maxConcurrentShards = 8
+)
+
+var (
+	cacheHits = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "timbala",
+			Subsystem: "query_cache",
+			Name:      "hits_total",
+			Help:      "Total number of days of range query results read from the cache",
+		},
+	)
+	cacheMisses = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "timbala",
+			Subsystem: "query_cache",
+			Name:      "misses_total",
+			Help:      "Total number of days of range query results that were not cached and had to be evaluated",
+		},
+	)
+	cachedSamples = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "timbala",
+			Subsystem: "query_cache",
+			Name:      "samples",
+			Help:      "Number of samples held in the range query results cache",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(cacheHits)
+	prometheus.MustRegister(cacheMisses)
+	prometheus.MustRegister(cachedSamples)
+}
+
+// EvalFunc evaluates a range query between start and end inclusive.
+type EvalFunc func(ctx context.Context, start, end time.Time) (promql.Matrix, error)
+
+// key identifies the results of a query for a single day. Results are only
+// cached for queries whose steps are aligned to the Unix epoch, so the
+// timestamps evaluated in a day depend only on the step.
+type key struct {
+	query string
+	step  int64
+	day   int64
+}
+
+type entry struct {
+	key        key
+	matrix     promql.Matrix
+	numSamples int
+	cachedAt   time.Time
+}
+
+type cache struct {
+	maxSamples int
+	now        func() time.Time
+
+	mu         sync.Mutex
+	entries    map[key]*list.Element
+	lru        *list.List
+	numSamples int
+	// generation is incremented whenever the cache is purged, so that
+	// results evaluated before a purge are not cached after it
+	generation uint64
+}
+
+// New returns a cache that holds up to maxSamples samples, evicting the least
+// recently used results once full.
+func New(maxSamples int) *cache {
+	return &cache{
+		maxSamples: maxSamples,
+		now:        time.Now,
+		entries:    make(map[key]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// shard is the part of a range query that falls on a single day.
+type shard struct {
+	key         key
+	first, last int64
+	cacheable   bool
+}
+
+// QueryRange returns the results of the given range query. The query is split
+// into a shard for each day, which are evaluated concurrently using eval.
+//
+// The results for days that ended more than immutableAfter ago are cached for
+// up to maxEntryAge. Days that are not yet cached are evaluated in full, so that their results
+// can be reused by later queries covering more of the day. Queries whose start
+// time is not a multiple of the step are not cached, since their results
+// cannot be reused by queries evaluated at other timestamps.
+func (c *cache) QueryRange(ctx context.Context, expr promql.Expr, start, end time.Time, step time.Duration, eval EvalFunc) (promql.Matrix, error) {
+	mint, maxt := timestamp.FromTime(start), timestamp.FromTime(end)
+	stepMs := int64(step / time.Millisecond)
+	if stepMs <= 0 {
+		return eval(ctx, start, end)
+	}
+
+	var (
+		query     = expr.String()
+		cutoff    = timestamp.FromTime(c.now().Add(-immutableAfter))
+		cacheable = c.maxSamples > 0 && mint%stepMs == 0
+		shards    []shard
+	)
+	for day := floorDiv(mint, dayMs); day*dayMs <= maxt; day++ {
+		s := shard{key: key{query: query, step: stepMs, day: day}}
+		dayStart, dayEnd := day*dayMs, (day+1)*dayMs-1
+		if cacheable && dayEnd < cutoff {
+			s.cacheable = true
+			s.first, s.last = ceilDiv(dayStart, stepMs)*stepMs, floorDiv(dayEnd, stepMs)*stepMs
+		} else {
+			// Evaluate the timestamps in the day that the query
+			// would evaluate if it were not split
+			s.first = mint
+			if dayStart > mint {
+				s.first = mint + ceilDiv(dayStart-mint, stepMs)*stepMs
+			}
+			s.last = dayEnd
+			if maxt < dayEnd {
+				s.last = maxt
+			}
+			s.last = mint + floorDiv(s.last-mint, stepMs)*stepMs
+		}
+		if s.first > s.last {
+			// The step is longer than a day and no timestamps are
+			// evaluated in this day
+			continue
+		}
+		shards = append(shards, s)
+	}
+
+	parts := make([]promql.Matrix, len(shards))
+	errs := make([]error, len(shards))
+	sem := make(chan struct{}, maxConcurrentShards)
+	var wg sync.WaitGroup
+	for i, s := range shards {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, s shard) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if !s.cacheable {
+				parts[i], errs[i] = eval(ctx, timestamp.Time(s.first), timestamp.Time(s.last))
+				return
+			}
+			m, ok := c.get(s.key)
+			if ok {
+				cacheHits.Inc()
+				parts[i] = m
+				return
+			}
+			cacheMisses.Inc()
+			parts[i], errs[i] = c.evalDay(ctx, s.key, timestamp.Time(s.first), timestamp.Time(s.last), eval)
+		}(i, s)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return merge(parts, mint, maxt), nil
+}
+
+// evalDay evaluates the results for a single day and caches them, unless
+// evaluation produced warnings indicating that the results may be incomplete.
+func (c *cache) evalDay(ctx context.Context, k key, first, last time.Time, eval EvalFunc) (promql.Matrix, error) {
+	c.mu.Lock()
+	generation := c.generation
+	c.mu.Unlock()
+
+	wctx := warnings.NewContext(ctx)
+	m, err := eval(wctx, first, last)
+	if err != nil {
+		return nil, err
+	}
+
+	warns := warnings.FromContext(wctx)
+	for _, w := range warns {
+		warnings.Add(ctx, w)
+	}
+	if len(warns) == 0 {
+		c.put(k, m, generation)
+	}
+	return m, nil
+}
+
+func (c *cache) get(k key) (promql.Matrix, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[k]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*entry)
+	if c.now().Sub(e.cachedAt) > maxEntryAge {
+		c.remove(el)
+		cachedSamples.Set(float64(c.numSamples))
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return e.matrix, true
+}
+
+// put caches the results for a day, unless the cache has been purged since
+// the given generation, when evaluating the results began.
+func (c *cache) put(k key, m promql.Matrix, generation uint64) {
+	var numSamples int
+	for _, s := range m {
+		numSamples += len(s.Points)
+	}
+	if numSamples > c.maxSamples {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+	if el, ok := c.entries[k]; ok {
+		c.remove(el)
+	}
+	c.entries[k] = c.lru.PushFront(&entry{key: k, matrix: m, numSamples: numSamples, cachedAt: c.now()})
+	c.numSamples += numSamples
+	for c.numSamples > c.maxSamples {
+		c.remove(c.lru.Back())
+	}
+	cachedSamples.Set(float64(c.numSamples))
+}
+
+func (c *cache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*entry)
+	delete(c.entries, e.key)
+	c.numSamples -= e.numSamples
+}
+
+// Purge removes all results from the cache. It is called when series are
+// deleted, so that deleted samples are not returned from the cache. Results
+// of queries being evaluated while the cache is purged are not cached.
+func (c *cache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	c.entries = make(map[key]*list.Element)
+	c.lru.Init()
+	c.numSamples = 0
+	cachedSamples.Set(0)
+}
+
+// merge combines the results for consecutive time ranges into a single
+// matrix sorted by labels, omitting any points outside mint and maxt. The
+// cached matrices are not modified.
+func merge(parts []promql.Matrix, mint, maxt int64) promql.Matrix {
+	series := make(map[string]*promql.Series)
+	for _, m := range parts {
+		for _, s := range m {
+			lo := sort.Search(len(s.Points), func(i int) bool { return s.Points[i].T >= mint })
+			hi := sort.Search(len(s.Points), func(i int) bool { return s.Points[i].T > maxt })
+			if lo >= hi {
+				continue
+			}
+
+			key := s.Metric.String()
+			ms, ok := series[key]
+			if !ok {
+				ms = &promql.Series{Metric: s.Metric}
+				series[key] = ms
+			}
+			ms.Points = append(ms.Points, s.Points[lo:hi]...)
+		}
+	}
+
+	merged := make(promql.Matrix, 0, len(series))
+	for _, s := range series {
+		merged = append(merged, *s)
+	}
+	sort.Sort(merged)
+	return merged
+}
+
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
+
+func ceilDiv(a, b int64) int64 {
+	return -floorDiv(-a, b)
+}
@@ -0,0 +1,242 @@
+package querycache
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mattbostock/timbala/internal/warnings"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/promql"
+)
+
+// fakeEval evaluates a query with two series, one of which only has points
+// in even hours, recording the ranges it was asked to evaluate.
+type fakeEval struct {
+	mu      sync.Mutex
+	calls   [][2]time.Time
+	warning string
+}
+
+func (f *fakeEval) eval(ctx context.Context, start, end time.Time) (promql.Matrix, error) {
+	f.mu.Lock()
+	f.calls = append(f.calls, [2]time.Time{start, end})
+	sort.Slice(f.calls, func(i, j int) bool {
+		return f.calls[i][0].Before(f.calls[j][0])
+	})
+	f.mu.Unlock()
+	if f.warning != "" {
+		warnings.Add(ctx, f.warning)
+	}
+
+	a := promql.Series{Metric: labels.FromStrings("series", "a")}
+	b := promql.Series{Metric: labels.FromStrings("series", "b")}
+	for t := timestamp.FromTime(start); t <= timestamp.FromTime(end); t += int64(time.Minute / time.Millisecond) {
+		a.Points = append(a.Points, promql.Point{T: t, V: float64(t)})
+		if (t/int64(time.Hour/time.Millisecond))%2 == 0 {
+			b.Points = append(b.Points, promql.Point{T: t, V: float64(t)})
+		}
+	}
+	return promql.Matrix{b, a}, nil
+}
+
+func TestQueryRange(t *testing.T) {
+	now := time.Date(2018, 3, 10, 12, 0, 0, 0, time.UTC)
+	start := now.Add(-3*24*time.Hour - 30*time.Minute)
+	step := time.Minute
+	expr, err := promql.ParseExpr(`sum(rate(foo[5m]))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := New(1e6)
+	c.now = func() time.Time { return now }
+
+	direct := &fakeEval{}
+	expected, _ := direct.eval(context.Background(), start, now)
+	expected = merge([]promql.Matrix{expected}, timestamp.FromTime(start), timestamp.FromTime(now))
+
+	f := &fakeEval{}
+	m, err := c.QueryRange(context.Background(), expr, start, now, step, f.eval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m, expected) {
+		t.Fatal("Results differ from evaluating the whole range at once")
+	}
+	// Three past days, evaluated in full, then the current day
+	if len(f.calls) != 4 {
+		t.Fatalf("Expected 4 evaluations, got %d: %v", len(f.calls), f.calls)
+	}
+	if first := f.calls[0][0]; !first.Equal(time.Date(2018, 3, 7, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("Expected first day to be evaluated from midnight, got %s", first)
+	}
+
+	// Queries whose start is not aligned to the step are split by day but
+	// not cached
+	f.calls = nil
+	unaligned := start.Add(30 * time.Second)
+	m, err = c.QueryRange(context.Background(), expr, unaligned, now, step, f.eval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.calls) != 4 || !f.calls[0][0].Equal(unaligned) || !f.calls[1][0].Equal(time.Date(2018, 3, 8, 0, 0, 30, 0, time.UTC)) {
+		t.Fatalf("Expected unaligned query to bypass the cache, got evaluations %v", f.calls)
+	}
+	expected, _ = direct.eval(context.Background(), unaligned, now)
+	if !reflect.DeepEqual(m, merge([]promql.Matrix{expected}, timestamp.FromTime(unaligned), timestamp.FromTime(now))) {
+		t.Fatal("Unaligned results differ from evaluating the whole range at once")
+	}
+
+	// Refreshing the query only evaluates the current day
+	f.calls = nil
+	later := now.Add(time.Minute)
+	m, err = c.QueryRange(context.Background(), expr, start.Add(time.Minute), later, step, f.eval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.calls) != 1 || !f.calls[0][0].Equal(time.Date(2018, 3, 10, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("Expected only the current day to be evaluated, got %v", f.calls)
+	}
+	expected, _ = direct.eval(context.Background(), start.Add(time.Minute), later)
+	if !reflect.DeepEqual(m, merge([]promql.Matrix{expected}, timestamp.FromTime(start.Add(time.Minute)), timestamp.FromTime(later))) {
+		t.Fatal("Cached results differ from evaluating the whole range at once")
+	}
+
+	// A different step is cached separately
+	f.calls = nil
+	if _, err := c.QueryRange(context.Background(), expr, start, now, 2*step, f.eval); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.calls) != 4 {
+		t.Fatalf("Expected 4 evaluations, got %d", len(f.calls))
+	}
+
+	c.Purge()
+	f.calls = nil
+	if _, err := c.QueryRange(context.Background(), expr, start, now, step, f.eval); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.calls) != 4 {
+		t.Fatalf("Expected 4 evaluations after purging, got %d", len(f.calls))
+	}
+}
+
+func TestQueryRangeDoesNotCacheIncompleteResults(t *testing.T) {
+	now := time.Date(2018, 3, 10, 12, 0, 0, 0, time.UTC)
+	start := now.Add(-24 * time.Hour)
+	expr, err := promql.ParseExpr(`foo`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := New(1e6)
+	c.now = func() time.Time { return now }
+
+	f := &fakeEval{warning: "node node2 did not respond"}
+	ctx := warnings.NewContext(context.Background())
+	if _, err := c.QueryRange(ctx, expr, start, now, time.Minute, f.eval); err != nil {
+		t.Fatal(err)
+	}
+	if w := warnings.FromContext(ctx); !reflect.DeepEqual(w, []string{f.warning}) {
+		t.Fatalf("Expected warnings to be passed on, got %v", w)
+	}
+
+	f.calls, f.warning = nil, ""
+	if _, err := c.QueryRange(context.Background(), expr, start, now, time.Minute, f.eval); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.calls) != 2 {
+		t.Fatalf("Expected incomplete results not to be cached, got evaluations %v", f.calls)
+	}
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := New(10)
+	m := promql.Matrix{{Points: make([]promql.Point, 4)}}
+	c.put(key{day: 1}, m, 0)
+	c.put(key{day: 2}, m, 0)
+	c.get(key{day: 1})
+	c.put(key{day: 3}, m, 0)
+
+	if _, ok := c.get(key{day: 2}); ok {
+		t.Fatal("Expected least recently used results to be evicted")
+	}
+	for _, day := range []int64{1, 3} {
+		if _, ok := c.get(key{day: day}); !ok {
+			t.Fatalf("Expected results for day %d to be cached", day)
+		}
+	}
+	if c.numSamples != 8 {
+		t.Fatalf("Expected 8 cached samples, got %d", c.numSamples)
+	}
+}
+
+func TestQueryRangeExpiresResults(t *testing.T) {
+	now := time.Date(2018, 3, 10, 12, 0, 0, 0, time.UTC)
+	start := now.Add(-24 * time.Hour)
+	expr, err := promql.ParseExpr(`foo`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := New(1e6)
+	c.now = func() time.Time { return now }
+
+	f := &fakeEval{}
+	query := func() {
+		f.calls = nil
+		if _, err := c.QueryRange(context.Background(), expr, start, now, time.Minute, f.eval); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	query()
+	query()
+	if len(f.calls) != 1 {
+		t.Fatalf("Expected only the current day to be evaluated, got %v", f.calls)
+	}
+
+	// Samples written for the previous day since it was cached, such as
+	// by repairs, are included once the cached results expire
+	now = now.Add(maxEntryAge + time.Minute)
+	query()
+	if len(f.calls) != 2 {
+		t.Fatalf("Expected expired results to be evaluated again, got %v", f.calls)
+	}
+}
+
+func TestQueryRangeRacingPurgeIsNotCached(t *testing.T) {
+	now := time.Date(2018, 3, 10, 12, 0, 0, 0, time.UTC)
+	start := now.Add(-24 * time.Hour)
+	expr, err := promql.ParseExpr(`foo`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := New(1e6)
+	c.now = func() time.Time { return now }
+
+	// Series are deleted while the query is being evaluated, so its
+	// results may include deleted samples
+	f := &fakeEval{}
+	purging := func(ctx context.Context, start, end time.Time) (promql.Matrix, error) {
+		c.Purge()
+		return f.eval(ctx, start, end)
+	}
+	if _, err := c.QueryRange(context.Background(), expr, start, now, time.Minute, purging); err != nil {
+		t.Fatal(err)
+	}
+
+	f.calls = nil
+	if _, err := c.QueryRange(context.Background(), expr, start, now, time.Minute, f.eval); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.calls) != 2 {
+		t.Fatalf("Expected results evaluated while purging not to be cached, got evaluations %v", f.calls)
+	}
+}
@@ -0,0 +1,96 @@
+package read
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/mattbostock/timbala/internal/cluster"
+	"github.com/mattbostock/timbala/internal/pushdown"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage"
+)
+
+// EvaluateRoute evaluates an aggregation pushed down from the node serving a
+// query, over only the samples for which the local node is the preferred
+// replica.
+const EvaluateRoute = "/evaluate"
+
+// NewPreferredQueryable returns a promql.Queryable over the local storage that
+// returns only the samples for which the local node is the preferred replica,
+// so that each sample in the cluster is evaluated by exactly one node.
+func NewPreferredQueryable(c cluster.Cluster, s storage.Storage) promql.Queryable {
+	return preferredQueryable{clstr: c, store: s}
+}
+
+type preferredQueryable struct {
+	clstr cluster.Cluster
+	store storage.Storage
+}
+
+func (p preferredQueryable) Querier(ctx context.Context, mint, maxt int64) (storage.Querier, error) {
+	q, err := p.store.Querier(ctx, mint, maxt)
+	if err != nil {
+		return nil, err
+	}
+	return preferredQuerier{Querier: q, clstr: p.clstr}, nil
+}
+
+type preferredQuerier struct {
+	storage.Querier
+	clstr cluster.Cluster
+}
+
+func (q preferredQuerier) Select(matchers ...*labels.Matcher) (storage.SeriesSet, error) {
+	set, err := q.Querier.Select(matchers...)
+	if err != nil {
+		return nil, err
+	}
+	return FilterPreferred(set, q.clstr, q.clstr.LocalNode().Name(), nil), nil
+}
+
+// EvaluateHandlerFunc evaluates the range query given by the query, start,
+// end and step form values, with times in milliseconds, over the samples for
+// which the local node is the preferred replica. The result is returned as a
+// snappy-compressed remote read query result.
+func (re *reader) EvaluateHandlerFunc(w http.ResponseWriter, r *http.Request) {
+	var times [3]int64
+	for i, name := range []string{"start", "end", "step"} {
+		var err error
+		if times[i], err = strconv.ParseInt(r.FormValue(name), 10, 64); err != nil {
+			http.Error(w, fmt.Sprintf("invalid %s: %q", name, r.FormValue(name)), http.StatusBadRequest)
+			return
+		}
+	}
+	start, end, step := timestamp.Time(times[0]), timestamp.Time(times[1]), time.Duration(times[2])*time.Millisecond
+
+	qry, err := re.engine.NewRangeQuery(r.FormValue("query"), start, end, step)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	m, err := qry.Exec(r.Context()).Matrix()
+	if err != nil {
+		re.log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data, err := pushdown.ToQueryResult(m).Marshal()
+	if err != nil {
+		re.log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Header().Set("Content-Encoding", "snappy")
+	if _, err := w.Write(snappy.Encode(nil, data)); err != nil {
+		re.log.Debug(err)
+	}
+}
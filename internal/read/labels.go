@@ -0,0 +1,220 @@
+package read
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/mattbostock/timbala/internal/cardinality"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+)
+
+const (
+	LabelNamesRoute  = "/labels/names"
+	LabelValuesRoute = "/labels/values"
+	TSDBStatusRoute  = "/status/tsdb"
+
+	// defaultStatusLimit is the number of metric names and label pairs
+	// returned in a TSDB status if no limit is given
+	defaultStatusLimit = 10
+)
+
+// LabelQuerier returns the label names and values held by a node, and a
+// summary of the cardinality of its series.
+type LabelQuerier interface {
+	LabelNames(mint, maxt int64) ([]string, error)
+	LabelValues(name string) ([]string, error)
+	TSDBStatus(limit int) (*cardinality.TSDBStatus, error)
+}
+
+// OutOfOrderStorage is local storage that holds out-of-order samples outside
+// the local node's TSDB, and reads from both.
+type OutOfOrderStorage interface {
+	storage.Queryable
+	OutOfOrderLabelNames(mint, maxt int64) ([]string, error)
+	BufferedSeries() []labels.Labels
+}
+
+type localLabelQuerier struct {
+	db    *tsdb.DB
+	store OutOfOrderStorage
+}
+
+// NewLocalLabelQuerier returns a LabelQuerier that reads the label names and
+// values held in the local node's TSDB index, and those of series held only
+// out of order in the given storage.
+func NewLocalLabelQuerier(db *tsdb.DB, s OutOfOrderStorage) *localLabelQuerier {
+	return &localLabelQuerier{db: db, store: s}
+}
+
+// LabelNames returns the sorted names of all labels in the head block, the
+// persisted blocks and the out-of-order samples that overlap the given time
+// range. Since the names are read from each block's index, they may include
+// labels of series with no samples in the range itself.
+func (l *localLabelQuerier) LabelNames(mint, maxt int64) ([]string, error) {
+	readers := make([]tsdb.IndexReader, 0, len(l.db.Blocks())+1)
+	defer func() {
+		for _, r := range readers {
+			r.Close()
+		}
+	}()
+
+	for _, b := range l.db.Blocks() {
+		// Block time ranges are half-open
+		if m := b.Meta(); m.MinTime > maxt || m.MaxTime <= mint {
+			continue
+		}
+		r, err := b.Index()
+		if err != nil {
+			return nil, err
+		}
+		readers = append(readers, r)
+	}
+	// The head's time range starts at the beginning of the block range
+	// holding its earliest sample, so it may overlap ranges before that
+	if h := l.db.Head(); h.MinTime() <= maxt && h.MaxTime() >= mint {
+		r, err := h.Index()
+		if err != nil {
+			return nil, err
+		}
+		readers = append(readers, r)
+	}
+
+	names, err := l.store.OutOfOrderLabelNames(mint, maxt)
+	if err != nil {
+		return nil, err
+	}
+	set := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		set[name] = struct{}{}
+	}
+	for _, r := range readers {
+		indices, err := r.LabelIndices()
+		if err != nil {
+			return nil, err
+		}
+		for _, names := range indices {
+			// Indices over more than one label name are not used
+			if len(names) == 1 {
+				set[names[0]] = struct{}{}
+			}
+		}
+	}
+	return sortedSet(set), nil
+}
+
+// LabelValues returns the sorted values of the given label.
+func (l *localLabelQuerier) LabelValues(name string) ([]string, error) {
+	q, err := l.store.Querier(context.Background(), math.MinInt64, math.MaxInt64)
+	if err != nil {
+		return nil, err
+	}
+	defer q.Close()
+	return q.LabelValues(name)
+}
+
+// TSDBStatus summarises the series in the local node's head block and its
+// buffer of out-of-order samples.
+func (l *localLabelQuerier) TSDBStatus(limit int) (*cardinality.TSDBStatus, error) {
+	return cardinality.FromHead(l.db.Head(), l.store.BufferedSeries(), limit)
+}
+
+// LabelNamesHandlerFunc returns the names of the labels held by this node as
+// a JSON array, limited to the blocks overlapping the time range given by the
+// start and end query parameters in milliseconds. It does not query other
+// nodes.
+func (re *reader) LabelNamesHandlerFunc(w http.ResponseWriter, r *http.Request) {
+	mint, err := parseMillis(r.FormValue("start"), math.MinInt64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid start: %v", err), http.StatusBadRequest)
+		return
+	}
+	maxt, err := parseMillis(r.FormValue("end"), math.MaxInt64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid end: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	names, err := re.localLabels.LabelNames(mint, maxt)
+	if err != nil {
+		re.log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	re.respondJSON(w, names)
+}
+
+// LabelValuesHandlerFunc returns the values of the label given by the name
+// query parameter that are held by this node, as a JSON array. It does not
+// query other nodes.
+func (re *reader) LabelValuesHandlerFunc(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("name")
+	if !model.LabelNameRE.MatchString(name) {
+		http.Error(w, fmt.Sprintf("invalid label name: %q", name), http.StatusBadRequest)
+		return
+	}
+
+	values, err := re.localLabels.LabelValues(name)
+	if err != nil {
+		re.log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	re.respondJSON(w, values)
+}
+
+// TSDBStatusHandlerFunc summarises the series held in this node's head block
+// and out-of-order buffer. The number of metric names and label pairs returned
+// is given by the limit query parameter. It does not query other nodes.
+func (re *reader) TSDBStatusHandlerFunc(w http.ResponseWriter, r *http.Request) {
+	limit := defaultStatusLimit
+	if l := r.FormValue("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 1 {
+			http.Error(w, fmt.Sprintf("invalid limit: %q", l), http.StatusBadRequest)
+			return
+		}
+	}
+
+	s, err := re.localLabels.TSDBStatus(limit)
+	if err != nil {
+		re.log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	re.respondJSON(w, s)
+}
+
+func (re *reader) respondJSON(w http.ResponseWriter, v interface{}) {
+	if s, ok := v.([]string); ok && s == nil {
+		v = []string{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		re.log.Error(err)
+	}
+}
+
+// parseMillis parses a timestamp in milliseconds, returning def if s is empty.
+func parseMillis(s string, def int64) (int64, error) {
+	if s == "" {
+		return def, nil
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+func sortedSet(set map[string]struct{}) []string {
+	s := make([]string, 0, len(set))
+	for v := range set {
+		s = append(s, v)
+	}
+	sort.Strings(s)
+	return s
+}
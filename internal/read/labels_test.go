@@ -0,0 +1,145 @@
+package read
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mattbostock/timbala/internal/outoforder"
+	promlabels "github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	promtsdb "github.com/prometheus/prometheus/storage/tsdb"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+	"github.com/sirupsen/logrus"
+)
+
+func TestLocalLabelNamesInTimeRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "labels_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := tsdb.Open(dir, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// The head's time range starts at the beginning of the two-hour block
+	// range holding its first sample
+	const (
+		headMinTime = 2 * 3600 * 1000
+		first       = 3 * 3600 * 1000
+		last        = first + 1000
+	)
+	app := db.Appender()
+	if _, err := app.Add(labels.FromStrings("__name__", "foo", "bar", "baz"), first, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.Add(labels.FromStrings("__name__", "foo", "bar", "baz"), last, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := outoforder.New(logrus.New(), promtsdb.Adapter(db, 0), filepath.Join(dir, "out_of_order"), filepath.Join(dir, "buffer"), outoforder.DefaultGracePeriod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	lq := NewLocalLabelQuerier(db, store)
+	for _, tc := range []struct {
+		mint, maxt int64
+		expected   []string
+	}{
+		{math.MinInt64, math.MaxInt64, []string{"__name__", "bar"}},
+		{first + 500, first + 600, []string{"__name__", "bar"}},
+		{last, last + 1000, []string{"__name__", "bar"}},
+		{headMinTime, headMinTime + 1, []string{"__name__", "bar"}},
+		{0, headMinTime - 1, []string{}},
+		{last + 1, last + 1000, []string{}},
+	} {
+		names, err := lq.LabelNames(tc.mint, tc.maxt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(names, tc.expected) {
+			t.Errorf("Expected label names %v between %d and %d, got %v", tc.expected, tc.mint, tc.maxt, names)
+		}
+	}
+}
+
+func TestLocalLabelsIncludeOutOfOrderSeries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "labels_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := tsdb.Open(filepath.Join(dir, "tsdb"), nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	store, err := outoforder.New(logrus.New(), promtsdb.Adapter(db, 0), filepath.Join(dir, "out_of_order"), filepath.Join(dir, "buffer"), outoforder.DefaultGracePeriod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	now := timestamp.FromTime(time.Now())
+	app, err := store.Appender()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.Add(promlabels.FromStrings("__name__", "foo", "bar", "baz"), now, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A series with only historical samples is held out of order
+	old := now - int64(24*time.Hour/time.Millisecond)
+	app, err = store.RepairAppender()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.Add(promlabels.FromStrings("__name__", "old", "qux", "quux"), old, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	lq := NewLocalLabelQuerier(db, store)
+	names, err := lq.LabelNames(old, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"__name__", "qux"}; !reflect.DeepEqual(names, expected) {
+		t.Fatalf("Expected label names %v, got %v", expected, names)
+	}
+	values, err := lq.LabelValues("__name__")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"foo", "old"}; !reflect.DeepEqual(values, expected) {
+		t.Fatalf("Expected label values %v, got %v", expected, values)
+	}
+	status, err := lq.TSDBStatus(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.HeadStats.NumSeries != 2 {
+		t.Fatalf("Expected 2 series, got %d", status.HeadStats.NumSeries)
+	}
+}
@@ -0,0 +1,175 @@
+package read
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/mattbostock/timbala/internal/cluster"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/storage"
+)
+
+// HTTPHeaderPreferredReplica requests that an internal read returns only the
+// samples for which the receiving node is the preferred replica. The header's
+// value lists the nodes, separated by commas, that should not be considered
+// when choosing the preferred replica, such as nodes that have failed to
+// respond.
+const HTTPHeaderPreferredReplica = "X-Timbala-Preferred-Replica-Excluding"
+
+// PreferredReplica returns the name of the node that should serve reads for
+// the given partition key: the first of its replicas that is not excluded.
+// It returns an empty string if all replicas are excluded.
+func PreferredReplica(c cluster.Cluster, pKey uint64, excluded map[string]bool) string {
+	for _, n := range c.NodesByPartitionKey(pKey) {
+		if !excluded[n.Name()] {
+			return n.Name()
+		}
+	}
+	return ""
+}
+
+// FormatExcluded formats a set of excluded nodes as the value of the
+// HTTPHeaderPreferredReplica header.
+func FormatExcluded(excluded map[string]bool) string {
+	names := make([]string, 0, len(excluded))
+	for name := range excluded {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// ParseExcluded parses the value of the HTTPHeaderPreferredReplica header.
+func ParseExcluded(header string) map[string]bool {
+	excluded := make(map[string]bool)
+	for _, name := range strings.Split(header, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			excluded[name] = true
+		}
+	}
+	return excluded
+}
+
+// FilterPreferred returns the series from the given set with only the samples
+// for which the given node is the preferred replica. Series with no such
+// samples are omitted.
+func FilterPreferred(set storage.SeriesSet, c cluster.Cluster, node string, excluded map[string]bool) storage.SeriesSet {
+	return FilterPartitions(set, c, func(pKey uint64) bool {
+		return PreferredReplica(c, pKey, excluded) == node
+	})
+}
+
+// FilterPartitions returns the series from the given set with only the samples
+// whose partition keys satisfy keep. Samples are filtered as each series is
+// iterated over, so they stay encoded in the underlying series until then.
+// Series with no such samples are omitted.
+func FilterPartitions(set storage.SeriesSet, c cluster.Cluster, keep func(pKey uint64) bool) storage.SeriesSet {
+	return &partitionSeriesSet{
+		set:   set,
+		clstr: c,
+		keys:  c.KeyVersion(),
+		keep:  keep,
+	}
+}
+
+type partitionSeriesSet struct {
+	set   storage.SeriesSet
+	clstr cluster.Cluster
+	keys  cluster.KeyVersion
+	keep  func(pKey uint64) bool
+
+	cur storage.Series
+	err error
+}
+
+func (p *partitionSeriesSet) Next() bool {
+	for p.set.Next() {
+		s := p.set.At()
+		lbls := s.Labels()
+		cur := &partitionSeries{
+			Series: s,
+			keys:   p.keys,
+			pHash:  p.clstr.PartitionHash(lbls.Get(labels.MetricName), lbls.Hash()),
+			keep:   p.keep,
+		}
+
+		// Only decode as much of the series as is needed to find out
+		// whether it has any samples to keep
+		it := cur.Iterator()
+		if it.Next() {
+			p.cur = cur
+			return true
+		}
+		if err := it.Err(); err != nil {
+			p.err = err
+			return false
+		}
+	}
+	return false
+}
+
+func (p *partitionSeriesSet) At() storage.Series {
+	return p.cur
+}
+
+func (p *partitionSeriesSet) Err() error {
+	if p.err != nil {
+		return p.err
+	}
+	return p.set.Err()
+}
+
+// partitionSeries implements storage.Series, omitting the samples whose
+// partition keys do not satisfy keep.
+type partitionSeries struct {
+	storage.Series
+	keys  cluster.KeyVersion
+	pHash uint64
+	keep  func(pKey uint64) bool
+}
+
+func (s *partitionSeries) Iterator() storage.SeriesIterator {
+	return &partitionSeriesIterator{
+		SeriesIterator: s.Series.Iterator(),
+		series:         s,
+	}
+}
+
+type partitionSeriesIterator struct {
+	storage.SeriesIterator
+	series *partitionSeries
+
+	// Samples are in timestamp order, so consecutive samples usually
+	// share a partition key; the last one is remembered to avoid calling
+	// keep for every sample
+	checked bool
+	pKey    uint64
+	kept    bool
+}
+
+func (it *partitionSeriesIterator) Seek(t int64) bool {
+	if !it.SeriesIterator.Seek(t) {
+		return false
+	}
+	if st, _ := it.At(); it.keep(st) {
+		return true
+	}
+	return it.Next()
+}
+
+func (it *partitionSeriesIterator) Next() bool {
+	for it.SeriesIterator.Next() {
+		if t, _ := it.At(); it.keep(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func (it *partitionSeriesIterator) keep(t int64) bool {
+	pKey := it.series.keys.SamplePartitionKey(t, it.series.pHash)
+	if !it.checked || pKey != it.pKey {
+		it.checked, it.pKey, it.kept = true, pKey, it.series.keep(pKey)
+	}
+	return it.kept
+}
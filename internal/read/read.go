@@ -4,11 +4,13 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"sync"
 
 	"github.com/golang/snappy"
 	"github.com/mattbostock/timbala/internal/cluster"
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/promql"
 	"github.com/prometheus/prometheus/storage"
 	"github.com/prometheus/prometheus/storage/remote"
 	"github.com/sirupsen/logrus"
@@ -20,6 +22,10 @@ const (
 	HTTPHeaderRemoteRead          = "X-Prometheus-Remote-Read-Version"
 	HTTPHeaderRemoteReadVersion   = "0.1.0"
 	Route                         = "/read"
+
+	// maxConcurrentQueries limits how many of the queries in a single read
+	// request are run at once
+	maxConcurrentQueries = 8
 )
 
 type Reader interface {
@@ -28,15 +34,19 @@ type Reader interface {
 
 type reader struct {
 	clstr       cluster.Cluster
+	engine      *promql.Engine
 	fanoutStore storage.Storage
+	localLabels LabelQuerier
 	localStore  storage.Storage
 	log         *logrus.Logger
 }
 
-func New(c cluster.Cluster, l *logrus.Logger, s storage.Storage, fo storage.Storage) *reader {
+func New(c cluster.Cluster, l *logrus.Logger, s storage.Storage, fo storage.Storage, lq LabelQuerier, e *promql.Engine) *reader {
 	return &reader{
 		clstr:       c,
+		engine:      e,
 		fanoutStore: fo,
+		localLabels: lq,
 		localStore:  s,
 		log:         l,
 	}
@@ -64,45 +74,67 @@ func (re *reader) HandlerFunc(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	resp := &prompb.ReadResponse{
-		Results: make([]*prompb.QueryResult, len(req.Queries)),
-	}
-
-	internal := r.Header.Get(HTTPHeaderInternalRead) != ""
+	matchers := make([][]*labels.Matcher, len(req.Queries))
 	for i, query := range req.Queries {
-		// FIXME paralellise queries
-		matchers, err := fromLabelMatchers(query.Matchers)
+		matchers[i], err = fromLabelMatchers(query.Matchers)
 		if err != nil {
 			re.log.Debug(err)
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+	}
 
+	internal := r.Header.Get(HTTPHeaderInternalRead) != ""
+	// The header may be present but empty if no nodes are excluded
+	_, preferredOnly := r.Header[http.CanonicalHeaderKey(HTTPHeaderPreferredReplica)]
+	excluded := ParseExcluded(r.Header.Get(HTTPHeaderPreferredReplica))
+	selectSeries := func(i int) (storage.SeriesSet, storage.Querier, error) {
+		query := req.Queries[i]
 		var querier storage.Querier
+		var err error
 		if internal {
 			querier, err = re.localStore.Querier(r.Context(), query.StartTimestampMs, query.EndTimestampMs)
 		} else {
 			querier, err = re.fanoutStore.Querier(r.Context(), query.StartTimestampMs, query.EndTimestampMs)
 		}
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			re.log.Error(err)
-			return
+			return nil, nil, err
 		}
-		defer querier.Close()
 
-		sset, err := querier.Select(matchers...)
+		sset, err := querier.Select(matchers[i]...)
 		if err != nil {
-			re.log.Error(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			querier.Close()
+			return nil, nil, err
 		}
-		resp.Results[i], err = remote.ToQueryResult(sset)
+		if internal && preferredOnly {
+			sset = FilterPreferred(sset, re.clstr, re.clstr.LocalNode().Name(), excluded)
+		}
+		return sset, querier, nil
+	}
+
+	if internal && r.Header.Get(HTTPHeaderStreamedRead) != "" {
+		re.stream(w, len(req.Queries), selectSeries)
+		return
+	}
+
+	resp := &prompb.ReadResponse{
+		Results: make([]*prompb.QueryResult, len(req.Queries)),
+	}
+
+	err = runQueries(len(req.Queries), func(i int) error {
+		sset, querier, err := selectSeries(i)
 		if err != nil {
-			re.log.Error(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return err
 		}
+		defer querier.Close()
+
+		resp.Results[i], err = remote.ToQueryResult(sset)
+		return err
+	})
+	if err != nil {
+		re.log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
 	data, err := resp.Marshal()
@@ -125,6 +157,62 @@ func (re *reader) HandlerFunc(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// stream writes each series as a frame as soon as it has been read, so that
+// neither this node nor the node that sent the request needs to hold the
+// whole response in memory.
+func (re *reader) stream(w http.ResponseWriter, numQueries int, selectSeries func(int) (storage.SeriesSet, storage.Querier, error)) {
+	w.Header().Set("Content-Type", StreamedReadContentType)
+	sw := newStreamWriter(w)
+	err := runQueries(numQueries, func(i int) error {
+		sset, querier, err := selectSeries(i)
+		if err == nil {
+			err = sw.writeSeries(i, sset)
+			querier.Close()
+		}
+		if err != nil && err != errStreamFailed {
+			re.log.Error(err)
+			// The response status has already been sent, so report
+			// the error in the stream instead
+			if err := sw.writeError(i, err); err != nil && err != errStreamFailed {
+				re.log.Debug(err)
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return
+	}
+	if err := sw.close(); err != nil {
+		re.log.Debug(err)
+	}
+}
+
+// runQueries calls fn for each query in a read request, running up to
+// maxConcurrentQueries at once. It returns the error for the first query that
+// failed, if any.
+func runQueries(numQueries int, fn func(i int) error) error {
+	errs := make([]error, numQueries)
+	sem := make(chan struct{}, maxConcurrentQueries)
+	var wg sync.WaitGroup
+	for i := 0; i < numQueries; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			errs[i] = fn(i)
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // BEGIN FIXME: Use upstream versions of the following functions once they are exported
 // See: github.com/prometheus/prometheus/storage/remote
 func fromLabelMatchers(matchers []*prompb.LabelMatcher) ([]*labels.Matcher, error) {
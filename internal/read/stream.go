@@ -0,0 +1,470 @@
+package read
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"sync"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/tsdb/chunkenc"
+)
+
+const (
+	// HTTPHeaderStreamedRead requests that an internal read response is
+	// streamed as a sequence of frames, each holding one series encoded as
+	// compressed chunks, rather than as a single protobuf message.
+	HTTPHeaderStreamedRead        = "X-Timbala-Streamed-Read-Version"
+	HTTPHeaderStreamedReadVersion = "0.0.1"
+	StreamedReadContentType       = "application/x-timbala-streamed-read"
+
+	// samplesPerChunk matches the number of samples per chunk used by the
+	// local TSDB
+	samplesPerChunk = 120
+	// maxFrameSize guards against allocating excessive memory when reading
+	// a corrupt stream
+	maxFrameSize = 64 << 20
+)
+
+// Each frame in a streamed read response is laid out as follows:
+//
+//	length (uvarint) | type (1 byte) | payload | CRC32 of type and payload
+//
+// A series frame's payload holds the index of the query in the read request,
+// the series' labels and its chunks. An error frame's payload holds the index
+// of the query and an error message. The stream ends with an end frame, so
+// that a truncated stream is not mistaken for a complete one.
+const (
+	frameSeries byte = iota + 1
+	frameError
+	frameEnd
+)
+
+var (
+	castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+	errTruncatedFrame = errors.New("truncated frame")
+	// errStreamFailed is returned when writing to a stream after an error
+	// has been reported in it
+	errStreamFailed = errors.New("stream has already failed")
+)
+
+type chunkMeta struct {
+	mint, maxt int64
+	chunk      chunkenc.Chunk
+}
+
+// chunkedSeries holds a series' samples as compressed chunks, which are only
+// decoded as the series is iterated over.
+type chunkedSeries struct {
+	labels labels.Labels
+	chunks []chunkMeta
+}
+
+// EncodeSeries returns a copy of the given series with its samples held as
+// compressed chunks. Series that are already held as chunks are returned
+// unchanged. It returns a nil series if the series has no samples.
+func EncodeSeries(series storage.Series) (storage.Series, error) {
+	if cs, ok := series.(*chunkedSeries); ok {
+		return cs, nil
+	}
+	s := &chunkedSeries{labels: series.Labels()}
+
+	var (
+		c   chunkenc.Chunk
+		app chunkenc.Appender
+		err error
+	)
+	it := series.Iterator()
+	for it.Next() {
+		t, v := it.At()
+		if c == nil || c.NumSamples() >= samplesPerChunk {
+			c = chunkenc.NewXORChunk()
+			if app, err = c.Appender(); err != nil {
+				return nil, err
+			}
+			s.chunks = append(s.chunks, chunkMeta{mint: t, chunk: c})
+		}
+		app.Append(t, v)
+		s.chunks[len(s.chunks)-1].maxt = t
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(s.chunks) == 0 {
+		return nil, nil
+	}
+	return s, nil
+}
+
+func (s *chunkedSeries) Labels() labels.Labels {
+	return s.labels
+}
+
+func (s *chunkedSeries) Iterator() storage.SeriesIterator {
+	return &chunkedSeriesIterator{chunks: s.chunks, cur: -1}
+}
+
+// chunkedSeriesIterator implements storage.SeriesIterator, decoding each chunk
+// only when the iterator reaches it.
+type chunkedSeriesIterator struct {
+	chunks []chunkMeta
+	cur    int
+	it     chunkenc.Iterator
+}
+
+func (it *chunkedSeriesIterator) Seek(t int64) bool {
+	if it.cur < 0 {
+		it.cur = 0
+		it.it = nil
+	}
+	// Skip chunks that end before t without decoding them
+	for it.cur < len(it.chunks) && it.chunks[it.cur].maxt < t {
+		it.cur++
+		it.it = nil
+	}
+	if it.cur >= len(it.chunks) {
+		return false
+	}
+	if it.it == nil {
+		it.it = it.chunks[it.cur].chunk.Iterator()
+		if !it.it.Next() {
+			return it.Next()
+		}
+	}
+
+	for {
+		if st, _ := it.it.At(); st >= t {
+			return true
+		}
+		if !it.Next() {
+			return false
+		}
+	}
+}
+
+func (it *chunkedSeriesIterator) At() (int64, float64) {
+	return it.it.At()
+}
+
+func (it *chunkedSeriesIterator) Next() bool {
+	if it.it != nil && it.it.Next() {
+		return true
+	}
+	if it.it != nil && it.it.Err() != nil {
+		return false
+	}
+
+	for it.cur+1 < len(it.chunks) {
+		it.cur++
+		it.it = it.chunks[it.cur].chunk.Iterator()
+		if it.it.Next() {
+			return true
+		}
+		if it.it.Err() != nil {
+			return false
+		}
+	}
+	it.cur = len(it.chunks)
+	return false
+}
+
+func (it *chunkedSeriesIterator) Err() error {
+	if it.it == nil {
+		return nil
+	}
+	return it.it.Err()
+}
+
+// streamWriter writes the frames of a streamed read response. It is safe for
+// concurrent use, so that the series for several queries can be interleaved.
+type streamWriter struct {
+	mu     sync.Mutex
+	w      *bufio.Writer
+	failed bool
+}
+
+func newStreamWriter(w io.Writer) *streamWriter {
+	return &streamWriter{w: bufio.NewWriter(w)}
+}
+
+// writeSeries encodes each series in the set as chunks and writes it as a
+// frame. Series without any samples are omitted.
+func (sw *streamWriter) writeSeries(query int, set storage.SeriesSet) error {
+	var buf []byte
+	for set.Next() {
+		encoded, err := EncodeSeries(set.At())
+		if err != nil {
+			return err
+		}
+		if encoded == nil {
+			continue
+		}
+		cs := encoded.(*chunkedSeries)
+
+		b := buf[:0]
+		b = appendUvarint(b, uint64(query))
+		b = appendUvarint(b, uint64(len(cs.labels)))
+		for _, l := range cs.labels {
+			b = appendString(b, l.Name)
+			b = appendString(b, l.Value)
+		}
+		b = appendUvarint(b, uint64(len(cs.chunks)))
+		for _, c := range cs.chunks {
+			b = appendVarint(b, c.mint)
+			b = appendVarint(b, c.maxt)
+			b = append(b, byte(c.chunk.Encoding()))
+			b = appendString(b, string(c.chunk.Bytes()))
+		}
+		buf = b
+
+		if err := sw.writeFrame(frameSeries, b); err != nil {
+			return err
+		}
+	}
+	return set.Err()
+}
+
+// writeError reports an error that occurred after the response headers were
+// sent. Nothing more can be written to the stream afterwards.
+func (sw *streamWriter) writeError(query int, err error) error {
+	b := appendUvarint(nil, uint64(query))
+	b = appendString(b, err.Error())
+
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if err := sw.writeFrameLocked(frameError, b); err != nil {
+		return err
+	}
+	sw.failed = true
+	return sw.w.Flush()
+}
+
+// close marks the end of the stream.
+func (sw *streamWriter) close() error {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if err := sw.writeFrameLocked(frameEnd, nil); err != nil {
+		return err
+	}
+	return sw.w.Flush()
+}
+
+func (sw *streamWriter) writeFrame(typ byte, payload []byte) error {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return sw.writeFrameLocked(typ, payload)
+}
+
+func (sw *streamWriter) writeFrameLocked(typ byte, payload []byte) error {
+	if sw.failed {
+		return errStreamFailed
+	}
+
+	var hdr [binary.MaxVarintLen64 + 1]byte
+	n := binary.PutUvarint(hdr[:], uint64(len(payload)+1))
+	hdr[n] = typ
+
+	crc := crc32.Update(crc32.Checksum(hdr[n:n+1], castagnoliTable), castagnoliTable, payload)
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc)
+
+	if _, err := sw.w.Write(hdr[:n+1]); err != nil {
+		return err
+	}
+	if _, err := sw.w.Write(payload); err != nil {
+		return err
+	}
+	_, err := sw.w.Write(sum[:])
+	return err
+}
+
+// StreamReader reads the series from a streamed read response, one frame at a
+// time. Chunks are not decoded until the series are iterated over.
+type StreamReader struct {
+	r     *bufio.Reader
+	query int
+	cur   storage.Series
+	err   error
+	done  bool
+}
+
+func NewStreamReader(r io.Reader) *StreamReader {
+	return &StreamReader{r: bufio.NewReader(r)}
+}
+
+// Next reads the next series from the stream, returning false once the
+// stream has ended or an error has occurred.
+func (sr *StreamReader) Next() bool {
+	if sr.done || sr.err != nil {
+		return false
+	}
+
+	typ, payload, err := sr.readFrame()
+	if err != nil {
+		sr.err = err
+		return false
+	}
+
+	switch typ {
+	case frameSeries:
+		sr.query, sr.cur, err = decodeSeries(payload)
+		if err != nil {
+			sr.err = err
+			return false
+		}
+		return true
+	case frameError:
+		query, n := binary.Uvarint(payload)
+		if n <= 0 {
+			sr.err = errTruncatedFrame
+			return false
+		}
+		msg, _, err := readString(payload[n:])
+		if err != nil {
+			sr.err = err
+			return false
+		}
+		sr.err = fmt.Errorf("query %d failed: %s", query, msg)
+		return false
+	case frameEnd:
+		sr.done = true
+		return false
+	default:
+		sr.err = fmt.Errorf("unknown frame type %d", typ)
+		return false
+	}
+}
+
+// At returns the index of the query in the read request that the current
+// series was returned for, and the series itself.
+func (sr *StreamReader) At() (int, storage.Series) {
+	return sr.query, sr.cur
+}
+
+func (sr *StreamReader) Err() error {
+	return sr.err
+}
+
+func (sr *StreamReader) readFrame() (byte, []byte, error) {
+	size, err := binary.ReadUvarint(sr.r)
+	if err == io.EOF {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	if size == 0 || size > maxFrameSize {
+		return 0, nil, fmt.Errorf("invalid frame size %d", size)
+	}
+
+	b := make([]byte, size+4)
+	if _, err := io.ReadFull(sr.r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	if binary.BigEndian.Uint32(b[size:]) != crc32.Checksum(b[:size], castagnoliTable) {
+		return 0, nil, errors.New("frame checksum mismatch")
+	}
+	return b[0], b[1:size], nil
+}
+
+func decodeSeries(b []byte) (int, storage.Series, error) {
+	query, n := binary.Uvarint(b)
+	if n <= 0 || query > math.MaxInt32 {
+		return 0, nil, errTruncatedFrame
+	}
+	b = b[n:]
+
+	numLabels, n := binary.Uvarint(b)
+	if n <= 0 || numLabels > uint64(len(b)) {
+		return 0, nil, errTruncatedFrame
+	}
+	b = b[n:]
+
+	s := &chunkedSeries{labels: make(labels.Labels, 0, numLabels)}
+	for i := uint64(0); i < numLabels; i++ {
+		var l labels.Label
+		var err error
+		if l.Name, b, err = readString(b); err != nil {
+			return 0, nil, err
+		}
+		if l.Value, b, err = readString(b); err != nil {
+			return 0, nil, err
+		}
+		s.labels = append(s.labels, l)
+	}
+
+	numChunks, n := binary.Uvarint(b)
+	if n <= 0 || numChunks > uint64(len(b)) {
+		return 0, nil, errTruncatedFrame
+	}
+	b = b[n:]
+
+	s.chunks = make([]chunkMeta, 0, numChunks)
+	for i := uint64(0); i < numChunks; i++ {
+		var c chunkMeta
+		if c.mint, n = binary.Varint(b); n <= 0 {
+			return 0, nil, errTruncatedFrame
+		}
+		b = b[n:]
+		if c.maxt, n = binary.Varint(b); n <= 0 {
+			return 0, nil, errTruncatedFrame
+		}
+		b = b[n:]
+		if len(b) == 0 {
+			return 0, nil, errTruncatedFrame
+		}
+		enc := chunkenc.Encoding(b[0])
+
+		data, rest, err := readBytes(b[1:])
+		if err != nil {
+			return 0, nil, err
+		}
+		b = rest
+		if c.chunk, err = chunkenc.FromData(enc, data); err != nil {
+			return 0, nil, err
+		}
+		s.chunks = append(s.chunks, c)
+	}
+	return int(query), s, nil
+}
+
+func appendUvarint(b []byte, x uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], x)
+	return append(b, buf[:n]...)
+}
+
+func appendVarint(b []byte, x int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(buf[:], x)
+	return append(b, buf[:n]...)
+}
+
+func appendString(b []byte, s string) []byte {
+	b = appendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func readString(b []byte) (string, []byte, error) {
+	data, rest, err := readBytes(b)
+	return string(data), rest, err
+}
+
+func readBytes(b []byte) ([]byte, []byte, error) {
+	size, n := binary.Uvarint(b)
+	if n <= 0 || size > uint64(len(b)-n) {
+		return nil, nil, errTruncatedFrame
+	}
+	b = b[n:]
+	return b[:size], b[size:], nil
+}
@@ -0,0 +1,262 @@
+package rebalance
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/mattbostock/timbala/internal/cluster"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"golang.org/x/net/context/ctxhttp"
+)
+
+const (
+	DecommissionRoute = "/admin/decommission"
+	VerifyRoute       = "/rebalance/verify"
+)
+
+type verifyResponse struct {
+	Missing int `json:"missing"`
+}
+
+// Decommission marks the local node as leaving the cluster, so that other
+// nodes stop sending it new data, then drains all of its data to the nodes
+// taking over from it. The node leaves the cluster once draining has
+// completed. Draining is retried if it fails or cluster membership changes.
+func (r *rebalancer) Decommission() error {
+	if err := r.clstr.MarkLeaving(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.status.Decommissioning = true
+	r.mu.Unlock()
+
+	select {
+	case r.decommission <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// verifyDrained checks that the data drained between first and last can be
+// read from the nodes it was sent to.
+func (r *rebalancer) verifyDrained(ctx context.Context, previous, current placement, first, last time.Time) error {
+	r.log.Info("Verifying that drained data can be read from the nodes taking over from this node")
+	for d := last; !d.Before(first); d = d.Add(-day) {
+		mint := d.UnixNano() / 1e6
+		maxt := d.Add(day).UnixNano()/1e6 - 1
+		if err := r.rebalanceRange(ctx, previous, current, true, true, mint, maxt); err != nil {
+			return fmt.Errorf("unable to verify data drained for %s: %s", d.Format("2006-01-02"), err)
+		}
+
+		r.mu.Lock()
+		r.status.DaysVerified++
+		r.mu.Unlock()
+	}
+	return nil
+}
+
+// verify checks that the samples in the batch can be read from the nodes they
+// were sent to.
+func (r *rebalancer) verify(ctx context.Context, members map[string]*cluster.Node, b *batcher) error {
+	for name, series := range b.series {
+		n, ok := members[name]
+		if !ok {
+			continue
+		}
+
+		timeseries := make([]*prompb.TimeSeries, 0, len(series))
+		var numSamples int
+		for _, ts := range series {
+			timeseries = append(timeseries, ts)
+			numSamples += len(ts.Samples)
+		}
+
+		verifyCtx, cancel := context.WithTimeout(ctx, sendTimeout)
+		missing, err := verifyOnNode(verifyCtx, *n, timeseries)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("unable to verify samples sent to %s: %s", name, err)
+		}
+		if missing > 0 {
+			return fmt.Errorf("%d of %d samples sent to %s cannot be read from it", missing, numSamples, name)
+		}
+	}
+	return nil
+}
+
+func verifyOnNode(ctx context.Context, n cluster.Node, series []*prompb.TimeSeries) (int, error) {
+	httpAddr, err := n.HTTPAddr()
+	if err != nil {
+		return 0, err
+	}
+
+	req := &prompb.WriteRequest{Timeseries: series}
+	data, err := req.Marshal()
+	if err != nil {
+		return 0, err
+	}
+	// FIXME handle HTTPS
+	httpResp, err := ctxhttp.Post(ctx, httpClient, "http://"+httpAddr+VerifyRoute, "application/x-protobuf", bytes.NewReader(snappy.Encode(nil, data)))
+	if err != nil {
+		return 0, err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode/100 != 2 {
+		return 0, fmt.Errorf("server returned HTTP status %s", httpResp.Status)
+	}
+	var resp verifyResponse
+	if err := json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
+		return 0, err
+	}
+	return resp.Missing, nil
+}
+
+// VerifyHandlerFunc responds with the number of samples in the request that
+// cannot be read from local storage. It is used by a node that is draining its
+// data to check that the data can be read from the nodes taking over from it.
+func (r *rebalancer) VerifyHandlerFunc(w http.ResponseWriter, req *http.Request) {
+	compressed, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		r.log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		r.log.Debug(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var verifyReq prompb.WriteRequest
+	if err := verifyReq.Unmarshal(data); err != nil {
+		r.log.Debug(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	missing, err := r.missing(req.Context(), verifyReq.Timeseries)
+	if err != nil {
+		r.log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(verifyResponse{missing}); err != nil {
+		r.log.Error(err)
+	}
+}
+
+// missing returns the number of the given samples that cannot be read from
+// local storage.
+func (r *rebalancer) missing(ctx context.Context, series []*prompb.TimeSeries) (int, error) {
+	var numMissing int
+	for _, ts := range series {
+		if len(ts.Samples) == 0 {
+			continue
+		}
+
+		wanted := make(map[int64]uint64, len(ts.Samples))
+		mint, maxt := ts.Samples[0].Timestamp, ts.Samples[0].Timestamp
+		for _, s := range ts.Samples {
+			wanted[s.Timestamp] = math.Float64bits(s.Value)
+			if s.Timestamp < mint {
+				mint = s.Timestamp
+			}
+			if s.Timestamp > maxt {
+				maxt = s.Timestamp
+			}
+		}
+
+		matchers := make([]*labels.Matcher, 0, len(ts.Labels))
+		for _, l := range ts.Labels {
+			m, err := labels.NewMatcher(labels.MatchEqual, l.Name, l.Value)
+			if err != nil {
+				return 0, err
+			}
+			matchers = append(matchers, m)
+		}
+
+		if err := r.readSamples(ctx, mint, maxt, len(ts.Labels), matchers, wanted); err != nil {
+			return 0, err
+		}
+		numMissing += len(wanted)
+	}
+	return numMissing, nil
+}
+
+// readSamples removes the samples that can be read from local storage from
+// wanted, which maps timestamps to the bits of the expected value.
+func (r *rebalancer) readSamples(ctx context.Context, mint, maxt int64, numLabels int, matchers []*labels.Matcher, wanted map[int64]uint64) error {
+	q, err := r.localStore.Querier(ctx, mint, maxt)
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+
+	set, err := q.Select(matchers...)
+	if err != nil {
+		return err
+	}
+	for set.Next() {
+		s := set.At()
+		// Skip series that have labels in addition to those matched
+		if len(s.Labels()) != numLabels {
+			continue
+		}
+
+		it := s.Iterator()
+		for it.Next() {
+			t, v := it.At()
+			if bits, ok := wanted[t]; ok && bits == math.Float64bits(v) {
+				delete(wanted, t)
+			}
+		}
+		if err := it.Err(); err != nil {
+			return err
+		}
+	}
+	return set.Err()
+}
+
+func (r *rebalancer) leave() {
+	if err := r.clstr.Leave(); err != nil {
+		r.fail(err, true)
+		return
+	}
+
+	r.mu.Lock()
+	r.status.State = stateDecommissioned
+	r.status.CompletedAt = time.Now()
+	r.mu.Unlock()
+	r.log.Info("Draining completed; this node has left the cluster and can be shut down")
+}
+
+// DecommissionHandlerFunc responds with the status of the current or most
+// recent rebalance. POST requests decommission the local node.
+func (r *rebalancer) DecommissionHandlerFunc(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodPost {
+		if err := r.Decommission(); err != nil {
+			http.Error(w, "failed to mark node as leaving: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if req.Method == http.MethodPost {
+		w.WriteHeader(http.StatusAccepted)
+	}
+	if err := json.NewEncoder(w).Encode(r.Status()); err != nil {
+		r.log.Error(err)
+	}
+}
@@ -0,0 +1,693 @@
+// Package rebalance moves data to the nodes that become responsible for it
+// when cluster membership or the replication factor changes.
+//
+// When a node joins or leaves the cluster, the hashring assigns some partition
+// keys to different nodes. Raising the replication factor adds owners to every
+// partition key. Each node scans its local data and, for each
+// partition key whose set of owners has changed, streams the affected samples
+// to the new owners. To avoid sending the same data multiple times, only the
+// first previous owner that is still a member of the cluster sends data for a
+// given partition key.
+//
+// Data that the local node is no longer responsible for is retained, so that
+// it can still be queried should rebalancing fail part way through.
+package rebalance
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mattbostock/timbala/internal/cluster"
+	"github.com/mattbostock/timbala/internal/write"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	Route                  = "/admin/rebalance"
+	ReplicationFactorRoute = "/admin/replication_factor"
+
+	batchSize   = 10000
+	day         = 24 * time.Hour
+	sendTimeout = time.Minute
+	settleDelay = 30 * time.Second
+
+	stateRunning        = "running"
+	stateIdle           = "idle"
+	stateDraining       = "draining"
+	stateDecommissioned = "decommissioned"
+)
+
+var (
+	httpClient = &http.Client{
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{
+				DualStack: true,
+				KeepAlive: 10 * time.Minute,
+				Timeout:   2 * time.Second,
+			}).DialContext,
+			ExpectContinueTimeout: 5 * time.Second,
+			IdleConnTimeout:       10 * time.Minute,
+			ResponseHeaderTimeout: time.Minute,
+		}}
+
+	inProgress = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "timbala",
+			Subsystem: "rebalance",
+			Name:      "in_progress",
+			Help:      "Whether data is currently being rebalanced following a change in cluster membership",
+		},
+	)
+	daysRemaining = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "timbala",
+			Subsystem: "rebalance",
+			Name:      "days_remaining",
+			Help:      "Number of days of local data remaining to be scanned by the current rebalance",
+		},
+	)
+	samplesSent = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "timbala",
+			Subsystem: "rebalance",
+			Name:      "samples_sent_total",
+			Help:      "Total number of samples sent to nodes that became responsible for them",
+		},
+		[]string{"node"},
+	)
+	runs = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "timbala",
+			Subsystem: "rebalance",
+			Name:      "runs_total",
+			Help:      "Total number of rebalances, by result",
+		},
+		[]string{"result"},
+	)
+	lastCompleted = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "timbala",
+			Subsystem: "rebalance",
+			Name:      "last_completed_timestamp_seconds",
+			Help:      "Time the most recent rebalance completed successfully, as a Unix timestamp",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(inProgress, daysRemaining, samplesSent, runs, lastCompleted)
+}
+
+// Status describes the progress of the current or most recent rebalance.
+type Status struct {
+	State                     string           `json:"state"`
+	StartedAt                 time.Time        `json:"started_at,omitempty"`
+	CompletedAt               time.Time        `json:"completed_at,omitempty"`
+	DaysTotal                 int              `json:"days_total"`
+	DaysCompleted             int              `json:"days_completed"`
+	SamplesSent               map[string]int64 `json:"samples_sent"`
+	SamplesNoLongerOwned      int64            `json:"samples_no_longer_owned"`
+	PreviousMembers           []string         `json:"previous_members"`
+	CurrentMembers            []string         `json:"current_members"`
+	PreviousReplicationFactor int              `json:"previous_replication_factor"`
+	ReplicationFactor         int              `json:"replication_factor"`
+	LastError                 string           `json:"last_error,omitempty"`
+	// Decommissioning is true once the local node has been marked as
+	// leaving the cluster
+	Decommissioning bool `json:"decommissioning"`
+	// DaysVerified is the number of days of drained data that have been
+	// checked to be readable from the nodes they were sent to
+	DaysVerified int `json:"days_verified"`
+	// Full is true if all local data is being sent to its current
+	// owners, regardless of where it was previously placed
+	Full bool `json:"full"`
+	// MembershipChanged is true if cluster membership or the replication
+	// factor has changed since data was last rebalanced
+	MembershipChanged bool `json:"membership_changed"`
+}
+
+// Decommissioned returns true if the local node has drained its data and left
+// the cluster.
+func (s Status) Decommissioned() bool {
+	return s.State == stateDecommissioned
+}
+
+type rebalancer struct {
+	clstr      cluster.Cluster
+	localStore storage.Storage
+	log        *logrus.Logger
+
+	// trigger requests a rebalance, e.g. from the admin API
+	trigger chan struct{}
+	// decommission requests that the local node's data is drained to
+	// other nodes before it leaves the cluster
+	decommission chan struct{}
+
+	mu sync.Mutex
+	// members and replFactor are the cluster membership and replication
+	// factor that data was last successfully rebalanced for
+	members    cluster.Nodes
+	replFactor int
+	status     Status
+	// full is true if the next rebalance should send all data to its
+	// current owners, regardless of where it was previously placed
+	full bool
+}
+
+func New(c cluster.Cluster, l *logrus.Logger, s storage.Storage) *rebalancer {
+	return &rebalancer{
+		clstr:      c,
+		localStore: s,
+		log:        l,
+		members:    c.Nodes().Active(),
+		replFactor: c.ReplicationFactor(),
+		trigger:    make(chan struct{}, 1),
+		status:     Status{State: stateIdle},
+
+		decommission: make(chan struct{}, 1),
+	}
+}
+
+// Run rebalances data whenever nodes join or leave the cluster or the
+// replication factor changes, until the context is cancelled. Rebalancing
+// begins once membership has been stable for settleDelay, and is restarted if
+// membership changes again while it is in progress.
+//
+// Once the local node has been decommissioned, each run instead drains all of
+// its data to the remaining nodes.
+func (r *rebalancer) Run(ctx context.Context) {
+	events := r.clstr.Subscribe()
+	local := r.clstr.LocalNode().Name()
+
+	var (
+		cancel   context.CancelFunc
+		done     chan struct{}
+		draining bool
+		settled  <-chan time.Time
+	)
+	for {
+		select {
+		case <-ctx.Done():
+			if cancel != nil {
+				cancel()
+				<-done
+			}
+			return
+		case ev := <-events:
+			if ev.Type == cluster.NodeUpdate {
+				// A node that is leaving drains its own data, so
+				// other nodes need not send data on its behalf
+				if ev.Node.Leaving() && ev.Node.Name() != local {
+					r.forget(ev.Node.Name())
+				}
+				continue
+			}
+			r.setMembershipChanged(true)
+			settled = time.After(settleDelay)
+			continue
+		case <-r.decommission:
+			// Allow time for other nodes to stop sending new data to
+			// this node before draining it
+			draining = true
+			settled = time.After(settleDelay)
+			continue
+		case <-r.trigger:
+		case <-settled:
+		}
+		settled = nil
+
+		if cancel != nil {
+			cancel()
+			<-done
+		}
+
+		var runCtx context.Context
+		runCtx, cancel = context.WithCancel(ctx)
+		done = make(chan struct{})
+		go func(drain bool) {
+			defer close(done)
+			r.rebalance(runCtx, drain)
+		}(draining)
+	}
+}
+
+// Trigger requests a rebalance without waiting for cluster membership to
+// change.
+func (r *rebalancer) Trigger() {
+	select {
+	case r.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// TriggerFull requests a rebalance in which all local data is sent to every
+// node currently responsible for it, regardless of where it was previously
+// placed. It is needed when data is held by nodes that are not responsible for
+// it, other than as a result of a change in membership.
+func (r *rebalancer) TriggerFull() {
+	r.mu.Lock()
+	r.full = true
+	r.mu.Unlock()
+	r.Trigger()
+}
+
+func (r *rebalancer) Status() Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	st := r.status
+	st.SamplesSent = make(map[string]int64, len(r.status.SamplesSent))
+	for k, v := range r.status.SamplesSent {
+		st.SamplesSent[k] = v
+	}
+	return st
+}
+
+func (r *rebalancer) setMembershipChanged(changed bool) {
+	r.mu.Lock()
+	r.status.MembershipChanged = changed
+	r.mu.Unlock()
+}
+
+// forget removes the given node from the membership that data was last
+// rebalanced for.
+func (r *rebalancer) forget(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	members := make(cluster.Nodes, 0, len(r.members))
+	for _, n := range r.members {
+		if n.Name() != name {
+			members = append(members, n)
+		}
+	}
+	r.members = members
+}
+
+// rebalance sends data to the nodes that have become responsible for it. If
+// drain is true, the local node is leaving the cluster and sends all of its
+// data to the nodes that are taking over from it, then leaves the cluster.
+func (r *rebalancer) rebalance(ctx context.Context, drain bool) {
+	r.mu.Lock()
+	if r.status.State == stateDecommissioned {
+		r.mu.Unlock()
+		return
+	}
+	previous := r.members
+	prevReplFactor := r.replFactor
+	full := r.full
+	r.mu.Unlock()
+	current := r.clstr.Nodes().Active()
+	replFactor := r.clstr.ReplicationFactor()
+
+	state := stateRunning
+	if full {
+		// Without a previous placement, the local node sends each
+		// sample to all of its current owners
+		previous, prevReplFactor = nil, 0
+	}
+	if drain {
+		// Compare data placement with and without the local node
+		state = stateDraining
+		previous = append(current[:len(current):len(current)], r.clstr.LocalNode())
+		prevReplFactor = replFactor
+	}
+
+	start, err := r.localStore.StartTime()
+	if err != nil {
+		r.fail(err, drain)
+		return
+	}
+	// The start time only accounts for persisted blocks, so allow for
+	// older data that is still in the head block
+	first := time.Unix(0, start*1e6).Add(-day).UTC().Truncate(day)
+	last := time.Now().UTC().Truncate(day)
+	numDays := int(last.Sub(first)/day) + 1
+
+	r.mu.Lock()
+	r.status = Status{
+		State:           state,
+		StartedAt:       time.Now(),
+		DaysTotal:       numDays,
+		SamplesSent:     make(map[string]int64),
+		PreviousMembers: nodeNames(previous),
+		CurrentMembers:  nodeNames(current),
+
+		PreviousReplicationFactor: prevReplFactor,
+		ReplicationFactor:         replFactor,
+		Decommissioning:           drain,
+		Full:                      full && !drain,
+	}
+	r.mu.Unlock()
+	inProgress.Set(1)
+	defer inProgress.Set(0)
+
+	if drain {
+		r.log.Infof("Draining %d days of data to %v before leaving the cluster", numDays, current)
+	} else if full {
+		r.log.Infof("Sending %d days of data to every node responsible for it in %v with replication factor %d", numDays, current, replFactor)
+	} else {
+		r.log.Infof("Rebalancing %d days of data following cluster change from %v with replication factor %d to %v with replication factor %d", numDays, previous, prevReplFactor, current, replFactor)
+	}
+
+	// Scan the most recent data first, as it's the most likely to be
+	// queried
+	for d := last; !d.Before(first); d = d.Add(-day) {
+		daysRemaining.Set(float64(d.Sub(first)/day) + 1)
+
+		select {
+		case <-ctx.Done():
+			runs.WithLabelValues("cancelled").Inc()
+			r.mu.Lock()
+			r.status.State = stateIdle
+			if drain {
+				r.status.State = stateDraining
+			}
+			r.status.LastError = "cancelled due to a further cluster change"
+			r.mu.Unlock()
+			return
+		default:
+		}
+
+		mint := d.UnixNano() / 1e6
+		maxt := d.Add(day).UnixNano()/1e6 - 1
+		if err := r.rebalanceRange(ctx, placement{previous, prevReplFactor}, placement{current, replFactor}, drain, false, mint, maxt); err != nil {
+			r.fail(err, drain)
+			return
+		}
+
+		r.mu.Lock()
+		r.status.DaysCompleted++
+		r.mu.Unlock()
+	}
+	daysRemaining.Set(0)
+
+	if drain {
+		// Only leave once the nodes taking over from the local node
+		// can be read from, as no other node may hold the data
+		if err := r.verifyDrained(ctx, placement{previous, prevReplFactor}, placement{current, replFactor}, first, last); err != nil {
+			r.fail(err, drain)
+			return
+		}
+	}
+
+	runs.WithLabelValues("success").Inc()
+	lastCompleted.Set(float64(time.Now().Unix()))
+	if drain {
+		r.leave()
+		return
+	}
+	r.mu.Lock()
+	r.members = current
+	r.replFactor = replFactor
+	r.full = false
+	r.status.State = stateIdle
+	r.status.CompletedAt = time.Now()
+	r.status.MembershipChanged = false
+	r.mu.Unlock()
+	r.log.Info("Rebalancing completed")
+}
+
+func (r *rebalancer) fail(err error, drain bool) {
+	runs.WithLabelValues("error").Inc()
+	r.log.Errorf("Rebalancing failed: %s", err)
+	r.mu.Lock()
+	r.status.State = stateIdle
+	if drain {
+		r.status.State = stateDraining
+	}
+	r.status.LastError = err.Error()
+	r.mu.Unlock()
+}
+
+// placement describes how data was or is distributed across the cluster.
+type placement struct {
+	nodes      cluster.Nodes
+	replFactor int
+}
+
+// rebalanceRange sends the local data between mint and maxt to the nodes that
+// have become responsible for it. If verify is true, the data is not sent but
+// instead checked to be readable on those nodes.
+func (r *rebalancer) rebalanceRange(ctx context.Context, previous, current placement, drain, verify bool, mint, maxt int64) error {
+	q, err := r.localStore.Querier(ctx, mint, maxt)
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+
+	allSeries, err := labels.NewMatcher(labels.MatchRegexp, labels.MetricName, ".+")
+	if err != nil {
+		return err
+	}
+	set, err := q.Select(allSeries)
+	if err != nil {
+		return err
+	}
+
+	local := r.clstr.LocalNode().Name()
+	members := make(map[string]*cluster.Node, len(current.nodes))
+	for _, n := range current.nodes {
+		members[n.Name()] = n
+	}
+
+	// Cache the destinations for each partition key, as every series has
+	// many samples for the same partition key
+	destinations := make(map[uint64][]*cluster.Node)
+	noLongerOwned := make(map[uint64]bool)
+
+	flush := r.flush
+	if verify {
+		flush = r.verify
+	}
+
+	var numNoLongerOwned int64
+	defer func() {
+		if verify {
+			return
+		}
+		r.mu.Lock()
+		r.status.SamplesNoLongerOwned += numNoLongerOwned
+		r.mu.Unlock()
+	}()
+
+	keys := r.clstr.KeyVersion()
+	b := newBatcher()
+	for set.Next() {
+		s := set.At()
+		lbls := s.Labels()
+		seriesHash := lbls.Hash()
+		pHash := r.clstr.PartitionHash(lbls.Get(labels.MetricName), seriesHash)
+
+		it := s.Iterator()
+		for it.Next() {
+			t, v := it.At()
+			if t < mint || t > maxt {
+				continue
+			}
+
+			pKey := keys.SamplePartitionKey(t, pHash)
+			dests, ok := destinations[pKey]
+			if !ok {
+				dests, noLongerOwned[pKey] = r.destinations(previous, current, drain, members, local, pKey)
+				destinations[pKey] = dests
+			}
+
+			if noLongerOwned[pKey] {
+				numNoLongerOwned++
+			}
+			for _, n := range dests {
+				b.add(n.Name(), lbls, seriesHash, t, v)
+			}
+
+			if b.size >= batchSize {
+				if err := flush(ctx, members, b); err != nil {
+					return err
+				}
+				b = newBatcher()
+			}
+		}
+		if err := it.Err(); err != nil {
+			return err
+		}
+	}
+	if err := set.Err(); err != nil {
+		return err
+	}
+
+	return flush(ctx, members, b)
+}
+
+// destinations returns the nodes that the local node should send data for the
+// given partition key to, and whether the local node is no longer
+// responsible for the partition key.
+func (r *rebalancer) destinations(previous, current placement, drain bool, members map[string]*cluster.Node, local string, pKey uint64) ([]*cluster.Node, bool) {
+	prevOwners := r.clstr.NodesByPartitionKeyFrom(previous.nodes, previous.replFactor, pKey)
+	curOwners := r.clstr.NodesByPartitionKeyFrom(current.nodes, current.replFactor, pKey)
+
+	wasOwner := make(map[string]bool, len(prevOwners))
+	for _, n := range prevOwners {
+		wasOwner[n.Name()] = true
+	}
+	isOwner := make(map[string]bool, len(curOwners))
+	for _, n := range curOwners {
+		isOwner[n.Name()] = true
+	}
+	noLongerOwned := wasOwner[local] && !isOwner[local]
+
+	// Only the first previous owner that is still a member of the
+	// cluster sends data, to avoid every replica sending the same samples.
+	// If the local node was not a previous owner, it may hold data for the
+	// partition key because of an earlier membership change, in which case
+	// it sends data only if none of the previous owners remain.
+	//
+	// A node that is draining sends all of the data it was responsible for.
+	var sender string
+	for _, n := range prevOwners {
+		if _, ok := members[n.Name()]; ok {
+			sender = n.Name()
+			break
+		}
+	}
+	if sender == "" || (drain && wasOwner[local]) {
+		sender = local
+	}
+	if sender != local {
+		return nil, noLongerOwned
+	}
+
+	var dests []*cluster.Node
+	for _, n := range curOwners {
+		if n.Name() == local || wasOwner[n.Name()] {
+			continue
+		}
+		dests = append(dests, n)
+	}
+	return dests, noLongerOwned
+}
+
+func (r *rebalancer) flush(ctx context.Context, members map[string]*cluster.Node, b *batcher) error {
+	for name, series := range b.series {
+		n, ok := members[name]
+		if !ok {
+			continue
+		}
+
+		timeseries := make([]*prompb.TimeSeries, 0, len(series))
+		var numSamples int
+		for _, ts := range series {
+			timeseries = append(timeseries, ts)
+			numSamples += len(ts.Samples)
+		}
+
+		// Samples the node rejected are not held by any of their
+		// current owners, so the rebalance cannot complete
+		sendCtx, cancel := context.WithTimeout(ctx, sendTimeout)
+		accepted, err := write.WriteToNode(sendCtx, httpClient, *n, timeseries)
+		cancel()
+
+		samplesSent.WithLabelValues(name).Add(float64(accepted))
+		r.mu.Lock()
+		r.status.SamplesSent[name] += int64(accepted)
+		r.mu.Unlock()
+		if err != nil {
+			return fmt.Errorf("unable to send %d of %d samples to %s: %s", numSamples-accepted, numSamples, name, err)
+		}
+	}
+	return nil
+}
+
+// HandlerFunc responds with the status of the current or most recent
+// rebalance. POST requests trigger a rebalance, which is a full rebalance if
+// the full form value is true.
+func (r *rebalancer) HandlerFunc(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if req.Method == http.MethodPost {
+		if full, _ := strconv.ParseBool(req.FormValue("full")); full {
+			r.TriggerFull()
+		} else {
+			r.Trigger()
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+
+	if err := json.NewEncoder(w).Encode(r.Status()); err != nil {
+		r.log.Error(err)
+	}
+}
+
+type replicationFactorResponse struct {
+	ReplicationFactor int `json:"replication_factor"`
+}
+
+// ReplicationFactorHandlerFunc responds with the cluster's replication factor.
+// POST requests change the replication factor across the whole cluster, using
+// the replication_factor form value. Once the change has been gossiped to all
+// nodes, each node rebalances its data so that new replicas are backfilled.
+func (r *rebalancer) ReplicationFactorHandlerFunc(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodPost {
+		replFactor, err := strconv.Atoi(req.FormValue("replication_factor"))
+		if err != nil {
+			http.Error(w, "invalid replication factor: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := r.clstr.SetReplicationFactor(replFactor); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.log.Infof("Replication factor set to %d using admin API", replFactor)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if req.Method == http.MethodPost {
+		w.WriteHeader(http.StatusAccepted)
+	}
+	if err := json.NewEncoder(w).Encode(replicationFactorResponse{r.clstr.ReplicationFactor()}); err != nil {
+		r.log.Error(err)
+	}
+}
+
+// batcher groups samples by destination node and series.
+type batcher struct {
+	series map[string]map[uint64]*prompb.TimeSeries
+	size   int
+}
+
+func newBatcher() *batcher {
+	return &batcher{series: make(map[string]map[uint64]*prompb.TimeSeries)}
+}
+
+func (b *batcher) add(node string, lbls labels.Labels, seriesHash uint64, t int64, v float64) {
+	if _, ok := b.series[node]; !ok {
+		b.series[node] = make(map[uint64]*prompb.TimeSeries)
+	}
+	ts, ok := b.series[node][seriesHash]
+	if !ok {
+		pairs := make([]*prompb.Label, 0, len(lbls))
+		for _, l := range lbls {
+			pairs = append(pairs, &prompb.Label{Name: l.Name, Value: l.Value})
+		}
+		ts = &prompb.TimeSeries{Labels: pairs}
+		b.series[node][seriesHash] = ts
+	}
+	ts.Samples = append(ts.Samples, &prompb.Sample{Timestamp: t, Value: v})
+	b.size++
+}
+
+func nodeNames(nodes cluster.Nodes) []string {
+	names := make([]string, 0, len(nodes))
+	for _, n := range nodes {
+		names = append(names, n.Name())
+	}
+	return names
+}
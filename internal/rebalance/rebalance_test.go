@@ -0,0 +1,341 @@
+package rebalance
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mattbostock/timbala/internal/cluster"
+	"github.com/mattbostock/timbala/internal/outoforder"
+	"github.com/mattbostock/timbala/internal/write"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/storage"
+	promtsdb "github.com/prometheus/prometheus/storage/tsdb"
+	"github.com/prometheus/tsdb"
+	"github.com/sirupsen/logrus"
+)
+
+const numTestSeries = 50
+
+// testPeer is a node that receives data from the rebalancer under test. Its
+// storage can be replaced while it is running.
+type testPeer struct {
+	addr string
+	dir  string
+	db   *tsdb.DB
+	srv  *http.Server
+
+	mu     sync.Mutex
+	store  storage.Storage
+	write  http.HandlerFunc
+	verify http.HandlerFunc
+}
+
+func startPeer(t *testing.T, dir string) *testPeer {
+	db, err := tsdb.Open(dir, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Hold a recent sample so that historical samples are out of bounds
+	// unless the node accepts repair writes
+	app, err := promtsdb.Adapter(db, 0).Appender()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.Add(labels.FromStrings(labels.MetricName, "recent"), timestamp.FromTime(time.Now()), 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testPeer{addr: l.Addr().String(), dir: dir, db: db}
+	p.setStore(t, promtsdb.Adapter(db, 0))
+	p.srv = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		h := p.write
+		if r.URL.Path == VerifyRoute {
+			h = p.verify
+		}
+		p.mu.Unlock()
+		h(w, r)
+	})}
+	go p.srv.Serve(l)
+	return p
+}
+
+func (p *testPeer) setStore(t *testing.T, s storage.Storage) {
+	wr, err := write.New(nil, logrus.New(), s, filepath.Join(p.dir, "hints"), write.ConsistencyOne)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := New(cluster.NewStatic(logrus.New(), "b", p.addr, 1, 1), logrus.New(), s)
+	p.mu.Lock()
+	p.store = s
+	p.write = wr.HandlerFunc
+	p.verify = r.VerifyHandlerFunc
+	p.mu.Unlock()
+}
+
+// loseData causes samples written to the node to not be readable from it.
+func (p *testPeer) loseData(t *testing.T) {
+	db, err := tsdb.Open(filepath.Join(p.dir, "lost"), nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := New(cluster.NewStatic(logrus.New(), "b", p.addr, 1, 1), logrus.New(), promtsdb.Adapter(db, 0))
+	p.mu.Lock()
+	p.verify = r.VerifyHandlerFunc
+	p.mu.Unlock()
+}
+
+// acceptRepairs replaces the node's storage with storage that accepts
+// historical samples.
+func (p *testPeer) acceptRepairs(t *testing.T) *testPeer {
+	s, err := outoforder.New(logrus.New(), promtsdb.Adapter(p.db, 0), filepath.Join(p.dir, "out_of_order"), filepath.Join(p.dir, "buffer"), outoforder.DefaultGracePeriod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.setStore(t, s)
+	return p
+}
+
+func (p *testPeer) close() {
+	p.srv.Close()
+	p.mu.Lock()
+	if c, ok := p.store.(interface{ Close() error }); ok {
+		c.Close()
+	}
+	p.mu.Unlock()
+	p.db.Close()
+}
+
+func (p *testPeer) numSamples(t *testing.T, mint, maxt int64) int {
+	p.mu.Lock()
+	s := p.store
+	p.mu.Unlock()
+	return countSamples(t, s, mint, maxt)
+}
+
+// newLocalStore returns storage holding a historical sample for each of
+// numTestSeries series.
+func newLocalStore(t *testing.T, dir string, ts int64) (storage.Storage, func()) {
+	db, err := tsdb.Open(dir, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := outoforder.New(logrus.New(), promtsdb.Adapter(db, 0), filepath.Join(dir, "out_of_order"), filepath.Join(dir, "buffer"), outoforder.DefaultGracePeriod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app, err := s.RepairAppender()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < numTestSeries; i++ {
+		if _, err := app.Add(labels.FromStrings(labels.MetricName, "foo", "i", fmt.Sprint(i)), ts, float64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := app.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	return s, func() {
+		s.Close()
+		db.Close()
+	}
+}
+
+func countSamples(t *testing.T, s storage.Storage, mint, maxt int64) int {
+	q, err := s.Querier(context.Background(), mint, maxt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	m, err := labels.NewMatcher(labels.MatchEqual, labels.MetricName, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, err := q.Select(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	for set.Next() {
+		it := set.At().Iterator()
+		for it.Next() {
+			n++
+		}
+	}
+	if err := set.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestRebalanceRejected(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timbala-rebalance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	old := timestamp.FromTime(time.Now().Add(-3 * time.Hour))
+	localStore, closeStore := newLocalStore(t, filepath.Join(dir, "a"), old)
+	defer closeStore()
+
+	peer := startPeer(t, filepath.Join(dir, "b"))
+	defer peer.close()
+
+	clstr := cluster.NewStatic(logrus.New(), "a", "127.0.0.1:0", 0, 1)
+	r := New(clstr, logrus.New(), localStore)
+	clstr.Join("b", peer.addr, 1)
+
+	// The new node does not accept historical samples, so the data it is
+	// now responsible for cannot be moved to it
+	r.rebalance(context.Background(), false)
+	st := r.Status()
+	if st.LastError == "" {
+		t.Fatal("Expected rebalance to fail when samples are rejected")
+	}
+	if !st.CompletedAt.IsZero() {
+		t.Fatal("Expected failed rebalance not to be marked as completed")
+	}
+	if got := nodeNames(r.members); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Fatalf("Expected membership not to be updated after failed rebalance, got %v", got)
+	}
+
+	// Once the node accepts the samples, rebalancing succeeds
+	peer.acceptRepairs(t)
+	r.rebalance(context.Background(), false)
+	st = r.Status()
+	if st.LastError != "" {
+		t.Fatalf("Expected rebalance to succeed, got %s", st.LastError)
+	}
+	if got := nodeNames(r.members); len(got) != 2 {
+		t.Fatalf("Expected membership to be updated after rebalance, got %v", got)
+	}
+	sent := st.SamplesSent["b"]
+	if sent == 0 || sent == numTestSeries {
+		t.Fatalf("Expected some but not all samples to be sent to b, sent %d", sent)
+	}
+	if got := peer.numSamples(t, old, old); int64(got) != sent {
+		t.Fatalf("Expected b to hold the %d samples sent to it, got %d", sent, got)
+	}
+}
+
+func TestDecommission(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timbala-decommission")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	old := timestamp.FromTime(time.Now().Add(-3 * time.Hour))
+	localStore, closeStore := newLocalStore(t, filepath.Join(dir, "a"), old)
+	defer closeStore()
+
+	peer := startPeer(t, filepath.Join(dir, "b"))
+	defer peer.close()
+
+	clstr := cluster.NewStatic(logrus.New(), "a", "127.0.0.1:0", 0, 1)
+	clstr.Join("b", peer.addr, 1)
+	r := New(clstr, logrus.New(), localStore)
+	if err := r.Decommission(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The node taking over does not accept historical samples, so the
+	// local node must not leave
+	r.rebalance(context.Background(), true)
+	if st := r.Status(); st.Decommissioned() || st.LastError == "" {
+		t.Fatalf("Expected draining to fail when samples are rejected, got state %q", st.State)
+	}
+
+	// The node taking over accepts the samples, but they cannot be read
+	// from it
+	peer.acceptRepairs(t)
+	peer.loseData(t)
+	r.rebalance(context.Background(), true)
+	if st := r.Status(); st.Decommissioned() || st.LastError == "" {
+		t.Fatalf("Expected draining to fail when samples cannot be read, got state %q", st.State)
+	}
+
+	peer.acceptRepairs(t)
+	r.rebalance(context.Background(), true)
+	st := r.Status()
+	if !st.Decommissioned() {
+		t.Fatalf("Expected node to be decommissioned, got state %q: %s", st.State, st.LastError)
+	}
+	if st.DaysVerified != st.DaysTotal {
+		t.Fatalf("Expected all %d days to be verified, got %d", st.DaysTotal, st.DaysVerified)
+	}
+	sent := st.SamplesSent["b"]
+	if sent == 0 {
+		t.Fatal("Expected samples to be sent to b")
+	}
+	if got := peer.numSamples(t, old, old); int64(got) != sent {
+		t.Fatalf("Expected b to hold the %d samples sent to it, got %d", sent, got)
+	}
+}
+
+func TestFullRebalance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timbala-rebalance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	old := timestamp.FromTime(time.Now().Add(-3 * time.Hour))
+	localStore, closeStore := newLocalStore(t, filepath.Join(dir, "a"), old)
+	defer closeStore()
+
+	peer := startPeer(t, filepath.Join(dir, "b")).acceptRepairs(t)
+	defer peer.close()
+
+	// The local node holds data that belongs to b, such as data placed
+	// using a different partition key, but membership has not changed
+	clstr := cluster.NewStatic(logrus.New(), "a", "127.0.0.1:0", 0, 1)
+	clstr.Join("b", peer.addr, 1)
+	r := New(clstr, logrus.New(), localStore)
+
+	r.rebalance(context.Background(), false)
+	if sent := r.Status().SamplesSent["b"]; sent != 0 {
+		t.Fatalf("Expected no samples to be sent without a membership change, sent %d", sent)
+	}
+
+	r.TriggerFull()
+	r.rebalance(context.Background(), false)
+	st := r.Status()
+	if st.LastError != "" {
+		t.Fatalf("Expected full rebalance to succeed, got %s", st.LastError)
+	}
+	if !st.Full {
+		t.Fatal("Expected rebalance to be reported as full")
+	}
+	sent := st.SamplesSent["b"]
+	if sent == 0 || sent == numTestSeries {
+		t.Fatalf("Expected some but not all samples to be sent to b, sent %d", sent)
+	}
+	if got := peer.numSamples(t, old, old); int64(got) != sent {
+		t.Fatalf("Expected b to hold the %d samples sent to it, got %d", sent, got)
+	}
+
+	r.rebalance(context.Background(), false)
+	if st := r.Status(); st.Full {
+		t.Fatal("Expected full rebalance to run only once")
+	}
+}
@@ -0,0 +1,61 @@
+// Package selectors passes the series selectors of a PromQL expression to the
+// storage queried while evaluating it, so that the storage can fetch the
+// series for every selector at once instead of one selector at a time.
+package selectors
+
+import (
+	"context"
+	"strings"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+)
+
+type contextKey struct{}
+
+// FromExpr returns the label matchers of each distinct vector and matrix
+// selector in the given expression, in the order they appear.
+func FromExpr(expr promql.Expr) [][]*labels.Matcher {
+	var (
+		sels [][]*labels.Matcher
+		seen = make(map[string]bool)
+	)
+	promql.Inspect(expr, func(node promql.Node) bool {
+		var matchers []*labels.Matcher
+		switch n := node.(type) {
+		case *promql.VectorSelector:
+			matchers = n.LabelMatchers
+		case *promql.MatrixSelector:
+			matchers = n.LabelMatchers
+		default:
+			return true
+		}
+
+		if k := Key(matchers); !seen[k] {
+			seen[k] = true
+			sels = append(sels, matchers)
+		}
+		return true
+	})
+	return sels
+}
+
+// Key returns a string that uniquely identifies the given label matchers.
+func Key(matchers []*labels.Matcher) string {
+	strs := make([]string, 0, len(matchers))
+	for _, m := range matchers {
+		strs = append(strs, m.String())
+	}
+	return strings.Join(strs, ",")
+}
+
+// NewContext returns a context carrying the given selectors.
+func NewContext(ctx context.Context, sels [][]*labels.Matcher) context.Context {
+	return context.WithValue(ctx, contextKey{}, sels)
+}
+
+// FromContext returns the selectors carried by the given context, if any.
+func FromContext(ctx context.Context) [][]*labels.Matcher {
+	sels, _ := ctx.Value(contextKey{}).([][]*labels.Matcher)
+	return sels
+}
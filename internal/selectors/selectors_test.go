@@ -0,0 +1,40 @@
+package selectors
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/prometheus/promql"
+)
+
+func TestFromExprReturnsDistinctSelectors(t *testing.T) {
+	expr, err := promql.ParseExpr(`rate(foo{job="a"}[5m]) / rate(foo{job="a"}[5m]) + on(job) bar`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	for _, m := range FromExpr(expr) {
+		keys = append(keys, Key(m))
+	}
+	expected := []string{`job="a",__name__="foo"`, `__name__="bar"`}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("Expected selectors %v, got %v", expected, keys)
+	}
+}
+
+func TestSelectorsFromContext(t *testing.T) {
+	if sels := FromContext(context.Background()); sels != nil {
+		t.Fatalf("Expected no selectors, got %v", sels)
+	}
+
+	expr, err := promql.ParseExpr(`foo`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := NewContext(context.Background(), FromExpr(expr))
+	if sels := FromContext(ctx); len(sels) != 1 {
+		t.Fatalf("Expected 1 selector, got %d", len(sels))
+	}
+}
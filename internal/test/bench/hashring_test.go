@@ -0,0 +1,49 @@
+// +build bench
+
+package main
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/mattbostock/timbala/internal/hashring"
+)
+
+const hashringBuckets = 19
+
+// BenchmarkHashRing measures how quickly each hashring assigns partition keys
+// to the buckets occupied by a cluster's nodes. Every node looks up partition
+// keys for each sample it receives and each query it serves, so run the
+// benchmark with several values of -cpu to see how lookups scale with
+// GOMAXPROCS:
+//
+//	go test -tags bench -run NONE -bench HashRing -cpu 1,2,4,8 ./internal/test/bench
+func BenchmarkHashRing(b *testing.B) {
+	buckets := make([]int32, hashringBuckets)
+	for i := range buckets {
+		buckets[i] = int32(i)
+	}
+
+	for _, name := range hashring.Names() {
+		b.Run(name, func(b *testing.B) {
+			ring, err := hashring.ByName(name)
+			if err != nil {
+				b.Fatal(err)
+			}
+			get := func(key uint64) int32 { return ring.Get(key, len(buckets)) }
+			if sparse, ok := ring.(hashring.SparseHashRing); ok {
+				get = func(key uint64) int32 { return sparse.GetFrom(key, buckets) }
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				key := rand.Uint64()
+				for pb.Next() {
+					get(key)
+					key++
+				}
+			})
+		})
+	}
+}
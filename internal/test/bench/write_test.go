@@ -0,0 +1,101 @@
+// +build bench
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/mattbostock/timbala/internal/write"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/prompb"
+	promtsdb "github.com/prometheus/prometheus/storage/tsdb"
+	"github.com/prometheus/tsdb"
+	log "github.com/sirupsen/logrus"
+)
+
+const seriesPerRequest = 1000
+
+// BenchmarkLocalWrite measures how quickly a node appends internal writes
+// received from other nodes to local storage. Each parallel worker writes its
+// own series, so run the benchmark with several values of -cpu to see how
+// ingestion scales with GOMAXPROCS:
+//
+//	go test -tags bench -run NONE -bench LocalWrite -cpu 1,2,4,8 ./internal/test/bench
+func BenchmarkLocalWrite(b *testing.B) {
+	dir, err := ioutil.TempDir("", "timbala-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := tsdb.Open(filepath.Join(dir, "data"), nil, nil, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	logger := log.New()
+	logger.Out = ioutil.Discard
+	wr, err := write.New(nil, logger, promtsdb.Adapter(db, 0), filepath.Join(dir, "hints"), write.DefaultConsistencyLevel)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	// Report throughput as the size of the uncompressed write requests,
+	// each of which holds one sample for each of seriesPerRequest series
+	var workers int64
+	start := timestamp.FromTime(time.Now())
+	b.SetBytes(int64(newWriteRequest(1, start).Size()))
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		worker := atomic.AddInt64(&workers, 1)
+		req := newWriteRequest(worker, start)
+
+		for ts := start; pb.Next(); ts++ {
+			for _, series := range req.Timeseries {
+				series.Samples[0].Timestamp = ts
+				series.Samples[0].Value = float64(ts)
+			}
+			data, err := req.Marshal()
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			httpReq := httptest.NewRequest("POST", write.Route, bytes.NewReader(snappy.Encode(nil, data)))
+			httpReq.Header.Set(write.HTTPHeaderInternalWrite, write.HTTPHeaderInternalWriteVersion)
+			rec := httptest.NewRecorder()
+			wr.HandlerFunc(rec, httpReq)
+			if rec.Code != http.StatusOK {
+				b.Fatalf("Expected HTTP status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body)
+			}
+		}
+	})
+}
+
+// newWriteRequest returns a write request holding one sample at the given
+// timestamp for each of the given worker's series.
+func newWriteRequest(worker, ts int64) *prompb.WriteRequest {
+	req := &prompb.WriteRequest{Timeseries: make([]*prompb.TimeSeries, 0, seriesPerRequest)}
+	for i := 0; i < seriesPerRequest; i++ {
+		req.Timeseries = append(req.Timeseries, &prompb.TimeSeries{
+			Labels: []*prompb.Label{
+				{Name: "__name__", Value: "bench_metric"},
+				{Name: "series", Value: fmt.Sprintf("%d", i)},
+				{Name: "worker", Value: fmt.Sprintf("%d", worker)},
+			},
+			Samples: []*prompb.Sample{{Timestamp: ts, Value: float64(ts)}},
+		})
+	}
+	return req
+}
@@ -0,0 +1,52 @@
+// Package warnings collects non-fatal problems encountered while serving a
+// request, such as nodes that failed to respond to a query, so that they can
+// be reported to the client alongside the response.
+package warnings
+
+import (
+	"sync"
+
+	"context"
+)
+
+type contextKey struct{}
+
+type collector struct {
+	mu       sync.Mutex
+	warnings []string
+}
+
+// NewContext returns a context that collects warnings added using Add.
+func NewContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, contextKey{}, &collector{})
+}
+
+// Add records a warning against the given context. Warnings are discarded if
+// the context was not created using NewContext.
+func Add(ctx context.Context, warning string) {
+	c, ok := ctx.Value(contextKey{}).(*collector)
+	if !ok {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, w := range c.warnings {
+		if w == warning {
+			return
+		}
+	}
+	c.warnings = append(c.warnings, warning)
+}
+
+// FromContext returns the warnings recorded against the given context.
+func FromContext(ctx context.Context) []string {
+	c, ok := ctx.Value(contextKey{}).(*collector)
+	if !ok {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.warnings...)
+}
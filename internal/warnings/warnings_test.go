@@ -0,0 +1,27 @@
+package warnings
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestWarningsAreCollectedOnce(t *testing.T) {
+	ctx := NewContext(context.Background())
+	Add(ctx, "node a did not respond")
+	Add(ctx, "node b did not respond")
+	Add(ctx, "node a did not respond")
+
+	expected := []string{"node a did not respond", "node b did not respond"}
+	if w := FromContext(ctx); !reflect.DeepEqual(w, expected) {
+		t.Fatalf("Expected warnings %v, got %v", expected, w)
+	}
+}
+
+func TestWarningsWithoutCollectorAreDiscarded(t *testing.T) {
+	ctx := context.Background()
+	Add(ctx, "node a did not respond")
+	if w := FromContext(ctx); w != nil {
+		t.Fatalf("Expected no warnings, got %v", w)
+	}
+}
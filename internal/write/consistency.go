@@ -0,0 +1,123 @@
+package write
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ConsistencyLevel determines how many of the replicas responsible for a
+// sample must commit it before the write is acknowledged to the client.
+type ConsistencyLevel int
+
+const (
+	ConsistencyOne ConsistencyLevel = iota + 1
+	ConsistencyQuorum
+	ConsistencyAll
+
+	DefaultConsistencyLevel = ConsistencyQuorum
+)
+
+var consistencyLevelNames = map[ConsistencyLevel]string{
+	ConsistencyOne:    "one",
+	ConsistencyQuorum: "quorum",
+	ConsistencyAll:    "all",
+}
+
+// ConsistencyLevelNames returns the names of all valid consistency levels.
+func ConsistencyLevelNames() []string {
+	return []string{
+		ConsistencyOne.String(),
+		ConsistencyQuorum.String(),
+		ConsistencyAll.String(),
+	}
+}
+
+func ParseConsistencyLevel(s string) (ConsistencyLevel, error) {
+	for level, name := range consistencyLevelNames {
+		if strings.EqualFold(s, name) {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid write consistency level %q, must be one of: %s", s, strings.Join(ConsistencyLevelNames(), ", "))
+}
+
+func (c ConsistencyLevel) String() string {
+	return consistencyLevelNames[c]
+}
+
+// required returns the number of replicas that must succeed for a write to
+// a set of replicas of the given size to be acknowledged.
+func (c ConsistencyLevel) required(replicas int) int {
+	switch c {
+	case ConsistencyOne:
+		if replicas < 1 {
+			return replicas
+		}
+		return 1
+	case ConsistencyAll:
+		return replicas
+	default:
+		return replicas/2 + 1
+	}
+}
+
+// writeTracker tracks the outcome of writes to each node and determines
+// whether the consistency level has been met for every set of replicas
+// touched by a write request.
+type writeTracker struct {
+	level       ConsistencyLevel
+	replicaSets [][]string
+	succeeded   map[string]bool
+	failed      map[string]bool
+}
+
+func newWriteTracker(level ConsistencyLevel, replicaSets [][]string) *writeTracker {
+	return &writeTracker{
+		level:       level,
+		replicaSets: replicaSets,
+		succeeded:   make(map[string]bool),
+		failed:      make(map[string]bool),
+	}
+}
+
+func (t *writeTracker) record(node string, err error) {
+	if err != nil {
+		t.failed[node] = true
+		return
+	}
+	t.succeeded[node] = true
+}
+
+// satisfied returns true if enough replicas in every replica set have
+// succeeded.
+func (t *writeTracker) satisfied() bool {
+	for _, set := range t.replicaSets {
+		var ok int
+		for _, n := range set {
+			if t.succeeded[n] {
+				ok++
+			}
+		}
+		if ok < t.level.required(len(set)) {
+			return false
+		}
+	}
+	return true
+}
+
+// unsatisfiable returns true if so many replicas in a replica set have failed
+// that the consistency level cannot be met.
+func (t *writeTracker) unsatisfiable() bool {
+	for _, set := range t.replicaSets {
+		var failed int
+		for _, n := range set {
+			if t.failed[n] {
+				failed++
+			}
+		}
+		if len(set)-failed < t.level.required(len(set)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+package write
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestConsistencyLevelRequired(t *testing.T) {
+	var tests = []struct {
+		level    ConsistencyLevel
+		replicas int
+		expected int
+	}{
+		{ConsistencyOne, 1, 1},
+		{ConsistencyOne, 3, 1},
+		{ConsistencyQuorum, 1, 1},
+		{ConsistencyQuorum, 2, 2},
+		{ConsistencyQuorum, 3, 2},
+		{ConsistencyQuorum, 5, 3},
+		{ConsistencyAll, 1, 1},
+		{ConsistencyAll, 3, 3},
+	}
+
+	for _, test := range tests {
+		if got := test.level.required(test.replicas); got != test.expected {
+			t.Errorf("Expected %d replicas to be required for %s with %d replicas, got %d", test.expected, test.level, test.replicas, got)
+		}
+	}
+}
+
+func TestParseConsistencyLevel(t *testing.T) {
+	for _, name := range ConsistencyLevelNames() {
+		level, err := ParseConsistencyLevel(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if level.String() != name {
+			t.Fatalf("Expected %q, got %q", name, level)
+		}
+	}
+
+	if level, err := ParseConsistencyLevel("QUORUM"); err != nil || level != ConsistencyQuorum {
+		t.Fatalf("Expected consistency level names to be case-insensitive")
+	}
+	if _, err := ParseConsistencyLevel("most"); err == nil {
+		t.Fatal("Expected error for invalid consistency level")
+	}
+}
+
+func TestWriteTracker(t *testing.T) {
+	sets := [][]string{{"a", "b", "c"}, {"b", "c", "d"}}
+	errFailed := errors.New("failed")
+
+	tracker := newWriteTracker(ConsistencyQuorum, sets)
+	tracker.record("a", nil)
+	tracker.record("b", nil)
+	if tracker.satisfied() {
+		t.Fatal("Expected quorum not to be met for second replica set")
+	}
+	tracker.record("d", errFailed)
+	if tracker.unsatisfiable() {
+		t.Fatal("Expected quorum to still be achievable for second replica set")
+	}
+	tracker.record("c", nil)
+	if !tracker.satisfied() {
+		t.Fatal("Expected quorum to be met for all replica sets")
+	}
+
+	tracker = newWriteTracker(ConsistencyAll, sets)
+	tracker.record("a", nil)
+	tracker.record("d", errFailed)
+	if !tracker.unsatisfiable() {
+		t.Fatal("Expected consistency level all to be unsatisfiable after a failure")
+	}
+
+	tracker = newWriteTracker(ConsistencyOne, sets)
+	tracker.record("a", errFailed)
+	tracker.record("b", nil)
+	if !tracker.satisfied() {
+		t.Fatal("Expected consistency level one to be met by a single shared replica")
+	}
+}
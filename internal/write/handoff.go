@@ -0,0 +1,671 @@
+package write
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/mattbostock/timbala/internal/cluster"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const (
+	hintFileExt         = ".hint"
+	hintRejectedFileExt = ".rejected"
+	hintReplayInterval  = 10 * time.Second
+	hintReplayTimeout   = 30 * time.Second
+	hintTmpFileExt      = ".tmp"
+
+	// maxHintAge is how long a write is queued for a node before it is
+	// discarded. Anti-entropy repairs any data discarded this way.
+	maxHintAge = 72 * time.Hour
+
+	// maxHintBytes bounds the size of the writes queued for each node
+	maxHintBytes = 1 << 30
+
+	// hintRerouteDelay is how long a node must have been absent from the
+	// cluster before the writes queued for it are sent to the nodes now
+	// responsible for their samples instead. Writes queued for nodes that
+	// were decommissioned are re-routed without waiting.
+	hintRerouteDelay = 15 * time.Minute
+
+	// rejectedHintRetryInterval is how often a queued write that the node
+	// rejected but may accept later, such as after being upgraded, is
+	// replayed again
+	rejectedHintRetryInterval = 10 * time.Minute
+)
+
+var errHintQueueFull = errors.New("too many writes queued on disk for node")
+
+var (
+	hintsQueued = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "timbala",
+			Subsystem: "hinted_handoff",
+			Name:      "queued_hints",
+			Help:      "Number of writes queued on disk for a node that could not be reached",
+		},
+		[]string{"node"},
+	)
+	hintsQueuedBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "timbala",
+			Subsystem: "hinted_handoff",
+			Name:      "queued_bytes",
+			Help:      "Size in bytes of the writes queued on disk for a node that could not be reached",
+		},
+		[]string{"node"},
+	)
+	hintsStored = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "timbala",
+			Subsystem: "hinted_handoff",
+			Name:      "stored_total",
+			Help:      "Total number of writes queued on disk for a node that could not be reached",
+		},
+		[]string{"node"},
+	)
+	hintsReplayed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "timbala",
+			Subsystem: "hinted_handoff",
+			Name:      "replayed_total",
+			Help:      "Total number of queued writes successfully replayed to a node",
+		},
+		[]string{"node"},
+	)
+	hintsRerouted = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "timbala",
+			Subsystem: "hinted_handoff",
+			Name:      "rerouted_total",
+			Help:      "Total number of writes queued for a node that left the cluster and sent to the nodes now responsible for them",
+		},
+		[]string{"node"},
+	)
+	hintsRejected = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "timbala",
+			Subsystem: "hinted_handoff",
+			Name:      "rejected_hints",
+			Help:      "Number of queued writes kept on disk because a node rejected samples in them that it may accept later",
+		},
+		[]string{"node"},
+	)
+	hintsRejectedSamples = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "timbala",
+			Subsystem: "hinted_handoff",
+			Name:      "rejected_samples_total",
+			Help:      "Total number of samples in replayed writes rejected by a node, by reason",
+		},
+		[]string{"node", "reason"},
+	)
+	hintsDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "timbala",
+			Subsystem: "hinted_handoff",
+			Name:      "dropped_total",
+			Help:      "Total number of writes for a node that were not queued on disk because too many writes were already queued",
+		},
+		[]string{"node"},
+	)
+	hintsExpired = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "timbala",
+			Subsystem: "hinted_handoff",
+			Name:      "expired_total",
+			Help:      "Total number of queued writes discarded because they could not be replayed to a node within the maximum age",
+		},
+		[]string{"node"},
+	)
+	hintReplayLag = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "timbala",
+			Subsystem: "hinted_handoff",
+			Name:      "replay_lag_seconds",
+			Help:      "Time between a write being queued and it being replayed, for the most recently replayed write",
+		},
+		[]string{"node"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(hintsQueued, hintsQueuedBytes, hintsStored, hintsReplayed, hintsRerouted, hintsRejected, hintsRejectedSamples, hintsDropped, hintsExpired, hintReplayLag)
+}
+
+// hintStore durably queues internal writes that could not be delivered to
+// the node responsible for them, so that they can be replayed once the node
+// rejoins the cluster.
+//
+// Each node has its own directory containing one file per queued write. The
+// file contains the snappy-compressed request body exactly as it would have
+// been sent and is named after the time it was queued, so that hints can be
+// replayed in the order they were received. Hints that the node rejected but
+// may accept later are renamed to have a different extension.
+//
+// Hints are discarded once they are older than maxHintAge, and no more hints
+// are queued for a node once its hints reach maxHintBytes.
+type hintStore struct {
+	dir string
+
+	mu       sync.Mutex
+	lastHint int64
+	// sizes holds the size in bytes of the hints queued for each node
+	sizes map[string]int64
+}
+
+func newHintStore(dir string) (*hintStore, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, fmt.Errorf("unable to create hinted handoff directory: %s", err)
+	}
+
+	h := &hintStore{dir: dir, sizes: make(map[string]int64)}
+	nodes, err := h.nodes()
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range nodes {
+		h.updateQueueMetrics(n)
+	}
+	return h, nil
+}
+
+func (h *hintStore) store(node string, compressed []byte) error {
+	nodeDir := h.nodeDir(node)
+	if err := os.MkdirAll(nodeDir, 0777); err != nil {
+		return err
+	}
+
+	// Ensure that hint names are unique and strictly increasing, even if
+	// the clock goes backwards or two hints are queued concurrently
+	h.mu.Lock()
+	if h.sizes[node]+int64(len(compressed)) > maxHintBytes {
+		h.mu.Unlock()
+		hintsDropped.WithLabelValues(node).Inc()
+		return errHintQueueFull
+	}
+	h.sizes[node] += int64(len(compressed))
+	ts := time.Now().UnixNano()
+	if ts <= h.lastHint {
+		ts = h.lastHint + 1
+	}
+	h.lastHint = ts
+	h.mu.Unlock()
+
+	if err := writeHint(filepath.Join(nodeDir, fmt.Sprintf("%020d", ts)), compressed); err != nil {
+		h.updateQueueMetrics(node)
+		return err
+	}
+
+	hintsStored.WithLabelValues(node).Inc()
+	hintsQueued.WithLabelValues(node).Inc()
+	hintsQueuedBytes.WithLabelValues(node).Add(float64(len(compressed)))
+	return nil
+}
+
+// writeHint durably writes a hint to the given path, without an extension.
+func writeHint(path string, compressed []byte) error {
+	tmpPath := path + hintTmpFileExt
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(compressed); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, path+hintFileExt); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// nodes returns the names of all nodes that have hints directories.
+func (h *hintStore) nodes() ([]string, error) {
+	files, err := ioutil.ReadDir(h.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make([]string, 0, len(files))
+	for _, fi := range files {
+		if !fi.IsDir() {
+			continue
+		}
+		name, err := url.PathUnescape(fi.Name())
+		if err != nil {
+			continue
+		}
+		nodes = append(nodes, name)
+	}
+	return nodes, nil
+}
+
+// hints returns the paths of all hints queued for the given node, oldest
+// first, including those previously rejected by the node.
+func (h *hintStore) hints(node string) ([]string, error) {
+	files, err := ioutil.ReadDir(h.nodeDir(node))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, fi := range files {
+		if fi.IsDir() || !isHint(fi.Name()) {
+			continue
+		}
+		paths = append(paths, filepath.Join(h.nodeDir(node), fi.Name()))
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+func isHint(name string) bool {
+	return strings.HasSuffix(name, hintFileExt) || strings.HasSuffix(name, hintRejectedFileExt)
+}
+
+func isRejectedHint(path string) bool {
+	return strings.HasSuffix(path, hintRejectedFileExt)
+}
+
+func (h *hintStore) remove(node, path string) error {
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	h.updateQueueMetrics(node)
+	return nil
+}
+
+// reject marks a hint as rejected by the node, so that it is kept but only
+// replayed again after rejectedHintRetryInterval.
+func (h *hintStore) reject(node, path string) error {
+	if !isRejectedHint(path) {
+		rejectedPath := strings.TrimSuffix(path, hintFileExt) + hintRejectedFileExt
+		if err := os.Rename(path, rejectedPath); err != nil {
+			return err
+		}
+		path = rejectedPath
+	}
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err != nil {
+		return err
+	}
+	h.updateQueueMetrics(node)
+	return nil
+}
+
+// expire removes the hints queued for the given node that are older than
+// maxHintAge, returning the number removed.
+func (h *hintStore) expire(node string) (int, error) {
+	paths, err := h.hints(node)
+	if err != nil {
+		return 0, err
+	}
+
+	var expired int
+	for _, path := range paths {
+		queued, err := hintTime(path)
+		if err != nil || time.Since(queued) <= maxHintAge {
+			// Hints are sorted by the time they were queued
+			break
+		}
+		if err := os.Remove(path); err != nil {
+			return expired, err
+		}
+		expired++
+	}
+	if expired > 0 {
+		hintsExpired.WithLabelValues(node).Add(float64(expired))
+		h.updateQueueMetrics(node)
+	}
+	return expired, nil
+}
+
+func (h *hintStore) nodeDir(node string) string {
+	return filepath.Join(h.dir, url.PathEscape(node))
+}
+
+func (h *hintStore) updateQueueMetrics(node string) {
+	files, err := ioutil.ReadDir(h.nodeDir(node))
+	if err != nil {
+		return
+	}
+
+	var count, rejected, size int64
+	for _, fi := range files {
+		if fi.IsDir() || !isHint(fi.Name()) {
+			continue
+		}
+		count++
+		if isRejectedHint(fi.Name()) {
+			rejected++
+		}
+		size += fi.Size()
+	}
+	hintsQueued.WithLabelValues(node).Set(float64(count))
+	hintsQueuedBytes.WithLabelValues(node).Set(float64(size))
+	hintsRejected.WithLabelValues(node).Set(float64(rejected))
+
+	h.mu.Lock()
+	h.sizes[node] = size
+	h.mu.Unlock()
+}
+
+func hintTime(path string) (time.Time, error) {
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	ts, err := strconv.ParseInt(name, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, ts), nil
+}
+
+// ReplayHints replays queued writes to nodes that are members of the cluster
+// until the context is cancelled. Replays are attempted periodically and
+// whenever cluster membership changes. Senders for nodes that leave the
+// cluster are stopped, and writes queued for nodes that have left are
+// re-routed to the nodes now responsible for them.
+func (wr *writer) ReplayHints(ctx context.Context) {
+	events := wr.clstr.Subscribe()
+	ticker := time.NewTicker(hintReplayInterval)
+	defer ticker.Stop()
+
+	for {
+		wr.replayHints(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-events:
+			if ev.Type == cluster.NodeLeave {
+				wr.stopSenders(ev.Node.Name())
+				if ev.Node.Leaving() {
+					// The node was decommissioned and will not
+					// return
+					wr.markDeparted(ev.Node.Name(), time.Time{})
+				}
+			}
+		case <-ticker.C:
+		}
+	}
+}
+
+func (wr *writer) replayHints(ctx context.Context) {
+	nodesWithHints, err := wr.hints.nodes()
+	if err != nil {
+		wr.log.Warningf("Unable to list hinted handoff queues: %s", err)
+		return
+	}
+	if len(nodesWithHints) == 0 {
+		return
+	}
+
+	for _, name := range nodesWithHints {
+		expired, err := wr.hints.expire(name)
+		if err != nil {
+			wr.log.Warningf("Unable to discard expired writes queued for %s: %s", name, err)
+		}
+		if expired > 0 {
+			wr.log.Warningf("Discarded %d writes queued for %s for longer than %s", expired, name, maxHintAge)
+		}
+	}
+
+	members := make(map[string]*cluster.Node, len(wr.clstr.Nodes()))
+	for _, n := range wr.clstr.Nodes() {
+		members[n.Name()] = n
+	}
+
+	wr.departedMu.Lock()
+	departed := make(map[string]time.Time, len(nodesWithHints))
+	for _, name := range nodesWithHints {
+		since, ok := wr.departed[name]
+		if n, member := members[name]; member && !n.Leaving() {
+			continue
+		} else if member {
+			// Nodes being decommissioned are no longer responsible
+			// for any samples
+			since = time.Time{}
+		} else if !ok {
+			since = time.Now()
+		}
+		departed[name] = since
+	}
+	wr.departed = departed
+	wr.departedMu.Unlock()
+
+	for _, name := range nodesWithHints {
+		if since, ok := departed[name]; ok {
+			if time.Since(since) < hintRerouteDelay {
+				continue
+			}
+			if err := wr.rerouteNodeHints(ctx, name); err != nil {
+				wr.log.Infof("Unable to re-route writes queued for %s, will retry: %s", name, err)
+			}
+			continue
+		}
+
+		if err := wr.replayNodeHints(ctx, members[name]); err != nil {
+			wr.log.Infof("Unable to replay queued writes to %s, will retry: %s", name, err)
+		}
+	}
+}
+
+// markDeparted records the time from which the given node is treated as
+// having left the cluster.
+func (wr *writer) markDeparted(name string, since time.Time) {
+	wr.departedMu.Lock()
+	wr.departed[name] = since
+	wr.departedMu.Unlock()
+}
+
+// replayNodeHints replays the writes queued for a node, oldest first. Writes
+// whose samples the node rejected as duplicates are discarded, as they will
+// never be accepted. Writes with samples rejected for other reasons, such as
+// by a node that does not accept historical samples, are kept and replayed
+// again later.
+func (wr *writer) replayNodeHints(ctx context.Context, n *cluster.Node) error {
+	paths, err := wr.hints.hints(n.Name())
+	if err != nil {
+		return err
+	}
+
+	var replayed, rejected int
+	for _, path := range paths {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		if isRejectedHint(path) {
+			fi, err := os.Stat(path)
+			if err != nil {
+				return err
+			}
+			if time.Since(fi.ModTime()) < rejectedHintRetryInterval {
+				continue
+			}
+		}
+
+		compressed, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		reqCtx, cancel := context.WithTimeout(ctx, hintReplayTimeout)
+		err = wr.sendToNode(reqCtx, *n, compressed, true)
+		cancel()
+		if rerr, ok := err.(*rejectedError); ok {
+			for reason, count := range rerr.reasons {
+				hintsRejectedSamples.WithLabelValues(n.Name(), reason).Add(float64(count))
+			}
+			if rerr.retryable() {
+				wr.log.Warningf("Keeping queued write to %s, which rejected samples in it: %s", n.Name(), rerr)
+				if err := wr.hints.reject(n.Name(), path); err != nil {
+					return err
+				}
+				rejected++
+				continue
+			}
+			wr.log.Debugf("Replayed write to %s had rejected samples: %s", n.Name(), rerr)
+		} else if err != nil {
+			return err
+		}
+
+		if queued, err := hintTime(path); err == nil {
+			hintReplayLag.WithLabelValues(n.Name()).Set(time.Since(queued).Seconds())
+		}
+		hintsReplayed.WithLabelValues(n.Name()).Inc()
+		replayed++
+
+		if err := wr.hints.remove(n.Name(), path); err != nil {
+			return err
+		}
+	}
+
+	if replayed > 0 {
+		wr.log.Infof("Replayed %d queued writes to %s", replayed, n.Name())
+	}
+	if rejected > 0 {
+		return fmt.Errorf("%d queued writes had samples rejected", rejected)
+	}
+	return nil
+}
+
+// rerouteNodeHints sends the writes queued for a node that has left the
+// cluster to the nodes now responsible for their samples, oldest first.
+// Writes are removed once every node has accepted them or rejected them as
+// duplicates. Writes with samples rejected for other reasons are kept and
+// re-routed again later.
+func (wr *writer) rerouteNodeHints(ctx context.Context, name string) error {
+	paths, err := wr.hints.hints(name)
+	if err != nil {
+		return err
+	}
+
+	var rerouted, rejected int
+	for _, path := range paths {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		if isRejectedHint(path) {
+			fi, err := os.Stat(path)
+			if err != nil {
+				return err
+			}
+			if time.Since(fi.ModTime()) < rejectedHintRetryInterval {
+				continue
+			}
+		}
+
+		compressed, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		retryable, err := wr.reroute(ctx, name, compressed)
+		if err != nil {
+			return err
+		}
+		if retryable {
+			wr.log.Warningf("Keeping write queued for %s, which had samples rejected when re-routed", name)
+			if err := wr.hints.reject(name, path); err != nil {
+				return err
+			}
+			rejected++
+			continue
+		}
+
+		hintsRerouted.WithLabelValues(name).Inc()
+		rerouted++
+		if err := wr.hints.remove(name, path); err != nil {
+			return err
+		}
+	}
+
+	if rerouted > 0 {
+		wr.log.Infof("Re-routed %d writes queued for %s, which has left the cluster", rerouted, name)
+	}
+	if rejected > 0 {
+		return fmt.Errorf("%d queued writes had samples rejected", rejected)
+	}
+	return nil
+}
+
+// reroute writes a request queued for the given node to the nodes now
+// responsible for its samples, reporting whether any node rejected samples
+// that it may accept later.
+func (wr *writer) reroute(ctx context.Context, name string, compressed []byte) (bool, error) {
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return false, err
+	}
+	var req prompb.WriteRequest
+	if err := req.Unmarshal(data); err != nil {
+		return false, err
+	}
+
+	seriesToNodes, _ := wr.placeSeries(req.Timeseries)
+	var retryable bool
+	for n, sMap := range seriesToNodes {
+		if len(sMap) == 0 {
+			continue
+		}
+		series := make([]*prompb.TimeSeries, 0, len(sMap))
+		for _, ts := range sMap {
+			series = append(series, ts)
+		}
+
+		if n.Name() == wr.clstr.LocalNode().Name() {
+			err = wr.localWrite(series, true)
+		} else {
+			var data []byte
+			data, err = (&prompb.WriteRequest{Timeseries: series}).Marshal()
+			if err != nil {
+				return false, err
+			}
+			reqCtx, cancel := context.WithTimeout(ctx, hintReplayTimeout)
+			err = wr.sendToNode(reqCtx, n, snappy.Encode(nil, data), true)
+			cancel()
+		}
+
+		if rerr, ok := err.(*rejectedError); ok {
+			for reason, count := range rerr.reasons {
+				hintsRejectedSamples.WithLabelValues(n.Name(), reason).Add(float64(count))
+			}
+			retryable = retryable || rerr.retryable()
+			wr.log.Debugf("Write re-routed from %s to %s had rejected samples: %s", name, n.Name(), rerr)
+		} else if err != nil {
+			return false, fmt.Errorf("%s: %s", n.Name(), err)
+		}
+	}
+	return retryable, nil
+}
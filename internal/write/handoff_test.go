@@ -0,0 +1,393 @@
+package write
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/mattbostock/timbala/internal/cluster"
+	"github.com/mattbostock/timbala/internal/outoforder"
+	promlabels "github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/prompb"
+	promtsdb "github.com/prometheus/prometheus/storage/tsdb"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+	"github.com/sirupsen/logrus"
+)
+
+func TestHintStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timbala-hints")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	h, err := newHintStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node := "node/with:odd-characters"
+	payloads := [][]byte{[]byte("first"), []byte("second"), []byte("third")}
+	for _, p := range payloads {
+		if err := h.store(node, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	nodes, err := h.nodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 1 || nodes[0] != node {
+		t.Fatalf("Expected hints for node %q, got %q", node, nodes)
+	}
+
+	paths, err := h.hints(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != len(payloads) {
+		t.Fatalf("Expected %d hints, got %d", len(payloads), len(paths))
+	}
+	for i, path := range paths {
+		got, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, payloads[i]) {
+			t.Fatalf("Hints not in order queued; expected %q, got %q", payloads[i], got)
+		}
+		if _, err := hintTime(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := h.remove(node, paths[0]); err != nil {
+		t.Fatal(err)
+	}
+	paths, err = h.hints(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != len(payloads)-1 {
+		t.Fatalf("Expected %d hints after removal, got %d", len(payloads)-1, len(paths))
+	}
+
+	paths, err = h.hints("unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 0 {
+		t.Fatalf("Expected no hints for unknown node, got %d", len(paths))
+	}
+}
+
+func TestHintedHandoff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timbala-handoff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Reserve an address for node b, which cannot be reached until it
+	// starts serving
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrB := l.Addr().String()
+	l.Close()
+
+	clstr := cluster.NewStatic(logrus.New(), "a", "127.0.0.1:0", 0, 2)
+	clstr.Join("b", addrB, 1)
+
+	dbA, err := tsdb.Open(filepath.Join(dir, "a"), nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbA.Close()
+	wrA, err := New(clstr, logrus.New(), promtsdb.Adapter(dbA, 0), filepath.Join(dir, "a", "hints"), ConsistencyOne)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lbls := []*prompb.Label{{Name: "__name__", Value: "foo"}}
+	now := timestamp.FromTime(time.Now())
+	old := now - int64(3*time.Hour/time.Millisecond)
+
+	// The write succeeds on node a, and is queued for node b
+	req := &prompb.WriteRequest{Timeseries: []*prompb.TimeSeries{{
+		Labels:  lbls,
+		Samples: []*prompb.Sample{{Timestamp: old, Value: 1}},
+	}}}
+	data, err := req.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	wrA.HandlerFunc(rec, httptest.NewRequest("POST", Route, bytes.NewReader(snappy.Encode(nil, data))))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected write to succeed, got HTTP %d: %s", rec.Code, rec.Body)
+	}
+	hints := func() []string {
+		paths, err := wrA.hints.hints("b")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return paths
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(hints()) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for write to be queued for node b")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Node b already holds a newer sample for the same series, so the
+	// queued sample is older than its storage accepts in order
+	dbB, err := tsdb.Open(filepath.Join(dir, "b"), nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbB.Close()
+	wrB, err := New(nil, logrus.New(), promtsdb.Adapter(dbB, 0), filepath.Join(dir, "b", "hints"), ConsistencyOne)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wrB.localWrite([]*prompb.TimeSeries{{Labels: lbls, Samples: []*prompb.Sample{{Timestamp: now, Value: 2}}}}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	handler := wrB.HandlerFunc
+	l, err = net.Listen("tcp", addrB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		h := handler
+		mu.Unlock()
+		h(w, r)
+	})}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	// Storage that does not accept historical samples rejects the queued
+	// write, which is kept
+	wrA.replayHints(context.Background())
+	if paths := hints(); len(paths) != 1 || !isRejectedHint(paths[0]) {
+		t.Fatalf("Expected queued write to be kept after being rejected, got %v", paths)
+	}
+
+	// Once node b accepts historical samples, the write is replayed
+	store, err := outoforder.New(logrus.New(), promtsdb.Adapter(dbB, 0), filepath.Join(dir, "b", "out_of_order"), filepath.Join(dir, "b", "buffer"), outoforder.DefaultGracePeriod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	wrB, err = New(nil, logrus.New(), store, filepath.Join(dir, "b", "hints"), ConsistencyOne)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	handler = wrB.HandlerFunc
+	mu.Unlock()
+
+	retry := time.Now().Add(-rejectedHintRetryInterval)
+	if err := os.Chtimes(hints()[0], retry, retry); err != nil {
+		t.Fatal(err)
+	}
+	wrA.replayHints(context.Background())
+	if paths := hints(); len(paths) != 0 {
+		t.Fatalf("Expected queued write to be replayed, got %v", paths)
+	}
+
+	q, err := store.Querier(context.Background(), 0, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	m, err := promlabels.NewMatcher(promlabels.MatchEqual, "__name__", "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, err := q.Select(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []int64
+	for set.Next() {
+		it := set.At().Iterator()
+		for it.Next() {
+			ts, _ := it.At()
+			got = append(got, ts)
+		}
+	}
+	if len(got) != 2 || got[0] != old || got[1] != now {
+		t.Fatalf("Expected samples at %d and %d on node b, got %v", old, now, got)
+	}
+}
+
+func TestHintStoreLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timbala-hints")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	h, err := newHintStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Hints older than the maximum age are discarded
+	node := "node"
+	if err := writeHint(filepath.Join(h.nodeDir(node), fmt.Sprintf("%020d", time.Now().Add(-maxHintAge-time.Minute).UnixNano())), []byte("old")); err == nil {
+		t.Fatal("Expected error writing hint before the node's directory exists")
+	}
+	if err := h.store(node, []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeHint(filepath.Join(h.nodeDir(node), fmt.Sprintf("%020d", time.Now().Add(-maxHintAge-time.Minute).UnixNano())), []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	if expired, err := h.expire(node); err != nil || expired != 1 {
+		t.Fatalf("Expected 1 hint to expire, got %d: %v", expired, err)
+	}
+	paths, err := h.hints(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 1 {
+		t.Fatalf("Expected 1 hint to remain, got %d", len(paths))
+	}
+
+	// No more hints are queued once the maximum size is reached
+	h.sizes[node] = maxHintBytes - 1
+	if err := h.store(node, []byte("too large")); err != errHintQueueFull {
+		t.Fatalf("Expected %v, got %v", errHintQueueFull, err)
+	}
+}
+
+func TestHintsReroutedWhenNodeLeaves(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timbala-handoff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Node b is never reachable
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrB := l.Addr().String()
+	l.Close()
+
+	dbC, err := tsdb.Open(filepath.Join(dir, "c"), nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbC.Close()
+	wrC, err := New(nil, logrus.New(), promtsdb.Adapter(dbC, 0), filepath.Join(dir, "c", "hints"), ConsistencyOne)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(wrC.HandlerFunc))
+	defer srv.Close()
+
+	clstr := cluster.NewStatic(logrus.New(), "a", "127.0.0.1:0", 0, 2)
+	clstr.Join("b", addrB, 1)
+	clstr.Join("c", srv.Listener.Addr().String(), 2)
+
+	dbA, err := tsdb.Open(filepath.Join(dir, "a"), nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbA.Close()
+	wrA, err := New(clstr, logrus.New(), promtsdb.Adapter(dbA, 0), filepath.Join(dir, "a", "hints"), ConsistencyOne)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const numSeries = 20
+	now := timestamp.FromTime(time.Now())
+	req := &prompb.WriteRequest{}
+	for i := 0; i < numSeries; i++ {
+		req.Timeseries = append(req.Timeseries, &prompb.TimeSeries{
+			Labels:  []*prompb.Label{{Name: "__name__", Value: "foo"}, {Name: "i", Value: fmt.Sprint(i)}},
+			Samples: []*prompb.Sample{{Timestamp: now, Value: float64(i)}},
+		})
+	}
+	data, err := req.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	wrA.HandlerFunc(rec, httptest.NewRequest("POST", Route, bytes.NewReader(snappy.Encode(nil, data))))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected write to succeed, got HTTP %d: %s", rec.Code, rec.Body)
+	}
+	hints := func() []string {
+		paths, err := wrA.hints.hints("b")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return paths
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(hints()) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for write to be queued for node b")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	wrA.stopSenders("b")
+
+	// Writes queued for a node that has only just left are kept, in case
+	// it rejoins
+	clstr.Remove("b")
+	wrA.replayHints(context.Background())
+	if len(hints()) == 0 {
+		t.Fatal("Expected queued write to be kept for node that has just left")
+	}
+
+	// Once the node has been gone for long enough, its writes are sent to
+	// the nodes now responsible for them
+	wrA.markDeparted("b", time.Now().Add(-hintRerouteDelay))
+	wrA.replayHints(context.Background())
+	if paths := hints(); len(paths) != 0 {
+		t.Fatalf("Expected queued write to be re-routed, got %v", paths)
+	}
+
+	for name, db := range map[string]*tsdb.DB{"a": dbA, "c": dbC} {
+		q, err := db.Querier(0, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		set, err := q.Select(labels.NewEqualMatcher("__name__", "foo"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got int
+		for set.Next() {
+			got++
+		}
+		q.Close()
+		if got != numSeries {
+			t.Fatalf("Expected %d series on node %s, got %d", numSeries, name, got)
+		}
+	}
+}
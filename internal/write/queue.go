@@ -0,0 +1,433 @@
+package write
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/mattbostock/timbala/internal/cluster"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const (
+	// maxBatchBytes is the approximate maximum size of a batch of series
+	// sent to a node in one request, before compression
+	maxBatchBytes = 4 * 1024 * 1024
+
+	// maxQueuedBytes bounds the size of the series queued or being sent to
+	// each node. Writes that would exceed it are queued on disk instead.
+	maxQueuedBytes = 64 * 1024 * 1024
+
+	// maxQueuedWrites bounds the number of writes queued for each node
+	maxQueuedWrites = 10000
+
+	// sendConcurrency is the number of batches sent to each node at once
+	sendConcurrency = 4
+
+	// sendTimeout bounds how long a worker waits for a node to accept a
+	// batch, during which later batches for the same worker are held up
+	sendTimeout = 10 * time.Second
+)
+
+var (
+	errQueueFull     = errors.New("too many writes queued for node")
+	errSenderStopped = errors.New("node left the cluster")
+)
+
+var httpClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			DualStack: true,
+			KeepAlive: 10 * time.Minute,
+			Timeout:   2 * time.Second,
+		}).DialContext,
+		ExpectContinueTimeout: 5 * time.Second,
+		IdleConnTimeout:       10 * time.Minute,
+		MaxIdleConnsPerHost:   sendConcurrency,
+	}}
+
+var (
+	queuedBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "timbala",
+			Subsystem: "internal_write",
+			Name:      "queued_bytes",
+			Help:      "Approximate size in bytes of the series queued or being sent to a node",
+		},
+		[]string{"node"},
+	)
+	batchesSent = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "timbala",
+			Subsystem: "internal_write",
+			Name:      "batches_sent_total",
+			Help:      "Total number of batches of series successfully sent to a node",
+		},
+		[]string{"node"},
+	)
+	batchesFailed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "timbala",
+			Subsystem: "internal_write",
+			Name:      "batches_failed_total",
+			Help:      "Total number of batches of series that could not be sent to a node and were queued on disk instead",
+		},
+		[]string{"node"},
+	)
+	queueFull = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "timbala",
+			Subsystem: "internal_write",
+			Name:      "queue_full_total",
+			Help:      "Total number of writes queued on disk because too many writes were already queued for a node",
+		},
+		[]string{"node"},
+	)
+	sendDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "timbala",
+			Subsystem: "internal_write",
+			Name:      "send_duration_seconds",
+			Help:      "Time taken to send a batch of series to a node",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"node"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(queuedBytes, batchesSent, batchesFailed, queueFull, sendDuration)
+}
+
+// queuedWrite is the part of a client's write destined for a single node.
+type queuedWrite struct {
+	series []*prompb.TimeSeries
+	size   int
+	shard  int
+
+	// done is called once with the outcome of the write
+	done func(error)
+}
+
+// peerSender sends writes to a single node. Writes from many client requests
+// are queued and combined into batches, which are sent by a fixed number of
+// workers so that the number of requests to each node is bounded regardless
+// of the rate of client requests. Each series is always queued for the same
+// worker, so that its samples are sent to the node in the order they were
+// received.
+type peerSender struct {
+	node   cluster.Node
+	queues []chan *queuedWrite
+	wr     *writer
+
+	mu          sync.Mutex
+	queuedBytes int
+	stopped     bool
+}
+
+// senderKey identifies a sender by the node's name and the address it is
+// sent to, so that a node rejoining the cluster on a new address is not sent
+// writes on its old address.
+type senderKey struct {
+	name string
+	addr string
+}
+
+// sender returns the sender for the given node, starting it if necessary.
+func (wr *writer) sender(n cluster.Node) *peerSender {
+	addr, _ := n.HTTPAddr()
+	key := senderKey{n.Name(), addr}
+
+	wr.sendersMu.Lock()
+	defer wr.sendersMu.Unlock()
+
+	if wr.senders == nil {
+		wr.senders = make(map[senderKey]*peerSender)
+	}
+	s, ok := wr.senders[key]
+	if ok {
+		return s
+	}
+
+	// Stop any sender for the node's previous address
+	for k, old := range wr.senders {
+		if k.name == key.name {
+			old.stop()
+			delete(wr.senders, k)
+		}
+	}
+
+	s = &peerSender{
+		node:   n,
+		queues: make([]chan *queuedWrite, sendConcurrency),
+		wr:     wr,
+	}
+	for i := range s.queues {
+		s.queues[i] = make(chan *queuedWrite, maxQueuedWrites/sendConcurrency)
+		go s.run(s.queues[i])
+	}
+	wr.senders[key] = s
+	return s
+}
+
+// stopSenders stops the senders for the named node, such as when it leaves
+// the cluster. Writes already queued are still sent.
+func (wr *writer) stopSenders(name string) {
+	wr.sendersMu.Lock()
+	defer wr.sendersMu.Unlock()
+
+	for k, s := range wr.senders {
+		if k.name == name {
+			s.stop()
+			delete(wr.senders, k)
+		}
+	}
+}
+
+func (s *peerSender) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopped {
+		return
+	}
+	s.stopped = true
+	for _, q := range s.queues {
+		close(q)
+	}
+}
+
+// enqueue queues the given series to be sent to the node. done is called
+// once with the outcome once the series have been sent or sending has failed,
+// in which case the series are queued on disk to be replayed later.
+func (s *peerSender) enqueue(series seriesMap, done func(error)) {
+	shards := make([][]*prompb.TimeSeries, len(s.queues))
+	for hash, ts := range series {
+		i := hash % uint64(len(s.queues))
+		shards[i] = append(shards[i], ts)
+	}
+
+	var writes []*queuedWrite
+	for i, shard := range shards {
+		if len(shard) == 0 {
+			continue
+		}
+		w := &queuedWrite{series: shard, shard: i}
+		for _, ts := range shard {
+			w.size += ts.Size()
+		}
+		writes = append(writes, w)
+	}
+	if len(writes) == 0 {
+		done(nil)
+		return
+	}
+	joined := joinDone(len(writes), done)
+
+	var failed []*queuedWrite
+	var full bool
+	s.mu.Lock()
+	for _, w := range writes {
+		w.done = joined
+		if s.stopped {
+			failed = append(failed, w)
+			continue
+		}
+		if s.queuedBytes+w.size > maxQueuedBytes && s.queuedBytes > 0 {
+			failed = append(failed, w)
+			full = true
+			continue
+		}
+		select {
+		case s.queues[w.shard] <- w:
+			s.queuedBytes += w.size
+		default:
+			failed = append(failed, w)
+			full = true
+		}
+	}
+	queuedBytes.WithLabelValues(s.node.Name()).Set(float64(s.queuedBytes))
+	s.mu.Unlock()
+
+	if len(failed) == 0 {
+		return
+	}
+	if full {
+		queueFull.WithLabelValues(s.node.Name()).Inc()
+		go s.fail(failed, nil, errQueueFull)
+		return
+	}
+	go s.fail(failed, nil, errSenderStopped)
+}
+
+// joinDone returns a function to be called once with the outcome of each of
+// n writes, which calls done once all have completed. An error that may
+// succeed if retried takes precedence over rejected samples.
+func joinDone(n int, done func(error)) func(error) {
+	var mu sync.Mutex
+	var rejected, failed error
+	return func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch err.(type) {
+		case nil:
+		case *rejectedError:
+			if rejected == nil {
+				rejected = err
+			}
+		default:
+			if failed == nil {
+				failed = err
+			}
+		}
+
+		n--
+		if n > 0 {
+			return
+		}
+		switch {
+		case failed != nil:
+			done(failed)
+		case rejected != nil:
+			done(rejected)
+		default:
+			done(nil)
+		}
+	}
+}
+
+func (s *peerSender) run(queue chan *queuedWrite) {
+	for first := range queue {
+		batch := []*queuedWrite{first}
+		size := first.size
+	drain:
+		for size < maxBatchBytes {
+			select {
+			case w, ok := <-queue:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, w)
+				size += w.size
+			default:
+				break drain
+			}
+		}
+
+		s.send(batch)
+
+		s.mu.Lock()
+		s.queuedBytes -= size
+		queuedBytes.WithLabelValues(s.node.Name()).Set(float64(s.queuedBytes))
+		s.mu.Unlock()
+	}
+}
+
+// send sends a batch to the node. A batch that cannot be sent is queued on
+// disk straight away rather than retried, so that a node that is slow or
+// failing holds up later batches for no longer than sendTimeout; queued
+// batches are replayed in the background.
+func (s *peerSender) send(batch []*queuedWrite) {
+	var numSeries int
+	for _, w := range batch {
+		numSeries += len(w.series)
+	}
+	req := &prompb.WriteRequest{Timeseries: make([]*prompb.TimeSeries, 0, numSeries)}
+	for _, w := range batch {
+		req.Timeseries = append(req.Timeseries, w.series...)
+	}
+
+	data, err := req.Marshal()
+	if err != nil {
+		for _, w := range batch {
+			w.done(err)
+		}
+		return
+	}
+	compressed := snappy.Encode(nil, data)
+
+	s.wr.log.Debugf("Writing %d series to %s", numSeries, s.node.Name())
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	start := time.Now()
+	err = s.wr.sendToNode(ctx, s.node, compressed, false)
+	cancel()
+	sendDuration.WithLabelValues(s.node.Name()).Observe(time.Since(start).Seconds())
+
+	if rerr, ok := err.(*rejectedError); ok {
+		batchesSent.WithLabelValues(s.node.Name()).Inc()
+		s.reject(batch, rerr)
+		return
+	}
+	if err != nil {
+		batchesFailed.WithLabelValues(s.node.Name()).Inc()
+		s.fail(batch, compressed, err)
+		return
+	}
+
+	batchesSent.WithLabelValues(s.node.Name()).Inc()
+	for _, w := range batch {
+		w.done(nil)
+	}
+}
+
+// reject reports rejected samples to the writes in the batch whose series
+// had samples rejected by the node, and success to the others.
+func (s *peerSender) reject(batch []*queuedWrite, rerr *rejectedError) {
+	if rerr.series == nil {
+		// The node did not report which series had rejected samples
+		for _, w := range batch {
+			w.done(rerr)
+		}
+		return
+	}
+
+	rejected := make(map[int]bool, len(rerr.series))
+	for _, i := range rerr.series {
+		rejected[i] = true
+	}
+	var offset int
+	for _, w := range batch {
+		var err error
+		for i := offset; i < offset+len(w.series); i++ {
+			if rejected[i] {
+				err = rerr
+				break
+			}
+		}
+		offset += len(w.series)
+		w.done(err)
+	}
+}
+
+// fail reports the error to the writes in the batch and queues the batch on
+// disk, so that the node eventually receives it even if the consistency level
+// was met without it. compressed is the encoded batch, if already encoded.
+func (s *peerSender) fail(batch []*queuedWrite, compressed []byte, err error) {
+	for _, w := range batch {
+		w.done(err)
+	}
+
+	if compressed == nil {
+		var series []*prompb.TimeSeries
+		for _, w := range batch {
+			series = append(series, w.series...)
+		}
+		data, err := (&prompb.WriteRequest{Timeseries: series}).Marshal()
+		if err != nil {
+			s.wr.log.Errorf("Unable to queue write for %s: %s", s.node.Name(), err)
+			return
+		}
+		compressed = snappy.Encode(nil, data)
+	}
+
+	s.wr.log.Warningf("Queueing write for %s after failing to write to it: %s", s.node.Name(), err)
+	if err := s.wr.hints.store(s.node.Name(), compressed); err != nil {
+		s.wr.log.Errorf("Unable to queue write for %s: %s", s.node.Name(), err)
+	}
+}
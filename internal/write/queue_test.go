@@ -0,0 +1,255 @@
+package write
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/mattbostock/timbala/internal/cluster"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/sirupsen/logrus"
+)
+
+func TestPeerSenderReject(t *testing.T) {
+	var errs []error
+	newWrite := func(numSeries int) *queuedWrite {
+		i := len(errs)
+		errs = append(errs, errors.New("not done"))
+		return &queuedWrite{
+			series: make([]*prompb.TimeSeries, numSeries),
+			done:   func(err error) { errs[i] = err },
+		}
+	}
+
+	batch := []*queuedWrite{newWrite(2), newWrite(3), newWrite(1)}
+	rerr := &rejectedError{msg: "rejected", series: []int{2, 4}}
+	(&peerSender{}).reject(batch, rerr)
+	// Only the second write contains series 2 to 4
+	if errs[0] != nil || errs[1] != rerr || errs[2] != nil {
+		t.Fatalf("Expected only the second write to be rejected, got %v", errs)
+	}
+
+	// Every write is rejected if the node did not report which series
+	// had samples rejected
+	errs = nil
+	batch = []*queuedWrite{newWrite(2), newWrite(3)}
+	rerr = &rejectedError{msg: "rejected"}
+	(&peerSender{}).reject(batch, rerr)
+	if errs[0] != rerr || errs[1] != rerr {
+		t.Fatalf("Expected every write to be rejected, got %v", errs)
+	}
+}
+
+// recordingNode serves writes, recording the timestamps received for each
+// series in the order they were received.
+type recordingNode struct {
+	mu      sync.Mutex
+	samples map[string][]int64
+}
+
+func (n *recordingNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	compressed, _ := ioutil.ReadAll(r.Body)
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var req prompb.WriteRequest
+	if err := req.Unmarshal(data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Vary how long each request takes, so that batches sent at the same
+	// time complete in any order
+	time.Sleep(time.Duration(rand.Intn(2000)) * time.Microsecond)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, ts := range req.Timeseries {
+		for _, s := range ts.Samples {
+			n.samples[ts.Labels[0].Value] = append(n.samples[ts.Labels[0].Value], s.Timestamp)
+		}
+	}
+}
+
+func newSenderTestWriter(t *testing.T, addr string) (*writer, *cluster.Static, func()) {
+	dir, err := ioutil.TempDir("", "timbala-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clstr := cluster.NewStatic(logrus.New(), "a", "127.0.0.1:0", 0, 2)
+	clstr.Join("b", addr, 1)
+	wr, err := New(clstr, logrus.New(), nil, dir, ConsistencyOne)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return wr, clstr, func() { os.RemoveAll(dir) }
+}
+
+func nodeNamed(t *testing.T, c cluster.Cluster, name string) cluster.Node {
+	for _, n := range c.Nodes() {
+		if n.Name() == name {
+			return *n
+		}
+	}
+	t.Fatalf("Node %s not found", name)
+	return cluster.Node{}
+}
+
+func TestPeerSenderPreservesSeriesOrder(t *testing.T) {
+	node := &recordingNode{samples: make(map[string][]int64)}
+	srv := httptest.NewServer(node)
+	defer srv.Close()
+
+	wr, clstr, cleanup := newSenderTestWriter(t, srv.Listener.Addr().String())
+	defer cleanup()
+	s := wr.sender(nodeNamed(t, clstr, "b"))
+
+	const numSeries, numWrites = 16, 200
+	var wg sync.WaitGroup
+	for i := 0; i < numWrites; i++ {
+		series := make(seriesMap, numSeries)
+		for j := 0; j < numSeries; j++ {
+			series[uint64(j)] = &prompb.TimeSeries{
+				Labels:  []*prompb.Label{{Name: "__name__", Value: strconv.Itoa(j)}},
+				Samples: []*prompb.Sample{{Timestamp: int64(i), Value: 1}},
+			}
+		}
+		wg.Add(1)
+		s.enqueue(series, func(err error) {
+			if err != nil {
+				t.Error(err)
+			}
+			wg.Done()
+		})
+	}
+	wg.Wait()
+
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	for name, timestamps := range node.samples {
+		if len(timestamps) != numWrites {
+			t.Fatalf("Expected %d samples for series %s, got %d", numWrites, name, len(timestamps))
+		}
+		for i, ts := range timestamps {
+			if ts != int64(i) {
+				t.Fatalf("Samples for series %s were sent out of order: %v", name, timestamps)
+			}
+		}
+	}
+}
+
+func TestPeerSenderStoppedOnLeave(t *testing.T) {
+	wr, clstr, cleanup := newSenderTestWriter(t, "127.0.0.1:1")
+	defer cleanup()
+	s := wr.sender(nodeNamed(t, clstr, "b"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go wr.ReplayHints(ctx)
+
+	// Wait for ReplayHints to subscribe to membership changes
+	time.Sleep(50 * time.Millisecond)
+	clstr.Remove("b")
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		s.mu.Lock()
+		stopped := s.stopped
+		s.mu.Unlock()
+		if stopped {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for sender to be stopped")
+		}
+	}
+
+	// Writes to a stopped sender are queued on disk
+	errs := make(chan error, 1)
+	s.enqueue(seriesMap{1: &prompb.TimeSeries{
+		Labels:  []*prompb.Label{{Name: "__name__", Value: "foo"}},
+		Samples: []*prompb.Sample{{Timestamp: 1, Value: 1}},
+	}}, func(err error) { errs <- err })
+	if err := <-errs; err != errSenderStopped {
+		t.Fatalf("Expected write to stopped sender to fail with %q, got %v", errSenderStopped, err)
+	}
+
+}
+
+func TestPeerSenderKeyedByAddress(t *testing.T) {
+	wr, clstr, cleanup := newSenderTestWriter(t, "127.0.0.1:1")
+	defer cleanup()
+	s := wr.sender(nodeNamed(t, clstr, "b"))
+	if wr.sender(nodeNamed(t, clstr, "b")) != s {
+		t.Fatal("Expected the same sender for the same node and address")
+	}
+
+	// A node rejoining on a new address gets a new sender, and the sender
+	// for its previous address is stopped
+	clstr.Remove("b")
+	clstr.Join("b", "127.0.0.1:2", 1)
+	if wr.sender(nodeNamed(t, clstr, "b")) == s {
+		t.Fatal("Expected a new sender for the node's new address")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.stopped {
+		t.Fatal("Expected sender for the node's previous address to be stopped")
+	}
+}
+
+func TestPeerSenderQueuesFailedBatchOnDisk(t *testing.T) {
+	var mu sync.Mutex
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	wr, clstr, cleanup := newSenderTestWriter(t, srv.Listener.Addr().String())
+	defer cleanup()
+	s := wr.sender(nodeNamed(t, clstr, "b"))
+	defer s.stop()
+
+	// A failed batch is queued on disk without being retried, so that it
+	// does not hold up later batches
+	errs := make(chan error, 1)
+	s.enqueue(seriesMap{1: &prompb.TimeSeries{
+		Labels:  []*prompb.Label{{Name: "__name__", Value: "foo"}},
+		Samples: []*prompb.Sample{{Timestamp: 1, Value: 1}},
+	}}, func(err error) { errs <- err })
+	if err := <-errs; err == nil {
+		t.Fatal("Expected write to failing node to return an error")
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		paths, err := wr.hints.hints("b")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(paths) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for failed batch to be queued on disk")
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if requests != 1 {
+		t.Fatalf("Expected batch to be sent once, got %d requests", requests)
+	}
+}
@@ -0,0 +1,176 @@
+package write
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/cespare/xxhash"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const (
+	// refCacheSize is the maximum number of series whose storage
+	// references are cached
+	refCacheSize = 1 << 20
+
+	// refCacheShards is the number of independently locked parts of the
+	// cache, to reduce contention between concurrent writes
+	refCacheShards = 16
+
+	labelSep = '\xff'
+)
+
+var (
+	refCacheHits = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "timbala",
+			Subsystem: "write",
+			Name:      "series_ref_cache_hits_total",
+			Help:      "Total number of series written locally whose storage reference was cached",
+		},
+	)
+	refCacheMisses = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "timbala",
+			Subsystem: "write",
+			Name:      "series_ref_cache_misses_total",
+			Help:      "Total number of series written locally whose storage reference was not cached",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(refCacheHits, refCacheMisses)
+}
+
+// refCache maps the labels of a series, as received in a write, to the
+// series' reference in local storage, so that samples for series that have
+// been written before can be appended using AddFast without sorting their
+// labels or looking up the series by its labels.
+//
+// References become invalid once storage removes the series from memory,
+// which storage reports by returning storage.ErrNotFound from AddFast; the
+// entry must then be removed. Storage never reuses a reference for a
+// different series.
+type refCache struct {
+	shards [refCacheShards]refCacheShard
+}
+
+type refCacheShard struct {
+	mu      sync.Mutex
+	entries map[uint64]*list.Element
+	lru     *list.List
+}
+
+type refCacheEntry struct {
+	key uint64
+
+	// pairs holds the labels in the order they were received, to guard
+	// against hash collisions
+	pairs []prompb.Label
+	lset  labels.Labels
+	hash  uint64
+	ref   uint64
+}
+
+func newRefCache() *refCache {
+	c := &refCache{}
+	for i := range c.shards {
+		c.shards[i].entries = make(map[uint64]*list.Element)
+		c.shards[i].lru = list.New()
+	}
+	return c
+}
+
+// get returns the cached entry for the series with the given labels, whose
+// hash is key.
+func (c *refCache) get(key uint64, pairs []*prompb.Label) (*refCacheEntry, bool) {
+	s := &c.shards[key%refCacheShards]
+	s.mu.Lock()
+	el, ok := s.entries[key]
+	if !ok {
+		s.mu.Unlock()
+		refCacheMisses.Inc()
+		return nil, false
+	}
+	e := el.Value.(*refCacheEntry)
+	if !e.matches(pairs) {
+		s.mu.Unlock()
+		refCacheMisses.Inc()
+		return nil, false
+	}
+	s.lru.MoveToFront(el)
+	s.mu.Unlock()
+
+	refCacheHits.Inc()
+	return e, true
+}
+
+// put caches the reference for a series, replacing any existing entry with
+// the same key.
+func (c *refCache) put(key uint64, pairs []*prompb.Label, lset labels.Labels, hash, ref uint64) {
+	e := &refCacheEntry{
+		key:   key,
+		pairs: make([]prompb.Label, 0, len(pairs)),
+		lset:  lset,
+		hash:  hash,
+		ref:   ref,
+	}
+	for _, p := range pairs {
+		e.pairs = append(e.pairs, *p)
+	}
+
+	s := &c.shards[key%refCacheShards]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if el, ok := s.entries[key]; ok {
+		s.lru.Remove(el)
+	}
+	s.entries[key] = s.lru.PushFront(e)
+	for s.lru.Len() > refCacheSize/refCacheShards {
+		oldest := s.lru.Remove(s.lru.Back()).(*refCacheEntry)
+		delete(s.entries, oldest.key)
+	}
+}
+
+// remove removes the entry with the given key if it still holds ref.
+func (c *refCache) remove(key, ref uint64) {
+	s := &c.shards[key%refCacheShards]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	el, ok := s.entries[key]
+	if !ok || el.Value.(*refCacheEntry).ref != ref {
+		return
+	}
+	s.lru.Remove(el)
+	delete(s.entries, key)
+}
+
+func (e *refCacheEntry) matches(pairs []*prompb.Label) bool {
+	if len(pairs) != len(e.pairs) {
+		return false
+	}
+	for i, p := range pairs {
+		if p.Name != e.pairs[i].Name || p.Value != e.pairs[i].Value {
+			return false
+		}
+	}
+	return true
+}
+
+// hashLabelPairs hashes labels in the order they were received, using buf to
+// avoid allocating.
+func hashLabelPairs(pairs []*prompb.Label, buf []byte) (uint64, []byte) {
+	buf = buf[:0]
+	for _, p := range pairs {
+		buf = append(buf, p.Name...)
+		buf = append(buf, labelSep)
+		buf = append(buf, p.Value...)
+		buf = append(buf, labelSep)
+	}
+	return xxhash.Sum64(buf), buf
+}
@@ -0,0 +1,106 @@
+package write
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/prompb"
+	promtsdb "github.com/prometheus/prometheus/storage/tsdb"
+	"github.com/prometheus/tsdb"
+	tsdbLabels "github.com/prometheus/tsdb/labels"
+	"github.com/sirupsen/logrus"
+)
+
+func TestRefCache(t *testing.T) {
+	c := newRefCache()
+	pairs := []*prompb.Label{{Name: "job", Value: "a"}, {Name: "__name__", Value: "up"}}
+	key, _ := hashLabelPairs(pairs, nil)
+	lset := labels.FromStrings("__name__", "up", "job", "a")
+
+	if _, ok := c.get(key, pairs); ok {
+		t.Fatal("Expected empty cache to miss")
+	}
+	c.put(key, pairs, lset, lset.Hash(), 1)
+	e, ok := c.get(key, pairs)
+	if !ok || e.ref != 1 || !labels.Equal(e.lset, lset) {
+		t.Fatalf("Expected cached reference 1 for %s, got %v", lset, e)
+	}
+
+	// Labels that hash to the same key are not mistaken for the cached
+	// series
+	other := []*prompb.Label{{Name: "job", Value: "b"}, {Name: "__name__", Value: "up"}}
+	if _, ok := c.get(key, other); ok {
+		t.Fatal("Expected different labels with the same key to miss")
+	}
+
+	// A stale reference is not removed if it has already been replaced
+	c.put(key, pairs, lset, lset.Hash(), 2)
+	c.remove(key, 1)
+	if e, ok := c.get(key, pairs); !ok || e.ref != 2 {
+		t.Fatalf("Expected cached reference 2, got %v", e)
+	}
+	c.remove(key, 2)
+	if _, ok := c.get(key, pairs); ok {
+		t.Fatal("Expected removed reference to miss")
+	}
+}
+
+func TestLocalWriteInvalidatesStaleRefs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "refcache_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := tsdb.Open(dir, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	wr, err := New(nil, logrus.New(), promtsdb.Adapter(db, 0), filepath.Join(dir, "hints"), ConsistencyOne)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pairs := []*prompb.Label{{Name: "__name__", Value: "up"}}
+	key, _ := hashLabelPairs(pairs, nil)
+	lset := labels.FromStrings("__name__", "up")
+	// Storage never issues this reference, as if the series had been
+	// removed from memory
+	wr.refs.put(key, pairs, lset, lset.Hash(), 1<<40)
+
+	for ts := int64(1); ts <= 2; ts++ {
+		series := []*prompb.TimeSeries{{Labels: pairs, Samples: []*prompb.Sample{{Timestamp: ts, Value: 1}}}}
+		if err := wr.localWrite(series, false); err != nil {
+			t.Fatal(err)
+		}
+		e, ok := wr.refs.get(key, pairs)
+		if !ok || e.ref == 1<<40 {
+			t.Fatalf("Expected stale reference to be replaced, got %v", e)
+		}
+	}
+
+	q, err := db.Querier(0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	set, err := q.Select(tsdbLabels.NewEqualMatcher("__name__", "up"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var numSamples int
+	for set.Next() {
+		it := set.At().Iterator()
+		for it.Next() {
+			numSamples++
+		}
+	}
+	if numSamples != 2 {
+		t.Fatalf("Expected 2 samples to be written, got %d", numSamples)
+	}
+}
@@ -8,12 +8,16 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"runtime"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/golang/snappy"
 	"github.com/mattbostock/timbala/internal/cluster"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/prompb"
 	"github.com/prometheus/prometheus/storage"
@@ -24,30 +28,87 @@ import (
 const (
 	HTTPHeaderInternalWrite        = "X-Timbala-Internal-Write-Version"
 	HTTPHeaderInternalWriteVersion = "0.0.1"
+	HTTPHeaderWriteConsistency     = "X-Timbala-Write-Consistency"
 	Route                          = "/write"
 
+	httpHeaderRejectedReasons    = "X-Timbala-Rejected-Reasons"
+	httpHeaderRejectedSeries     = "X-Timbala-Rejected-Series"
+	httpHeaderRepairWrite        = "X-Timbala-Repair-Write"
 	httpHeaderRemoteWrite        = "X-Prometheus-Remote-Write-Version"
 	httpHeaderRemoteWriteVersion = "0.1.0"
 	numPreallocTimeseries        = 1e5
+
+	reasonDuplicateTimestamp = "duplicate_timestamp"
+	reasonOutOfBounds        = "out_of_bounds"
+	reasonOutOfOrder         = "out_of_order"
+
+	// maxRejectedErrorBytes limits how much of a rejection message returned
+	// by another node is read
+	maxRejectedErrorBytes = 4096
+)
+
+var rejectedSamples = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "timbala",
+		Subsystem: "write",
+		Name:      "rejected_samples_total",
+		Help:      "Total number of samples rejected by local storage, by reason",
+	},
+	[]string{"reason"},
 )
 
+func init() {
+	prometheus.MustRegister(rejectedSamples)
+}
+
 type Writer interface {
 	HandlerFunc(http.ResponseWriter, *http.Request)
 }
 
+// repairStorage is implemented by storage that can accept samples of any age
+// when restoring samples missing from this node, such as samples replayed
+// from hinted handoff.
+type repairStorage interface {
+	RepairAppender() (storage.Appender, error)
+}
+
 type writer struct {
-	clstr      cluster.Cluster
-	localStore storage.Storage
-	log        *logrus.Logger
-	mu         sync.Mutex
+	clstr       cluster.Cluster
+	consistency ConsistencyLevel
+	hints       *hintStore
+	localStore  storage.Storage
+	log         *logrus.Logger
+
+	// appendLocks serialise appends to each shard of local storage
+	appendLocks []sync.Mutex
+	refs        *refCache
+
+	sendersMu sync.Mutex
+	senders   map[senderKey]*peerSender
+
+	// departed holds the time each node with queued writes was first seen
+	// to be absent from the cluster
+	departedMu sync.Mutex
+	departed   map[string]time.Time
 }
 
-func New(c cluster.Cluster, l *logrus.Logger, s storage.Storage) *writer {
-	return &writer{
-		clstr:      c,
-		log:        l,
-		localStore: s,
+func New(c cluster.Cluster, l *logrus.Logger, s storage.Storage, hintsDir string, consistency ConsistencyLevel) (*writer, error) {
+	hints, err := newHintStore(hintsDir)
+	if err != nil {
+		return nil, err
 	}
+
+	return &writer{
+		clstr:       c,
+		consistency: consistency,
+		hints:       hints,
+		log:         l,
+		localStore:  s,
+		senders:     make(map[senderKey]*peerSender),
+		departed:    make(map[string]time.Time),
+		appendLocks: make([]sync.Mutex, runtime.GOMAXPROCS(0)),
+		refs:        newRefCache(),
+	}, nil
 }
 
 func (wr *writer) HandlerFunc(w http.ResponseWriter, r *http.Request) {
@@ -82,43 +143,125 @@ func (wr *writer) HandlerFunc(w http.ResponseWriter, r *http.Request) {
 	// This is an internal write, so don't replicate it to other nodes
 	// This case is very common, to make it fast
 	if r.Header.Get(HTTPHeaderInternalWrite) != "" {
-		wr.mu.Lock()
-		appender, err := wr.localStore.Appender()
+		err := wr.localWrite(req.Timeseries, r.Header.Get(httpHeaderRepairWrite) != "")
+		if rerr, ok := err.(*rejectedError); ok {
+			// Report which series had rejected samples, so that the
+			// sender can tell which of the writes it batched together
+			// they belong to, and why they were rejected
+			indexes := make([]string, 0, len(rerr.series))
+			for _, i := range rerr.series {
+				indexes = append(indexes, strconv.Itoa(i))
+			}
+			w.Header().Set(httpHeaderRejectedSeries, strings.Join(indexes, ","))
+			reasons := make([]string, 0, len(rerr.reasons))
+			for reason, count := range rerr.reasons {
+				reasons = append(reasons, reason+"="+strconv.Itoa(count))
+			}
+			sort.Strings(reasons)
+			w.Header().Set(httpHeaderRejectedReasons, strings.Join(reasons, ","))
+			wr.log.Debug(rerr)
+			http.Error(w, rerr.Error(), http.StatusBadRequest)
+			return
+		}
 		if err != nil {
-			wr.mu.Unlock()
 			wr.log.Warning(err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 
-		for _, ts := range req.Timeseries {
-			m := make(labels.Labels, 0, len(ts.Labels))
-			for _, l := range ts.Labels {
-				m = append(m, labels.Label{
-					Name:  l.Name,
-					Value: l.Value,
-				})
-			}
-			sort.Stable(m)
+		wr.log.Debugf("Wrote %d series received from another node in the cluster", len(req.Timeseries))
+		return
+	}
 
-			for _, s := range ts.Samples {
-				// FIXME: Look at using AddFast
-				appender.Add(m, s.Timestamp, s.Value)
-			}
+	consistency := wr.consistency
+	if h := r.Header.Get(HTTPHeaderWriteConsistency); h != "" {
+		consistency, err = ParseConsistencyLevel(h)
+		if err != nil {
+			wr.log.Debug(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
-		appender.Commit()
-		wr.mu.Unlock()
+	}
 
-		wr.log.Debugf("Wrote %d series received from another node in the cluster", len(req.Timeseries))
-		return
+	seriesToNodes, sets := wr.placeSeries(req.Timeseries)
+	tracker := newWriteTracker(consistency, sets)
+
+	// Samples rejected by a node count towards the consistency level, since
+	// the node has processed the write and sending it again would not help
+	var rejected []string
+	record := func(node string, err error) {
+		if rerr, ok := err.(*rejectedError); ok {
+			rejected = append(rejected, fmt.Sprintf("%s: %s", node, rerr))
+			err = nil
+		}
+		tracker.record(node, err)
+	}
+
+	localSeries, ok := seriesToNodes[*wr.clstr.LocalNode()]
+	if ok {
+		series := make([]*prompb.TimeSeries, 0, len(localSeries))
+		for _, ts := range localSeries {
+			series = append(series, ts)
+		}
+		err = wr.localWrite(series, false)
+		if _, ok := err.(*rejectedError); !ok && err != nil {
+			wr.log.Warningln(err)
+		}
+		record(wr.clstr.LocalNode().Name(), err)
+
+		// Remove local node so that it's not written to again as a 'remote' node
+		delete(seriesToNodes, *wr.clstr.LocalNode())
 	}
 
+	// Acknowledge the write as soon as the consistency level is met; writes
+	// to the remaining nodes continue in the background
+	results := wr.remoteWrite(seriesToNodes)
+	for !tracker.satisfied() {
+		if tracker.unsatisfiable() {
+			err := fmt.Errorf("unable to satisfy write consistency level %q", consistency)
+			wr.log.Warningln(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		res, ok := <-results
+		if !ok {
+			// Should not be reachable as all nodes have reported
+			// back, but avoid blocking forever
+			err := fmt.Errorf("unable to satisfy write consistency level %q", consistency)
+			wr.log.Warningln(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		record(res.node, res.err)
+	}
+
+	// Respond with 400 if any samples were rejected so that the client
+	// does not retry them; the remaining samples have been written.
+	// Rejections reported by nodes after the consistency level was met are
+	// not included.
+	if len(rejected) > 0 {
+		sort.Strings(rejected)
+		err := errors.New(strings.Join(rejected, "; "))
+		wr.log.Debug(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// placeSeries splits the samples in the given series between the nodes
+// currently responsible for them. It also returns each distinct set of
+// replicas that samples were placed on.
+func (wr *writer) placeSeries(series []*prompb.TimeSeries) (seriesNodeMap, [][]string) {
 	// FIXME handle change in cluster size
 	seriesToNodes := make(seriesNodeMap, len(wr.clstr.Nodes()))
+	replicaSets := make(map[string][]string)
+	seenPKeys := make(map[uint64]bool)
+	keys := wr.clstr.KeyVersion()
 	for _, n := range wr.clstr.Nodes() {
 		seriesToNodes[*n] = make(seriesMap, numPreallocTimeseries)
 	}
 
-	for _, ts := range req.Timeseries {
+	for _, ts := range series {
 		m := make(labels.Labels, 0, len(ts.Labels))
 		for _, l := range ts.Labels {
 			m = append(m, labels.Label{
@@ -129,12 +272,22 @@ func (wr *writer) HandlerFunc(w http.ResponseWriter, r *http.Request) {
 		sort.Stable(m)
 		// FIXME: Handle collisions
 		mHash := m.Hash()
+		pHash := wr.clstr.PartitionHash(m.Get(labels.MetricName), mHash)
 
 		for _, s := range ts.Samples {
-			timestamp := time.Unix(s.Timestamp/1000, (s.Timestamp-s.Timestamp/1000)*1e6)
 			// FIXME: Avoid panic if the cluster is not yet initialised
-			pKey := cluster.PartitionKey(timestamp, mHash)
-			for _, n := range wr.clstr.NodesByPartitionKey(pKey) {
+			pKey := keys.SamplePartitionKey(s.Timestamp, pHash)
+			nodes := wr.clstr.NodesByPartitionKey(pKey)
+			if !seenPKeys[pKey] {
+				seenPKeys[pKey] = true
+				names := make([]string, 0, len(nodes))
+				for _, n := range nodes {
+					names = append(names, n.Name())
+				}
+				replicaSets[strings.Join(names, ",")] = names
+			}
+
+			for _, n := range nodes {
 				if _, ok := seriesToNodes[*n][mHash]; !ok {
 					// FIXME handle change in cluster size
 					seriesToNodes[*n][mHash] = &prompb.TimeSeries{
@@ -145,131 +298,426 @@ func (wr *writer) HandlerFunc(w http.ResponseWriter, r *http.Request) {
 				seriesToNodes[*n][mHash].Samples = append(seriesToNodes[*n][mHash].Samples, s)
 			}
 		}
-		// FIXME: sort samples by time?
 	}
 
-	localSeries, ok := seriesToNodes[*wr.clstr.LocalNode()]
-	if ok {
-		err = wr.localWrite(localSeries)
-		if err != nil {
-			wr.log.Warningln(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+	sets := make([][]string, 0, len(replicaSets))
+	for _, set := range replicaSets {
+		sets = append(sets, set)
+	}
+	return seriesToNodes, sets
+}
+
+// localWrite writes the given series to local storage. Samples that the
+// storage permanently rejects are skipped and reported by returning a
+// *rejectedError once the remaining samples have been committed. Any other
+// error aborts the write, which may then be retried.
+//
+// If repair is true, the write restores samples missing from this node, and
+// samples of any age are accepted if the storage supports it.
+//
+// Series are split into shards by the hash of their labels, and each shard is
+// appended and committed while holding its own lock. Writes for different
+// series proceed concurrently, while the samples for each series are
+// committed in the order the writes were received: storage only detects
+// out-of-order samples by comparing them to committed samples, and silently
+// drops samples older than one committed concurrently.
+func (wr *writer) localWrite(series []*prompb.TimeSeries, repair bool) error {
+	shards := make([][]int, len(wr.appendLocks))
+	local := make([]localSeries, len(series))
+	var buf []byte
+	for i, sseries := range series {
+		ls := &local[i]
+		ls.TimeSeries = sseries
+		ls.key, buf = hashLabelPairs(sseries.Labels, buf)
+
+		if e, ok := wr.refs.get(ls.key, sseries.Labels); ok {
+			ls.lset, ls.hash, ls.ref = e.lset, e.hash, e.ref
+			ls.cachedRef = e.ref
+		} else {
+			m := make(labels.Labels, 0, len(sseries.Labels))
+			for _, l := range sseries.Labels {
+				m = append(m, labels.Label{
+					Name:  l.Name,
+					Value: l.Value,
+				})
+			}
+			sort.Stable(m)
+			ls.lset, ls.hash = m, m.Hash()
 		}
 
-		// Remove local node so that it's not written to again as a 'remote' node
-		delete(seriesToNodes, *wr.clstr.LocalNode())
+		shard := ls.hash % uint64(len(shards))
+		shards[shard] = append(shards[shard], i)
 	}
 
-	err = wr.remoteWrite(seriesToNodes)
-	if err != nil {
-		wr.log.Warningln(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	results := make([]rejections, len(shards))
+	errs := make([]error, len(shards))
+	var wg sync.WaitGroup
+	for shard, indexes := range shards {
+		if len(indexes) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(shard int, indexes []int) {
+			defer wg.Done()
+			errs[shard] = wr.appendShard(shard, local, indexes, repair, &results[shard])
+		}(shard, indexes)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	var rejections rejections
+	for i := range results {
+		rejections.merge(&results[i])
 	}
+	return rejections.err()
+}
+
+// localSeries is a series being written to local storage.
+type localSeries struct {
+	*prompb.TimeSeries
+
+	// key is the hash of the labels as received, identifying the series
+	// in the reference cache
+	key uint64
+
+	lset labels.Labels
+	hash uint64
+
+	// ref is the series' reference in storage, or 0 if not yet known.
+	// cachedRef is the reference read from the cache, if any.
+	ref       uint64
+	cachedRef uint64
 }
 
-func (wr *writer) localWrite(series seriesMap) error {
-	wr.mu.Lock()
-	appender, err := wr.localStore.Appender()
+// appendShard appends and commits the series with the given indexes, which
+// all belong to the same shard, recording any rejected samples.
+func (wr *writer) appendShard(shard int, series []localSeries, indexes []int, repair bool, rejections *rejections) error {
+	wr.appendLocks[shard].Lock()
+	appender, err := wr.appender(repair)
 	if err != nil {
-		wr.mu.Unlock()
+		wr.appendLocks[shard].Unlock()
 		return err
 	}
 
-	for _, sseries := range series {
-		m := make(labels.Labels, 0, len(sseries.Labels))
-		for _, l := range sseries.Labels {
-			m = append(m, labels.Label{
-				Name:  l.Name,
-				Value: l.Value,
-			})
+	for _, i := range indexes {
+		ls := &series[i]
+
+		// Samples for the same series must be appended in order, or
+		// storage silently drops any sample older than one appended
+		// before it when committing
+		samples := ls.Samples
+		if !sort.SliceIsSorted(samples, func(i, j int) bool { return samples[i].Timestamp < samples[j].Timestamp }) {
+			sort.SliceStable(samples, func(i, j int) bool { return samples[i].Timestamp < samples[j].Timestamp })
 		}
-		sort.Stable(m)
 
-		for _, s := range sseries.Samples {
-			// FIXME: Look at using AddFast
-			appender.Add(m, s.Timestamp, s.Value)
+		// The series only needs to be looked up by its labels if its
+		// reference is not yet known, or is no longer valid because
+		// storage has removed the series from memory
+		for _, s := range samples {
+			err := storage.ErrNotFound
+			if ls.ref != 0 {
+				err = appender.AddFast(ls.lset, ls.ref, s.Timestamp, s.Value)
+			}
+			if err == storage.ErrNotFound {
+				ls.ref, err = appender.Add(ls.lset, s.Timestamp, s.Value)
+			}
+			if err == nil {
+				continue
+			}
+			reason, ok := rejectionReason(err)
+			if !ok {
+				appender.Rollback()
+				wr.appendLocks[shard].Unlock()
+				return err
+			}
+			rejections.add(reason, i, ls.lset, s, err)
 		}
 	}
 	// Intentionally avoid defer on hot path
-	appender.Commit()
-	wr.mu.Unlock()
+	err = appender.Commit()
+	wr.appendLocks[shard].Unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, i := range indexes {
+		ls := &series[i]
+		if ls.ref == ls.cachedRef {
+			continue
+		}
+		if ls.ref == 0 {
+			// The reference is not known, such as when the only
+			// sample was buffered out of order
+			wr.refs.remove(ls.key, ls.cachedRef)
+			continue
+		}
+		wr.refs.put(ls.key, ls.Labels, ls.lset, ls.hash, ls.ref)
+	}
+
+	for reason, count := range rejections.counts {
+		rejectedSamples.WithLabelValues(reason).Add(float64(count))
+	}
 	return nil
 }
 
-func (wr *writer) remoteWrite(sNodeMap seriesNodeMap) error {
+// appender returns an appender for local storage that, if repair is true and
+// the storage supports it, accepts samples of any age.
+func (wr *writer) appender(repair bool) (storage.Appender, error) {
+	if rs, ok := wr.localStore.(repairStorage); ok && repair {
+		return rs.RepairAppender()
+	}
+	return wr.localStore.Appender()
+}
+
+// rejectionReason returns the reason label for errors returned by storage
+// for samples that can never be written, such that retrying the write would
+// not succeed.
+func rejectionReason(err error) (string, bool) {
+	switch err {
+	case storage.ErrOutOfOrderSample:
+		return reasonOutOfOrder, true
+	case storage.ErrDuplicateSampleForTimestamp:
+		return reasonDuplicateTimestamp, true
+	case storage.ErrOutOfBounds:
+		return reasonOutOfBounds, true
+	}
+	return "", false
+}
+
+// rejections counts the samples rejected in a single write by reason, and
+// records the first rejected sample as an example to report to the client.
+// Samples must be added in order of the index of their series.
+type rejections struct {
+	counts  map[string]int
+	total   int
+	example string
+	series  []int
+}
+
+func (r *rejections) add(reason string, index int, m labels.Labels, s *prompb.Sample, err error) {
+	if r.counts == nil {
+		r.counts = make(map[string]int)
+		r.example = fmt.Sprintf("%s at timestamp %d: %s", m, s.Timestamp, err)
+	}
+	r.counts[reason]++
+	r.total++
+	if len(r.series) == 0 || r.series[len(r.series)-1] != index {
+		r.series = append(r.series, index)
+	}
+}
+
+// merge adds the rejections from another shard of the same write.
+func (r *rejections) merge(other *rejections) {
+	if other.total == 0 {
+		return
+	}
+	if r.counts == nil {
+		r.counts = make(map[string]int)
+	}
+	if r.total == 0 || other.series[0] < r.series[0] {
+		r.example = other.example
+	}
+	for reason, count := range other.counts {
+		r.counts[reason] += count
+	}
+	r.total += other.total
+	r.series = append(r.series, other.series...)
+	sort.Ints(r.series)
+}
+
+func (r *rejections) err() error {
+	if r.total == 0 {
+		return nil
+	}
+
+	reasons := make([]string, 0, len(r.counts))
+	for reason, count := range r.counts {
+		reasons = append(reasons, fmt.Sprintf("%s: %d", reason, count))
+	}
+	sort.Strings(reasons)
+	return &rejectedError{
+		msg:     fmt.Sprintf("rejected %d samples (%s), e.g. %s", r.total, strings.Join(reasons, ", "), r.example),
+		reasons: r.counts,
+		series:  r.series,
+	}
+}
+
+// rejectedError reports samples that were rejected, which sending the same
+// write again immediately would not change. The other samples in the same
+// write were written successfully.
+type rejectedError struct {
+	msg string
+
+	// reasons holds the number of samples rejected for each reason, or
+	// nil if not known
+	reasons map[string]int
+
+	// series holds the indexes of the series in the write that had
+	// samples rejected, or nil if not known
+	series []int
+}
+
+func (e *rejectedError) Error() string {
+	return e.msg
+}
+
+// retryable returns true if the node may accept the rejected samples later.
+// Only samples that conflict with a stored sample can never be accepted;
+// samples rejected for being too old are accepted once the node accepts
+// historical samples, such as after it has been upgraded.
+func (e *rejectedError) retryable() bool {
+	if e.reasons == nil {
+		return true
+	}
+	for reason := range e.reasons {
+		if reason != reasonDuplicateTimestamp {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteWrite queues the series for each node to be sent by the node's
+// sender, returning a channel on which the outcome of the write to each node
+// is sent. The channel is closed once all writes have completed.
+func (wr *writer) remoteWrite(sNodeMap seriesNodeMap) <-chan nodeWriteResult {
 	var wg sync.WaitGroup
-	var wgErrChan = make(chan error, len(wr.clstr.Nodes()))
+	var results = make(chan nodeWriteResult, len(sNodeMap))
 	for node, nodeSeries := range sNodeMap {
 		if len(nodeSeries) == 0 {
 			continue
 		}
 
 		wg.Add(1)
-		go func(n cluster.Node, nSeries seriesMap) {
-			defer wg.Done()
+		name := node.Name()
+		wr.sender(node).enqueue(nodeSeries, func(err error) {
+			results <- nodeWriteResult{name, err}
+			wg.Done()
+		})
+	}
 
-			wr.log.Debugf("Writing %d series to %s", len(nSeries), n.Name())
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
 
-			httpAddr, err := n.HTTPAddr()
-			if err != nil {
-				wgErrChan <- err
-				return
-			}
-			apiURL := fmt.Sprintf("%s%s%s", "http://", httpAddr, Route)
+	return results
+}
 
-			req := &prompb.WriteRequest{
-				Timeseries: make([]*prompb.TimeSeries, 0, len(nSeries)),
-			}
-			for _, ts := range nSeries {
-				req.Timeseries = append(req.Timeseries, ts)
-			}
+// sendToNode sends a compressed write request to a node. If repair is true,
+// the write restores samples missing from the node, which accepts them
+// regardless of their age.
+func (wr *writer) sendToNode(ctx context.Context, n cluster.Node, compressed []byte, repair bool) error {
+	return postToNode(ctx, httpClient, n, compressed, repair)
+}
 
-			data, err := req.Marshal()
-			if err != nil {
-				wgErrChan <- err
-				return
-			}
+// WriteToNode writes the given series to a node using the internal write
+// API, such that the node stores the series locally without replicating them.
+// The write restores samples missing from the node, which accepts them
+// regardless of their age.
+//
+// WriteToNode returns the number of samples the node accepted. Samples that
+// the node rejects, for example because it does not accept historical
+// samples, are returned as an error, since the node does not hold them.
+func WriteToNode(ctx context.Context, client *http.Client, n cluster.Node, series []*prompb.TimeSeries) (int, error) {
+	var numSamples int
+	for _, ts := range series {
+		numSamples += len(ts.Samples)
+	}
 
-			compressed := snappy.Encode(nil, data)
-			nodeReq, err := http.NewRequest("POST", apiURL, bytes.NewBuffer(compressed))
-			if err != nil {
-				wgErrChan <- err
-				return
-			}
-			nodeReq.Header.Add("Content-Encoding", "snappy")
-			nodeReq.Header.Set("Content-Type", "application/x-protobuf")
-			nodeReq.Header.Set(httpHeaderRemoteWrite, httpHeaderRemoteWriteVersion)
-			nodeReq.Header.Set(HTTPHeaderInternalWrite, HTTPHeaderInternalWriteVersion)
-
-			// FIXME set timeout using context
-			httpResp, err := ctxhttp.Do(context.TODO(), http.DefaultClient, nodeReq)
-			if err != nil {
-				wgErrChan <- err
-				return
-			}
+	req := &prompb.WriteRequest{Timeseries: series}
+	data, err := req.Marshal()
+	if err != nil {
+		return 0, err
+	}
+	err = postToNode(ctx, client, n, snappy.Encode(nil, data), true)
+	if err == nil {
+		return numSamples, nil
+	}
+	rerr, ok := err.(*rejectedError)
+	if !ok || rerr.reasons == nil {
+		return 0, err
+	}
+	accepted := numSamples
+	for _, count := range rerr.reasons {
+		accepted -= count
+	}
+	if accepted < 0 {
+		accepted = 0
+	}
+	return accepted, err
+}
 
-			io.Copy(ioutil.Discard, httpResp.Body)
-			httpResp.Body.Close()
+func postToNode(ctx context.Context, client *http.Client, n cluster.Node, compressed []byte, repair bool) error {
+	httpAddr, err := n.HTTPAddr()
+	if err != nil {
+		return err
+	}
+	apiURL := fmt.Sprintf("%s%s%s", "http://", httpAddr, Route)
 
-			if httpResp.StatusCode != http.StatusOK {
-				wgErrChan <- fmt.Errorf("got HTTP %d status code", httpResp.StatusCode)
-				return
-			}
-		}(node, nodeSeries)
+	nodeReq, err := http.NewRequest("POST", apiURL, bytes.NewBuffer(compressed))
+	if err != nil {
+		return err
+	}
+	nodeReq.Header.Add("Content-Encoding", "snappy")
+	nodeReq.Header.Set("Content-Type", "application/x-protobuf")
+	nodeReq.Header.Set(httpHeaderRemoteWrite, httpHeaderRemoteWriteVersion)
+	nodeReq.Header.Set(HTTPHeaderInternalWrite, HTTPHeaderInternalWriteVersion)
+	if repair {
+		nodeReq.Header.Set(httpHeaderRepairWrite, "1")
 	}
-	// FIXME cancel requests if one fails
-	wg.Wait()
 
-	select {
-	case err := <-wgErrChan:
+	httpResp, err := ctxhttp.Do(ctx, client, nodeReq)
+	if err != nil {
 		return err
-	default:
 	}
 
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode == http.StatusBadRequest {
+		// The node will not accept these samples however many times
+		// they are sent
+		msg, _ := ioutil.ReadAll(io.LimitReader(httpResp.Body, maxRejectedErrorBytes))
+		rerr := &rejectedError{msg: strings.TrimSpace(string(msg))}
+		if h := httpResp.Header.Get(httpHeaderRejectedSeries); h != "" {
+			for _, idx := range strings.Split(h, ",") {
+				i, err := strconv.Atoi(idx)
+				if err != nil {
+					rerr.series = nil
+					break
+				}
+				rerr.series = append(rerr.series, i)
+			}
+		}
+		if h := httpResp.Header.Get(httpHeaderRejectedReasons); h != "" {
+			rerr.reasons = make(map[string]int)
+			for _, r := range strings.Split(h, ",") {
+				parts := strings.SplitN(r, "=", 2)
+				count, err := strconv.Atoi(parts[len(parts)-1])
+				if len(parts) != 2 || err != nil {
+					rerr.reasons = nil
+					break
+				}
+				rerr.reasons[parts[0]] = count
+			}
+		}
+		return rerr
+	}
+	io.Copy(ioutil.Discard, httpResp.Body)
+
+	if httpResp.StatusCode != http.StatusOK {
+		return fmt.Errorf("got HTTP %d status code", httpResp.StatusCode)
+	}
 	return nil
 }
 
+type nodeWriteResult struct {
+	node string
+	err  error
+}
+
 type seriesNodeMap map[cluster.Node]seriesMap
 type seriesMap map[uint64]*prompb.TimeSeries
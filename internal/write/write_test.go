@@ -0,0 +1,82 @@
+package write
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+	promtsdb "github.com/prometheus/prometheus/storage/tsdb"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+	"github.com/sirupsen/logrus"
+)
+
+func TestLocalWriteRejectsSamples(t *testing.T) {
+	dir, err := ioutil.TempDir("", "write_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := tsdb.Open(dir, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	wr, err := New(nil, logrus.New(), promtsdb.Adapter(db, 0), filepath.Join(dir, "hints"), ConsistencyOne)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lbls := []*prompb.Label{{Name: "__name__", Value: "foo"}}
+	series := func(samples ...*prompb.Sample) []*prompb.TimeSeries {
+		return []*prompb.TimeSeries{{Labels: lbls, Samples: samples}}
+	}
+
+	if err := wr.localWrite(series(&prompb.Sample{Timestamp: 10, Value: 1}), false); err != nil {
+		t.Fatal(err)
+	}
+
+	err = wr.localWrite(series(
+		&prompb.Sample{Timestamp: 5, Value: 1},
+		&prompb.Sample{Timestamp: 10, Value: 2},
+		&prompb.Sample{Timestamp: 20, Value: 1},
+	), false)
+	rerr, ok := err.(*rejectedError)
+	if !ok {
+		t.Fatalf("Expected rejected samples error, got %v", err)
+	}
+	if len(rerr.series) != 1 || rerr.series[0] != 0 {
+		t.Fatalf("Expected the first series to have rejected samples, got %v", rerr.series)
+	}
+	for _, s := range []string{"rejected 2 samples", "duplicate_timestamp: 1", "out_of_order: 1", `{__name__="foo"} at timestamp 5`} {
+		if !strings.Contains(rerr.Error(), s) {
+			t.Fatalf("Expected %q in error, got %q", s, rerr)
+		}
+	}
+
+	// The sample that was not rejected is still written
+	q, err := db.Querier(0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	set, err := q.Select(labels.NewEqualMatcher("__name__", "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var timestamps []int64
+	for set.Next() {
+		it := set.At().Iterator()
+		for it.Next() {
+			ts, _ := it.At()
+			timestamps = append(timestamps, ts)
+		}
+	}
+	if len(timestamps) != 2 || timestamps[1] != 20 {
+		t.Fatalf("Expected samples at timestamps 10 and 20, got %v", timestamps)
+	}
+}